@@ -0,0 +1,159 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "bryan/GoDB/dbFiles"
+    "github.com/gorilla/mux"
+)
+
+//  Cluster mode, used when GODB_TOPOLOGY names a topology file (see
+//  db.Topology). The process is node GODB_NODE_ID of the cluster (the
+//  hostname if that's not set), keeping its shards under GODB_DATA_DIR,
+//  and serves the cluster's one keyspace under /api/cluster. Any node takes
+//  requests for any key and passes them on to the node leading the key's
+//  shard, or with ?redirect=true sends the client there with a 307.
+var clusterNode *db.Node
+
+func runCluster(topologyFile string) {
+    topology, err := db.ReadTopology(topologyFile)
+    if err != nil {
+        log.Fatalf("Failed to read cluster topology: %v", err)
+    }
+    id := os.Getenv("GODB_NODE_ID")
+    if id == "" {
+        if id, err = os.Hostname(); err != nil {
+            log.Fatalf("Failed to find the node ID: %v", err)
+        }
+    }
+    dir := os.Getenv("GODB_DATA_DIR")
+    if dir == "" {
+        dir = "cluster"
+    }
+    clusterNode, err = db.StartNode(topology, id, dir, db.DefaultOptions())
+    if err != nil {
+        log.Fatalf("Failed to start cluster node %s: %v", id, err)
+    }
+
+    router := mux.NewRouter().UseEncodedPath()
+    router.HandleFunc("/api/cluster/set/{key}/{value}", clusterSetHandler).Methods("POST")
+    router.HandleFunc("/api/cluster/get/{key}", clusterGetHandler).Methods("GET")
+    router.HandleFunc("/api/cluster/delete/{key}", clusterDeleteHandler).Methods("DELETE")
+    router.HandleFunc("/api/cluster/topology", topologyHandler).Methods("GET")
+    router.HandleFunc("/api/cluster/status", clusterStatusHandler).Methods("GET")
+
+    srv := &http.Server{
+        Addr:    ":8080",
+        Handler: router,
+    }
+    go func() {
+        log.Printf("Cluster node %s starting on port 8080", id)
+        if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            log.Fatalf("ListenAndServe(): %v", err)
+        }
+    }()
+
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    <-c
+    log.Println("Shutting down gracefully...")
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := srv.Shutdown(ctx); err != nil {
+        log.Printf("Server forced to shutdown: %v", err)
+    }
+    if err := clusterNode.Save(); err != nil {
+        log.Printf("Failed to save cluster node: %v", err)
+    }
+    if err := clusterNode.Close(); err != nil {
+        log.Printf("Failed to close cluster node: %v", err)
+    }
+    log.Println("Server exiting")
+}
+
+// Function for sending the client to the node leading key's shard, if it
+// asked to be and that's another node with an HTTP address. Returns
+// whether it was.
+func redirectToLeader(w http.ResponseWriter, r *http.Request, key string) bool {
+    if r.URL.Query().Get("redirect") != "true" {
+        return false
+    }
+    leader, err := clusterNode.Locate(key)
+    if err != nil || leader.ID == clusterNode.ID || leader.HTTPAddr == "" {
+        return false
+    }
+    http.Redirect(w, r, "http://"+leader.HTTPAddr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+    return true
+}
+
+func clusterSetHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    key, err := url.PathUnescape(vars["key"])
+    if err != nil {
+        http.Error(w, "Invalid key", http.StatusBadRequest)
+        return
+    }
+    value, err := url.PathUnescape(vars["value"])
+    if err != nil {
+        http.Error(w, "Invalid value", http.StatusBadRequest)
+        return
+    }
+    if redirectToLeader(w, r, key) {
+        return
+    }
+    if err := clusterNode.Set(key, value); err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    json.NewEncoder(w).Encode(Response{Message: "Key set successfully"})
+}
+
+func clusterGetHandler(w http.ResponseWriter, r *http.Request) {
+    key, err := url.PathUnescape(mux.Vars(r)["key"])
+    if err != nil {
+        http.Error(w, "Invalid key", http.StatusBadRequest)
+        return
+    }
+    if redirectToLeader(w, r, key) {
+        return
+    }
+    value, err := clusterNode.Get(key)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    json.NewEncoder(w).Encode(Response{Message: value})
+}
+
+func clusterDeleteHandler(w http.ResponseWriter, r *http.Request) {
+    key, err := url.PathUnescape(mux.Vars(r)["key"])
+    if err != nil {
+        http.Error(w, "Invalid key", http.StatusBadRequest)
+        return
+    }
+    if redirectToLeader(w, r, key) {
+        return
+    }
+    if err := clusterNode.Delete(key); err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    json.NewEncoder(w).Encode(Response{Message: "Key deleted successfully"})
+}
+
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(clusterNode.Topology())
+}
+
+// Where each shard's raft group has got, as far as this node knows
+func clusterStatusHandler(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(clusterNode.Status())
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const DefaultBlockCacheSize = 8 << 20
+
+// Counters for a BlockCache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int64
+	Capacity  int64
+}
+
+type blockCacheKey struct {
+	table  uint64
+	offset uint64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	block []byte
+}
+
+//  LRU cache of SSTable data blocks and B+tree pages, bounded by their total
+//  size. One cache is shared by every table of every shard in a ShardedDB.
+type BlockCache struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[blockCacheKey]*list.Element
+	lru      *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func NewBlockCache(capacity int64) *BlockCache {
+	if capacity <= 0 {
+		capacity = DefaultBlockCacheSize
+	}
+	return &BlockCache{
+		capacity: capacity,
+		entries:  make(map[blockCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (cache *BlockCache) get(key blockCacheKey) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.lru.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).block, true
+}
+
+func (cache *BlockCache) put(key blockCacheKey, block []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if int64(len(block)) > cache.capacity {
+		return
+	}
+	if element, exists := cache.entries[key]; exists {
+		cache.lru.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(&blockCacheEntry{key: key, block: block})
+	cache.size += int64(len(block))
+	for cache.size > cache.capacity {
+		oldest := cache.lru.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		cache.lru.Remove(oldest)
+		delete(cache.entries, entry.key)
+		cache.size -= int64(len(entry.block))
+		cache.evictions++
+	}
+}
+
+// For blocks whose location gets reused by something else
+func (cache *BlockCache) remove(key blockCacheKey) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, exists := cache.entries[key]; exists {
+		cache.lru.Remove(element)
+		delete(cache.entries, key)
+		cache.size -= int64(len(element.Value.(*blockCacheEntry).block))
+	}
+}
+
+func (cache *BlockCache) Stats() CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return CacheStats{
+		Hits:      cache.hits,
+		Misses:    cache.misses,
+		Evictions: cache.evictions,
+		Size:      cache.size,
+		Capacity:  cache.capacity,
+	}
+}
+
+// Every open table gets its own id so blocks from different shards (whose
+// file numbers overlap) never collide in a shared cache
+var nextCacheID uint64
+
+func newCacheID() uint64 {
+	return atomic.AddUint64(&nextCacheID, 1)
+}
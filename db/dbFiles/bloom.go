@@ -0,0 +1,81 @@
+package db
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const DefaultBloomFalsePositiveRate = 0.01
+
+//  Bloom filter over the keys of an SSTable.
+//  Encoded as the number of hash functions followed by the bit array.
+//  Uses double hashing on one 64 bit FNV hash to get the k bit positions.
+type bloomFilter struct {
+	k    uint8
+	bits []byte
+}
+
+// Function for sizing a filter for n keys at the given false positive rate
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = DefaultBloomFalsePositiveRate
+	}
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &bloomFilter{k: uint8(k), bits: make([]byte, (int(m)+7)/8)}
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (filter *bloomFilter) add(key string) {
+	filter.addHash(bloomHash(key))
+}
+
+func (filter *bloomFilter) addHash(h1, h2 uint32) {
+	nbits := uint32(len(filter.bits) * 8)
+	for i := uint32(0); i < uint32(filter.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		filter.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// False means the key is definitely not in the table
+func (filter *bloomFilter) mayContain(key string) bool {
+	if len(filter.bits) == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(filter.bits) * 8)
+	for i := uint32(0); i < uint32(filter.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		if filter.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *bloomFilter) encode() []byte {
+	return append([]byte{filter.k}, filter.bits...)
+}
+
+func decodeBloomFilter(data []byte) *bloomFilter {
+	if len(data) < 2 {
+		return nil
+	}
+	return &bloomFilter{k: data[0], bits: data[1:]}
+}
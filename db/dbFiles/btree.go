@@ -0,0 +1,509 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+const btreeMagic uint64 = 0x676f64622d627472 // "godb-btr"
+
+var errCorruptPage = errors.New("btree: corrupt page")
+
+// Settings for the B+tree engine.
+// MaxUncommittedWrites is how many writes are kept in memory before they're
+// committed to the file without waiting for a Snapshot
+type BTreeOptions struct {
+	MaxUncommittedWrites int
+}
+
+func DefaultBTreeOptions() BTreeOptions {
+	return BTreeOptions{MaxUncommittedWrites: 10000}
+}
+
+func (opts BTreeOptions) withDefaults() BTreeOptions {
+	if opts.MaxUncommittedWrites <= 0 {
+		opts.MaxUncommittedWrites = DefaultBTreeOptions().MaxUncommittedWrites
+	}
+	return opts
+}
+
+// The state a commit leaves behind, written to one of the two meta pages
+type btreeMeta struct {
+	root     uint64
+	freelist uint64
+	pages    uint64 // high water mark, every page id below it is in use or free
+	txid     uint64
+	lsn      uint64
+}
+
+//  Copy-on-write B+tree engine keeping everything in one file of 4KB pages.
+//  Pages 0 and 1 are meta pages. A commit writes the changed nodes and the
+//  freelist to free pages, fsyncs, then writes the meta page for its txid
+//  (alternating between the two) and fsyncs again. Pages the last commit
+//  uses are never overwritten, so a crash anywhere leaves the previous
+//  commit in place and no WAL is needed to keep the file consistent.
+//
+//  Between commits the changed nodes live in memory. Because nodes are
+//  copied rather than changed, a read snapshot is just the current root.
+//  Pages freed by a commit stay pending until no snapshot from before it is
+//  still open.
+type btreeEngine struct {
+	lock     sync.RWMutex
+	file     *os.File
+	filename string
+	opts     Options
+	btOpts   BTreeOptions
+	cache    *BlockCache
+	cacheID  uint64
+
+	root          btreeRef
+	meta          btreeMeta
+	freelistPages int
+	free          []uint64            // sorted
+	pending       map[uint64][]uint64 // txid -> pages that commit stopped using
+	freed         []uint64            // pages the uncommitted changes stopped using
+	writes        int
+	snapshots     map[*btreeSnapshot]struct{}
+	closed        bool
+}
+
+func openBTreeEngine(filename string, opts Options) (StorageEngine, uint64, error) {
+	opts = opts.withDefaults()
+	engine := &btreeEngine{
+		filename:  filename + ".btree",
+		opts:      opts,
+		btOpts:    opts.BTree.withDefaults(),
+		cache:     opts.BlockCache,
+		cacheID:   newCacheID(),
+		pending:   make(map[uint64][]uint64),
+		snapshots: make(map[*btreeSnapshot]struct{}),
+	}
+	if engine.cache == nil {
+		engine.cache = NewBlockCache(opts.BlockCacheSize)
+	}
+	file, err := os.OpenFile(engine.filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	engine.file = file
+	if err := engine.load(); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("%s: %w", engine.filename, err)
+	}
+	return engine, engine.meta.lsn, nil
+}
+
+// Function for picking the newest good meta page and reading the freelist,
+// a brand new file gets its two meta pages written first
+func (engine *btreeEngine) load() error {
+	info, err := engine.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		for txid := uint64(0); txid < 2; txid++ {
+			if err := engine.writeMeta(btreeMeta{pages: 2, txid: txid}); err != nil {
+				return err
+			}
+		}
+		if err := engine.sync(); err != nil {
+			return err
+		}
+		engine.meta = btreeMeta{pages: 2, txid: 1}
+		return nil
+	}
+
+	found := false
+	for page := uint64(0); page < 2; page++ {
+		meta, err := engine.readMeta(page)
+		if err != nil {
+			continue
+		}
+		if !found || meta.txid > engine.meta.txid {
+			engine.meta = meta
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("btree: no valid meta page")
+	}
+	engine.root = btreeRef{page: engine.meta.root}
+	if engine.meta.freelist == 0 {
+		return nil
+	}
+	buf, err := engine.readRun(engine.meta.freelist)
+	if err != nil {
+		return err
+	}
+	flags, body, err := parsePage(buf)
+	if err != nil || flags != btreeFreelistPage || len(body)%8 != 0 {
+		return errCorruptPage
+	}
+	engine.freelistPages = pageCount(len(buf))
+	for ; len(body) > 0; body = body[8:] {
+		engine.free = append(engine.free, binary.BigEndian.Uint64(body))
+	}
+	sort.Slice(engine.free, func(i, j int) bool { return engine.free[i] < engine.free[j] })
+	return nil
+}
+
+func (engine *btreeEngine) readMeta(page uint64) (btreeMeta, error) {
+	buf := make([]byte, btreeHeaderSize+48)
+	if _, err := engine.file.ReadAt(buf, int64(page*btreePageSize)); err != nil {
+		return btreeMeta{}, err
+	}
+	flags, body, err := parsePage(buf)
+	if err != nil || flags != btreeMetaPage || len(body) != 48 || binary.BigEndian.Uint64(body) != btreeMagic {
+		return btreeMeta{}, errCorruptPage
+	}
+	return btreeMeta{
+		root:     binary.BigEndian.Uint64(body[8:16]),
+		freelist: binary.BigEndian.Uint64(body[16:24]),
+		pages:    binary.BigEndian.Uint64(body[24:32]),
+		txid:     binary.BigEndian.Uint64(body[32:40]),
+		lsn:      binary.BigEndian.Uint64(body[40:48]),
+	}, nil
+}
+
+func (engine *btreeEngine) writeMeta(meta btreeMeta) error {
+	buf := make([]byte, btreeHeaderSize, btreeHeaderSize+48)
+	for _, field := range []uint64{btreeMagic, meta.root, meta.freelist, meta.pages, meta.txid, meta.lsn} {
+		buf = binary.BigEndian.AppendUint64(buf, field)
+	}
+	putPageHeader(buf, btreeMetaPage)
+	_, err := engine.file.WriteAt(buf, int64(meta.txid%2*btreePageSize))
+	return err
+}
+
+func (engine *btreeEngine) sync() error {
+	if engine.opts.Durability == DurabilityNone {
+		return nil
+	}
+	return engine.file.Sync()
+}
+
+// Function for reading the whole page run starting at page, through the cache
+func (engine *btreeEngine) readRun(page uint64) ([]byte, error) {
+	key := blockCacheKey{table: engine.cacheID, offset: page}
+	if buf, found := engine.cache.get(key); found {
+		return buf, nil
+	}
+	buf := make([]byte, btreePageSize)
+	if _, err := engine.file.ReadAt(buf, int64(page*btreePageSize)); err != nil {
+		return nil, fmt.Errorf("btree: reading page %d: %w", page, err)
+	}
+	if overflow := binary.BigEndian.Uint32(buf[4:8]); overflow > 0 {
+		buf = append(buf, make([]byte, int(overflow)*btreePageSize)...)
+		if _, err := engine.file.ReadAt(buf[btreePageSize:], int64((page+1)*btreePageSize)); err != nil {
+			return nil, fmt.Errorf("btree: reading page %d: %w", page, err)
+		}
+	}
+	engine.cache.put(key, buf)
+	return buf, nil
+}
+
+func (engine *btreeEngine) node(ref btreeRef) (*btreeNode, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	buf, err := engine.readRun(ref.page)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(buf, ref.page)
+	if err != nil {
+		return nil, fmt.Errorf("btree: page %d: %w", ref.page, err)
+	}
+	return n, nil
+}
+
+// Function for noting that the pages behind a node aren't needed once the
+// current changes are committed
+func (engine *btreeEngine) release(n *btreeNode) {
+	if n.page == 0 {
+		return
+	}
+	for i := uint64(0); i <= uint64(n.overflow); i++ {
+		engine.freed = append(engine.freed, n.page+i)
+	}
+}
+
+// Function for taking n contiguous pages from the freelist, or from the end
+// of the file when there's no run long enough
+func (engine *btreeEngine) allocate(n int) uint64 {
+	var page uint64
+	found := false
+	for i := 0; i+n <= len(engine.free); i++ {
+		if engine.free[i+n-1]-engine.free[i] == uint64(n-1) {
+			page = engine.free[i]
+			engine.free = append(engine.free[:i:i], engine.free[i+n:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		page = engine.meta.pages
+		engine.meta.pages += uint64(n)
+	}
+	for i := uint64(0); i < uint64(n); i++ {
+		engine.cache.remove(blockCacheKey{table: engine.cacheID, offset: page + i})
+	}
+	return page
+}
+
+// Function for writing out the changed nodes under ref, children first
+func (engine *btreeEngine) writeTree(ref btreeRef) (uint64, error) {
+	if ref.node == nil {
+		return ref.page, nil
+	}
+	n := ref.node
+	var children []uint64
+	for _, child := range n.children {
+		page, err := engine.writeTree(child)
+		if err != nil {
+			return 0, err
+		}
+		children = append(children, page)
+	}
+	buf := n.encode(children)
+	page := engine.allocate(pageCount(len(buf)))
+	if err := engine.writeRun(page, buf); err != nil {
+		return 0, err
+	}
+	return page, nil
+}
+
+// Padded out to whole pages so a run at the end of the file reads back in full
+func (engine *btreeEngine) writeRun(page uint64, buf []byte) error {
+	buf = append(buf, make([]byte, pageCount(len(buf))*btreePageSize-len(buf))...)
+	_, err := engine.file.WriteAt(buf, int64(page*btreePageSize))
+	return err
+}
+
+// Function for handing pages back to the freelist once no open snapshot
+// can still be reading them
+func (engine *btreeEngine) releasePending() {
+	oldest := engine.meta.txid
+	for snapshot := range engine.snapshots {
+		if snapshot.txid < oldest {
+			oldest = snapshot.txid
+		}
+	}
+	for txid, pages := range engine.pending {
+		if txid <= oldest {
+			engine.free = append(engine.free, pages...)
+			delete(engine.pending, txid)
+		}
+	}
+	sort.Slice(engine.free, func(i, j int) bool { return engine.free[i] < engine.free[j] })
+}
+
+// Function for making the current tree the committed one, caller holds the lock.
+// If anything fails the previous commit is left as it was.
+func (engine *btreeEngine) commit(lsn uint64) error {
+	if engine.root.node == nil && len(engine.freed) == 0 && lsn == engine.meta.lsn {
+		return nil
+	}
+	engine.releasePending()
+	previousMeta := engine.meta
+	previousFree := append([]uint64(nil), engine.free...)
+	fail := func(err error) error {
+		engine.meta = previousMeta
+		engine.free = previousFree
+		return err
+	}
+
+	meta := engine.meta
+	meta.txid++
+	meta.lsn = lsn
+	root, err := engine.writeTree(engine.root)
+	if err != nil {
+		return fail(err)
+	}
+	meta.root = root
+
+	// The pages this commit stops using are free as far as the file is
+	// concerned, but stay pending in memory for the open snapshots
+	unused := append([]uint64(nil), engine.freed...)
+	for i := 0; i < engine.freelistPages; i++ {
+		unused = append(unused, engine.meta.freelist+uint64(i))
+	}
+	count := len(engine.free) + len(unused)
+	for _, pages := range engine.pending {
+		count += len(pages)
+	}
+	freelistPages := pageCount(btreeHeaderSize + 8*count)
+	meta.freelist = engine.allocate(freelistPages)
+	buf := make([]byte, btreeHeaderSize, btreeHeaderSize+8*count)
+	for _, pages := range append([][]uint64{engine.free, unused}, pendingPages(engine.pending)...) {
+		for _, page := range pages {
+			buf = binary.BigEndian.AppendUint64(buf, page)
+		}
+	}
+	putPageHeader(buf, btreeFreelistPage)
+	// The run can be a page longer than needed, allocating it took some pages
+	// off the list
+	binary.BigEndian.PutUint32(buf[4:8], uint32(freelistPages-1))
+	if err := engine.writeRun(meta.freelist, buf); err != nil {
+		return fail(err)
+	}
+	meta.pages = engine.meta.pages
+
+	if err := engine.sync(); err != nil {
+		return fail(err)
+	}
+	if err := engine.writeMeta(meta); err != nil {
+		return fail(err)
+	}
+	if err := engine.sync(); err != nil {
+		return fail(err)
+	}
+
+	engine.meta = meta
+	engine.root = btreeRef{page: meta.root}
+	engine.freelistPages = freelistPages
+	engine.pending[meta.txid] = unused
+	engine.freed = nil
+	engine.writes = 0
+	return nil
+}
+
+func pendingPages(pending map[uint64][]uint64) [][]uint64 {
+	all := make([][]uint64, 0, len(pending))
+	for _, pages := range pending {
+		all = append(all, pages)
+	}
+	return all
+}
+
+func (engine *btreeEngine) Get(key string) (string, error) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	return engine.lookup(engine.root, key)
+}
+
+func (engine *btreeEngine) Put(key, value string) error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	parts, err := engine.insert(engine.root, key, value)
+	if err != nil {
+		return err
+	}
+	for len(parts) > 1 {
+		keys, refs := branchEntries(parts)
+		parts = (&btreeNode{keys: keys, children: refs}).split()
+	}
+	engine.root = btreeRef{node: parts[0]}
+	return engine.written()
+}
+
+func (engine *btreeEngine) Delete(key string) error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	root, changed, err := engine.remove(engine.root, key)
+	if err != nil || !changed {
+		return err
+	}
+	// A root with a single child isn't needed
+	for root != nil && !root.leaf && len(root.children) == 1 {
+		child, err := engine.node(root.children[0])
+		if err != nil {
+			return err
+		}
+		root = child
+	}
+	switch {
+	case root == nil:
+		engine.root = btreeRef{}
+	case root.page != 0:
+		engine.root = btreeRef{page: root.page}
+	default:
+		engine.root = btreeRef{node: root}
+	}
+	return engine.written()
+}
+
+// Function for committing once enough writes have piled up in memory.
+// The commit keeps the last snapshot's LSN, replaying the WAL from there
+// over the newer state still ends up in the right place.
+func (engine *btreeEngine) written() error {
+	engine.writes++
+	if engine.writes < engine.btOpts.MaxUncommittedWrites {
+		return nil
+	}
+	return engine.commit(engine.meta.lsn)
+}
+
+// Goes in key order, over a read snapshot so writes aren't held up
+func (engine *btreeEngine) Iterate(fn func(key, value string) bool) error {
+	return engine.IterateFrom("", fn)
+}
+
+func (engine *btreeEngine) IterateFrom(start string, fn func(key, value string) bool) error {
+	snapshot, err := engine.ReadSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	_, err = engine.walk(snapshot.(*btreeSnapshot).root, start, fn)
+	return err
+}
+
+func (engine *btreeEngine) Snapshot(lsn uint64) (uint64, error) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if err := engine.commit(lsn); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// Uncommitted writes are dropped, the db's WAL still has them
+func (engine *btreeEngine) Close() error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if engine.closed {
+		return nil
+	}
+	engine.closed = true
+	return engine.file.Close()
+}
+
+func (engine *btreeEngine) ReadSnapshot() (ReadSnapshot, error) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if engine.closed {
+		return nil, errors.New("btree: engine is closed")
+	}
+	snapshot := &btreeSnapshot{engine: engine, root: engine.root, txid: engine.meta.txid}
+	engine.snapshots[snapshot] = struct{}{}
+	return snapshot, nil
+}
+
+//  Point-in-time view of a btreeEngine.
+//  txid is the commit the view's on-disk pages belong to, the engine keeps
+//  those pages from being reused until Release.
+type btreeSnapshot struct {
+	engine *btreeEngine
+	root   btreeRef
+	txid   uint64
+}
+
+func (snapshot *btreeSnapshot) Get(key string) (string, error) {
+	return snapshot.engine.lookup(snapshot.root, key)
+}
+
+func (snapshot *btreeSnapshot) Iterate(fn func(key, value string) bool) error {
+	_, err := snapshot.engine.walk(snapshot.root, "", fn)
+	return err
+}
+
+func (snapshot *btreeSnapshot) Release() {
+	snapshot.engine.lock.Lock()
+	defer snapshot.engine.lock.Unlock()
+	delete(snapshot.engine.snapshots, snapshot)
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestBTree(t *testing.T, filename string) *btreeEngine {
+	engine, _, err := openBTreeEngine(filename, Options{BTree: BTreeOptions{MaxUncommittedWrites: 500}})
+	require.NoError(t, err)
+	return engine.(*btreeEngine)
+}
+
+// Function for checking the engine holds exactly expected, in key order
+func assertBTreeContents(t *testing.T, engine *btreeEngine, expected map[string]string) {
+	keys := []string{}
+	require.NoError(t, engine.Iterate(func(key, value string) bool {
+		assert.Equal(t, expected[key], value, key)
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Len(t, keys, len(expected))
+	assert.True(t, sort.StringsAreSorted(keys))
+	for key, value := range expected {
+		got, err := engine.Get(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestBTreeRandomOperations(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestBTree(t, filename)
+	random := rand.New(rand.NewSource(1))
+
+	expected := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", random.Intn(5000))
+		if random.Intn(3) == 0 {
+			require.NoError(t, engine.Delete(key))
+			delete(expected, key)
+			continue
+		}
+		value := strings.Repeat("v", random.Intn(200))
+		require.NoError(t, engine.Put(key, value))
+		expected[key] = value
+		if i%5000 == 0 {
+			_, err := engine.Snapshot(uint64(i))
+			require.NoError(t, err)
+		}
+	}
+	assertBTreeContents(t, engine, expected)
+
+	lsn, err := engine.Snapshot(20000)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20000), lsn)
+	require.NoError(t, engine.Close())
+
+	reopened, lsn, err := openBTreeEngine(filename, Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, uint64(20000), lsn)
+	assertBTreeContents(t, reopened.(*btreeEngine), expected)
+}
+
+// Freed pages are reused, so rewriting the same keys doesn't keep growing
+// the file
+func TestBTreeReusesPages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestBTree(t, filename)
+	defer engine.Close()
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, engine.Put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value-%d", round)))
+		}
+		_, err := engine.Snapshot(uint64(round + 1))
+		require.NoError(t, err)
+		if round == 1 {
+			engine.lock.RLock()
+			assert.NotEmpty(t, engine.free)
+			engine.lock.RUnlock()
+		}
+	}
+	info, err := os.Stat(filename + ".btree")
+	require.NoError(t, err)
+	// 2000 small keys fit in well under 100 pages, a few rounds of garbage
+	// waiting to be reused are fine, ten rounds of it aren't
+	assert.Less(t, info.Size(), int64(400*btreePageSize))
+}
+
+// A commit that never got its meta page written leaves the previous one
+func TestBTreeTornCommit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestBTree(t, filename)
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		expected[key] = "first"
+		require.NoError(t, engine.Put(key, "first"))
+	}
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i += 3 {
+		require.NoError(t, engine.Put(fmt.Sprintf("key%05d", i), "second"))
+	}
+	_, err = engine.Snapshot(2)
+	require.NoError(t, err)
+	torn := engine.meta.txid % 2
+	require.NoError(t, engine.Close())
+
+	file, err := os.OpenFile(filename+".btree", os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("torn"), int64(torn*btreePageSize)+btreeHeaderSize+4)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reopened, lsn, err := openBTreeEngine(filename, Options{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, uint64(1), lsn)
+	assertBTreeContents(t, reopened.(*btreeEngine), expected)
+}
+
+func TestBTreeReadSnapshot(t *testing.T) {
+	engine := openTestBTree(t, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+
+	before := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		before[key] = "old"
+		require.NoError(t, engine.Put(key, "old"))
+	}
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+
+	snapshot, err := engine.ReadSnapshot()
+	require.NoError(t, err)
+
+	// Several commits later the pages the snapshot reads would have been
+	// reused, if it weren't holding on to them
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			if i%2 == 0 {
+				require.NoError(t, engine.Delete(key))
+			} else {
+				require.NoError(t, engine.Put(key, fmt.Sprintf("new-%d", round)))
+			}
+		}
+		_, err := engine.Snapshot(uint64(round + 2))
+		require.NoError(t, err)
+	}
+
+	count := 0
+	require.NoError(t, snapshot.Iterate(func(key, value string) bool {
+		assert.Equal(t, "old", value)
+		count++
+		return true
+	}))
+	assert.Equal(t, len(before), count)
+	value, err := snapshot.Get("key00000")
+	require.NoError(t, err)
+	assert.Equal(t, "old", value)
+
+	_, err = engine.Get("key00000")
+	assert.Equal(t, ErrNotFound, err)
+
+	engine.lock.RLock()
+	pending := len(engine.pending)
+	engine.lock.RUnlock()
+	snapshot.Release()
+	_, err = engine.Snapshot(10)
+	require.NoError(t, err)
+	engine.lock.RLock()
+	assert.Less(t, len(engine.pending), pending)
+	engine.lock.RUnlock()
+}
+
+// Values bigger than a page take up a run of pages
+func TestBTreeLargeValues(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestBTree(t, filename)
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		expected[key] = strings.Repeat(key, 1000*(i+1))
+		require.NoError(t, engine.Put(key, expected[key]))
+	}
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+	require.NoError(t, engine.Close())
+
+	reopened := openTestBTree(t, filename)
+	defer reopened.Close()
+	assertBTreeContents(t, reopened, expected)
+}
@@ -0,0 +1,387 @@
+package db
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+)
+
+//  Every page run (a node or the freelist) starts with a 16 byte header:
+//
+//	flags    uint16   leaf, branch, meta or freelist
+//	unused   uint16
+//	overflow uint32   pages after the first one the run takes up
+//	length   uint32   bytes of body after the header
+//	crc      uint32   crc32c of the body
+//
+//  A leaf body is key length and value length as uvarints then the key and
+//  value, for each entry. A branch body is key length as a uvarint, the key,
+//  then the child's page id as a uint64, for each child, where the key is the
+//  smallest key under that child.
+const (
+	btreePageSize   = 4096
+	btreeHeaderSize = 16
+
+	btreeLeafPage     uint16 = 1
+	btreeBranchPage   uint16 = 2
+	btreeMetaPage     uint16 = 4
+	btreeFreelistPage uint16 = 8
+)
+
+// A node below this size is merged with a sibling after a delete
+const btreeMinFill = btreePageSize / 4
+
+//  Reference to a child: a page on disk, or a node that only exists in
+//  memory because it was changed since the last commit.
+//  The zero value is the empty tree.
+type btreeRef struct {
+	page uint64
+	node *btreeNode
+}
+
+func (ref btreeRef) empty() bool {
+	return ref.page == 0 && ref.node == nil
+}
+
+//  A B+tree node. Nodes are never changed once other code can see them,
+//  writes copy every node from the leaf up to the root, which is what makes
+//  read snapshots free.
+//  page and overflow are set for nodes read from disk so the pages can be
+//  freed once the node is replaced.
+type btreeNode struct {
+	leaf     bool
+	keys     []string
+	values   []string
+	children []btreeRef
+	page     uint64
+	overflow uint32
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	return &btreeNode{
+		leaf:     n.leaf,
+		keys:     append([]string(nil), n.keys...),
+		values:   append([]string(nil), n.values...),
+		children: append([]btreeRef(nil), n.children...),
+	}
+}
+
+func (n *btreeNode) elementSize(i int) int {
+	if n.leaf {
+		return uvarintLen(len(n.keys[i])) + uvarintLen(len(n.values[i])) + len(n.keys[i]) + len(n.values[i])
+	}
+	return uvarintLen(len(n.keys[i])) + len(n.keys[i]) + 8
+}
+
+// Encoded size, header included
+func (n *btreeNode) size() int {
+	size := btreeHeaderSize
+	for i := range n.keys {
+		size += n.elementSize(i)
+	}
+	return size
+}
+
+// Index of the child that key belongs under
+func (n *btreeNode) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// Function for breaking a node that grew past a page into page sized nodes
+func (n *btreeNode) split() []*btreeNode {
+	if n.size() <= btreePageSize || len(n.keys) < 2 {
+		return []*btreeNode{n}
+	}
+	parts := []*btreeNode{}
+	part := &btreeNode{leaf: n.leaf}
+	size := btreeHeaderSize
+	for i := range n.keys {
+		element := n.elementSize(i)
+		if len(part.keys) > 0 && size+element > btreePageSize {
+			parts = append(parts, part)
+			part = &btreeNode{leaf: n.leaf}
+			size = btreeHeaderSize
+		}
+		part.keys = append(part.keys, n.keys[i])
+		if n.leaf {
+			part.values = append(part.values, n.values[i])
+		} else {
+			part.children = append(part.children, n.children[i])
+		}
+		size += element
+	}
+	return append(parts, part)
+}
+
+// Branch entries pointing at nodes
+func branchEntries(nodes []*btreeNode) ([]string, []btreeRef) {
+	keys := make([]string, len(nodes))
+	refs := make([]btreeRef, len(nodes))
+	for i, node := range nodes {
+		keys[i] = node.keys[0]
+		refs[i] = btreeRef{node: node}
+	}
+	return keys, refs
+}
+
+// Function for encoding a node, children holds the page ids of a branch's children
+func (n *btreeNode) encode(children []uint64) []byte {
+	buf := make([]byte, btreeHeaderSize, n.size())
+	for i, key := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		if n.leaf {
+			buf = binary.AppendUvarint(buf, uint64(len(n.values[i])))
+			buf = append(buf, key...)
+			buf = append(buf, n.values[i]...)
+		} else {
+			buf = append(buf, key...)
+			buf = binary.BigEndian.AppendUint64(buf, children[i])
+		}
+	}
+	flags := btreeBranchPage
+	if n.leaf {
+		flags = btreeLeafPage
+	}
+	putPageHeader(buf, flags)
+	return buf
+}
+
+// Function for filling in the header of an encoded page run
+func putPageHeader(buf []byte, flags uint16) {
+	body := buf[btreeHeaderSize:]
+	binary.BigEndian.PutUint16(buf[0:2], flags)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(pageCount(len(buf))-1))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[12:16], crc32.Checksum(body, crcTable))
+}
+
+// Function for checking a page run's header and returning its flags and body
+func parsePage(buf []byte) (uint16, []byte, error) {
+	if len(buf) < btreeHeaderSize {
+		return 0, nil, errCorruptPage
+	}
+	length := binary.BigEndian.Uint32(buf[8:12])
+	if uint64(length) > uint64(len(buf)-btreeHeaderSize) {
+		return 0, nil, errCorruptPage
+	}
+	body := buf[btreeHeaderSize : btreeHeaderSize+int(length)]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(buf[12:16]) {
+		return 0, nil, errCorruptPage
+	}
+	return binary.BigEndian.Uint16(buf[0:2]), body, nil
+}
+
+func decodeNode(buf []byte, page uint64) (*btreeNode, error) {
+	flags, body, err := parsePage(buf)
+	if err != nil {
+		return nil, err
+	}
+	if flags != btreeLeafPage && flags != btreeBranchPage {
+		return nil, errCorruptPage
+	}
+	n := &btreeNode{
+		leaf:     flags == btreeLeafPage,
+		page:     page,
+		overflow: binary.BigEndian.Uint32(buf[4:8]),
+	}
+	for len(body) > 0 {
+		keyLen, read := binary.Uvarint(body)
+		if read <= 0 {
+			return nil, errCorruptPage
+		}
+		body = body[read:]
+		if n.leaf {
+			valueLen, read := binary.Uvarint(body)
+			if read <= 0 || uint64(len(body)-read) < keyLen+valueLen {
+				return nil, errCorruptPage
+			}
+			body = body[read:]
+			n.keys = append(n.keys, string(body[:keyLen]))
+			n.values = append(n.values, string(body[keyLen:keyLen+valueLen]))
+			body = body[keyLen+valueLen:]
+		} else {
+			if uint64(len(body)) < keyLen+8 {
+				return nil, errCorruptPage
+			}
+			n.keys = append(n.keys, string(body[:keyLen]))
+			n.children = append(n.children, btreeRef{page: binary.BigEndian.Uint64(body[keyLen:])})
+			body = body[keyLen+8:]
+		}
+	}
+	return n, nil
+}
+
+// Pages needed to hold size bytes
+func pageCount(size int) int {
+	return (size + btreePageSize - 1) / btreePageSize
+}
+
+func uvarintLen(n int) int {
+	length := 1
+	for n >= 0x80 {
+		n >>= 7
+		length++
+	}
+	return length
+}
+
+// Function for setting key under ref, returns the node(s) that replace it
+func (engine *btreeEngine) insert(ref btreeRef, key, value string) ([]*btreeNode, error) {
+	if ref.empty() {
+		return []*btreeNode{{leaf: true, keys: []string{key}, values: []string{value}}}, nil
+	}
+	n, err := engine.node(ref)
+	if err != nil {
+		return nil, err
+	}
+	engine.release(n)
+	n = n.clone()
+
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			n.values[i] = value
+		} else {
+			n.keys = append(n.keys[:i], append([]string{key}, n.keys[i:]...)...)
+			n.values = append(n.values[:i], append([]string{value}, n.values[i:]...)...)
+		}
+		return n.split(), nil
+	}
+
+	i := n.childIndex(key)
+	parts, err := engine.insert(n.children[i], key, value)
+	if err != nil {
+		return nil, err
+	}
+	keys, refs := branchEntries(parts)
+	n.keys = append(n.keys[:i], append(keys, n.keys[i+1:]...)...)
+	n.children = append(n.children[:i], append(refs, n.children[i+1:]...)...)
+	return n.split(), nil
+}
+
+//  Function for removing key under ref.
+//  Returns the replacement node, nil when the node ended up empty, and
+//  whether anything changed at all so untouched paths aren't copied.
+func (engine *btreeEngine) remove(ref btreeRef, key string) (*btreeNode, bool, error) {
+	if ref.empty() {
+		return nil, false, nil
+	}
+	n, err := engine.node(ref)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return n, false, nil
+		}
+		engine.release(n)
+		n = n.clone()
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		if len(n.keys) == 0 {
+			return nil, true, nil
+		}
+		return n, true, nil
+	}
+
+	i := n.childIndex(key)
+	child, changed, err := engine.remove(n.children[i], key)
+	if err != nil || !changed {
+		return n, false, err
+	}
+	engine.release(n)
+	n = n.clone()
+	if child == nil {
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		if len(n.keys) == 0 {
+			return nil, true, nil
+		}
+		return n, true, nil
+	}
+	n.keys[i] = child.keys[0]
+	n.children[i] = btreeRef{node: child}
+	if child.size() >= btreeMinFill || len(n.keys) == 1 {
+		return n, true, nil
+	}
+
+	// Merge the small child with a sibling, then split again if that
+	// turned out too big for one page
+	left := i - 1
+	if left < 0 {
+		left = 0
+	}
+	first, err := engine.node(n.children[left])
+	if err != nil {
+		return nil, false, err
+	}
+	second, err := engine.node(n.children[left+1])
+	if err != nil {
+		return nil, false, err
+	}
+	engine.release(first)
+	engine.release(second)
+	merged := &btreeNode{
+		leaf:     first.leaf,
+		keys:     append(append([]string(nil), first.keys...), second.keys...),
+		values:   append(append([]string(nil), first.values...), second.values...),
+		children: append(append([]btreeRef(nil), first.children...), second.children...),
+	}
+	keys, refs := branchEntries(merged.split())
+	n.keys = append(n.keys[:left], append(keys, n.keys[left+2:]...)...)
+	n.children = append(n.children[:left], append(refs, n.children[left+2:]...)...)
+	return n, true, nil
+}
+
+// Function for looking key up under ref
+func (engine *btreeEngine) lookup(ref btreeRef, key string) (string, error) {
+	for !ref.empty() {
+		n, err := engine.node(ref)
+		if err != nil {
+			return "", err
+		}
+		if !n.leaf {
+			ref = n.children[n.childIndex(key)]
+			continue
+		}
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			return n.values[i], nil
+		}
+		break
+	}
+	return "", ErrNotFound
+}
+
+// Function for visiting everything under ref from start on, in key order.
+// Returns false once fn has asked to stop.
+func (engine *btreeEngine) walk(ref btreeRef, start string, fn func(key, value string) bool) (bool, error) {
+	if ref.empty() {
+		return true, nil
+	}
+	n, err := engine.node(ref)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		for i := sort.SearchStrings(n.keys, start); i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.values[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := n.childIndex(start); i < len(n.children); i++ {
+		more, err := engine.walk(n.children[i], start, fn)
+		if err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,667 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A node of a cluster. Addr is where the other nodes reach it, HTTPAddr
+// where clients do, for redirects.
+type ClusterNode struct {
+	ID       string `json:"id"`
+	Addr     string `json:"addr"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+}
+
+// A shard of a cluster, its raft group has a member on each of Nodes
+type ClusterShard struct {
+	ID    int      `json:"id"`
+	Range [2]int   `json:"range"`
+	Nodes []string `json:"nodes"`
+}
+
+//  Which nodes make up a cluster and which of them host each shard, every
+//  node is started with the same one. Partitioner and VirtualNodes pick how
+//  keys map onto the shards, as they do for a ShardedDB.
+type Topology struct {
+	Nodes        []ClusterNode  `json:"nodes"`
+	Partitioner  string         `json:"partitioner,omitempty"`
+	VirtualNodes int            `json:"virtual_nodes,omitempty"`
+	Shards       []ClusterShard `json:"shards"`
+}
+
+// Function for laying ranges out over nodes, each shard gets
+// replicationFactor nodes (all of them if there aren't that many), taking
+// turns so every node hosts about as many
+func NewTopology(nodes []ClusterNode, ranges [][2]int, replicationFactor int, partitioner string) Topology {
+	topology := Topology{Nodes: nodes, Partitioner: partitioner}
+	replicationFactor = min(max(replicationFactor, 1), len(nodes))
+	for id, r := range ranges {
+		shard := ClusterShard{ID: id, Range: r}
+		for i := 0; i < replicationFactor; i++ {
+			shard.Nodes = append(shard.Nodes, nodes[(id+i)%len(nodes)].ID)
+		}
+		topology.Shards = append(topology.Shards, shard)
+	}
+	return topology
+}
+
+// Function for loading a topology written as JSON
+func ReadTopology(filename string) (Topology, error) {
+	topology := Topology{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return topology, err
+	}
+	if err := json.Unmarshal(data, &topology); err != nil {
+		return topology, fmt.Errorf("reading topology %s: %w", filename, err)
+	}
+	return topology, topology.Validate()
+}
+
+// Function for checking every node has an ID and address of its own, and
+// every shard is on nodes that exist, each once
+func (topology Topology) Validate() error {
+	ids := map[string]bool{}
+	for _, node := range topology.Nodes {
+		switch {
+		case node.ID == "" || strings.Contains(node.ID, "@"):
+			return fmt.Errorf("node ID %q has to be set and can't have an @ in it", node.ID)
+		case node.Addr == "":
+			return fmt.Errorf("node %s has no address", node.ID)
+		case ids[node.ID]:
+			return fmt.Errorf("node %s is in the topology twice", node.ID)
+		}
+		ids[node.ID] = true
+	}
+	shardIDs := map[int]bool{}
+	ranges := [][2]int{}
+	for _, shard := range topology.Shards {
+		if shardIDs[shard.ID] {
+			return fmt.Errorf("shard %d is in the topology twice", shard.ID)
+		}
+		shardIDs[shard.ID] = true
+		if len(shard.Nodes) == 0 {
+			return fmt.Errorf("shard %d isn't on any node", shard.ID)
+		}
+		for i, id := range shard.Nodes {
+			if !ids[id] {
+				return fmt.Errorf("shard %d is on unknown node %s", shard.ID, id)
+			}
+			if slices.Contains(shard.Nodes[:i], id) {
+				return fmt.Errorf("shard %d is on node %s twice", shard.ID, id)
+			}
+		}
+		ranges = append(ranges, shard.Range)
+	}
+	return ValidatePartitioner(topology.Partitioner, ranges)
+}
+
+func (topology Topology) node(id string) (ClusterNode, bool) {
+	for _, node := range topology.Nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+func (topology Topology) shard(id int) ClusterShard {
+	for _, shard := range topology.Shards {
+		if shard.ID == id {
+			return shard
+		}
+	}
+	return ClusterShard{}
+}
+
+// Name of a node's member of a shard's raft group, nodeOf undoes it
+func memberID(shardID int, node string) string {
+	return fmt.Sprintf("%d@%s", shardID, node)
+}
+
+func nodeOf(member string) string {
+	return member[strings.LastIndex(member, "@")+1:]
+}
+
+// Request ops, see NodeRequest
+const (
+	opGet    = "get"
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+// How many times a request can be passed on between nodes looking for the
+// shard's leader
+const clusterHops = 2
+
+//  A request a node passes on to another, or a NodeClient sends. Hops is
+//  how many nodes it's been through.
+type NodeRequest struct {
+	Op    string
+	Key   string
+	Value string
+	Hops  int
+}
+
+// The answer to a NodeRequest, Node is the node that carried it out
+type NodeReply struct {
+	Value string
+	Err   string
+	Code  int
+	Node  string
+}
+
+// Errors that keep their identity on their way between nodes, a reply's
+// Code is the index into it plus one. errNotSent is also ErrUnreachable, so
+// it comes first.
+var nodeErrors = []error{ErrNotFound, ErrItemDoesNotExist, ErrInvalidKey, ErrNotLeader,
+	ErrLeadershipLost, ErrReplicationTimeout, errNotSent, ErrUnreachable}
+
+// An error from another node, it unwraps to one of nodeErrors if it was
+// one of them
+type remoteError struct {
+	message string
+	kind    error
+}
+
+func (err remoteError) Error() string { return err.message }
+func (err remoteError) Unwrap() error { return err.kind }
+
+func replyFor(err error) NodeReply {
+	reply := NodeReply{Err: err.Error()}
+	for i, kind := range nodeErrors {
+		if errors.Is(err, kind) {
+			reply.Code = i + 1
+			break
+		}
+	}
+	return reply
+}
+
+func (reply NodeReply) err() error {
+	switch {
+	case reply.Err == "":
+		return nil
+	case reply.Code > 0 && reply.Code <= len(nodeErrors):
+		return remoteError{message: reply.Err, kind: nodeErrors[reply.Code-1]}
+	}
+	return remoteError{message: reply.Err}
+}
+
+//  One process of a cluster. It has a member of the raft group of each
+//  shard the topology puts on it, in its own directory, and carries out
+//  requests for the shards it leads. Requests for other shards are passed
+//  on to the node leading them.
+//  The nodes keep track of each other by gossip. When it has a shard's
+//  leader dead, or gone, a member of the shard stands for election rather
+//  than wait for raft to notice.
+//  shards are stand-ins with the topology's IDs and ranges, for the
+//  partitioner. leaders is the node last seen leading each shard this one
+//  has no member of. membership is signalled when gossip has news.
+type Node struct {
+	ID          string
+	topology    Topology
+	opts        Options
+	partitioner Partitioner
+	shards      []*Shard
+	members     map[int]*db
+	transport   *TCPTransport
+	gossip      *Gossip
+	listener    net.Listener
+	lock        sync.Mutex
+	leaders     map[int]string
+	promotions  []Promotion
+	conns       map[net.Conn]bool
+	closed      bool
+	membership  chan struct{}
+	done        chan struct{}
+	serving     sync.WaitGroup
+	watching    sync.WaitGroup
+}
+
+//  Function for starting node id of topology, its members' files are kept
+//  in dir. It listens on the port of its address for the other nodes and
+//  NodeClients. Members carry on from their files if they're there, new
+//  ones start out with the shard's nodes as their group. The node joins
+//  the others' gossip in the background, trying again until one of them
+//  answers.
+func StartNode(topology Topology, id, dir string, opts Options) (*Node, error) {
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	self, ok := topology.node(id)
+	if !ok {
+		return nil, fmt.Errorf("node %s isn't in the topology", id)
+	}
+	opts = opts.withDefaults().withSharedCache()
+	partitioner, err := NewPartitioner(topology.Partitioner, topology.VirtualNodes)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	_, port, err := net.SplitHostPort(self.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("address of node %s: %w", id, err)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{ID: id, topology: topology, opts: opts, partitioner: partitioner, members: make(map[int]*db),
+		transport: NewTCPTransport(topology.Nodes, opts), listener: listener,
+		leaders: make(map[int]string), conns: make(map[net.Conn]bool), membership: make(chan struct{}, 1),
+		done: make(chan struct{})}
+	gossipOpts := opts.Gossip
+	gossipOpts.OnChange = node.memberChanged
+	node.gossip = NewGossip(id, node.transport, gossipOpts)
+	for _, shard := range topology.Shards {
+		node.shards = append(node.shards, &Shard{ID: shard.ID, Range: shard.Range})
+		if !slices.Contains(shard.Nodes, id) {
+			continue
+		}
+		if err := node.startMember(shard, dir); err != nil {
+			node.Close()
+			return nil, err
+		}
+	}
+	node.gossip.Start(true)
+	node.serving.Add(1)
+	go node.serve()
+	peers := []string{}
+	for _, other := range topology.Nodes {
+		if other.ID != id {
+			peers = append(peers, other.ID)
+		}
+	}
+	node.watching.Add(1)
+	go node.watchMembers(peers)
+	return node, nil
+}
+
+// Function for opening the node's member of shard and joining its group
+func (node *Node) startMember(shard ClusterShard, dir string) error {
+	database, _, err := openRaftMember(filepath.Join(dir, fmt.Sprintf("shard_%d", shard.ID)), node.opts)
+	if err != nil {
+		return err
+	}
+	members := []string{}
+	for _, id := range shard.Nodes {
+		members = append(members, memberID(shard.ID, id))
+	}
+	raft, err := newRaftNode(memberID(shard.ID, node.ID), database, node.transport, members, node.opts)
+	if err != nil {
+		database.Close()
+		return fmt.Errorf("starting raft for shard %d: %w", shard.ID, err)
+	}
+	database.raft = raft
+	node.members[shard.ID] = database
+	raft.start()
+	return nil
+}
+
+// Function for taking connections from other nodes and clients until the
+// node is closed
+func (node *Node) serve() {
+	defer node.serving.Done()
+	server := newNodeServer(node)
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			return
+		}
+		node.lock.Lock()
+		if node.closed {
+			node.lock.Unlock()
+			conn.Close()
+			return
+		}
+		node.conns[conn] = true
+		node.lock.Unlock()
+		node.serving.Add(1)
+		go func() {
+			defer node.serving.Done()
+			server.ServeConn(conn)
+			node.lock.Lock()
+			delete(node.conns, conn)
+			node.lock.Unlock()
+		}()
+	}
+}
+
+// Function for joining the gossip through peers, then checking the leaders
+// of the node's shards whenever gossip has news, and every Interval anyway,
+// until the node is closed
+func (node *Node) watchMembers(peers []string) {
+	defer node.watching.Done()
+	joined := len(peers) == 0
+	ticker := time.NewTicker(node.gossip.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if !joined {
+			joined = node.gossip.Join(peers...) == nil
+		}
+		select {
+		case <-node.done:
+			return
+		case <-node.membership:
+		case <-ticker.C:
+		}
+		node.checkLeaders()
+	}
+}
+
+// Function for passing gossip's news on to watchMembers, and to the
+// OnChange in the node's options if there is one
+func (node *Node) memberChanged(member GossipMember) {
+	select {
+	case node.membership <- struct{}{}:
+	default:
+	}
+	if node.opts.Gossip.OnChange != nil {
+		node.opts.Gossip.OnChange(member)
+	}
+}
+
+// Whether gossip has node id as still in the cluster. Nodes it hasn't
+// heard of yet are taken to be.
+func (node *Node) live(id string) bool {
+	state, known := node.gossip.State(id)
+	return !known || state == MemberAlive || state == MemberSuspect
+}
+
+//  Function for taking over shards whose leader gossip has dead or gone.
+//  Of the shard's nodes still live, the first in the topology's order
+//  stands for election, so they don't all stand at once and split the
+//  vote. If its log is too far behind to win, raft elects someone else
+//  once its own timeout runs out.
+func (node *Node) checkLeaders() {
+	for _, shard := range node.topology.Shards {
+		member := node.members[shard.ID]
+		if member == nil || member.raft.isLeader() {
+			continue
+		}
+		leader := member.raft.status().Leader
+		if leader == "" || node.live(nodeOf(leader)) {
+			continue
+		}
+		first := ""
+		for _, id := range shard.Nodes {
+			if node.live(id) {
+				first = id
+				break
+			}
+		}
+		if first != node.ID {
+			continue
+		}
+		state, _ := node.gossip.State(nodeOf(leader))
+		member.raft.campaign()
+		if member.raft.isLeader() {
+			node.recordPromotion(Promotion{ShardID: shard.ID, From: nodeOf(leader), To: node.ID,
+				Reason: fmt.Sprintf("%s is %s according to gossip", nodeOf(leader), state), At: time.Now()})
+		}
+	}
+}
+
+// Function for adding a promotion to the node's history
+func (node *Node) recordPromotion(promotion Promotion) {
+	fmt.Printf("Node %s took over shard %d from %s: %s\n", promotion.To, promotion.ShardID, promotion.From, promotion.Reason)
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.promotions = append(node.promotions, promotion)
+	if len(node.promotions) > promotionHistory {
+		node.promotions = node.promotions[len(node.promotions)-promotionHistory:]
+	}
+}
+
+// Shards the node has taken over because of gossip, oldest first
+func (node *Node) Promotions() []Promotion {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return append([]Promotion{}, node.promotions...)
+}
+
+// The topology the node was started with
+func (node *Node) Topology() Topology {
+	return node.topology
+}
+
+// Function for setting key, wherever its shard is led from
+func (node *Node) Set(key, value string) error {
+	return node.do(NodeRequest{Op: opSet, Key: key, Value: value}).err()
+}
+
+// Function for getting key from the leader of its shard, so it's never
+// older than the last write acknowledged
+func (node *Node) Get(key string) (string, error) {
+	reply := node.do(NodeRequest{Op: opGet, Key: key})
+	return reply.Value, reply.err()
+}
+
+// Function for deleting key, wherever its shard is led from
+func (node *Node) Delete(key string) error {
+	return node.do(NodeRequest{Op: opDelete, Key: key}).err()
+}
+
+//  Function for carrying out request on the leader of its key's shard.
+//  Requests from clients are retried until ReplicationTimeout while the
+//  shard has no leader or its leader can't be connected to, ones passed on
+//  from another node are left to that node to retry. A request that got to
+//  a node but had no reply in time isn't tried again, it may have been
+//  carried out, and neither is one the leader lost track of.
+func (node *Node) do(request NodeRequest) NodeReply {
+	shard, err := node.partitioner.ShardFor(request.Key, node.shards)
+	if err != nil {
+		return replyFor(err)
+	}
+	deadline := time.Now().Add(node.opts.ReplicationTimeout)
+	for attempt := 0; ; attempt++ {
+		reply := node.try(node.topology.shard(shard.ID), request, attempt)
+		err := reply.err()
+		retry := errors.Is(err, ErrNotLeader) || errors.Is(err, errNotSent)
+		if !retry || request.Hops > 0 || time.Now().After(deadline) {
+			return reply
+		}
+		time.Sleep(node.opts.RaftHeartbeat)
+	}
+}
+
+// Function for carrying out request here if the node leads shard, or
+// passing it on to the node that looks most likely to
+func (node *Node) try(shard ClusterShard, request NodeRequest, attempt int) NodeReply {
+	if member := node.members[shard.ID]; member != nil && member.raft.isLeader() {
+		reply := node.apply(member, request)
+		reply.Node = node.ID
+		return reply
+	}
+	target := node.leaderOf(shard, attempt)
+	if target == "" || request.Hops >= clusterHops {
+		return replyFor(fmt.Errorf("%w: shard %d has no leader %s knows of", ErrNotLeader, shard.ID, node.ID))
+	}
+	request.Hops++
+	reply, err := node.transport.forward(target, request)
+	if err != nil {
+		reply = replyFor(err)
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	switch {
+	case errors.Is(reply.err(), ErrNotLeader) || errors.Is(reply.err(), ErrUnreachable):
+		delete(node.leaders, shard.ID)
+	case reply.Node != "":
+		node.leaders[shard.ID] = reply.Node
+	}
+	return reply
+}
+
+//  The node most likely to lead shard, going by this node's member of it if
+//  it has one, then by where requests went last time. Failing those the
+//  shard's other nodes take turns by attempt. Nodes gossip has dead or gone
+//  are passed over.
+func (node *Node) leaderOf(shard ClusterShard, attempt int) string {
+	if member := node.members[shard.ID]; member != nil {
+		if leader := member.raft.status().Leader; leader != "" && nodeOf(leader) != node.ID && node.live(nodeOf(leader)) {
+			return nodeOf(leader)
+		}
+	}
+	node.lock.Lock()
+	leader := node.leaders[shard.ID]
+	node.lock.Unlock()
+	if leader != "" && node.live(leader) {
+		return leader
+	}
+	others := slices.DeleteFunc(slices.Clone(shard.Nodes), func(id string) bool { return id == node.ID || !node.live(id) })
+	if len(others) == 0 {
+		return ""
+	}
+	return others[attempt%len(others)]
+}
+
+// Function for carrying out request on member, which leads its shard
+func (node *Node) apply(member *db, request NodeRequest) NodeReply {
+	timeout := node.opts.ReplicationTimeout
+	var err error
+	switch request.Op {
+	case opGet:
+		if err = member.raft.readBarrier(timeout); err == nil {
+			var value string
+			if value, err = member.Get(request.Key); err == nil {
+				return NodeReply{Value: value}
+			}
+		}
+	case opSet:
+		_, err = member.raft.propose(Record{Type: RecordSet, Key: request.Key, Value: request.Value}, timeout)
+	case opDelete:
+		if _, err = member.Get(request.Key); err == ErrNotFound {
+			err = ErrItemDoesNotExist
+		} else if err == nil {
+			_, err = member.raft.propose(Record{Type: RecordDelete, Key: request.Key}, timeout)
+		}
+	default:
+		err = fmt.Errorf("unknown op %q", request.Op)
+	}
+	if err != nil {
+		return replyFor(err)
+	}
+	return NodeReply{}
+}
+
+//  Function for finding the node that leads key's shard, as far as this
+//  node knows, for redirecting clients to it. ErrNotLeader if it doesn't
+//  know.
+func (node *Node) Locate(key string) (ClusterNode, error) {
+	shard, err := node.partitioner.ShardFor(key, node.shards)
+	if err != nil {
+		return ClusterNode{}, err
+	}
+	leader := ""
+	if member := node.members[shard.ID]; member != nil {
+		leader = nodeOf(member.raft.status().Leader)
+	} else {
+		node.lock.Lock()
+		leader = node.leaders[shard.ID]
+		node.lock.Unlock()
+	}
+	if found, ok := node.topology.node(leader); ok {
+		return found, nil
+	}
+	return ClusterNode{}, fmt.Errorf("%w: %s doesn't know who leads shard %d", ErrNotLeader, node.ID, shard.ID)
+}
+
+// What a node reports about itself, a shard's Raft is the node's member of
+// it, if it has one. Members is the cluster as gossip has it.
+type NodeStatus struct {
+	ID      string            `json:"id"`
+	Shards  []NodeShardStatus `json:"shards"`
+	Members []GossipMember    `json:"members"`
+}
+
+type NodeShardStatus struct {
+	ID     int         `json:"id"`
+	Range  [2]int      `json:"range"`
+	Nodes  []string    `json:"nodes"`
+	Leader string      `json:"leader,omitempty"`
+	Raft   *RaftStatus `json:"raft,omitempty"`
+}
+
+func (node *Node) Status() NodeStatus {
+	status := NodeStatus{ID: node.ID, Shards: []NodeShardStatus{}, Members: node.gossip.Members()}
+	for _, shard := range node.topology.Shards {
+		shardStatus := NodeShardStatus{ID: shard.ID, Range: shard.Range, Nodes: shard.Nodes}
+		if member := node.members[shard.ID]; member != nil {
+			raft := member.raft.status()
+			shardStatus.Raft = &raft
+			if raft.Leader != "" {
+				shardStatus.Leader = nodeOf(raft.Leader)
+			}
+		} else {
+			node.lock.Lock()
+			shardStatus.Leader = node.leaders[shard.ID]
+			node.lock.Unlock()
+		}
+		status.Shards = append(status.Shards, shardStatus)
+	}
+	return status
+}
+
+// Function for snapshotting each of the node's members, see db.Save
+func (node *Node) Save() error {
+	var firstErr error
+	for _, member := range node.members {
+		if err := member.Save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Function for telling the other nodes this one is leaving, then stopping
+// its members and its connections
+func (node *Node) Close() error {
+	return node.close(true)
+}
+
+// Same as Close, without telling anyone if leave isn't set, as if the node
+// had crashed
+func (node *Node) close(leave bool) error {
+	node.lock.Lock()
+	if node.closed {
+		node.lock.Unlock()
+		return nil
+	}
+	node.closed = true
+	node.lock.Unlock()
+	close(node.done)
+	node.watching.Wait()
+	if leave {
+		node.gossip.Leave()
+	} else {
+		node.gossip.Stop()
+	}
+	var firstErr error
+	for _, member := range node.members {
+		if err := member.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	node.listener.Close()
+	node.lock.Lock()
+	for conn := range node.conns {
+		conn.Close()
+	}
+	node.lock.Unlock()
+	node.serving.Wait()
+	node.transport.Close()
+	return firstErr
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func clusterTestOptions() Options {
+	return Options{RaftElectionTimeout: 150 * time.Millisecond, RaftHeartbeat: 30 * time.Millisecond, ReplicationTimeout: 5 * time.Second}
+}
+
+// Function for making a topology of nodes on free local ports, ranges laid
+// out over them as NewTopology does
+func localTopology(t *testing.T, nodes int, ranges [][2]int, replicationFactor int) Topology {
+	clusterNodes := []ClusterNode{}
+	for i := 0; i < nodes; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		clusterNodes = append(clusterNodes, ClusterNode{ID: fmt.Sprintf("node%d", i), Addr: listener.Addr().String()})
+		listener.Close()
+	}
+	return NewTopology(clusterNodes, ranges, replicationFactor, RangePartitioner)
+}
+
+// Function for waiting until every shard has a leader the node knows of
+func waitForLeaders(t *testing.T, client *NodeClient) NodeStatus {
+	var status NodeStatus
+	require.Eventually(t, func() bool {
+		var err error
+		if status, err = client.Status(); err != nil {
+			return false
+		}
+		for _, shard := range status.Shards {
+			if shard.Raft != nil && shard.Leader == "" {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+	return status
+}
+
+//  Every node takes requests for every key, passing them on to the node
+//  leading the key's shard, including nodes with no member of the shard.
+func TestClusterForwardsRequests(t *testing.T) {
+	topology := localTopology(t, 3, [][2]int{{0, 99}, {100, 199}, {200, 299}}, 2)
+	require.Equal(t, []string{"node0", "node1"}, topology.Shards[0].Nodes)
+	dir := t.TempDir()
+	nodes := []*Node{}
+	for _, clusterNode := range topology.Nodes {
+		node, err := StartNode(topology, clusterNode.ID, filepath.Join(dir, clusterNode.ID), clusterTestOptions())
+		require.NoError(t, err)
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+
+	for i := 0; i < 300; i += 7 {
+		require.NoError(t, nodes[i%3].Set(fmt.Sprint(i), fmt.Sprint("value", i)))
+	}
+	client := DialNode(topology.Nodes[2].Addr, 10*time.Second)
+	defer client.Close()
+	for i := 0; i < 300; i += 7 {
+		value, err := client.Get(fmt.Sprint(i))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), value)
+	}
+	require.NoError(t, client.Delete("7"))
+	_, err := nodes[0].Get("7")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, client.Delete("7"), ErrItemDoesNotExist)
+	assert.ErrorIs(t, client.Set("x", "y"), ErrInvalidKey)
+
+	// node2 has no member of shard 0, it knows the leader from passing
+	// requests on
+	leader, err := nodes[2].Locate("0")
+	require.NoError(t, err)
+	assert.Contains(t, topology.Shards[0].Nodes, leader.ID)
+	status := waitForLeaders(t, client)
+	require.Len(t, status.Shards, 3)
+	assert.Nil(t, status.Shards[0].Raft)
+	assert.Equal(t, leader.ID, status.Shards[0].Leader)
+	assert.NotNil(t, status.Shards[1].Raft)
+}
+
+//  When the node leading a shard crashes, gossip has it dead well before
+//  raft's election timeout runs out, and the first live node of the shard
+//  takes over. A node that closes tells the others it's leaving, and they
+//  take over straight away too.
+func TestClusterGossipPromotes(t *testing.T) {
+	topology := localTopology(t, 5, [][2]int{{0, 99}}, 5)
+	opts := clusterTestOptions()
+	opts.RaftElectionTimeout = 2 * time.Second
+	opts.Gossip = GossipOptions{Interval: 20 * time.Millisecond, SuspicionTimeout: 100 * time.Millisecond}
+	dir := t.TempDir()
+	nodes := map[string]*Node{}
+	for _, clusterNode := range topology.Nodes {
+		node, err := StartNode(topology, clusterNode.ID, filepath.Join(dir, clusterNode.ID), opts)
+		require.NoError(t, err)
+		defer node.Close()
+		nodes[clusterNode.ID] = node
+	}
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			members := node.Status().Members
+			if len(members) != len(nodes) {
+				return false
+			}
+			for _, member := range members {
+				if member.State != MemberAlive {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+	require.NoError(t, nodes["node1"].Set("1", "first"))
+
+	// Of the nodes left, the first in the shard's order takes over from
+	// the leader, the others don't
+	takeOver := func(stop func(node *Node) error, state MemberState, value string) {
+		var leader ClusterNode
+		var err error
+		for _, node := range nodes {
+			leader, err = node.Locate("1")
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, stop(nodes[leader.ID]))
+		delete(nodes, leader.ID)
+		next := ""
+		for _, id := range topology.Shards[0].Nodes {
+			if nodes[id] != nil {
+				next = id
+				break
+			}
+		}
+		started := time.Now()
+		require.Eventually(t, func() bool { return len(nodes[next].Promotions()) > 0 }, 5*time.Second, 10*time.Millisecond)
+		assert.Less(t, time.Since(started), opts.RaftElectionTimeout)
+		promotion := nodes[next].Promotions()[0]
+		assert.Equal(t, leader.ID, promotion.From)
+		assert.Equal(t, next, promotion.To)
+		assert.Equal(t, fmt.Sprintf("%s is %s according to gossip", leader.ID, state), promotion.Reason)
+		// Every view comes round to it
+		require.Eventually(t, func() bool {
+			for _, node := range nodes {
+				if got, _ := node.gossip.State(leader.ID); got != state {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+		for id, node := range nodes {
+			if id != next {
+				assert.Empty(t, node.Promotions(), id)
+			}
+		}
+		for _, node := range nodes {
+			require.NoError(t, node.Set("1", value))
+			got, err := node.Get("1")
+			require.NoError(t, err)
+			assert.Equal(t, value, got)
+		}
+	}
+	// The node that took over is the one to leave next
+	takeOver(func(node *Node) error { return node.close(false) }, MemberDead, "second")
+	takeOver((*Node).Close, MemberLeft, "third")
+}
+
+// Function for starting node id of the topology in topologyFile as a
+// process of its own, running TestClusterNodeProcess. It's shut down at
+// the end of the test by closing its stdin.
+func startNodeProcess(t *testing.T, topologyFile, id, dir string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestClusterNodeProcess$")
+	cmd.Env = append(os.Environ(), "GODB_TEST_TOPOLOGY="+topologyFile, "GODB_TEST_NODE="+id, "GODB_TEST_DIR="+dir)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// Not a test on its own, runs a node for TestClusterProcesses
+func TestClusterNodeProcess(t *testing.T) {
+	id := os.Getenv("GODB_TEST_NODE")
+	if id == "" {
+		t.Skip("only run by TestClusterProcesses")
+	}
+	topology, err := ReadTopology(os.Getenv("GODB_TEST_TOPOLOGY"))
+	require.NoError(t, err)
+	node, err := StartNode(topology, id, os.Getenv("GODB_TEST_DIR"), clusterTestOptions())
+	require.NoError(t, err)
+	io.Copy(io.Discard, os.Stdin)
+	require.NoError(t, node.Close())
+}
+
+//  A request that couldn't be sent can be tried again, one that got no
+//  reply in time may have been carried out and can't, including after
+//  passing through another node
+func TestClusterRetriesOnlyUnsentRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// Takes connections, never answers
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	transport := NewTCPTransport([]ClusterNode{{ID: "silent", Addr: listener.Addr().String()}, {ID: "down", Addr: closed.Addr().String()}}, Options{})
+	defer transport.Close()
+	transport.snapshotTimeout = 50 * time.Millisecond
+
+	_, err = transport.forward("down", NodeRequest{Op: opSet, Key: "1", Value: "one"})
+	assert.ErrorIs(t, err, errNotSent)
+	assert.ErrorIs(t, replyFor(err).err(), errNotSent)
+	assert.ErrorIs(t, replyFor(err).err(), ErrUnreachable)
+
+	_, err = transport.forward("silent", NodeRequest{Op: opSet, Key: "1", Value: "one"})
+	assert.ErrorIs(t, err, ErrUnreachable)
+	assert.NotErrorIs(t, err, errNotSent)
+	assert.NotErrorIs(t, replyFor(err).err(), errNotSent)
+}
+
+//  A cluster of three processes keeps taking writes, from any node, when the
+//  process leading a shard is killed. Once it's started again it catches up
+//  on what it missed.
+func TestClusterProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts processes")
+	}
+	dir := t.TempDir()
+	topology := localTopology(t, 3, [][2]int{{0, 99}, {100, 199}}, 3)
+	data, err := json.Marshal(topology)
+	require.NoError(t, err)
+	topologyFile := filepath.Join(dir, "topology.json")
+	require.NoError(t, os.WriteFile(topologyFile, data, 0644))
+
+	processes := map[string]*exec.Cmd{}
+	clients := map[string]*NodeClient{}
+	for _, node := range topology.Nodes {
+		processes[node.ID] = startNodeProcess(t, topologyFile, node.ID, filepath.Join(dir, node.ID))
+		clients[node.ID] = DialNode(node.Addr, 10*time.Second)
+		defer clients[node.ID].Close()
+	}
+	require.Eventually(t, func() bool { return clients["node0"].Set("0", "first") == nil }, 20*time.Second, 100*time.Millisecond)
+	for i := 0; i < 200; i += 5 {
+		require.NoError(t, clients["node1"].Set(fmt.Sprint(i), "before"))
+	}
+
+	status := waitForLeaders(t, clients["node2"])
+	killed := status.Shards[0].Leader
+	require.NoError(t, processes[killed].Process.Kill())
+	processes[killed].Wait()
+	var survivor string
+	for _, node := range topology.Nodes {
+		if node.ID != killed {
+			survivor = node.ID
+		}
+	}
+	for i := 0; i < 200; i += 5 {
+		err := clients[survivor].Set(fmt.Sprint(i), "after")
+		// One on its way to the killed process may or may not have been
+		// carried out, it's up to the client to make it again
+		for attempt := 0; errors.Is(err, ErrUnreachable) && attempt < 3; attempt++ {
+			err = clients[survivor].Set(fmt.Sprint(i), "after")
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, clients[survivor].Delete("5"))
+
+	startNodeProcess(t, topologyFile, killed, filepath.Join(dir, killed))
+	waitForLeaders(t, clients[killed])
+	for i := 0; i < 200; i += 5 {
+		value, err := clients[killed].Get(fmt.Sprint(i))
+		if i == 5 {
+			assert.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "after", value)
+	}
+	// Its members catch up
+	require.Eventually(t, func() bool {
+		status, err := clients[killed].Status()
+		if err != nil {
+			return false
+		}
+		for _, shard := range status.Shards {
+			if shard.Raft == nil || shard.Raft.Applied < shard.Raft.Commit || shard.Raft.Commit < 40 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+}
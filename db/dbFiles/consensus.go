@@ -0,0 +1,308 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// How a sharded database's shards replicate writes
+const (
+	// The primary takes writes and replicas stream its WAL, see follow.
+	// Failover is decided by the ShardedDB's health checks.
+	ConsensusPrimaryBackup = "primary-backup"
+	// Each shard's members form a raft group, see raftNode. A write is
+	// committed once a majority has it, and the group elects its own leader.
+	ConsensusRaft = "raft"
+)
+
+const DefaultConsensus = ConsensusPrimaryBackup
+
+// Function for checking a config/query string is a consensus mode, empty
+// is the default
+func ParseConsensus(s string) (string, error) {
+	switch s {
+	case ConsensusPrimaryBackup, ConsensusRaft:
+		return s, nil
+	case "":
+		return DefaultConsensus, nil
+	}
+	return "", fmt.Errorf("unknown consensus %q", s)
+}
+
+// Same as OpenDb for a raft member, nothing is replayed. Its engine picks up
+// from its last snapshot as entries are committed again.
+func openRaftMember(filename string, opts Options) (*db, *RecoveryReport, error) {
+	start := time.Now()
+	database := newDb(filename, opts)
+	if err := database.engineErr(); err != nil {
+		database.Close()
+		return nil, nil, fmt.Errorf("loading %s: %w", filename, err)
+	}
+	report := &RecoveryReport{Filename: filename, SnapshotLSN: database.lastLSN, BytesTruncated: database.wal.Truncated(), Duration: time.Since(start)}
+	return database, report, nil
+}
+
+// Name a member goes by in its raft group
+func (sdb *ShardedDB) raftID(member *db) string {
+	return relativeTo(filepath.Dir(sdb.basedFilename), member.filename)
+}
+
+//  Function for getting the members of a shard that's just been opened
+//  replicating. Replicas stream the primary's WAL, or every member joins the
+//  shard's raft group, which is every member if the group is brand new. The
+//  primary stands for election straight away rather than waiting for a
+//  timeout.
+func (sdb *ShardedDB) startShard(shard *Shard) error {
+	if sdb.consensus != ConsensusRaft {
+		shard.replicate()
+		return nil
+	}
+	ids := []string{}
+	for _, member := range shard.members() {
+		ids = append(ids, sdb.raftID(member))
+	}
+	for _, member := range shard.members() {
+		if err := sdb.joinRaft(shard, member, ids); err != nil {
+			return err
+		}
+	}
+	go shard.Database.raft.campaign()
+	return nil
+}
+
+// Function for starting member's raft node, a member that's never been in
+// the group starts out with members as the group
+func (sdb *ShardedDB) joinRaft(shard *Shard, member *db, members []string) error {
+	node, err := newRaftNode(sdb.raftID(member), member, sdb.transport, members, sdb.opts)
+	if err != nil {
+		return fmt.Errorf("starting raft for %s: %w", member.filename, err)
+	}
+	node.onLeader = func(node *raftNode, term uint64) {
+		sdb.leaderElected(shard, member)
+	}
+	member.raft = node
+	node.start()
+	return nil
+}
+
+//  Function for making member, just elected, the shard's primary. The
+//  shard's epoch moves on and the new layout is recorded, along with the
+//  promotion if the shard had a different leader before. Does nothing if
+//  member has lost the leadership again already.
+func (sdb *ShardedDB) leaderElected(shard *Shard, member *db) {
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	if sdb.closed.Load() || shard.Database == member || !member.raft.isLeader() {
+		return
+	}
+	others := []*db{}
+	for _, other := range shard.members() {
+		if other != member {
+			others = append(others, other)
+		}
+	}
+	if len(others) == len(shard.members()) {
+		return
+	}
+	primary := shard.Database
+	shard.Database, shard.Replicas = member, others
+	shard.Epoch++
+	if err := shard.fence(); err != nil {
+		fmt.Printf("Error fencing shard %d at epoch %d: %v\n", shard.ID, shard.Epoch, err)
+	}
+	if hasShard(sdb.Shards, shard) {
+		if err := sdb.writeLayout(sdb.Shards); err != nil {
+			fmt.Printf("Error recording the new leader of shard %d: %v\n", shard.ID, err)
+		}
+	}
+	sdb.recordPromotion(Promotion{ShardID: shard.ID, From: filepath.Base(primary.filename), To: filepath.Base(member.filename),
+		Reason: fmt.Sprintf("elected raft leader for term %d", member.raft.status().Term), At: time.Now()})
+}
+
+// Function for finding the member leading the shard's raft group, waiting
+// until deadline for one to be elected. Caller holds the read lock.
+func (shard *Shard) leader(deadline time.Time) (*db, error) {
+	for {
+		for _, member := range shard.members() {
+			if member.raft.isLeader() {
+				return member, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: shard %d has no leader", ErrNotLeader, shard.ID)
+		}
+		time.Sleep(shard.Database.opts.RaftHeartbeat)
+	}
+}
+
+//  Function for writing record through the shard's raft group, returns its
+//  LSN once it's committed. A delete of a key the leader doesn't have is
+//  ErrItemDoesNotExist, nothing is logged. Only ErrNotLeader is tried again
+//  through the next leader, nothing was written. A write the leader lost
+//  track of (ErrLeadershipLost) may be committed all the same, making it
+//  again could undo a newer write to the key, so it's left to the caller.
+//  Caller holds the read lock.
+func (shard *Shard) propose(record Record) (uint64, error) {
+	timeout := shard.Database.opts.ReplicationTimeout
+	deadline := time.Now().Add(timeout)
+	for {
+		leader, err := shard.leader(deadline)
+		if err != nil {
+			return 0, err
+		}
+		if record.Type == RecordDelete {
+			if _, err := leader.Get(record.Key); err == ErrNotFound {
+				return 0, ErrItemDoesNotExist
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		lsn, err := leader.raft.propose(record, time.Until(deadline))
+		// Nothing was written, try whoever leads now
+		if errors.Is(err, ErrNotLeader) && time.Now().Before(deadline) {
+			continue
+		}
+		return lsn, err
+	}
+}
+
+// Function for finding the member to read from for ReadPrimary, the leader
+// once it has caught up on its own term. Caller holds the read lock.
+func (shard *Shard) raftReader() (*db, error) {
+	deadline := time.Now().Add(shard.Database.opts.ReplicationTimeout)
+	for {
+		leader, err := shard.leader(deadline)
+		if err != nil {
+			return nil, err
+		}
+		err = leader.raft.readBarrier(time.Until(deadline))
+		if !errors.Is(err, ErrNotLeader) {
+			return leader, err
+		}
+	}
+}
+
+// Function for waiting until every member of the shard's raft group the
+// leader can reach has the entry at lsn. Caller holds the read lock.
+func (shard *Shard) raftReplicated(lsn uint64) error {
+	for _, member := range shard.members() {
+		if member.raft.isLeader() {
+			return member.raft.waitReplicated(lsn, member.opts.ReplicationTimeout)
+		}
+	}
+	// Committed all the same
+	return nil
+}
+
+// How far behind the primary replica could be, see staleness
+func (shard *Shard) staleness(replica *db) time.Duration {
+	if replica.raft != nil {
+		return shard.Database.raft.staleness(replica.raft.id)
+	}
+	return shard.Database.staleness(replica)
+}
+
+//  Function for acting on the health of a raft shard's members.
+//  Elections replace a leader that can't be reached. One that can but is
+//  failing its probes makes way for the furthest along healthy member, which
+//  stands for election. Failed members are taken out of the group and
+//  replaced.
+func (sdb *ShardedDB) checkRaftShard(shard *Shard, primary *db, replicas []*db, states map[*db]HealthState) {
+	failed := []*db{}
+	var candidate *db
+	for _, replica := range replicas {
+		switch {
+		case states[replica] == HealthFailed:
+			failed = append(failed, replica)
+		case states[replica] == HealthHealthy && (candidate == nil || replica.appliedLSN() > candidate.appliedLSN()):
+			candidate = replica
+		}
+	}
+	if len(failed) > 0 {
+		sdb.removeRaftMembers(shard, failed)
+	}
+	if states[primary] == HealthFailed {
+		if candidate == nil {
+			fmt.Printf("Leader of shard %d has failed and no member is healthy enough to take over\n", shard.ID)
+			return
+		}
+		candidate.raft.campaign()
+		return
+	}
+	sdb.lock.Lock()
+	sdb.repair(shard)
+	sdb.lock.Unlock()
+}
+
+// Function for taking members out of the shard's raft group, then out of
+// the shard. New ones take their place.
+func (sdb *ShardedDB) removeRaftMembers(shard *Shard, dropped []*db) {
+	for _, member := range dropped {
+		sdb.lock.RLock()
+		leader, err := shard.leader(time.Now().Add(sdb.opts.ReplicationTimeout))
+		if err == nil {
+			err = leader.raft.removeMember(member.raft.id, sdb.opts.ReplicationTimeout)
+		}
+		sdb.lock.RUnlock()
+		if err != nil {
+			fmt.Printf("Error removing %s from the raft group of shard %d: %v\n", member.filename, shard.ID, err)
+			continue
+		}
+		sdb.lock.Lock()
+		if slices.Contains(shard.Replicas, member) {
+			fmt.Printf("Dropped failed member %s from shard %d: %s\n", member.filename, shard.ID, member.healthReport().LastError)
+			sdb.dropReplicas(shard, []*db{member})
+			if err := sdb.writeLayout(sdb.Shards); err != nil {
+				fmt.Printf("Error recording dropped members on shard %d: %v\n", shard.ID, err)
+			}
+			sdb.retire(member, shard.Epoch)
+		}
+		sdb.lock.Unlock()
+	}
+}
+
+//  Function for adding replica, empty, to the shard's raft group. It's
+//  caught up by the leader, from a snapshot if the leader's WAL doesn't go
+//  back far enough. It joins the shard once the change is committed.
+func (sdb *ShardedDB) addRaftMember(shard *Shard, replica *db) error {
+	if err := sdb.joinRaft(shard, replica, nil); err != nil {
+		return err
+	}
+	sdb.lock.RLock()
+	leader, err := shard.leader(time.Now().Add(sdb.opts.ReplicationTimeout))
+	if err == nil {
+		if err = leader.raft.addMember(replica.raft.id, sdb.opts.ReplicationTimeout); err != nil {
+			// It may have made it in anyway
+			leader.raft.removeMember(replica.raft.id, sdb.opts.ReplicationTimeout)
+		}
+	}
+	sdb.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	shard.Replicas = append(shard.Replicas, replica)
+	shard.seeding = nil
+	sdb.forget(replica.filename)
+	if err := sdb.writeLayout(sdb.Shards); err != nil {
+		fmt.Printf("Error recording new member %s of shard %d: %v\n", replica.filename, shard.ID, err)
+	}
+	fmt.Printf("Member %s joined the raft group of shard %d\n", replica.filename, shard.ID)
+	return nil
+}
+
+// Where each member of a raft shard has got, nil for other shards
+func (shard *Shard) raftStatus() []RaftStatus {
+	if shard.Database.raft == nil {
+		return nil
+	}
+	statuses := []RaftStatus{}
+	for _, member := range shard.members() {
+		statuses = append(statuses, member.raft.status())
+	}
+	return statuses
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+// How many copies of a write there have to be before it returns
+type WriteConcern string
+
+const (
+	// The primary has it
+	WritePrimary WriteConcern = "primary"
+	// A majority of the shard's members, the primary included, have it
+	WriteMajority WriteConcern = "majority"
+	// Every replica that's streaming has it
+	WriteAll WriteConcern = "all"
+)
+
+const DefaultWriteConcern = WriteAll
+
+// Which member of a shard a read goes to
+type ReadPreference string
+
+const (
+	ReadPrimary ReadPreference = "primary"
+	// A replica, however far behind it is
+	ReadAnyReplica ReadPreference = "any-replica"
+	// A replica, as long as it's within ReadOptions.MaxStaleness
+	ReadBoundedStaleness ReadPreference = "bounded-staleness"
+)
+
+const DefaultReadPreference = ReadPrimary
+
+// The replica a bounded-staleness read landed on is too far behind
+var ErrStaleRead = errors.New("replica is too far behind for the read")
+
+// Settings for a single write
+type WriteOptions struct {
+	Concern WriteConcern
+}
+
+// Settings for a single read, MaxStaleness only matters for
+// bounded-staleness
+type ReadOptions struct {
+	Preference   ReadPreference
+	MaxStaleness time.Duration
+}
+
+// Function for turning a header/query string into a WriteConcern
+func ParseWriteConcern(s string) (WriteConcern, error) {
+	switch c := WriteConcern(s); c {
+	case WritePrimary, WriteMajority, WriteAll:
+		return c, nil
+	case "":
+		return DefaultWriteConcern, nil
+	}
+	return "", fmt.Errorf("unknown write concern %q", s)
+}
+
+// Function for turning a header/query string into a ReadPreference
+func ParseReadPreference(s string) (ReadPreference, error) {
+	switch p := ReadPreference(s); p {
+	case ReadPrimary, ReadAnyReplica, ReadBoundedStaleness:
+		return p, nil
+	case "":
+		return DefaultReadPreference, nil
+	}
+	return "", fmt.Errorf("unknown read preference %q", s)
+}
+
+// A bounded-staleness read needs a bound
+func (opts ReadOptions) Validate() error {
+	if opts.Preference == ReadBoundedStaleness && opts.MaxStaleness <= 0 {
+		return fmt.Errorf("a %s read needs a max staleness", ReadBoundedStaleness)
+	}
+	return nil
+}
+
+// Function for waiting until enough of the shard has the write at lsn for
+// concern. A raft shard has it on a majority once it's committed, so only
+// WriteAll waits for anything.
+func (shard *Shard) replicated(lsn uint64, concern WriteConcern) error {
+	if shard.Database.raft != nil {
+		// Committed means a majority has it already
+		if concern == WritePrimary || concern == WriteMajority {
+			return nil
+		}
+		return shard.raftReplicated(lsn)
+	}
+	switch concern {
+	case WritePrimary:
+		return nil
+	case WriteMajority:
+		// The primary is one of the majority
+		return shard.Database.waitReplicated(lsn, shard.Replicas, (len(shard.Replicas)+1)/2)
+	}
+	return shard.Database.waitReplicated(lsn, shard.Replicas, allReplicas)
+}
+
+//  Function for picking the member of the shard a read goes to.
+//  Replica reads take turns between the replicas, a shard without any reads
+//  from its primary. A raft shard's primary reads go to its leader. A bounded-staleness read that lands on a replica
+//  further behind than opts.MaxStaleness is ErrStaleRead.
+func (shard *Shard) reader(opts ReadOptions) (*db, error) {
+	primary := opts.Preference == ReadPrimary || opts.Preference == ""
+	if primary && shard.Database.raft != nil {
+		return shard.raftReader()
+	}
+	if primary || len(shard.Replicas) == 0 {
+		return shard.Database, nil
+	}
+	replica := shard.Replicas[shard.reads.Add(1)%uint64(len(shard.Replicas))]
+	if opts.Preference != ReadBoundedStaleness {
+		return replica, nil
+	}
+	staleness := shard.staleness(replica)
+	switch {
+	case staleness == math.MaxInt64:
+		return nil, fmt.Errorf("%w: %s hasn't caught up with its primary", ErrStaleRead, filepath.Base(replica.filename))
+	case staleness > opts.MaxStaleness:
+		return nil, fmt.Errorf("%w: %s is %v behind, the bound is %v", ErrStaleRead, filepath.Base(replica.filename), staleness.Round(time.Millisecond), opts.MaxStaleness)
+	}
+	return replica, nil
+}
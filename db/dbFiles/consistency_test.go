@@ -0,0 +1,68 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteConcerns(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ReplicationTimeout = 100 * time.Millisecond
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, filepath.Join(t.TempDir(), "concern"), 2, opts)
+	defer sdb.Close()
+	shard := sdb.Shards[0]
+	slow, fast := shard.Replicas[0], shard.Replicas[1]
+
+	// The slow replica can't apply anything until it's let go
+	slow.lock.Lock()
+	require.NoError(t, sdb.SetWithOptions("1", "one", WriteOptions{Concern: WritePrimary}))
+	require.NoError(t, sdb.SetWithOptions("2", "two", WriteOptions{Concern: WriteMajority}))
+	assert.Equal(t, uint64(2), fast.appliedLSN())
+	assert.ErrorIs(t, sdb.SetWithOptions("3", "three", WriteOptions{Concern: WriteAll}), ErrReplicationTimeout)
+	assert.ErrorIs(t, sdb.Delete("1"), ErrReplicationTimeout)
+	slow.lock.Unlock()
+
+	// It catches up once it can
+	assert.Eventually(t, func() bool { return slow.appliedLSN() == 4 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, sdb.Set("4", "four"))
+	assert.Equal(t, shard.Database.digest(), slow.digest())
+}
+
+func TestReadPreferences(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, filepath.Join(t.TempDir(), "preference"), 1, DefaultOptions())
+	defer sdb.Close()
+	replica := sdb.Shards[0].Replicas[0]
+	require.NoError(t, sdb.Set("1", "old"))
+
+	replica.lock.Lock()
+	require.NoError(t, sdb.SetWithOptions("1", "new", WriteOptions{Concern: WritePrimary}))
+	time.Sleep(20 * time.Millisecond)
+	value, err := sdb.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, "new", value)
+	_, err = sdb.GetWithOptions("1", ReadOptions{Preference: ReadBoundedStaleness, MaxStaleness: 10 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrStaleRead)
+	replica.lock.Unlock()
+	// Whatever the replica has, however old
+	value, err = sdb.GetWithOptions("1", ReadOptions{Preference: ReadAnyReplica})
+	require.NoError(t, err)
+	assert.Contains(t, []string{"old", "new"}, value)
+
+	assert.Eventually(t, func() bool { return replica.appliedLSN() == 2 }, time.Second, 10*time.Millisecond)
+	value, err = sdb.GetWithOptions("1", ReadOptions{Preference: ReadBoundedStaleness, MaxStaleness: 10 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, "new", value)
+
+	// A bound is needed
+	_, err = sdb.GetWithOptions("1", ReadOptions{Preference: ReadBoundedStaleness})
+	assert.Error(t, err)
+	_, err = ParseReadPreference("nearest")
+	assert.Error(t, err)
+	concern, err := ParseWriteConcern("")
+	require.NoError(t, err)
+	assert.Equal(t, WriteAll, concern)
+}
@@ -3,19 +3,43 @@ package db
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"fmt"
-	"strings"
 )
 
+// Returned by Delete when there's nothing to delete
+var ErrItemDoesNotExist = errors.New("item does not exist")
+
 //  Struct for database.
-//  Lock for concurrent actions
+//  Lock for concurrent actions, it keeps the WAL and the engine in the same order
 //  Filename for saving to disk
 //  WAL for logging actions
+//  Engine for where the data actually lives
+//  Opts for durability, WAL and engine settings
+//  lastLSN is the last WAL record applied to the engine
+//  saveLock keeps snapshots and WAL checkpoints from running concurrently
+//  health is what the last probes found, see CheckHealth
+//  epoch is the newest shard epoch the db has seen, only changed under the
+//  lock, see fence
+//  replication is the replicas streaming the db's WAL, see follow
+//  raft is the db's member of its shard's raft group, nil if it isn't in one
+//  keys and bytes are what the engine holds once sized is set, see size.
+//  Only changed under the lock.
 type db struct {
-	*Database
 	lock sync.RWMutex
 	filename string
 	wal *WAL
+	engine StorageEngine
+	opts Options
+	lastLSN uint64
+	saveLock sync.Mutex
+	health memberHealth
+	epoch atomic.Uint64
+	replication replication
+	raft *raftNode
+	sized bool
+	keys int
+	bytes int64
 }
 
 
@@ -25,26 +49,107 @@ type db struct {
 
 //Function for making new database
 func NewDb(filename string) *db {
+    return NewDbWithOptions(filename, DefaultOptions())
+}
+
+// Opens the engine's files under filename and replays the WAL records that
+// came after its snapshot. If the engine can't be opened every operation
+// returns the reason, use OpenDb to get it up front.
+func NewDbWithOptions(filename string, opts Options) *db {
+    db := newDb(filename, opts)
+    if db.engineErr() != nil {
+        return db
+    }
+    if _, err := db.replay(); err != nil {
+        fmt.Printf("Error replaying the WAL of %s: %v\n", filename, err)
+        db.engine.Close()
+        db.engine = failedEngine{err}
+    }
+    return db
+}
+
+// Same as NewDbWithOptions without the replay, for OpenDb to report on it
+// and for raft members, which only apply what's committed
+func newDb(filename string, opts Options) *db {
+    opts = opts.withDefaults()
     walFilename := filename + "_wal"
-    return &db{
-        Database: &Database{
-            Store: make(map[string]string),
-        },
+    db := &db{
         filename: filename,
-        wal:      NewWAL(walFilename),
+        wal:      NewWALWithOptions(walFilename, opts.walOptions()),
+        opts:     opts,
     }
+    db.openEngine()
+    if epoch, err := readEpoch(filename); err != nil {
+        fmt.Printf("Error reading the epoch of %s: %v\n", filename, err)
+        db.engine.Close()
+        db.engine = failedEngine{err}
+    } else {
+        db.epoch.Store(epoch)
+    }
+    return db
+}
+
+// Function for (re)opening the engine and lining the WAL up behind it.
+// Caller holds the lock or has the only reference.
+func (db *db) openEngine() error {
+    engine, lsn, err := openEngine(db.filename, db.opts)
+    if err != nil {
+        fmt.Printf("Error opening %s engine for %s: %v\n", db.opts.Engine, db.filename, err)
+        db.engine = failedEngine{err}
+        return err
+    }
+    db.engine = engine
+    db.lastLSN = lsn
+    db.sized = false
+    // The WAL may already have dropped everything up to the engine's
+    // snapshot, new records have to carry on after it
+    db.wal.SkipTo(lsn)
+    return nil
+}
+
+// Error the engine failed to open with, if it did
+func (db *db) engineErr() error {
+    if failed, ok := db.engine.(failedEngine); ok {
+        return failed.err
+    }
+    return nil
 }
 
 
 
 
 //function for setting item in shard
+// The fsync (if any) happens after the lock is released so concurrent
+// writers can share it
 func (db *db) Set(key, value string) error {
+    _, err := db.setAt(0, key, value)
+    return err
+}
+
+// Same as Set, for a write made in epoch (0 for none), see checkEpoch.
+// Returns the LSN the write was logged at.
+func (db *db) setAt(epoch uint64, key, value string) (uint64, error) {
     db.lock.Lock()
-    defer db.lock.Unlock()
-    db.wal.Append(fmt.Sprintf("SET %s %s", key, value))
-    db.Store[key] = value
-    return nil
+    if err := db.engineErr(); err != nil {
+        db.lock.Unlock()
+        return 0, err
+    }
+    if err := db.checkEpoch(epoch); err != nil {
+        db.lock.Unlock()
+        return 0, err
+    }
+    lsn, err := db.wal.Append(RecordSet, key, value)
+    if err != nil {
+        db.lock.Unlock()
+        return 0, err
+    }
+    err = db.put(key, value)
+    db.lastLSN = lsn
+    db.lock.Unlock()
+    if err != nil {
+        return lsn, err
+    }
+    return lsn, db.wal.Commit(lsn)
 }
 
 
@@ -52,42 +157,101 @@ func (db *db) Set(key, value string) error {
 func (db *db) Get(key string) (string, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
-	value, exists := db.Store[key]
-	if !exists {
-		return "", errors.New("item not found in database")
-	}
-	return value, nil
+	return db.engine.Get(key)
 }
 // Function for deleting item in database
 
 func (db *db) Delete(key string) error {
+    _, err := db.deleteAt(0, key)
+    return err
+}
+
+// Same as Delete, for a delete made in epoch (0 for none), see checkEpoch.
+// Returns the LSN the delete was logged at.
+func (db *db) deleteAt(epoch uint64, key string) (uint64, error) {
+    db.lock.Lock()
+    if err := db.checkEpoch(epoch); err != nil {
+        db.lock.Unlock()
+        return 0, err
+    }
+    if _, err := db.engine.Get(key); err != nil {
+        db.lock.Unlock()
+        if err == ErrNotFound {
+            return 0, ErrItemDoesNotExist
+        }
+        return 0, err
+    }
+    lsn, err := db.wal.Append(RecordDelete, key, "")
+    if err != nil {
+        db.lock.Unlock()
+        return 0, err
+    }
+    err = db.remove(key)
+    db.lastLSN = lsn
+    db.lock.Unlock()
+    if err != nil {
+        return lsn, err
+    }
+    return lsn, db.wal.Commit(lsn)
+}
+
+// Function for closing the database's WAL and engine, replicas streaming
+// from it (or its raft member) are stopped first
+func (db *db) Close() error {
+    db.stopFollowers()
+    if db.raft != nil {
+        db.raft.shutdown()
+    }
     db.lock.Lock()
     defer db.lock.Unlock()
-    if _, exists := db.Store[key]; !exists {
-        return errors.New("item does not exist")
+    err := db.wal.Close()
+    if engineErr := db.engine.Close(); err == nil {
+        err = engineErr
     }
-    db.wal.Append(fmt.Sprintf("DELETE %s", key))
-    delete(db.Store, key)
-    return nil
+    return err
 }
 
 
+// Function for replaying the WAL on top of the loaded snapshot.
+// Records the snapshot already has (LSN <= lastLSN) are skipped.
 func (db *db) Recover() error {
+    _, err := db.replay()
+    return err
+}
+
+// Same as Recover, returns how many records were applied
+func (db *db) replay() (int, error) {
     db.lock.Lock()
     defer db.lock.Unlock()
+    return db.replayLocked()
+}
+
+// Caller holds the lock
+func (db *db) replayLocked() (int, error) {
+    if err := db.engineErr(); err != nil {
+        return 0, err
+    }
     entries := db.wal.GetEntries()
-    fmt.Println("Recovering from WAL entries:", entries) // Debug log
+    replayed := 0
     for _, entry := range entries {
-        parts := strings.Split(entry, " ")
-        if parts[0] == "SET" {
-            db.Store[parts[1]] = parts[2]
-        } else if parts[0] == "DELETE" {
-            delete(db.Store, parts[1])
+        if entry.LSN <= db.lastLSN {
+            continue
+        }
+        var err error
+        switch entry.Type {
+        case RecordSet:
+            err = db.put(entry.Key, entry.Value)
+        case RecordDelete:
+            err = db.remove(entry.Key)
+        }
+        if err != nil {
+            return replayed, err
         }
+        db.lastLSN = entry.LSN
+        replayed++
     }
-    return nil
+    if replayed > 0 {
+        fmt.Printf("Replayed %d WAL records into %s, up to LSN %d\n", replayed, db.filename, db.lastLSN)
+    }
+    return replayed, nil
 }
-
-
-
-
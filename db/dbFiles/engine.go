@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Name of the engine used when none is picked
+const DefaultEngine = "map"
+
+var ErrNotFound = errors.New("item not found in database")
+
+// Interface for where a db keeps its data.
+// The db in front of it owns the WAL, so an engine only has to make its
+// state durable when Snapshot is called.
+//
+// Get returns ErrNotFound for keys it doesn't have.
+// Delete of a key that isn't there is not an error, WAL replay relies on it.
+// Iterate visits every key once until fn returns false.
+// Snapshot persists everything written so far as covering the WAL up to lsn,
+// and returns the LSN the WAL can be checkpointed to. That can be lower than
+// lsn when the engine keeps older states around to fall back on.
+type StorageEngine interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	Iterate(fn func(key, value string) bool) error
+	Snapshot(lsn uint64) (uint64, error)
+	Close() error
+}
+
+// Implemented by engines that keep their keys sorted.
+// IterateFrom visits keys >= start in key order until fn returns false.
+type OrderedEngine interface {
+	IterateFrom(start string, fn func(key, value string) bool) error
+}
+
+// Consistent point-in-time view of an engine's data, writes made after it
+// was taken don't show up in it. Release has to be called once done.
+type ReadSnapshot interface {
+	Get(key string) (string, error)
+	Iterate(fn func(key, value string) bool) error
+	Release()
+}
+
+// Implemented by engines that can hand out read snapshots without copying
+// their data
+type SnapshotReader interface {
+	ReadSnapshot() (ReadSnapshot, error)
+}
+
+// Opens (or creates) an engine's files under filename.
+// Returns the LSN its persisted state covers.
+type EngineFactory func(filename string, opts Options) (StorageEngine, uint64, error)
+
+var (
+	enginesLock sync.RWMutex
+	engines     = map[string]EngineFactory{
+		DefaultEngine: openMapEngine,
+		"lsm":         openLSMEngine,
+		"btree":       openBTreeEngine,
+	}
+)
+
+// Function for making an engine available by name
+func RegisterEngine(name string, factory EngineFactory) {
+	enginesLock.Lock()
+	defer enginesLock.Unlock()
+	engines[name] = factory
+}
+
+// Names of every registered engine, sorted
+func EngineNames() []string {
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func ValidateEngine(name string) error {
+	if name == "" {
+		return nil
+	}
+	enginesLock.RLock()
+	defer enginesLock.RUnlock()
+	if _, exists := engines[name]; !exists {
+		return fmt.Errorf("unknown storage engine %q", name)
+	}
+	return nil
+}
+
+func openEngine(filename string, opts Options) (StorageEngine, uint64, error) {
+	enginesLock.RLock()
+	factory, exists := engines[opts.Engine]
+	enginesLock.RUnlock()
+	if !exists {
+		return nil, 0, fmt.Errorf("unknown storage engine %q", opts.Engine)
+	}
+	return factory(filename, opts)
+}
+
+// Stands in for an engine that couldn't be opened, so every operation
+// reports why instead of quietly working on an empty database
+type failedEngine struct {
+	err error
+}
+
+func (engine failedEngine) Get(string) (string, error)              { return "", engine.err }
+func (engine failedEngine) Put(string, string) error                { return engine.err }
+func (engine failedEngine) Delete(string) error                     { return engine.err }
+func (engine failedEngine) Iterate(func(string, string) bool) error { return engine.err }
+func (engine failedEngine) Snapshot(uint64) (uint64, error)         { return 0, engine.err }
+func (engine failedEngine) Close() error                            { return nil }
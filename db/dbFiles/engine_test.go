@@ -0,0 +1,166 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Conformance suite every registered StorageEngine has to pass
+func TestEngineConformance(t *testing.T) {
+	for _, name := range EngineNames() {
+		t.Run(name, func(t *testing.T) {
+			t.Run("PutGet", func(t *testing.T) { testEnginePutGet(t, name) })
+			t.Run("Delete", func(t *testing.T) { testEngineDelete(t, name) })
+			t.Run("Iterate", func(t *testing.T) { testEngineIterate(t, name) })
+			t.Run("SnapshotReopen", func(t *testing.T) { testEngineSnapshotReopen(t, name) })
+			t.Run("ThroughDb", func(t *testing.T) { testEngineThroughDb(t, name) })
+		})
+	}
+}
+
+func openTestEngine(t *testing.T, name, filename string) (StorageEngine, uint64) {
+	engine, lsn, err := openEngine(filename, Options{Engine: name}.withDefaults())
+	require.NoError(t, err)
+	return engine, lsn
+}
+
+func testEnginePutGet(t *testing.T, name string) {
+	engine, lsn := openTestEngine(t, name, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+	assert.Equal(t, uint64(0), lsn)
+
+	_, err := engine.Get("missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, engine.Put("key", "value"))
+	require.NoError(t, engine.Put("empty", ""))
+	require.NoError(t, engine.Put("binary\x00key", "binary\x00value\n"))
+	require.NoError(t, engine.Put("key", "overwritten"))
+
+	for key, expected := range map[string]string{
+		"key":           "overwritten",
+		"empty":         "",
+		"binary\x00key": "binary\x00value\n",
+	} {
+		value, err := engine.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+}
+
+func testEngineDelete(t *testing.T, name string) {
+	engine, _ := openTestEngine(t, name, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+
+	require.NoError(t, engine.Put("key", "value"))
+	require.NoError(t, engine.Delete("key"))
+	_, err := engine.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Deleting what isn't there is fine
+	require.NoError(t, engine.Delete("key"))
+	require.NoError(t, engine.Delete("never-existed"))
+
+	require.NoError(t, engine.Put("key", "again"))
+	value, err := engine.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, "again", value)
+}
+
+func testEngineIterate(t *testing.T, name string) {
+	engine, _ := openTestEngine(t, name, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		expected[key] = fmt.Sprintf("value%d", i)
+		require.NoError(t, engine.Put(key, expected[key]))
+	}
+	for i := 0; i < 500; i += 3 {
+		key := fmt.Sprintf("key%04d", i)
+		delete(expected, key)
+		require.NoError(t, engine.Delete(key))
+	}
+
+	seen := make(map[string]string)
+	require.NoError(t, engine.Iterate(func(key, value string) bool {
+		_, duplicate := seen[key]
+		assert.False(t, duplicate, "key %s visited twice", key)
+		seen[key] = value
+		return true
+	}))
+	assert.Equal(t, expected, seen)
+
+	// Stops when told to
+	visited := 0
+	require.NoError(t, engine.Iterate(func(key, value string) bool {
+		visited++
+		return visited < 10
+	}))
+	assert.Equal(t, 10, visited)
+}
+
+func testEngineSnapshotReopen(t *testing.T, name string) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine, _ := openTestEngine(t, name, filename)
+
+	require.NoError(t, engine.Put("a", "1"))
+	require.NoError(t, engine.Put("b", "2"))
+	require.NoError(t, engine.Delete("a"))
+	checkpoint, err := engine.Snapshot(3)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, checkpoint, uint64(3))
+
+	require.NoError(t, engine.Put("c", "3"))
+	// Not valid UTF-8
+	require.NoError(t, engine.Put("d\xff\xfe", "\x80value"))
+	checkpoint, err = engine.Snapshot(4)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, checkpoint, uint64(4))
+	require.NoError(t, engine.Close())
+
+	reopened, lsn := openTestEngine(t, name, filename)
+	defer reopened.Close()
+	assert.Equal(t, uint64(4), lsn)
+
+	keys := []string{}
+	require.NoError(t, reopened.Iterate(func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, []string{"b", "c", "d\xff\xfe"}, keys)
+	value, err := reopened.Get("c")
+	require.NoError(t, err)
+	assert.Equal(t, "3", value)
+	value, err = reopened.Get("d\xff\xfe")
+	require.NoError(t, err)
+	assert.Equal(t, "\x80value", value)
+}
+
+// The engine behind a db, with the WAL covering what wasn't snapshotted
+func testEngineThroughDb(t *testing.T, name string) {
+	filename := filepath.Join(t.TempDir(), "db")
+	opts := Options{Engine: name}
+
+	database, _, err := OpenDb(filename, opts)
+	require.NoError(t, err)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+	require.NoError(t, database.Set("b", "2"))
+	require.NoError(t, database.Delete("a"))
+	require.NoError(t, database.Close())
+
+	reopened, report, err := OpenDb(filename, opts)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, uint64(1), report.SnapshotLSN)
+	assert.Equal(t, 2, report.RecordsReplayed)
+	assert.Equal(t, map[string]string{"b": "2"}, contents(t, reopened))
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// How many times in a row seeding a replacement replica can fail before
+	// the shard is left short until the next health check
+	seedAttempts = 3
+	// Catch-up goes round until a round has fewer records than this, the
+	// rest are applied with writes held
+	catchUpBatch = 256
+)
+
+var errPrimaryChanged = errors.New("the shard's primary changed while a replica was being seeded")
+
+//  Function for bringing the shard back up to sdb.replicas replicas, one new
+//  replica at a time in the background, unless that's already happening.
+//  Caller holds the lock.
+func (sdb *ShardedDB) repair(shard *Shard) {
+	if sdb.closed.Load() || shard.repairing || sdb.basedFilename == "" || len(shard.Replicas) >= sdb.replicas {
+		return
+	}
+	shard.repairing = true
+	sdb.repairs.Add(1)
+	go func() {
+		defer sdb.repairs.Done()
+		for failures := 0; failures < seedAttempts; {
+			sdb.lock.RLock()
+			needed := !sdb.closed.Load() && hasShard(sdb.Shards, shard) && len(shard.Replicas) < sdb.replicas
+			sdb.lock.RUnlock()
+			if !needed {
+				break
+			}
+			if err := sdb.addReplica(shard); err != nil {
+				fmt.Printf("Error adding a replica to shard %d: %v\n", shard.ID, err)
+				failures++
+			}
+		}
+		sdb.lock.Lock()
+		shard.repairing = false
+		sdb.lock.Unlock()
+	}()
+}
+
+//  Function for adding a new replica to the shard.
+//  It's seeded from a snapshot of the primary then catches up from the
+//  primary's WAL while writes carry on. It only joins the shard, and starts
+//  streaming the primary's WAL, once it has applied everything up to the
+//  primary's last LSN. Until then it's listed as discarded in the shard map, so a crash part
+//  way through leaves nothing behind. A raft shard's new member is caught
+//  up by the group's leader instead, see addRaftMember.
+func (sdb *ShardedDB) addReplica(shard *Shard) error {
+	sdb.changes.Lock()
+	defer sdb.changes.Unlock()
+	sdb.lock.RLock()
+	gone := sdb.closed.Load() || !hasShard(sdb.Shards, shard)
+	primary := shard.Database
+	filename := sdb.nextReplicaFilename(shard)
+	sdb.lock.RUnlock()
+	if gone {
+		return nil
+	}
+
+	sdb.discard(filename)
+	sdb.lock.RLock()
+	err := sdb.writeLayout(sdb.Shards)
+	sdb.lock.RUnlock()
+	if err != nil {
+		sdb.forget(filename)
+		return err
+	}
+	if err := removeDbFiles(filename); err != nil {
+		sdb.forget(filename)
+		return err
+	}
+	replica, _, err := OpenDb(filename, sdb.opts)
+	if err != nil {
+		removeDbFiles(filename)
+		sdb.forget(filename)
+		return err
+	}
+	sdb.lock.Lock()
+	shard.seeding = replica
+	sdb.lock.Unlock()
+	abandon := func() {
+		sdb.lock.Lock()
+		shard.seeding = nil
+		sdb.lock.Unlock()
+		(&Shard{Database: replica}).destroy()
+		sdb.forget(filename)
+	}
+	if primary.raft != nil {
+		if err := sdb.addRaftMember(shard, replica); err != nil {
+			abandon()
+			return err
+		}
+		return nil
+	}
+
+	applied, err := sdb.seed(primary, replica)
+	defer primary.wal.release(replica)
+	if err != nil {
+		abandon()
+		return err
+	}
+
+	// Writes are held from here on, whatever's left in the WAL is all that's
+	// left to catch up on
+	sdb.lock.Lock()
+	switch {
+	case sdb.closed.Load() || !hasShard(sdb.Shards, shard):
+		err = nil
+	case shard.Database != primary:
+		err = errPrimaryChanged
+	default:
+		if applied, _, err = catchUp(primary, replica, applied); err == nil && applied != primary.wal.LastLSN() {
+			err = fmt.Errorf("replica %s is at LSN %d, the primary at %d", replica.filename, applied, primary.wal.LastLSN())
+		}
+		if err == nil {
+			err = replica.fence(shard.Epoch)
+		}
+		if err == nil {
+			err = primary.follow(replica, shard.Epoch)
+		}
+		if err == nil {
+			shard.Replicas = append(shard.Replicas, replica)
+			shard.seeding = nil
+			sdb.forget(filename)
+			if err = sdb.writeLayout(sdb.Shards); err != nil {
+				shard.Replicas = shard.Replicas[:len(shard.Replicas)-1]
+				primary.unfollow(replica)
+			} else {
+				sdb.lock.Unlock()
+				fmt.Printf("Replica %s of shard %d is in sync at LSN %d\n", replica.filename, shard.ID, applied)
+				return nil
+			}
+		}
+	}
+	sdb.lock.Unlock()
+	abandon()
+	return err
+}
+
+//  Function for copying a snapshot of primary into replica, then catching up
+//  on the WAL a round at a time until there's little left. Returns the LSN of
+//  the primary's last record replica has.
+//  The primary's WAL holds on to everything replica hasn't applied yet,
+//  until the caller releases it.
+func (sdb *ShardedDB) seed(primary, replica *db) (uint64, error) {
+	primary.lock.RLock()
+	if err := primary.engineErr(); err != nil {
+		primary.lock.RUnlock()
+		return 0, err
+	}
+	applied := primary.lastLSN
+	primary.wal.hold(replica, applied)
+	entries := []KeyValue{}
+	err := primary.engine.Iterate(func(key, value string) bool {
+		entries = append(entries, KeyValue{Key: key, Value: value})
+		return true
+	})
+	primary.lock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := replica.installSnapshot(entries, applied); err != nil {
+		return 0, err
+	}
+
+	for !sdb.closed.Load() {
+		var n int
+		if applied, n, err = catchUp(primary, replica, applied); err != nil {
+			return 0, err
+		}
+		primary.wal.hold(replica, applied)
+		if n < catchUpBatch {
+			// The replica's own snapshot, so it doesn't replay all of that
+			// on restart
+			return applied, replica.Save()
+		}
+	}
+	return 0, fmt.Errorf("%s was closed", sdb.basedFilename)
+}
+
+// Function for shipping the primary's records after applied to replica.
+// Returns the LSN it got up to and how many records there were.
+func catchUp(primary, replica *db, applied uint64) (uint64, int, error) {
+	records, err := primary.wal.entriesAfter(applied)
+	if err != nil {
+		return applied, 0, err
+	}
+	applied, err = replica.applyShipped(0, records)
+	return applied, len(records), err
+}
+
+// Function for picking a filename for a new replica of the shard, the
+// lowest replica number nothing is using. Caller holds the lock.
+func (sdb *ShardedDB) nextReplicaFilename(shard *Shard) string {
+	used := make(map[string]bool)
+	for _, member := range append(shard.members(), shard.seeding) {
+		if member != nil {
+			used[member.filename] = true
+		}
+	}
+	for i := 0; ; i++ {
+		filename := memberFilename(sdb.basedFilename, shard.ID, i)
+		if !used[filename] && !dbFilesExist(filename) {
+			return filename
+		}
+	}
+}
+
+// Function for closing a member that's been taken out of its shard and
+// deleting its files. It's fenced at epoch first, so nothing still holding
+// on to it can write to it. In the background, a member that failed may not
+// close quickly, or at all.
+func (sdb *ShardedDB) retire(member *db, epoch uint64) {
+	go func() {
+		member.fence(epoch)
+		member.Close()
+		if err := removeDbFiles(member.filename); err != nil {
+			fmt.Printf("Error removing %s: %v\n", member.filename, err)
+			return
+		}
+		sdb.forget(member.filename)
+	}()
+}
+
+func hasShard(shards []*Shard, shard *Shard) bool {
+	for _, s := range shards {
+		if s == shard {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverReplacesMembers(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "failover")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 999}}, base, 2, DefaultOptions())
+	for i := 0; i < 500; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprint(i), "value"))
+	}
+	shard := sdb.Shards[0]
+	primary, first := shard.Database, shard.Replicas[0]
+
+	// The primary and one replica go, the other replica takes over and two
+	// new ones are seeded from it
+	require.NoError(t, primary.Close())
+	require.NoError(t, first.Close())
+	require.Len(t, sdb.CheckHealth(HealthOptions{FailAfter: 1}), 1)
+	sdb.repairs.Wait()
+	require.Len(t, shard.Replicas, 2)
+	for _, replica := range shard.Replicas {
+		assert.Equal(t, shard.Database.digest(), replica.digest(), replica.filename)
+	}
+	assert.Eventually(t, func() bool { return !dbFilesExist(primary.filename) }, time.Second, 10*time.Millisecond)
+	require.NoError(t, sdb.Set("999", "after"))
+	require.NoError(t, sdb.Close())
+
+	// The new members are in the shard map
+	sdb, _, err := OpenShardedDB(nil, base, 2, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	shard = sdb.Shards[0]
+	assert.Equal(t, base+"_0_replica_1", shard.Database.filename)
+	require.Len(t, shard.Replicas, 2)
+	for _, replica := range shard.Replicas {
+		value, err := replica.Get("999")
+		require.NoError(t, err)
+		assert.Equal(t, "after", value)
+		assert.Equal(t, shard.Database.digest(), replica.digest())
+	}
+}
+
+// Writes keep going while a replica is seeded, it ends up with all of them
+func TestSeedReplicaWhileWriting(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Durability = DurabilityNone
+	// Small segments so checkpoints have something to drop
+	opts.SegmentSize = 4096
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 9999}}, filepath.Join(t.TempDir(), "seed"), 1, opts)
+	defer sdb.Close()
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprint(i), "initial"))
+	}
+	shard := sdb.Shards[0]
+	sdb.dropFailedReplicas(shard, map[*db]HealthState{shard.Replicas[0]: HealthFailed})
+	require.Empty(t, shard.Replicas)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprint(i % 3000)
+			if i%3 == 0 {
+				sdb.Delete(key)
+			} else {
+				assert.NoError(t, sdb.Set(key, fmt.Sprint(i)))
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			assert.NoError(t, sdb.Save())
+		}
+	}()
+
+	var err error
+	for attempt := 0; attempt < seedAttempts; attempt++ {
+		if err = sdb.addReplica(shard); err == nil {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err)
+	require.Len(t, shard.Replicas, 1)
+	assert.Equal(t, shard.Database.digest(), shard.Replicas[0].digest())
+}
+
+func TestEntriesAfter(t *testing.T) {
+	wal := NewWALWithOptions(filepath.Join(t.TempDir(), "entries_wal"), WALOptions{SegmentSize: 64})
+	defer wal.Close()
+	for i := 0; i < 10; i++ {
+		_, err := wal.Append(RecordSet, fmt.Sprint(i), "value")
+		require.NoError(t, err)
+	}
+	records, err := wal.entriesAfter(7)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, uint64(8), records[0].LSN)
+
+	// Held records survive a checkpoint
+	wal.hold("test", 2)
+	require.NoError(t, wal.Checkpoint(5))
+	records, err = wal.entriesAfter(2)
+	require.NoError(t, err)
+	assert.Len(t, records, 8)
+
+	wal.release("test")
+	require.NoError(t, wal.Checkpoint(5))
+	_, err = wal.entriesAfter(2)
+	assert.ErrorIs(t, err, ErrWALGap)
+	records, err = wal.entriesAfter(10)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//  Every shard has an epoch, it goes up each time the shard gets a new
+//  primary. Members record the newest epoch they've seen in
+//  <filename>.epoch and turn away writes made in an older one, so a write
+//  through a stale handle to a deposed primary can't land anywhere that
+//  knows better.
+var ErrStaleEpoch = errors.New("stale epoch")
+
+func epochFilename(filename string) string {
+	return filename + ".epoch"
+}
+
+// 0 if the db has never been fenced
+func readEpoch(filename string) (uint64, error) {
+	data, err := os.ReadFile(epochFilename(filename))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+//  Function for checking a write made in epoch can be applied.
+//  A newer epoch than the db has seen is recorded first, an older one is
+//  ErrStaleEpoch. Writes made outside any epoch (0) only go through to a db
+//  that has never been fenced, one that has is a shard member and only
+//  takes writes from the shard.
+//  Caller holds the lock.
+func (db *db) checkEpoch(epoch uint64) error {
+	current := db.epoch.Load()
+	switch {
+	case epoch == current:
+		return nil
+	case epoch < current:
+		return fmt.Errorf("%w: %s is at epoch %d, the write was made in %d", ErrStaleEpoch, db.filename, current, epoch)
+	}
+	if err := writeFileAtomic(epochFilename(db.filename), []byte(strconv.FormatUint(epoch, 10)), true); err != nil {
+		return err
+	}
+	db.epoch.Store(epoch)
+	return nil
+}
+
+// Function for moving the db on to epoch, from then on it turns away writes
+// made in older ones. Fencing it at an older epoch than it has is
+// ErrStaleEpoch.
+func (db *db) fence(epoch uint64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.checkEpoch(epoch)
+}
+
+func (db *db) Epoch() uint64 {
+	return db.epoch.Load()
+}
+
+// Function for settling the shard's epoch when its members are opened, the
+// newest any of them has seen (at least epoch) so none of them is behind
+func (shard *Shard) settleEpoch(epoch uint64) error {
+	for _, member := range shard.members() {
+		epoch = max(epoch, member.Epoch())
+	}
+	shard.Epoch = epoch
+	return shard.fence()
+}
+
+// Function for fencing every member of the shard at the shard's epoch,
+// reports the first one that couldn't be
+func (shard *Shard) fence() error {
+	var firstErr error
+	for _, member := range shard.members() {
+		if err := member.fence(shard.Epoch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
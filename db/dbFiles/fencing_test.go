@@ -0,0 +1,74 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEpochFencing(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fenced")
+	database := NewDb(filename)
+	require.NoError(t, database.fence(3))
+	_, err := database.setAt(2, "key", "stale")
+	assert.ErrorIs(t, err, ErrStaleEpoch)
+	_, err = database.deleteAt(2, "key")
+	assert.ErrorIs(t, err, ErrStaleEpoch)
+	_, err = database.setAt(3, "key", "current")
+	require.NoError(t, err)
+	// A newer epoch is taken on
+	_, err = database.setAt(4, "key", "newer")
+	require.NoError(t, err)
+	assert.ErrorIs(t, database.fence(3), ErrStaleEpoch)
+	// Nor are writes outside any epoch, once it's been fenced
+	assert.ErrorIs(t, database.Set("other", "value"), ErrStaleEpoch)
+	assert.ErrorIs(t, database.Delete("key"), ErrStaleEpoch)
+	require.NoError(t, database.Close())
+
+	database, _, err = OpenDb(filename, DefaultOptions())
+	require.NoError(t, err)
+	defer database.Close()
+	assert.Equal(t, uint64(4), database.Epoch())
+	_, err = database.setAt(3, "key", "stale")
+	assert.ErrorIs(t, err, ErrStaleEpoch)
+	value, err := database.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, "newer", value)
+}
+
+func TestPromotionStartsNewEpoch(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "epoch")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, base, 1, DefaultOptions())
+	shard := sdb.Shards[0]
+	assert.Equal(t, uint64(1), shard.Epoch)
+	require.NoError(t, sdb.Set("1", "one"))
+
+	stale := shard.Database
+	sdb.PromoteReplica(shard, shard.Replicas[0])
+	assert.Equal(t, uint64(2), shard.Epoch)
+	assert.Equal(t, uint64(2), sdb.ShardInfo()[0].Epoch)
+	assert.NotEqual(t, stale, shard.Database)
+	// A write from the old primary's epoch doesn't get anywhere, through
+	// the deposed primary or the new one
+	_, err := stale.setAt(1, "1", "stale")
+	assert.ErrorIs(t, err, ErrStaleEpoch)
+	assert.ErrorIs(t, stale.Set("1", "stale"), ErrStaleEpoch)
+	_, err = shard.Database.setAt(1, "1", "stale")
+	assert.ErrorIs(t, err, ErrStaleEpoch)
+	require.NoError(t, sdb.Set("2", "two"))
+	sdb.repairs.Wait()
+	require.Len(t, shard.Replicas, 1)
+	assert.Equal(t, uint64(2), shard.Replicas[0].Epoch())
+	require.NoError(t, sdb.Close())
+
+	sdb, _, err = OpenShardedDB(nil, base, 1, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	assert.Equal(t, uint64(2), sdb.Shards[0].Epoch)
+	assert.Equal(t, uint64(2), sdb.ShardMap().Shards[0].Epoch)
+	value, err := sdb.Get("2")
+	require.NoError(t, err)
+	assert.Equal(t, "two", value)
+}
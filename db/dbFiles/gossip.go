@@ -0,0 +1,545 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What a member of a gossip group thinks of another
+type MemberState string
+
+const (
+	MemberAlive MemberState = "alive"
+	// Didn't answer a probe, direct or indirect. It has SuspicionTimeout to
+	// say otherwise before it's taken for dead.
+	MemberSuspect MemberState = "suspect"
+	MemberDead    MemberState = "dead"
+	// Said it was leaving
+	MemberLeft MemberState = "left"
+)
+
+const (
+	DefaultGossipInterval         = 200 * time.Millisecond
+	DefaultGossipSuspicionTimeout = time.Second
+	DefaultGossipIndirectProbes   = 3
+)
+
+// At most this many updates ride along on each message
+const gossipPiggyback = 16
+
+//  Settings for gossip.
+//  Every Interval a member probes the next one in turn. If it doesn't
+//  answer, IndirectProbes other members are asked to probe it. If none of
+//  them gets an answer either it's suspect, and dead once it's been suspect
+//  for SuspicionTimeout.
+//  OnChange is called, without any locks held, each time a member's state
+//  changes. Clock and Seed are for deterministic tests, they default to
+//  time.Now and a random seed.
+type GossipOptions struct {
+	Interval         time.Duration
+	SuspicionTimeout time.Duration
+	IndirectProbes   int
+	OnChange         func(member GossipMember)
+	Clock            func() time.Time
+	Seed             int64
+}
+
+// Function for filling in anything left unset with the defaults
+func (opts GossipOptions) withDefaults() GossipOptions {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultGossipInterval
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = DefaultGossipSuspicionTimeout
+	}
+	if opts.IndirectProbes <= 0 {
+		opts.IndirectProbes = DefaultGossipIndirectProbes
+	}
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+	if opts.Seed == 0 {
+		opts.Seed = rand.Int63()
+	}
+	return opts
+}
+
+//  A member of a gossip group as another member sees it. Incarnation only
+//  goes up, and only the member itself moves it on: to say it's alive
+//  after all when it hears it's suspected or dead.
+type GossipMember struct {
+	ID          string      `json:"id"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+//  What gossip members send each other, a ping and its ack alike. From is
+//  the sender as it sees itself. Target is who a ping-req asks to be
+//  probed. Updates are recent changes the sender is passing on, or
+//  everything it knows if Sync is set, which asks for the same back.
+type GossipMessage struct {
+	From    GossipMember
+	Target  string
+	Sync    bool
+	Updates []GossipMember
+}
+
+//  How gossip members reach each other. Members register under their ID to
+//  be called. Ping returns the ack, PingReq has via ping message.Target and
+//  returns its ack. Either is an error if there was no ack.
+type GossipTransport interface {
+	RegisterGossip(id string, member GossipHandler)
+	UnregisterGossip(id string)
+	Ping(to string, message GossipMessage) (GossipMessage, error)
+	PingReq(via string, message GossipMessage) (GossipMessage, error)
+}
+
+// The receiving end of a GossipTransport
+type GossipHandler interface {
+	HandlePing(message GossipMessage) GossipMessage
+	HandlePingReq(message GossipMessage) (GossipMessage, error)
+}
+
+// A member known to a Gossip. sends is how many messages the latest change
+// to it has ridden along on, suspected when it was suspected.
+type gossipEntry struct {
+	GossipMember
+	sends     int
+	suspected time.Time
+}
+
+//  SWIM-style membership, one member's view of the group. Each member
+//  probes the others in turn and passes on what it learns on the messages
+//  it sends anyway, so every member ends up with the same view. The first
+//  probe of each round swaps everything the two members know, in case
+//  anything was missed, and each round one member taken for dead is tried
+//  again, so members cut off from each other find each other again.
+//  order is the members left to probe this round.
+type Gossip struct {
+	id        string
+	transport GossipTransport
+	opts      GossipOptions
+	lock      sync.Mutex
+	members   map[string]*gossipEntry
+	order     []string
+	rand      *rand.Rand
+	events    []GossipMember
+	stop      chan struct{}
+	running   sync.WaitGroup
+	started   bool
+}
+
+// Function for making id's view of the group, with only itself in it. It
+// takes messages once Start is called.
+func NewGossip(id string, transport GossipTransport, opts GossipOptions) *Gossip {
+	opts = opts.withDefaults()
+	gossip := &Gossip{id: id, transport: transport, opts: opts, members: make(map[string]*gossipEntry),
+		rand: rand.New(rand.NewSource(opts.Seed)), stop: make(chan struct{})}
+	gossip.members[id] = &gossipEntry{GossipMember: GossipMember{ID: id, State: MemberAlive}}
+	return gossip
+}
+
+// Function for taking messages, and probing every Interval in the
+// background if probe is set. Tests leave it unset and call Probe.
+func (gossip *Gossip) Start(probe bool) {
+	gossip.transport.RegisterGossip(gossip.id, gossip)
+	if !probe {
+		return
+	}
+	gossip.lock.Lock()
+	gossip.started = true
+	gossip.lock.Unlock()
+	gossip.running.Add(1)
+	go func() {
+		defer gossip.running.Done()
+		ticker := time.NewTicker(gossip.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-gossip.stop:
+				return
+			case <-ticker.C:
+				gossip.Probe()
+			}
+		}
+	}()
+}
+
+// Function for stopping probes and messages, without telling anyone
+func (gossip *Gossip) Stop() {
+	gossip.lock.Lock()
+	if gossip.started {
+		close(gossip.stop)
+		gossip.started = false
+	}
+	gossip.lock.Unlock()
+	gossip.running.Wait()
+	gossip.transport.UnregisterGossip(gossip.id)
+}
+
+//  Function for joining the group through seeds, any one of them will do.
+//  Each one that answers sends back everything it knows. It's an error if
+//  none of them do.
+func (gossip *Gossip) Join(seeds ...string) error {
+	joined := 0
+	var errs []error
+	for _, seed := range seeds {
+		if seed == gossip.id {
+			continue
+		}
+		gossip.lock.Lock()
+		message := gossip.syncMessage()
+		gossip.lock.Unlock()
+		ack, err := gossip.transport.Ping(seed, message)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		gossip.lock.Lock()
+		gossip.receive(ack)
+		gossip.lock.Unlock()
+		gossip.fire()
+		joined++
+	}
+	if joined == 0 && len(errs) > 0 {
+		return fmt.Errorf("joining through %v: %w", seeds, errors.Join(errs...))
+	}
+	return nil
+}
+
+//  Function for leaving the group. Every member still alive is told
+//  straight away rather than left to find out, then the member stops. It
+//  can't be started again.
+func (gossip *Gossip) Leave() {
+	gossip.lock.Lock()
+	self := gossip.members[gossip.id]
+	self.State = MemberLeft
+	self.Incarnation++
+	self.sends = 0
+	message := gossip.message()
+	peers := gossip.live()
+	gossip.lock.Unlock()
+	for _, peer := range peers {
+		gossip.transport.Ping(peer, message)
+	}
+	gossip.Stop()
+}
+
+//  Function for one period of the failure detector: the next member in turn
+//  is pinged, then pinged through others if it doesn't answer, then
+//  suspected if it still hasn't. Members suspected for SuspicionTimeout are
+//  taken for dead first.
+func (gossip *Gossip) Probe() {
+	gossip.lock.Lock()
+	gossip.expireSuspects()
+	target, sync := gossip.nextTarget()
+	message := gossip.message()
+	if sync {
+		message = gossip.syncMessage()
+	}
+	gossip.lock.Unlock()
+	if target != "" {
+		ack, err := gossip.transport.Ping(target, message)
+		if err != nil {
+			gossip.lock.Lock()
+			helpers := gossip.helpers(target)
+			gossip.lock.Unlock()
+			message.Target = target
+			for _, via := range helpers {
+				if ack, err = gossip.transport.PingReq(via, message); err == nil {
+					break
+				}
+			}
+		}
+		gossip.lock.Lock()
+		if err == nil {
+			gossip.receive(ack)
+		} else {
+			gossip.suspect(target)
+		}
+		gossip.lock.Unlock()
+	}
+	if sync {
+		gossip.retryDead()
+	}
+	gossip.fire()
+}
+
+// Function for trying a member taken for dead again. If it answers it
+// hears it was and says otherwise, and both swap what they know.
+func (gossip *Gossip) retryDead() {
+	gossip.lock.Lock()
+	dead := []string{}
+	for _, id := range gossip.ids() {
+		if gossip.members[id].State == MemberDead {
+			dead = append(dead, id)
+		}
+	}
+	if len(dead) == 0 {
+		gossip.lock.Unlock()
+		return
+	}
+	target := dead[gossip.rand.Intn(len(dead))]
+	message := gossip.syncMessage()
+	gossip.lock.Unlock()
+	if ack, err := gossip.transport.Ping(target, message); err == nil {
+		gossip.lock.Lock()
+		gossip.receive(ack)
+		gossip.lock.Unlock()
+	}
+}
+
+// Function for answering a ping, with whatever updates there are, or the
+// whole group for a member joining
+func (gossip *Gossip) HandlePing(message GossipMessage) GossipMessage {
+	gossip.lock.Lock()
+	gossip.receive(message)
+	ack := gossip.message()
+	if message.Sync {
+		ack.Updates = gossip.all()
+	} else if sender := gossip.members[message.From.ID]; sender != nil && sender.State != MemberAlive && sender.State != MemberLeft {
+		// It can't say otherwise if it doesn't know
+		ack.Updates = append(ack.Updates, sender.GossipMember)
+	}
+	gossip.lock.Unlock()
+	gossip.fire()
+	return ack
+}
+
+// Function for pinging message.Target for another member that couldn't
+// get an answer from it, the ack is passed back
+func (gossip *Gossip) HandlePingReq(message GossipMessage) (GossipMessage, error) {
+	gossip.lock.Lock()
+	gossip.receive(message)
+	ping := gossip.message()
+	gossip.lock.Unlock()
+	gossip.fire()
+	ack, err := gossip.transport.Ping(message.Target, ping)
+	if err != nil {
+		return GossipMessage{}, err
+	}
+	gossip.lock.Lock()
+	gossip.receive(ack)
+	gossip.lock.Unlock()
+	gossip.fire()
+	return ack, nil
+}
+
+// Everyone the member knows of, dead and gone included, by ID
+func (gossip *Gossip) Members() []GossipMember {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+	return gossip.all()
+}
+
+// Same as Members, caller holds the lock
+func (gossip *Gossip) all() []GossipMember {
+	members := []GossipMember{}
+	for _, id := range gossip.ids() {
+		members = append(members, gossip.members[id].GossipMember)
+	}
+	return members
+}
+
+// What the member thinks of id, false if it's never heard of it
+func (gossip *Gossip) State(id string) (MemberState, bool) {
+	gossip.lock.Lock()
+	defer gossip.lock.Unlock()
+	entry := gossip.members[id]
+	if entry == nil {
+		return "", false
+	}
+	return entry.State, true
+}
+
+// Whether id is still in the group as far as the member knows, alive or
+// only suspected
+func (gossip *Gossip) Live(id string) bool {
+	state, known := gossip.State(id)
+	return known && (state == MemberAlive || state == MemberSuspect)
+}
+
+// IDs of the members, sorted so rounds go the same way every time. Caller
+// holds the lock.
+func (gossip *Gossip) ids() []string {
+	ids := []string{}
+	for id := range gossip.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// The other members still in the group. Caller holds the lock.
+func (gossip *Gossip) live() []string {
+	live := []string{}
+	for _, id := range gossip.ids() {
+		state := gossip.members[id].State
+		if id != gossip.id && (state == MemberAlive || state == MemberSuspect) {
+			live = append(live, id)
+		}
+	}
+	return live
+}
+
+// The member to probe next, each is probed once a round in a shuffled
+// order. sync is set for the first of each round. Caller holds the lock.
+func (gossip *Gossip) nextTarget() (target string, sync bool) {
+	for {
+		if len(gossip.order) == 0 {
+			gossip.order = gossip.live()
+			gossip.rand.Shuffle(len(gossip.order), func(i, j int) {
+				gossip.order[i], gossip.order[j] = gossip.order[j], gossip.order[i]
+			})
+			sync = true
+			if len(gossip.order) == 0 {
+				return "", true
+			}
+		}
+		target = gossip.order[0]
+		gossip.order = gossip.order[1:]
+		// It may have died or left since the round started
+		if state := gossip.members[target].State; state == MemberAlive || state == MemberSuspect {
+			return target, sync
+		}
+	}
+}
+
+// Up to IndirectProbes members, other than target, to ask to probe it.
+// Caller holds the lock.
+func (gossip *Gossip) helpers(target string) []string {
+	helpers := []string{}
+	for _, id := range gossip.live() {
+		if id != target && gossip.members[id].State == MemberAlive {
+			helpers = append(helpers, id)
+		}
+	}
+	gossip.rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	return helpers[:min(len(helpers), gossip.opts.IndirectProbes)]
+}
+
+//  Function for making a message from the member, with the updates that
+//  have been sent least. Each update is passed on a few times more than
+//  it takes to reach everyone, going by the size of the group. Caller
+//  holds the lock.
+func (gossip *Gossip) message() GossipMessage {
+	message := GossipMessage{From: gossip.members[gossip.id].GossipMember}
+	limit := 3 * bits.Len(uint(len(gossip.members)))
+	pending := []*gossipEntry{}
+	for _, id := range gossip.ids() {
+		if entry := gossip.members[id]; entry.sends < limit {
+			pending = append(pending, entry)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].sends < pending[j].sends })
+	for _, entry := range pending[:min(len(pending), gossipPiggyback)] {
+		entry.sends++
+		message.Updates = append(message.Updates, entry.GossipMember)
+	}
+	return message
+}
+
+// Same as message, with everything the member knows. Caller holds the lock.
+func (gossip *Gossip) syncMessage() GossipMessage {
+	return GossipMessage{From: gossip.members[gossip.id].GossipMember, Sync: true, Updates: gossip.all()}
+}
+
+// Function for taking in a message, the sender is alive as it says and
+// its updates are applied. Caller holds the lock.
+func (gossip *Gossip) receive(message GossipMessage) {
+	gossip.apply(message.From)
+	for _, update := range message.Updates {
+		gossip.apply(update)
+	}
+}
+
+//  Function for applying what another member says of update.ID, if it's
+//  news. A higher incarnation always is. At the same incarnation suspect
+//  beats alive, and dead or left beat both. A member told it's anything but
+//  alive, when it isn't leaving, says it is with a higher incarnation.
+//  Caller holds the lock.
+func (gossip *Gossip) apply(update GossipMember) {
+	entry := gossip.members[update.ID]
+	if update.ID == gossip.id {
+		self := entry
+		if update.State != MemberAlive && self.State == MemberAlive && update.Incarnation >= self.Incarnation {
+			self.Incarnation = update.Incarnation + 1
+			self.sends = 0
+		}
+		return
+	}
+	if entry == nil {
+		// Suspicions and deaths of members never heard of aren't news
+		if update.State == MemberAlive || update.State == MemberLeft {
+			gossip.members[update.ID] = &gossipEntry{GossipMember: update}
+			gossip.events = append(gossip.events, update)
+		}
+		return
+	}
+	rank := func(state MemberState) int {
+		switch state {
+		case MemberAlive:
+			return 0
+		case MemberSuspect:
+			return 1
+		}
+		return 2
+	}
+	switch {
+	case entry.State == MemberLeft:
+		// Gone for good, unless it comes back as a new incarnation
+		if update.State != MemberAlive || update.Incarnation <= entry.Incarnation {
+			return
+		}
+	case update.Incarnation < entry.Incarnation:
+		return
+	case update.Incarnation == entry.Incarnation && rank(update.State) <= rank(entry.State):
+		return
+	}
+	if update.State == MemberSuspect && entry.State != MemberSuspect {
+		entry.suspected = gossip.opts.Clock()
+	}
+	entry.GossipMember = update
+	entry.sends = 0
+	gossip.events = append(gossip.events, update)
+}
+
+// Function for suspecting id, which didn't answer. Caller holds the lock.
+func (gossip *Gossip) suspect(id string) {
+	entry := gossip.members[id]
+	if entry != nil && entry.State == MemberAlive {
+		gossip.apply(GossipMember{ID: id, State: MemberSuspect, Incarnation: entry.Incarnation})
+	}
+}
+
+// Function for taking members suspected for too long for dead. Caller
+// holds the lock.
+func (gossip *Gossip) expireSuspects() {
+	now := gossip.opts.Clock()
+	for _, id := range gossip.ids() {
+		entry := gossip.members[id]
+		if entry.State == MemberSuspect && now.Sub(entry.suspected) >= gossip.opts.SuspicionTimeout {
+			gossip.apply(GossipMember{ID: id, State: MemberDead, Incarnation: entry.Incarnation})
+		}
+	}
+}
+
+// Function for calling OnChange for the changes since last time, without
+// the lock
+func (gossip *Gossip) fire() {
+	gossip.lock.Lock()
+	events := gossip.events
+	gossip.events = nil
+	gossip.lock.Unlock()
+	if gossip.opts.OnChange == nil {
+		return
+	}
+	for _, event := range events {
+		gossip.opts.OnChange(event)
+	}
+}
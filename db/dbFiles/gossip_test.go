@@ -0,0 +1,171 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A clock tests move on by hand
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+// Function for starting n members on transport that probe only when told
+// to, each joining through the first. changes gets every OnChange.
+func startGossipGroup(t *testing.T, transport *MemoryTransport, clock *testClock, n int) ([]*Gossip, *[]string) {
+	var lock sync.Mutex
+	changes := []string{}
+	members := []*Gossip{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprint("g", i)
+		gossip := NewGossip(id, transport, GossipOptions{SuspicionTimeout: time.Second, Clock: clock.Now, Seed: int64(i + 1),
+			OnChange: func(member GossipMember) {
+				lock.Lock()
+				defer lock.Unlock()
+				changes = append(changes, fmt.Sprintf("%s: %s %s", id, member.ID, member.State))
+			}})
+		gossip.Start(false)
+		t.Cleanup(gossip.Stop)
+		require.NoError(t, gossip.Join("g0"))
+		members = append(members, gossip)
+	}
+	return members, &changes
+}
+
+// Function for having every member but skip probe once, n times over
+func gossipRounds(members []*Gossip, n int, skip ...*Gossip) {
+	for i := 0; i < n; i++ {
+		for _, gossip := range members {
+			if !containsGossip(skip, gossip) {
+				gossip.Probe()
+			}
+		}
+	}
+}
+
+func containsGossip(members []*Gossip, gossip *Gossip) bool {
+	for _, member := range members {
+		if member == gossip {
+			return true
+		}
+	}
+	return false
+}
+
+// Function for checking every member but skip sees id as state
+func assertGossipState(t *testing.T, members []*Gossip, id string, state MemberState, skip ...*Gossip) {
+	t.Helper()
+	for _, gossip := range members {
+		if containsGossip(skip, gossip) {
+			continue
+		}
+		got, known := gossip.State(id)
+		assert.True(t, known, "%s hasn't heard of %s", gossip.id, id)
+		assert.Equal(t, state, got, "%s's view of %s", gossip.id, id)
+	}
+}
+
+// Members that join through one seed end up knowing each other
+func TestGossipJoin(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	members, changes := startGossipGroup(t, NewMemoryTransport(), clock, 5)
+	gossipRounds(members, 5)
+	for _, gossip := range members {
+		view := gossip.Members()
+		require.Len(t, view, 5, gossip.id)
+		for _, member := range view {
+			assert.Equal(t, MemberAlive, member.State)
+			assert.Zero(t, member.Incarnation)
+		}
+	}
+	assert.Contains(t, *changes, "g4: g0 alive")
+	assert.Contains(t, *changes, "g0: g4 alive")
+	assert.Error(t, NewGossip("lonely", NewMemoryTransport(), GossipOptions{}).Join("nobody"))
+}
+
+//  A member that stops answering is suspected, then taken for dead once
+//  it's been suspect for SuspicionTimeout. One that's only out of touch
+//  for a while hears it's suspected and refutes it with a higher
+//  incarnation.
+func TestGossipFailureDetection(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	transport := NewMemoryTransport()
+	members, changes := startGossipGroup(t, transport, clock, 5)
+	gossipRounds(members, 3)
+
+	transport.Disconnect("g3")
+	gossipRounds(members, 5, members[3])
+	assertGossipState(t, members, "g3", MemberSuspect, members[3])
+	clock.Advance(time.Second)
+	gossipRounds(members, 5, members[3])
+	assertGossipState(t, members, "g3", MemberDead, members[3])
+	assert.Contains(t, *changes, "g0: g3 dead")
+
+	// Indirect probes keep a member only one other can't reach alive
+	transport.CutLink("g0", "g1")
+	for i := 0; i < 10; i++ {
+		members[0].Probe()
+		clock.Advance(time.Second)
+	}
+	state, _ := members[0].State("g1")
+	assert.Equal(t, MemberAlive, state)
+	transport.Heal()
+	transport.Disconnect("g3")
+
+	// Suspected but back before the timeout
+	transport.Disconnect("g2")
+	gossipRounds(members, 3, members[3], members[2])
+	state, _ = members[0].State("g2")
+	require.Equal(t, MemberSuspect, state)
+	transport.Reconnect("g2")
+	gossipRounds(members, 5, members[3])
+	assertGossipState(t, members, "g2", MemberAlive, members[3])
+	for _, member := range members[0].Members() {
+		if member.ID == "g2" {
+			assert.Equal(t, uint64(1), member.Incarnation)
+		}
+	}
+
+	// Taken for dead but back: it finds out, and everyone hears it's alive
+	// at a higher incarnation
+	transport.Reconnect("g3")
+	gossipRounds(members, 10)
+	assertGossipState(t, members, "g3", MemberAlive)
+	for _, member := range members[0].Members() {
+		if member.ID == "g3" {
+			assert.Positive(t, member.Incarnation)
+		}
+	}
+}
+
+// A member that leaves tells everyone, it isn't suspected or brought back
+func TestGossipLeave(t *testing.T) {
+	clock := &testClock{now: time.Unix(0, 0)}
+	members, _ := startGossipGroup(t, NewMemoryTransport(), clock, 4)
+	gossipRounds(members, 3)
+	members[2].Leave()
+	assertGossipState(t, members, "g2", MemberLeft, members[2])
+	clock.Advance(time.Minute)
+	gossipRounds(members, 5, members[2])
+	assertGossipState(t, members, "g2", MemberLeft, members[2])
+	assert.False(t, members[0].Live("g2"))
+	assert.True(t, members[0].Live("g1"))
+}
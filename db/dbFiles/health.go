@@ -0,0 +1,443 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// How a member of a shard is doing, going by its last few probes
+type HealthState string
+
+const (
+	// The last probe worked
+	HealthHealthy HealthState = "healthy"
+	// Probes have started failing, not enough of them yet to give up on it
+	HealthSuspect HealthState = "suspect"
+	// FailAfter probes in a row have failed
+	HealthFailed HealthState = "failed"
+)
+
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultProbeTimeout   = 5 * time.Second
+	DefaultSuspectAfter   = 1
+	DefaultFailAfter      = 3
+	// How many promotions a ShardedDB remembers
+	promotionHistory = 100
+)
+
+// Key the engine probe reads, it doesn't matter whether it's there
+const healthProbeKey = "\x00health"
+
+var ErrProbeTimeout = errors.New("probe timed out")
+
+//  Settings for health checks.
+//  Every Interval each member is probed, a probe that takes longer than
+//  Timeout fails. A member is suspect after SuspectAfter failed probes in a
+//  row and failed after FailAfter, one probe that works makes it healthy.
+type HealthOptions struct {
+	Interval     time.Duration
+	Timeout      time.Duration
+	SuspectAfter int
+	FailAfter    int
+}
+
+// Function for filling in anything left unset with the defaults
+func (opts HealthOptions) withDefaults() HealthOptions {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultHealthInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultProbeTimeout
+	}
+	if opts.SuspectAfter <= 0 {
+		opts.SuspectAfter = DefaultSuspectAfter
+	}
+	if opts.FailAfter <= 0 {
+		opts.FailAfter = DefaultFailAfter
+	}
+	if opts.SuspectAfter > opts.FailAfter {
+		opts.SuspectAfter = opts.FailAfter
+	}
+	return opts
+}
+
+// Probe results of a db, it has its own lock so probing never waits on the
+// db's lock to report
+type memberHealth struct {
+	lock      sync.Mutex
+	state     HealthState
+	failures  int
+	lastErr   error
+	lastProbe time.Time
+}
+
+// Health of one member as reported by the API
+type MemberHealth struct {
+	Member    string      `json:"member"`
+	Epoch     uint64      `json:"epoch"`
+	State     HealthState `json:"state"`
+	Failures  int         `json:"consecutive_failures"`
+	LastError string      `json:"last_error,omitempty"`
+	LastProbe *time.Time  `json:"last_probe,omitempty"`
+}
+
+// Health of a shard's members
+type ShardHealth struct {
+	ID       int            `json:"id"`
+	Primary  MemberHealth   `json:"primary"`
+	Replicas []MemberHealth `json:"replicas"`
+}
+
+// A replica taking over from its shard's primary
+type Promotion struct {
+	ShardID int       `json:"shard_id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Reason  string    `json:"reason"`
+	At      time.Time `json:"at"`
+}
+
+//  Function for checking the db is alive, its WAL can still be written to
+//  and its engine answers a read within timeout.
+//  A probe stuck behind a hung write times out, the goroutine left behind
+//  finishes whenever the db does.
+func (db *db) probe(timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		if err := db.wal.probe(); err != nil {
+			done <- err
+			return
+		}
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		if err := db.engineErr(); err != nil {
+			done <- err
+			return
+		}
+		if _, err := db.engine.Get(healthProbeKey); err != nil && err != ErrNotFound {
+			done <- err
+			return
+		}
+		done <- nil
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%w after %v", ErrProbeTimeout, timeout)
+	}
+}
+
+// Function for probing the db and updating its health with the result
+func (db *db) checkHealth(opts HealthOptions) HealthState {
+	err := db.probe(opts.Timeout)
+	health := &db.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	health.lastProbe = time.Now()
+	health.lastErr = err
+	if err == nil {
+		health.failures = 0
+		health.state = HealthHealthy
+		return health.state
+	}
+	health.failures++
+	switch {
+	case health.failures >= opts.FailAfter:
+		health.state = HealthFailed
+	case health.failures >= opts.SuspectAfter:
+		health.state = HealthSuspect
+	}
+	return health.state
+}
+
+// Healthy until a probe says otherwise
+func (db *db) healthState() HealthState {
+	db.health.lock.Lock()
+	defer db.health.lock.Unlock()
+	if db.health.state == "" {
+		return HealthHealthy
+	}
+	return db.health.state
+}
+
+func (db *db) healthReport() MemberHealth {
+	health := &db.health
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	report := MemberHealth{Member: filepath.Base(db.filename), Epoch: db.Epoch(), State: health.state, Failures: health.failures}
+	if report.State == "" {
+		report.State = HealthHealthy
+	}
+	if !health.lastProbe.IsZero() {
+		lastProbe := health.lastProbe
+		report.LastProbe = &lastProbe
+	}
+	if health.lastErr != nil {
+		report.LastError = health.lastErr.Error()
+	}
+	return report
+}
+
+// Function for checking the active segment is still on disk, is the file
+// being appended to, and can be opened for writing
+func (wal *WAL) probe() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.file == nil {
+		return fmt.Errorf("wal %s is closed", wal.filename)
+	}
+	name := wal.segmentName(wal.segments[len(wal.segments)-1].index)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	onDisk, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	open, err := wal.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(onDisk, open) {
+		return fmt.Errorf("wal segment %s was replaced", name)
+	}
+	return nil
+}
+
+//  Function for probing every member of every shard.
+//  A shard whose primary has failed gets the healthy replica with the most
+//  of its WAL promoted, or a suspect one if none are healthy. Failed
+//  replicas are never promoted. Returns the promotions made. Raft shards
+//  elect their own leaders, see checkRaftShard.
+func (sdb *ShardedDB) CheckHealth(opts HealthOptions) []Promotion {
+	opts = opts.withDefaults()
+	sdb.lock.RLock()
+	shards := append([]*Shard{}, sdb.Shards...)
+	sdb.lock.RUnlock()
+
+	promotions := []Promotion{}
+	for _, shard := range shards {
+		sdb.lock.RLock()
+		primary, replicas := shard.Database, append([]*db{}, shard.Replicas...)
+		sdb.lock.RUnlock()
+		states := make(map[*db]HealthState)
+		for _, member := range append([]*db{primary}, replicas...) {
+			states[member] = member.checkHealth(opts)
+		}
+		if primary.raft != nil {
+			sdb.checkRaftShard(shard, primary, replicas, states)
+			continue
+		}
+		// Streams that stopped are started again, a replica that can't catch
+		// up from the primary's WAL is as good as failed
+		sdb.lock.RLock()
+		for replica, err := range shard.replicate() {
+			fmt.Printf("Replica %s of shard %d can't catch up: %v\n", replica.filename, shard.ID, err)
+			states[replica] = HealthFailed
+		}
+		sdb.lock.RUnlock()
+		sdb.dropFailedReplicas(shard, states)
+		if states[primary] != HealthFailed {
+			sdb.lock.Lock()
+			sdb.repair(shard)
+			sdb.lock.Unlock()
+			continue
+		}
+
+		// The furthest along of the healthiest replicas
+		var candidate *db
+		for _, want := range []HealthState{HealthHealthy, HealthSuspect} {
+			for _, replica := range replicas {
+				if states[replica] != want {
+					continue
+				}
+				if candidate == nil || replica.appliedLSN() > candidate.appliedLSN() {
+					candidate = replica
+				}
+			}
+			if candidate != nil {
+				break
+			}
+		}
+		if candidate == nil {
+			fmt.Printf("Primary of shard %d has failed and no replica is healthy enough to take over\n", shard.ID)
+			continue
+		}
+		report := primary.healthReport()
+		reason := fmt.Sprintf("primary failed %d probes in a row, last: %s", report.Failures, report.LastError)
+		if promotion, ok := sdb.promote(shard, primary, candidate, reason); ok {
+			promotions = append(promotions, promotion)
+		}
+	}
+	return promotions
+}
+
+//  Function for making replica the shard's primary in place of primary, and
+//  recording why. Does nothing if the shard's primary changed in the
+//  meantime or replica isn't one of its replicas any more.
+func (sdb *ShardedDB) promote(shard *Shard, primary, replica *db, reason string) (Promotion, bool) {
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	if shard.Database != primary {
+		return Promotion{}, false
+	}
+	newReplicas := []*db{}
+	found := false
+	for _, rep := range shard.Replicas {
+		if rep == replica {
+			found = true
+		} else {
+			newReplicas = append(newReplicas, rep)
+		}
+	}
+	if !found {
+		return Promotion{}, false
+	}
+	// A new epoch, anything still holding on to the old primary can't write
+	// to it or to the rest of the shard. The old primary is fenced before
+	// anything else changes, so no write gets through to it once the
+	// promotion can be seen.
+	shard.Epoch++
+	if err := primary.fence(shard.Epoch); err != nil {
+		fmt.Printf("Error fencing old primary %s at epoch %d: %v\n", primary.filename, shard.Epoch, err)
+	}
+	shard.Database = replica
+	shard.Replicas = newReplicas
+	if err := shard.fence(); err != nil {
+		fmt.Printf("Error fencing shard %d at epoch %d: %v\n", shard.ID, shard.Epoch, err)
+	}
+	// Replicas that got further than the new primary have records it
+	// doesn't, they're replaced. The rest stream from it.
+	ahead := []*db{}
+	for _, other := range newReplicas {
+		if other.appliedLSN() > replica.appliedLSN() {
+			ahead = append(ahead, other)
+			fmt.Printf("Dropped replica %s from shard %d, it's ahead of the new primary\n", other.filename, shard.ID)
+		}
+	}
+	// The old primary is out of the shard for good, a new replica takes its
+	// place
+	sdb.discard(primary.filename)
+	sdb.dropReplicas(shard, ahead)
+	if err := sdb.writeLayout(sdb.Shards); err != nil {
+		fmt.Printf("Error recording promotion on shard %d: %v\n", shard.ID, err)
+	}
+	shard.replicate()
+	for _, member := range append(ahead, primary) {
+		sdb.retire(member, shard.Epoch)
+	}
+	sdb.repair(shard)
+
+	promotion := Promotion{ShardID: shard.ID, From: filepath.Base(primary.filename), To: filepath.Base(replica.filename), Reason: reason, At: time.Now()}
+	sdb.recordPromotion(promotion)
+	return promotion, true
+}
+
+// Function for adding a promotion to the history
+func (sdb *ShardedDB) recordPromotion(promotion Promotion) {
+	fmt.Printf("Promoted %s to primary of shard %d in place of %s: %s\n", promotion.To, promotion.ShardID, promotion.From, promotion.Reason)
+	sdb.healthLock.Lock()
+	defer sdb.healthLock.Unlock()
+	sdb.promotions = append(sdb.promotions, promotion)
+	if len(sdb.promotions) > promotionHistory {
+		sdb.promotions = sdb.promotions[len(sdb.promotions)-promotionHistory:]
+	}
+}
+
+// Function for taking the replicas that have failed out of the shard, new
+// ones take their place
+func (sdb *ShardedDB) dropFailedReplicas(shard *Shard, states map[*db]HealthState) {
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	dropped := []*db{}
+	for _, replica := range shard.Replicas {
+		if states[replica] == HealthFailed {
+			dropped = append(dropped, replica)
+			fmt.Printf("Dropped failed replica %s from shard %d: %s\n", replica.filename, shard.ID, replica.healthReport().LastError)
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+	sdb.dropReplicas(shard, dropped)
+	if err := sdb.writeLayout(sdb.Shards); err != nil {
+		fmt.Printf("Error recording dropped replicas on shard %d: %v\n", shard.ID, err)
+	}
+	for _, replica := range dropped {
+		sdb.retire(replica, shard.Epoch)
+	}
+}
+
+// Function for taking replicas out of the shard and listing them as
+// discarded, the caller records the new layout then retires them. Caller
+// holds the lock.
+func (sdb *ShardedDB) dropReplicas(shard *Shard, dropped []*db) {
+	kept := []*db{}
+	for _, replica := range shard.Replicas {
+		if !slices.Contains(dropped, replica) {
+			kept = append(kept, replica)
+		}
+	}
+	shard.Replicas = kept
+	for _, replica := range dropped {
+		shard.Database.unfollow(replica)
+		sdb.discard(replica.filename)
+	}
+}
+
+// Promotions made so far, oldest first
+func (sdb *ShardedDB) Promotions() []Promotion {
+	sdb.healthLock.Lock()
+	defer sdb.healthLock.Unlock()
+	return append([]Promotion{}, sdb.promotions...)
+}
+
+// Health of every shard's members as of their last probes
+func (sdb *ShardedDB) Health() []ShardHealth {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	shards := []ShardHealth{}
+	for _, shard := range sdb.Shards {
+		health := ShardHealth{ID: shard.ID, Primary: shard.Database.healthReport(), Replicas: []MemberHealth{}}
+		for _, replica := range shard.Replicas {
+			health.Replicas = append(health.Replicas, replica.healthReport())
+		}
+		shards = append(shards, health)
+	}
+	return shards
+}
+
+// Function for checking health every opts.Interval until stop is called
+func (sdb *ShardedDB) StartMonitoring(opts HealthOptions) (stop func()) {
+	opts = opts.withDefaults()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			sdb.CheckHealth(opts)
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe(t *testing.T) {
+	database := NewDb(filepath.Join(t.TempDir(), "probe"))
+	defer database.Close()
+	assert.NoError(t, database.probe(time.Second))
+
+	// A write that never finishes holds the lock, the engine doesn't answer
+	database.lock.Lock()
+	assert.ErrorIs(t, database.probe(10*time.Millisecond), ErrProbeTimeout)
+	database.lock.Unlock()
+
+	// The WAL segment being appended to is gone
+	segments, err := filepath.Glob(database.filename + "_wal.*")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(segments[0]))
+	assert.Error(t, database.probe(time.Second))
+}
+
+func TestHealthStates(t *testing.T) {
+	database := NewDb(filepath.Join(t.TempDir(), "states"))
+	opts := HealthOptions{Timeout: time.Second, SuspectAfter: 2, FailAfter: 3}
+	assert.Equal(t, HealthHealthy, database.checkHealth(opts))
+
+	require.NoError(t, database.Close())
+	assert.Equal(t, HealthHealthy, database.checkHealth(opts))
+	assert.Equal(t, HealthSuspect, database.checkHealth(opts))
+	assert.Equal(t, HealthFailed, database.checkHealth(opts))
+	report := database.healthReport()
+	assert.Equal(t, 3, report.Failures)
+	assert.Contains(t, report.LastError, "closed")
+}
+
+// Failed replicas aren't promoted, suspect ones only if there's nothing better
+func TestCheckHealthPromotion(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "promote")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, base, 2, DefaultOptions())
+	defer sdb.Close()
+	shard := sdb.Shards[0]
+	primary, first, second := shard.Database, shard.Replicas[0], shard.Replicas[1]
+	opts := HealthOptions{SuspectAfter: 1, FailAfter: 2}
+
+	require.NoError(t, primary.Close())
+	require.NoError(t, first.Close())
+	assert.Empty(t, sdb.CheckHealth(opts))
+	assert.Equal(t, HealthSuspect, sdb.ShardInfo()[0].Health)
+
+	promotions := sdb.CheckHealth(opts)
+	require.Len(t, promotions, 1)
+	assert.Equal(t, second, shard.Database)
+	assert.Equal(t, "promote_0_replica_1", promotions[0].To)
+	assert.Contains(t, promotions[0].Reason, "2 probes")
+	assert.Equal(t, promotions, sdb.Promotions())
+
+	// The promotion is in the shard map. The old primary is discarded, then
+	// forgotten once it's been retired in the background and its files are
+	// gone.
+	assert.Equal(t, "promote_0_replica_1", sdb.ShardMap().Shards[0].Primary)
+	require.Eventually(t, func() bool {
+		sdb.mapLock.Lock()
+		defer sdb.mapLock.Unlock()
+		return !slices.Contains(sdb.discarded, "promote_0")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, dbFilesExist(primary.filename))
+}
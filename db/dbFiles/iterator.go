@@ -0,0 +1,106 @@
+package db
+
+import (
+	"container/heap"
+)
+
+// Sorted stream of entries, used to walk memtables and SSTables together
+type entryIterator interface {
+	valid() bool
+	entry() memEntry
+	next()
+	err() error
+}
+
+// Iterator over entries copied out of a memtable
+type sliceIterator struct {
+	entries []memEntry
+	pos     int
+}
+
+func (it *sliceIterator) valid() bool     { return it.pos < len(it.entries) }
+func (it *sliceIterator) entry() memEntry { return it.entries[it.pos] }
+func (it *sliceIterator) next()           { it.pos++ }
+func (it *sliceIterator) err() error      { return nil }
+
+//  Merges several sorted iterators into one.
+//  Sources are passed newest first: when more than one has the same key only
+//  the newest entry comes out, the older ones are skipped.
+type mergingIterator struct {
+	sources []entryIterator
+	heap    mergeHeap
+	current memEntry
+	ok      bool
+	failure error
+}
+
+func newMergingIterator(sources []entryIterator) *mergingIterator {
+	it := &mergingIterator{sources: sources, heap: mergeHeap{sources: sources}}
+	for i, source := range sources {
+		if source.valid() {
+			it.heap.items = append(it.heap.items, i)
+		} else if source.err() != nil && it.failure == nil {
+			it.failure = source.err()
+		}
+	}
+	heap.Init(&it.heap)
+	it.next()
+	return it
+}
+
+func (it *mergingIterator) valid() bool     { return it.ok }
+func (it *mergingIterator) entry() memEntry { return it.current }
+func (it *mergingIterator) err() error      { return it.failure }
+
+func (it *mergingIterator) next() {
+	it.ok = false
+	if it.failure != nil || it.heap.Len() == 0 {
+		return
+	}
+	it.current = it.sources[it.heap.items[0]].entry()
+	it.ok = true
+	// Move every source past this key, the first one popped was the newest
+	for it.heap.Len() > 0 {
+		top := it.heap.items[0]
+		source := it.sources[top]
+		if source.entry().key != it.current.key {
+			break
+		}
+		source.next()
+		if source.valid() {
+			heap.Fix(&it.heap, 0)
+			continue
+		}
+		heap.Pop(&it.heap)
+		if source.err() != nil {
+			it.failure = source.err()
+			it.ok = false
+			return
+		}
+	}
+}
+
+// Heap of source indexes, smallest key first and newest source first on ties
+type mergeHeap struct {
+	sources []entryIterator
+	items   []int
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[h.items[i]].entry().key, h.sources[h.items[j]].entry().key
+	if a != b {
+		return a < b
+	}
+	return h.items[i] < h.items[j]
+}
+
+func (h *mergeHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(int)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
@@ -3,11 +3,28 @@ package db
 import (
 	"testing"
 	"os"
+	"path/filepath"
 	"github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/require"
 )
 
 
+// WAL files are segmented, remove all of them
+func removeWAL(filename string) {
+	segments, _ := filepath.Glob(filename + ".*")
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+}
+
+// Function for opening a sharded database the test fails without
+func mustOpenShardedDB(t *testing.T, ranges [][2]int, basedFilename string, replicas int, opts Options) *ShardedDB {
+	shardedDB, _, err := OpenShardedDB(ranges, basedFilename, replicas, opts)
+	require.NoError(t, err)
+	return shardedDB
+}
+
+
 func TestSetAndGet(t *testing.T) {
 	shardRanges := [][2]int{
 		{0, 9},
@@ -16,16 +33,16 @@ func TestSetAndGet(t *testing.T) {
 	}
 
 	
-	shardedDB := NewShardedDB(shardRanges, "shard_db", 2)
+	shardedDB := mustOpenShardedDB(t, shardRanges, filepath.Join(t.TempDir(), "shard_db"), 2, DefaultOptions())
 
 	// Set values
 	testCases := []struct {
-		key   int
+		key   string
 		value string
 	}{
-		{5, "low"},
-		{15, "medium"},
-		{25, "high"},
+		{"5", "low"},
+		{"15", "medium"},
+		{"25", "high"},
 	}
 
 	for _, tc := range testCases {
@@ -39,10 +56,10 @@ func TestSetAndGet(t *testing.T) {
 	for _, tc := range testCases {
 		value, err := shardedDB.Get(tc.key)
 		if err != nil {
-			t.Fatalf("Failed to get value for key %d: %v", tc.key, err)
+			t.Fatalf("Failed to get value for key %s: %v", tc.key, err)
 		}
 		if value != tc.value {
-			t.Fatalf("Expected value %s for key %d, got %s", tc.value, tc.key, value)
+			t.Fatalf("Expected value %s for key %s, got %s", tc.value, tc.key, value)
 		}
 	}
 }
@@ -55,22 +72,22 @@ func TestDelete(t *testing.T) {
 		{20, 29},
 	}
 
-	shardedDB := NewShardedDB(shardRanges, "shard_db", 2)
+	shardedDB := mustOpenShardedDB(t, shardRanges, filepath.Join(t.TempDir(), "shard_db"), 2, DefaultOptions())
 
 	// Set a value
-	err := shardedDB.Set(15, "medium")
+	err := shardedDB.Set("15", "medium")
 	if err != nil {
 		t.Fatalf("Failed to set value: %v", err)
 	}
 
 	// Delete the value
-	err = shardedDB.Delete(15)
+	err = shardedDB.Delete("15")
 	if err != nil {
 		t.Fatalf("Failed to delete value: %v", err)
 	}
 
 	// Verify deletion
-	_, err = shardedDB.Get(15)
+	_, err = shardedDB.Get("15")
 	if err == nil {
 		t.Fatalf("Expected error for getting deleted key, got nil")
 	}
@@ -88,16 +105,16 @@ func TestSharding(t *testing.T) {
         {20, 29},
     }
 
-    shardedDB := NewShardedDB(shardRanges, "shard_db", 2)
+    shardedDB := mustOpenShardedDB(t, shardRanges, filepath.Join(t.TempDir(), "shard_db"), 2, DefaultOptions())
 
     // Set values in different shards
     testCases := []struct {
-        key   int
+        key   string
         value string
     }{
-        {5, "low"},
-        {15, "medium"},
-        {25, "high"},
+        {"5", "low"},
+        {"15", "medium"},
+        {"25", "high"},
     }
 
     for _, tc := range testCases {
@@ -111,10 +128,10 @@ func TestSharding(t *testing.T) {
     for _, tc := range testCases {
         value, err := shardedDB.Get(tc.key)
         if err != nil {
-            t.Fatalf("Failed to get value for key %d: %v", tc.key, err)
+            t.Fatalf("Failed to get value for key %s: %v", tc.key, err)
         }
         if value != tc.value {
-            t.Fatalf("Expected value %s for key %d, got %s", tc.value, tc.key, value)
+            t.Fatalf("Expected value %s for key %s, got %s", tc.value, tc.key, value)
         }
     }
 }
@@ -124,7 +141,7 @@ func TestSharding(t *testing.T) {
 func TestWriteAheadLog(t *testing.T) {
     // Clean up any existing test files
     os.Remove("test_database_file")
-    os.Remove("test_database_file_wal")
+    removeWAL("test_database_file_wal")
 
     // Initialize the database
     db := NewDb("test_database_file")
@@ -163,16 +180,15 @@ func TestWriteAheadLog(t *testing.T) {
 
     // Clean up test files
     os.Remove("test_database_file")
-    os.Remove("test_database_file_wal")
+    removeWAL("test_database_file_wal")
 }
 func TestMonitorShards(t *testing.T) {
     // Create primary and replica databases
     primary := NewDb("primary.db")
-    err := primary.Set("healthcheck", "ok")
-    require.NoError(t, err)
-
     replica1 := NewDb("replica1.db")
     replica2 := NewDb("replica2.db")
+    defer replica1.Close()
+    defer replica2.Close()
 
     shard := &Shard{
         Database: primary,
@@ -183,11 +199,18 @@ func TestMonitorShards(t *testing.T) {
         Shards: []*Shard{shard},
     }
 
-    // Simulate shard failure by deleting the healthcheck key
-    err = primary.Delete("healthcheck")
-    require.NoError(t, err)
-
-    // Monitor and promote replica
+    // An empty shard is a healthy one
+    sdb.MonitorShards()
+    assert.Equal(t, primary, shard.Database)
+
+    // Simulate shard failure by closing the primary's WAL, it takes a few
+    // failed probes in a row to give up on it
+    require.NoError(t, primary.Close())
+    for i := 1; i < DefaultFailAfter; i++ {
+        sdb.MonitorShards()
+        assert.Equal(t, primary, shard.Database)
+        assert.Equal(t, HealthSuspect, primary.healthState())
+    }
     sdb.MonitorShards()
 
     // Assert that the primary database is promoted from replicas
@@ -196,5 +219,11 @@ func TestMonitorShards(t *testing.T) {
     // Ensure the replica1 is no longer in the replica list
     require.Len(t, shard.Replicas, 1)
     assert.Equal(t, replica2, shard.Replicas[0])
+
+    promotions := sdb.Promotions()
+    require.Len(t, promotions, 1)
+    assert.Equal(t, "primary.db", promotions[0].From)
+    assert.Equal(t, "replica1.db", promotions[0].To)
+    assert.Contains(t, promotions[0].Reason, "closed")
 }
 
@@ -0,0 +1,657 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const lsmLevels = 7
+
+//  Settings for the LSM engine.
+//  MemtableSize is how big the memtable gets before it's flushed to L0
+//  BlockSize is the target size of an SSTable data block
+//  TableSize is the target size of the tables compaction writes
+//  L0CompactionTrigger is how many L0 tables start a compaction into L1
+//  LevelSizeBase is the size L1 can reach, each level after is 10x the last
+// BloomFalsePositiveRate is what each table's bloom filter is sized for
+type LSMOptions struct {
+	MemtableSize           int
+	BlockSize              int
+	TableSize              int64
+	L0CompactionTrigger    int
+	LevelSizeBase          int64
+	BloomFalsePositiveRate float64
+}
+
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		MemtableSize:           4 << 20,
+		BlockSize:              4 << 10,
+		TableSize:              2 << 20,
+		L0CompactionTrigger:    4,
+		LevelSizeBase:          10 << 20,
+		BloomFalsePositiveRate: DefaultBloomFalsePositiveRate,
+	}
+}
+
+func (opts LSMOptions) withDefaults() LSMOptions {
+	defaults := DefaultLSMOptions()
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaults.MemtableSize
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaults.BlockSize
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = defaults.TableSize
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if opts.LevelSizeBase <= 0 {
+		opts.LevelSizeBase = defaults.LevelSizeBase
+	}
+	if opts.BloomFalsePositiveRate <= 0 || opts.BloomFalsePositiveRate >= 1 {
+		opts.BloomFalsePositiveRate = defaults.BloomFalsePositiveRate
+	}
+	return opts
+}
+
+// What's persisted in <filename>.lsm/MANIFEST: the tables on each level, by
+// file number, and the LSN the flushed state covers
+type lsmManifest struct {
+	LastLSN  uint64     `json:"last_lsn"`
+	NextFile uint64     `json:"next_file"`
+	Levels   [][]uint64 `json:"levels"`
+}
+
+//  Log-structured merge tree engine.
+//  Writes go to a sorted memtable (durable through the db's WAL), full
+//  memtables are flushed to immutable SSTables on L0, and a background
+//  compaction merges them down into the larger, non-overlapping levels.
+//  Deletes are tombstones until compaction reaches the bottom of the tree.
+//
+//  levels[0] is newest first and its tables may overlap, every other level is
+//  sorted by key with no overlaps. imm is a full memtable being flushed.
+type lsmEngine struct {
+	lock     sync.RWMutex
+	dir      string
+	opts     Options
+	lsmOpts  LSMOptions
+	mem      *memtable
+	imm      *memtable
+	levels   [lsmLevels][]*sstable
+	nextFile uint64
+	lastLSN  uint64
+
+	// flushLock keeps one flush (or Snapshot) going at a time
+	flushLock sync.Mutex
+	work      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closed    bool
+}
+
+func openLSMEngine(filename string, opts Options) (StorageEngine, uint64, error) {
+	opts = opts.withDefaults()
+	engine := &lsmEngine{
+		dir:     filename + ".lsm",
+		opts:    opts,
+		lsmOpts: opts.LSM.withDefaults(),
+		mem:     newMemtable(),
+		work:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if err := os.MkdirAll(engine.dir, 0755); err != nil {
+		return nil, 0, err
+	}
+	if err := engine.loadManifest(); err != nil {
+		engine.releaseTables()
+		return nil, 0, err
+	}
+	engine.wg.Add(1)
+	go engine.background()
+	engine.schedule()
+	return engine, engine.lastLSN, nil
+}
+
+func (engine *lsmEngine) tableName(id uint64) string {
+	return filepath.Join(engine.dir, fmt.Sprintf("%06d.sst", id))
+}
+
+func (engine *lsmEngine) manifestName() string {
+	return filepath.Join(engine.dir, "MANIFEST")
+}
+
+// Function for opening the tables the manifest lists and removing any table
+// files it doesn't, left over from a flush or compaction that never finished
+func (engine *lsmEngine) loadManifest() error {
+	manifest := lsmManifest{NextFile: 1}
+	data, err := ioutil.ReadFile(engine.manifestName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("lsm manifest %s: %w", engine.manifestName(), err)
+		}
+	}
+	engine.lastLSN = manifest.LastLSN
+	engine.nextFile = manifest.NextFile
+
+	live := make(map[uint64]bool)
+	for level, ids := range manifest.Levels {
+		if level >= lsmLevels {
+			return fmt.Errorf("lsm manifest %s: too many levels", engine.manifestName())
+		}
+		for _, id := range ids {
+			table, err := openSSTable(engine.tableName(id), id, engine.opts.BlockCache)
+			if err != nil {
+				return err
+			}
+			live[id] = true
+			engine.levels[level] = append(engine.levels[level], table)
+		}
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(engine.dir, "*.sst"))
+	for _, match := range matches {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(match), ".sst"), 10, 64)
+		if err == nil && !live[id] {
+			os.Remove(match)
+		}
+	}
+	return nil
+}
+
+// Function for persisting the current set of tables, caller holds the lock
+func (engine *lsmEngine) writeManifest() error {
+	manifest := lsmManifest{LastLSN: engine.lastLSN, NextFile: engine.nextFile}
+	for _, tables := range engine.levels {
+		ids := []uint64{}
+		for _, table := range tables {
+			ids = append(ids, table.id)
+		}
+		manifest.Levels = append(manifest.Levels, ids)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(engine.manifestName(), data, engine.opts.Durability != DurabilityNone)
+}
+
+func (engine *lsmEngine) Put(key, value string) error {
+	return engine.write(key, value, false)
+}
+
+func (engine *lsmEngine) Delete(key string) error {
+	return engine.write(key, "", true)
+}
+
+func (engine *lsmEngine) write(key, value string, tombstone bool) error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if engine.closed {
+		return fmt.Errorf("lsm engine %s is closed", engine.dir)
+	}
+	engine.mem.put(key, value, tombstone)
+	if engine.mem.size >= engine.lsmOpts.MemtableSize && engine.imm == nil {
+		engine.imm = engine.mem
+		engine.mem = newMemtable()
+		engine.schedule()
+	}
+	return nil
+}
+
+func (engine *lsmEngine) Get(key string) (string, error) {
+	engine.lock.RLock()
+	for _, mt := range []*memtable{engine.mem, engine.imm} {
+		if mt == nil {
+			continue
+		}
+		if entry, found := mt.get(key); found {
+			engine.lock.RUnlock()
+			return entryValueOrNotFound(entry)
+		}
+	}
+	// Tables that could hold the key, in the order they have to be checked
+	candidates := []*sstable{}
+	candidates = append(candidates, engine.levels[0]...)
+	for level := 1; level < lsmLevels; level++ {
+		tables := engine.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+		if i < len(tables) && tables[i].smallest <= key {
+			candidates = append(candidates, tables[i])
+		}
+	}
+	for _, table := range candidates {
+		table.ref()
+	}
+	engine.lock.RUnlock()
+	defer func() {
+		for _, table := range candidates {
+			table.unref()
+		}
+	}()
+
+	for _, table := range candidates {
+		entry, found, err := table.get(key)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return entryValueOrNotFound(entry)
+		}
+	}
+	return "", ErrNotFound
+}
+
+func entryValueOrNotFound(entry memEntry) (string, error) {
+	if entry.tombstone {
+		return "", ErrNotFound
+	}
+	return entry.value, nil
+}
+
+// Goes in key order
+func (engine *lsmEngine) Iterate(fn func(key, value string) bool) error {
+	return engine.IterateFrom("", fn)
+}
+
+func (engine *lsmEngine) IterateFrom(start string, fn func(key, value string) bool) error {
+	it, release := engine.newIterator(start)
+	defer release()
+	for ; it.valid(); it.next() {
+		entry := it.entry()
+		if entry.tombstone {
+			continue
+		}
+		if !fn(entry.key, entry.value) {
+			break
+		}
+	}
+	return it.err()
+}
+
+// Function for getting a consistent view of the whole tree from start on.
+// The memtables are copied so writes can carry on, the tables are held until
+// release is called.
+func (engine *lsmEngine) newIterator(start string) (*mergingIterator, func()) {
+	engine.lock.RLock()
+	sources := []entryIterator{}
+	for _, mt := range []*memtable{engine.mem, engine.imm} {
+		if mt == nil {
+			continue
+		}
+		entries := []memEntry{}
+		for it := mt.iterator(start); it.valid(); it.next() {
+			entries = append(entries, it.entry())
+		}
+		sources = append(sources, &sliceIterator{entries: entries})
+	}
+	held := []*sstable{}
+	for _, tables := range engine.levels {
+		for _, table := range tables {
+			table.ref()
+			held = append(held, table)
+		}
+	}
+	engine.lock.RUnlock()
+
+	for _, table := range held {
+		sources = append(sources, table.iterator(start))
+	}
+	release := func() {
+		for _, table := range held {
+			table.unref()
+		}
+	}
+	return newMergingIterator(sources), release
+}
+
+// Flushes the memtable and records that the tables cover the WAL up to lsn
+func (engine *lsmEngine) Snapshot(lsn uint64) (uint64, error) {
+	engine.flushLock.Lock()
+	defer engine.flushLock.Unlock()
+	// If a full memtable was already waiting, the first flush only gets that one
+	for i := 0; i < 2; i++ {
+		rotated, err := engine.flush(true)
+		if err != nil {
+			return 0, err
+		}
+		if rotated {
+			break
+		}
+	}
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if lsn > engine.lastLSN {
+		engine.lastLSN = lsn
+	}
+	if err := engine.writeManifest(); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+func (engine *lsmEngine) Close() error {
+	engine.lock.Lock()
+	if engine.closed {
+		engine.lock.Unlock()
+		return nil
+	}
+	engine.closed = true
+	engine.lock.Unlock()
+	close(engine.done)
+	engine.wg.Wait()
+	engine.releaseTables()
+	return nil
+}
+
+func (engine *lsmEngine) releaseTables() {
+	for level := range engine.levels {
+		for _, table := range engine.levels[level] {
+			table.unref()
+		}
+		engine.levels[level] = nil
+	}
+}
+
+// Function for waking up the background goroutine
+func (engine *lsmEngine) schedule() {
+	select {
+	case engine.work <- struct{}{}:
+	default:
+	}
+}
+
+// Flushes full memtables and compacts until there's nothing left to do
+func (engine *lsmEngine) background() {
+	defer engine.wg.Done()
+	for {
+		select {
+		case <-engine.done:
+			return
+		case <-engine.work:
+		}
+		engine.flushLock.Lock()
+		_, err := engine.flush(false)
+		engine.flushLock.Unlock()
+		if err != nil {
+			fmt.Printf("LSM flush in %s failed: %v\n", engine.dir, err)
+			continue
+		}
+		for {
+			select {
+			case <-engine.done:
+				return
+			default:
+			}
+			compacted, err := engine.compact()
+			if err != nil {
+				fmt.Printf("LSM compaction in %s failed: %v\n", engine.dir, err)
+				break
+			}
+			if !compacted {
+				break
+			}
+		}
+	}
+}
+
+// Function for writing the immutable memtable out as an L0 table.
+// With force the active memtable is rotated out and flushed if there's no
+// immutable one already, returns whether that happened (or it was empty).
+// Caller holds flushLock.
+func (engine *lsmEngine) flush(force bool) (bool, error) {
+	engine.lock.Lock()
+	rotated := false
+	if engine.imm == nil && force {
+		rotated = true
+		if engine.mem.count > 0 {
+			engine.imm = engine.mem
+			engine.mem = newMemtable()
+		}
+	}
+	imm := engine.imm
+	id := engine.nextFile
+	if imm != nil {
+		engine.nextFile++
+	}
+	engine.lock.Unlock()
+	if imm == nil {
+		return rotated, nil
+	}
+
+	table, err := engine.writeTable(id, imm.iterator(""), false)
+	if err != nil {
+		return false, err
+	}
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.levels[0] = append([]*sstable{table}, engine.levels[0]...)
+	engine.imm = nil
+	if err := engine.writeManifest(); err != nil {
+		return false, err
+	}
+	// Writes kept coming during the flush and may have filled the memtable again
+	if engine.mem.size >= engine.lsmOpts.MemtableSize {
+		engine.imm = engine.mem
+		engine.mem = newMemtable()
+	}
+	engine.schedule()
+	return rotated, nil
+}
+
+// Function for writing every entry of it to a single new table.
+// Tombstones are left out when dropTombstones is set.
+func (engine *lsmEngine) writeTable(id uint64, it entryIterator, dropTombstones bool) (*sstable, error) {
+	writer, err := engine.newTableWriter(id)
+	if err != nil {
+		return nil, err
+	}
+	for ; it.valid(); it.next() {
+		if dropTombstones && it.entry().tombstone {
+			continue
+		}
+		if err := writer.add(it.entry()); err != nil {
+			writer.abort()
+			return nil, err
+		}
+	}
+	if it.err() != nil {
+		writer.abort()
+		return nil, it.err()
+	}
+	if err := writer.finish(engine.opts.Durability != DurabilityNone); err != nil {
+		os.Remove(engine.tableName(id))
+		return nil, err
+	}
+	return openSSTable(engine.tableName(id), id, engine.opts.BlockCache)
+}
+
+func (engine *lsmEngine) newTableWriter(id uint64) (*sstableWriter, error) {
+	return newSSTableWriter(engine.tableName(id), engine.lsmOpts.BlockSize, engine.lsmOpts.BloomFalsePositiveRate)
+}
+
+// Most bytes a level can hold before it's compacted into the next one
+func (engine *lsmEngine) maxLevelBytes(level int) int64 {
+	size := engine.lsmOpts.LevelSizeBase
+	for i := 1; i < level; i++ {
+		size *= 10
+	}
+	return size
+}
+
+func levelBytes(tables []*sstable) int64 {
+	var total int64
+	for _, table := range tables {
+		total += table.size
+	}
+	return total
+}
+
+func overlapping(tables []*sstable, smallest, largest string) []*sstable {
+	result := []*sstable{}
+	for _, table := range tables {
+		if table.largest >= smallest && table.smallest <= largest {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+func keyRange(tables []*sstable) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, table := range tables[1:] {
+		if table.smallest < smallest {
+			smallest = table.smallest
+		}
+		if table.largest > largest {
+			largest = table.largest
+		}
+	}
+	return smallest, largest
+}
+
+// Function for running one compaction if any level needs it.
+// L0 is compacted once it has L0CompactionTrigger tables, every other level
+// once it's over its size budget. Returns whether anything was done.
+func (engine *lsmEngine) compact() (bool, error) {
+	engine.lock.RLock()
+	level := -1
+	var inputs []*sstable
+	if len(engine.levels[0]) >= engine.lsmOpts.L0CompactionTrigger {
+		level = 0
+		inputs = append(inputs, engine.levels[0]...)
+	} else {
+		for l := 1; l < lsmLevels-1; l++ {
+			if levelBytes(engine.levels[l]) > engine.maxLevelBytes(l) {
+				level = l
+				// The largest table frees up the most room
+				largest := engine.levels[l][0]
+				for _, table := range engine.levels[l] {
+					if table.size > largest.size {
+						largest = table
+					}
+				}
+				inputs = []*sstable{largest}
+				break
+			}
+		}
+	}
+	if level < 0 {
+		engine.lock.RUnlock()
+		return false, nil
+	}
+	smallest, largest := keyRange(inputs)
+	targets := overlapping(engine.levels[level+1], smallest, largest)
+	// Nothing deeper holds these keys, so tombstones have nothing left to hide
+	bottom := true
+	for l := level + 2; l < lsmLevels; l++ {
+		if len(overlapping(engine.levels[l], smallest, largest)) > 0 {
+			bottom = false
+		}
+	}
+	engine.lock.RUnlock()
+
+	// Newest first: the level being compacted shadows the one below it
+	sources := []entryIterator{}
+	for _, table := range append(append([]*sstable{}, inputs...), targets...) {
+		sources = append(sources, table.iterator(""))
+	}
+	outputs, err := engine.writeTables(newMergingIterator(sources), bottom)
+	if err != nil {
+		return false, err
+	}
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if engine.closed {
+		for _, table := range outputs {
+			table.retire()
+		}
+		return false, nil
+	}
+	engine.levels[level] = without(engine.levels[level], inputs)
+	next := append(without(engine.levels[level+1], targets), outputs...)
+	sort.Slice(next, func(i, j int) bool { return next[i].smallest < next[j].smallest })
+	engine.levels[level+1] = next
+	if err := engine.writeManifest(); err != nil {
+		return false, err
+	}
+	for _, table := range append(inputs, targets...) {
+		table.retire()
+	}
+	return true, nil
+}
+
+// Function for writing a merged stream out as tables of about TableSize each
+func (engine *lsmEngine) writeTables(it entryIterator, dropTombstones bool) ([]*sstable, error) {
+	outputs := []*sstable{}
+	fail := func(err error) ([]*sstable, error) {
+		for _, table := range outputs {
+			table.retire()
+		}
+		return nil, err
+	}
+	for it.valid() {
+		engine.lock.Lock()
+		id := engine.nextFile
+		engine.nextFile++
+		engine.lock.Unlock()
+
+		writer, err := engine.newTableWriter(id)
+		if err != nil {
+			return fail(err)
+		}
+		for ; it.valid() && int64(writer.size()) < engine.lsmOpts.TableSize; it.next() {
+			if dropTombstones && it.entry().tombstone {
+				continue
+			}
+			if err := writer.add(it.entry()); err != nil {
+				writer.abort()
+				return fail(err)
+			}
+		}
+		if writer.count == 0 {
+			writer.abort()
+			continue
+		}
+		if err := writer.finish(engine.opts.Durability != DurabilityNone); err != nil {
+			os.Remove(engine.tableName(id))
+			return fail(err)
+		}
+		table, err := openSSTable(engine.tableName(id), id, engine.opts.BlockCache)
+		if err != nil {
+			return fail(err)
+		}
+		outputs = append(outputs, table)
+	}
+	if it.err() != nil {
+		return fail(it.err())
+	}
+	return outputs, nil
+}
+
+func without(tables, remove []*sstable) []*sstable {
+	removed := make(map[*sstable]bool)
+	for _, table := range remove {
+		removed[table] = true
+	}
+	result := []*sstable{}
+	for _, table := range tables {
+		if !removed[table] {
+			result = append(result, table)
+		}
+	}
+	return result
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Small enough that a few hundred keys go through flushes and compactions
+func smallLSMOptions() Options {
+	return Options{
+		Engine: "lsm",
+		LSM: LSMOptions{
+			MemtableSize:        2 << 10,
+			BlockSize:           256,
+			TableSize:           4 << 10,
+			L0CompactionTrigger: 2,
+			LevelSizeBase:       8 << 10,
+		},
+	}.withDefaults()
+}
+
+func openTestLSM(t *testing.T, filename string) *lsmEngine {
+	engine, _, err := openLSMEngine(filename, smallLSMOptions())
+	require.NoError(t, err)
+	return engine.(*lsmEngine)
+}
+
+// Waits for the background goroutine to run out of work
+func waitForCompaction(t *testing.T, engine *lsmEngine) {
+	assert.Eventually(t, func() bool {
+		engine.lock.RLock()
+		defer engine.lock.RUnlock()
+		return engine.imm == nil && len(engine.levels[0]) < engine.lsmOpts.L0CompactionTrigger
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestLSMFlushAndCompaction(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestLSM(t, filename)
+
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 400; i++ {
+			key := fmt.Sprintf("key%05d", (i*7919)%400)
+			value := fmt.Sprintf("value-%d-%d", round, i)
+			expected[key] = value
+			require.NoError(t, engine.Put(key, value))
+		}
+	}
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+	waitForCompaction(t, engine)
+
+	engine.lock.RLock()
+	deeper := 0
+	for level := 1; level < lsmLevels; level++ {
+		deeper += len(engine.levels[level])
+		// Levels below L0 never overlap
+		tables := engine.levels[level]
+		for i := 1; i < len(tables); i++ {
+			assert.Less(t, tables[i-1].largest, tables[i].smallest)
+		}
+	}
+	engine.lock.RUnlock()
+	assert.Greater(t, deeper, 0, "nothing was compacted out of L0")
+
+	for key, value := range expected {
+		got, err := engine.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+	}
+
+	// Iterate goes in key order
+	previous := ""
+	count := 0
+	require.NoError(t, engine.Iterate(func(key, value string) bool {
+		assert.Less(t, previous, key)
+		assert.Equal(t, expected[key], value)
+		previous = key
+		count++
+		return true
+	}))
+	assert.Equal(t, len(expected), count)
+
+	require.NoError(t, engine.Close())
+	reopened := openTestLSM(t, filename)
+	defer reopened.Close()
+	for key, value := range expected {
+		got, err := reopened.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+	}
+}
+
+func TestLSMTombstones(t *testing.T) {
+	engine := openTestLSM(t, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+
+	for i := 0; i < 300; i++ {
+		require.NoError(t, engine.Put(fmt.Sprintf("key%05d", i), "value"))
+	}
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+	// The deletes land in newer tables than the values they hide
+	for i := 0; i < 300; i += 2 {
+		require.NoError(t, engine.Delete(fmt.Sprintf("key%05d", i)))
+	}
+	_, err = engine.Snapshot(2)
+	require.NoError(t, err)
+	waitForCompaction(t, engine)
+
+	for i := 0; i < 300; i++ {
+		_, err := engine.Get(fmt.Sprintf("key%05d", i))
+		if i%2 == 0 {
+			assert.Equal(t, ErrNotFound, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	// Once compacted to the bottom the tombstones themselves are gone
+	for i := 0; i < 600; i++ {
+		require.NoError(t, engine.Put(fmt.Sprintf("filler%05d", i), "value"))
+	}
+	_, err = engine.Snapshot(3)
+	require.NoError(t, err)
+	waitForCompaction(t, engine)
+	it, release := engine.newIterator("")
+	defer release()
+	for ; it.valid(); it.next() {
+		if it.entry().tombstone {
+			engine.lock.RLock()
+			l0 := len(engine.levels[0])
+			engine.lock.RUnlock()
+			// Tombstones can only still be sitting in L0 or the memtable
+			assert.Greater(t, l0, 0, "tombstone for %s left after compaction", it.entry().key)
+		}
+	}
+	require.NoError(t, it.err())
+}
+
+// Tables from a flush or compaction that never made it into the manifest
+// are cleaned up on open
+func TestLSMRemovesOrphanTables(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "engine")
+	engine := openTestLSM(t, filename)
+	require.NoError(t, engine.Put("a", "1"))
+	_, err := engine.Snapshot(1)
+	require.NoError(t, err)
+	require.NoError(t, engine.Close())
+
+	orphan := filepath.Join(filename+".lsm", "999999.sst")
+	require.NoError(t, os.WriteFile(orphan, []byte("half written"), 0644))
+
+	reopened := openTestLSM(t, filename)
+	defer reopened.Close()
+	assert.NoFileExists(t, orphan)
+	value, err := reopened.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, "1", value)
+}
+
+func TestLSMConcurrentReadsAndWrites(t *testing.T) {
+	engine := openTestLSM(t, filepath.Join(t.TempDir(), "engine"))
+	defer engine.Close()
+
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("w%d-key%05d", writer, i)
+				assert.NoError(t, engine.Put(key, key))
+				value, err := engine.Get(key)
+				assert.NoError(t, err)
+				assert.Equal(t, key, value)
+			}
+		}(writer)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, engine.Iterate(func(key, value string) bool { return true }))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	filter := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		filter.add(fmt.Sprintf("key%05d", i))
+	}
+	decoded := decodeBloomFilter(filter.encode())
+	for i := 0; i < 10000; i++ {
+		require.True(t, decoded.mayContain(fmt.Sprintf("key%05d", i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if decoded.mayContain(fmt.Sprintf("missing%05d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+}
+
+func TestLSMBlockCache(t *testing.T) {
+	opts := smallLSMOptions()
+	opts.BlockCache = NewBlockCache(1 << 20)
+	engine, _, err := openLSMEngine(filepath.Join(t.TempDir(), "engine"), opts)
+	require.NoError(t, err)
+	lsm := engine.(*lsmEngine)
+	defer lsm.Close()
+
+	for i := 0; i < 400; i += 2 {
+		require.NoError(t, lsm.Put(fmt.Sprintf("key%05d", i), "value"))
+	}
+	_, err = lsm.Snapshot(1)
+	require.NoError(t, err)
+	waitForCompaction(t, lsm)
+
+	// Keys that were never written are ruled out by the filters without
+	// reading a block
+	before := opts.BlockCache.Stats()
+	for i := 1; i < 400; i += 2 {
+		_, err := lsm.Get(fmt.Sprintf("key%05d", i))
+		assert.Equal(t, ErrNotFound, err)
+	}
+	after := opts.BlockCache.Stats()
+	assert.Less(t, (after.Hits+after.Misses)-(before.Hits+before.Misses), uint64(20))
+
+	// The second read of a key comes out of the cache
+	_, err = lsm.Get("key00100")
+	require.NoError(t, err)
+	before = opts.BlockCache.Stats()
+	_, err = lsm.Get("key00100")
+	require.NoError(t, err)
+	after = opts.BlockCache.Stats()
+	assert.Equal(t, before.Hits+1, after.Hits)
+	assert.Equal(t, before.Misses, after.Misses)
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	cache := NewBlockCache(1000)
+	for i := uint64(0); i < 10; i++ {
+		cache.put(blockCacheKey{table: 1, offset: i * 300}, make([]byte, 300))
+	}
+	stats := cache.Stats()
+	assert.LessOrEqual(t, stats.Size, stats.Capacity)
+	assert.Equal(t, uint64(7), stats.Evictions)
+
+	// Least recently used goes first
+	_, found := cache.get(blockCacheKey{table: 1, offset: 7 * 300})
+	assert.True(t, found)
+	cache.put(blockCacheKey{table: 2, offset: 0}, make([]byte, 300))
+	_, found = cache.get(blockCacheKey{table: 1, offset: 8 * 300})
+	assert.False(t, found)
+	_, found = cache.get(blockCacheKey{table: 1, offset: 7 * 300})
+	assert.True(t, found)
+}
+
+func TestShardedDBSharesBlockCache(t *testing.T) {
+	opts := smallLSMOptions()
+	base := filepath.Join(t.TempDir(), "sharded")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 1, opts)
+	defer sdb.Close()
+
+	cache := sdb.Shards[0].Database.opts.BlockCache
+	require.NotNil(t, cache)
+	for _, shard := range sdb.Shards {
+		for _, member := range shard.members() {
+			assert.Same(t, cache, member.opts.BlockCache)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"))
+	}
+	for i := 0; i < 200; i++ {
+		_, err := sdb.Get(strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(DefaultBlockCacheSize), sdb.CacheStats().Capacity)
+}
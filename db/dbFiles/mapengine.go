@@ -0,0 +1,120 @@
+package db
+
+import (
+	"sync"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/proto"
+)
+
+//  The original engine: everything in a map, persisted as a protobuf
+//  Database message written out whole as a snapshot generation.
+//  snapshotLock keeps generations from being written concurrently.
+type mapEngine struct {
+	*Database
+	lock         sync.RWMutex
+	snapshotLock sync.Mutex
+	filename     string
+	opts         Options
+}
+
+func openMapEngine(filename string, opts Options) (StorageEngine, uint64, error) {
+	engine := &mapEngine{
+		Database: &Database{Store: make(map[string]string)},
+		filename: filename,
+		opts:     opts.withDefaults(),
+	}
+	snapshot, err := engine.readSnapshot()
+	if err != nil {
+		return nil, 0, err
+	}
+	if snapshot != nil {
+		if snapshot.Store == nil {
+			snapshot.Store = make(map[string]string)
+		}
+		for i, key := range snapshot.BinaryKeys {
+			snapshot.Store[string(key)] = string(snapshot.BinaryValues[i])
+		}
+		snapshot.BinaryKeys, snapshot.BinaryValues = nil, nil
+		engine.Database = snapshot
+	}
+	return engine, engine.LastLsn, nil
+}
+
+func (engine *mapEngine) Get(key string) (string, error) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	value, exists := engine.Store[key]
+	if !exists {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (engine *mapEngine) Put(key, value string) error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.Store[key] = value
+	return nil
+}
+
+func (engine *mapEngine) Delete(key string) error {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	delete(engine.Store, key)
+	return nil
+}
+
+// Goes in map order, so no order at all
+func (engine *mapEngine) Iterate(fn func(key, value string) bool) error {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	for key, value := range engine.Store {
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (engine *mapEngine) Snapshot(lsn uint64) (uint64, error) {
+	engine.snapshotLock.Lock()
+	defer engine.snapshotLock.Unlock()
+	engine.lock.Lock()
+	engine.LastLsn = lsn
+	data, err := proto.Marshal(engine.snapshotMessage())
+	engine.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return engine.writeSnapshot(data, lsn)
+}
+
+// Keys and values that aren't valid UTF-8 can't go in the Store map,
+// proto3 strings have to be, so they're written as bytes instead
+func (engine *mapEngine) snapshotMessage() *Database {
+	binary := false
+	for key, value := range engine.Store {
+		if !utf8.ValidString(key) || !utf8.ValidString(value) {
+			binary = true
+			break
+		}
+	}
+	if !binary {
+		return engine.Database
+	}
+	message := &Database{Store: make(map[string]string, len(engine.Store)), LastLsn: engine.LastLsn}
+	for key, value := range engine.Store {
+		if utf8.ValidString(key) && utf8.ValidString(value) {
+			message.Store[key] = value
+		} else {
+			message.BinaryKeys = append(message.BinaryKeys, []byte(key))
+			message.BinaryValues = append(message.BinaryValues, []byte(value))
+		}
+	}
+	return message
+}
+
+func (engine *mapEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxHeight = 12
+	// Rough per-entry bookkeeping cost, counted towards the memtable size
+	memtableEntryOverhead = 32
+)
+
+// One key in the memtable. A tombstone records a delete, it has to shadow
+// older values for the key in the SSTables.
+type memEntry struct {
+	key       string
+	value     string
+	tombstone bool
+}
+
+type skipNode struct {
+	entry memEntry
+	next  []*skipNode
+}
+
+// Sorted in-memory table for the LSM engine, a plain skiplist.
+// Not safe for concurrent use, the engine's lock covers it.
+// The data in it is only durable through the db's WAL until it's flushed
+// to an SSTable.
+type memtable struct {
+	head   *skipNode
+	height int
+	size   int
+	count  int
+	rand   *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:   &skipNode{next: make([]*skipNode, skiplistMaxHeight)},
+		height: 1,
+		rand:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (mt *memtable) randomHeight() int {
+	height := 1
+	for height < skiplistMaxHeight && mt.rand.Intn(4) == 0 {
+		height++
+	}
+	return height
+}
+
+// Function for finding the last node before key on every level
+func (mt *memtable) findPrev(key string) [skiplistMaxHeight]*skipNode {
+	var prev [skiplistMaxHeight]*skipNode
+	node := mt.head
+	for level := mt.height - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.key < key {
+			node = node.next[level]
+		}
+		prev[level] = node
+	}
+	return prev
+}
+
+func (mt *memtable) put(key, value string, tombstone bool) {
+	prev := mt.findPrev(key)
+	if next := prev[0].next[0]; next != nil && next.entry.key == key {
+		mt.size += len(value) - len(next.entry.value)
+		next.entry.value = value
+		next.entry.tombstone = tombstone
+		return
+	}
+
+	height := mt.randomHeight()
+	for level := mt.height; level < height; level++ {
+		prev[level] = mt.head
+	}
+	if height > mt.height {
+		mt.height = height
+	}
+	node := &skipNode{
+		entry: memEntry{key: key, value: value, tombstone: tombstone},
+		next:  make([]*skipNode, height),
+	}
+	for level := 0; level < height; level++ {
+		node.next[level] = prev[level].next[level]
+		prev[level].next[level] = node
+	}
+	mt.size += len(key) + len(value) + memtableEntryOverhead
+	mt.count++
+}
+
+// Returns the entry for key and whether the memtable has one at all
+func (mt *memtable) get(key string) (memEntry, bool) {
+	next := mt.findPrev(key)[0].next[0]
+	if next != nil && next.entry.key == key {
+		return next.entry, true
+	}
+	return memEntry{}, false
+}
+
+// Iterator over the memtable in key order, starting at the first key >= start
+func (mt *memtable) iterator(start string) *memtableIterator {
+	return &memtableIterator{node: mt.findPrev(start)[0].next[0]}
+}
+
+type memtableIterator struct {
+	node *skipNode
+}
+
+func (it *memtableIterator) valid() bool     { return it.node != nil }
+func (it *memtableIterator) entry() memEntry { return it.node.entry }
+func (it *memtableIterator) next()           { it.node = it.node.next[0] }
+func (it *memtableIterator) err() error      { return nil }
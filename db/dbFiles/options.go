@@ -0,0 +1,144 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Durability decides when WAL writes are fsynced
+type Durability string
+
+const (
+	// fsync before a write is acknowledged, concurrent writes share one fsync
+	DurabilityAlways Durability = "always"
+	// fsync in the background every SyncInterval
+	DurabilityInterval Durability = "interval"
+	// leave it to the OS
+	DurabilityNone Durability = "none"
+)
+
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// Function for turning a config/query string into a Durability
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityAlways, DurabilityInterval, DurabilityNone:
+		return d, nil
+	case "":
+		return DurabilityAlways, nil
+	}
+	return "", fmt.Errorf("unknown durability mode %q", s)
+}
+
+// Settings for a database.
+// Durability and SyncInterval control fsync of the WAL and snapshots
+// SegmentSize is the size a WAL segment rolls over at
+// WALArchiveDir keeps checkpointed WAL segments instead of deleting them
+// SnapshotRetention is how many snapshot generations Load can fall back on
+// ReplicationTimeout is how long a write waits for replicas to apply it
+// Consensus is how a ShardedDB's shards replicate writes, empty for whatever
+// the database was created with
+// RaftElectionTimeout and RaftHeartbeat time raft elections and heartbeats,
+// RaftTransport is how raft members reach each other, nil for in-process
+// Gossip tunes how the nodes of a cluster keep track of each other
+// Engine is the name of the StorageEngine that holds the data
+// LSM tunes the "lsm" engine, BTree the "btree" engine
+// BlockCache is shared by the tables of every database opened with it, nil for none
+// BlockCacheSize sizes the cache a ShardedDB creates when BlockCache is nil
+// Partitioner is how a ShardedDB places keys, empty for whatever the database
+// was created with
+// VirtualNodes is how many points each shard gets on the ring partitioner's
+// ring, 0 for DefaultVirtualNodes or whatever the database was created with
+type Options struct {
+	Engine              string
+	LSM                 LSMOptions
+	BTree               BTreeOptions
+	BlockCache          *BlockCache
+	BlockCacheSize      int64
+	Partitioner         string
+	VirtualNodes        int
+	Durability          Durability
+	SyncInterval        time.Duration
+	SegmentSize         int64
+	WALArchiveDir       string
+	SnapshotRetention   int
+	ReplicationTimeout  time.Duration
+	Consensus           string
+	RaftElectionTimeout time.Duration
+	RaftHeartbeat       time.Duration
+	RaftTransport       RaftTransport
+	Gossip              GossipOptions
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Engine:              DefaultEngine,
+		Durability:          DurabilityAlways,
+		SyncInterval:        DefaultSyncInterval,
+		SegmentSize:         DefaultSegmentSize,
+		SnapshotRetention:   DefaultSnapshotRetention,
+		BlockCacheSize:      DefaultBlockCacheSize,
+		ReplicationTimeout:  DefaultReplicationTimeout,
+		RaftElectionTimeout: DefaultRaftElectionTimeout,
+		RaftHeartbeat:       DefaultRaftHeartbeat,
+	}
+}
+
+// Function for filling in anything left unset with the defaults
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.Engine == "" {
+		opts.Engine = defaults.Engine
+	}
+	if opts.Durability == "" {
+		opts.Durability = defaults.Durability
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaults.SyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaults.SegmentSize
+	}
+	if opts.SnapshotRetention <= 0 {
+		opts.SnapshotRetention = defaults.SnapshotRetention
+	}
+	if opts.BlockCacheSize <= 0 {
+		opts.BlockCacheSize = defaults.BlockCacheSize
+	}
+	if opts.ReplicationTimeout <= 0 {
+		opts.ReplicationTimeout = defaults.ReplicationTimeout
+	}
+	if opts.RaftElectionTimeout <= 0 {
+		opts.RaftElectionTimeout = defaults.RaftElectionTimeout
+	}
+	if opts.RaftHeartbeat <= 0 {
+		opts.RaftHeartbeat = defaults.RaftHeartbeat
+	}
+	return opts
+}
+
+// Function for giving every member of a ShardedDB the same block cache
+func (opts Options) withSharedCache() Options {
+	if opts.BlockCache == nil {
+		opts.BlockCache = NewBlockCache(opts.withDefaults().BlockCacheSize)
+	}
+	return opts
+}
+
+// The transport raft members reach each other with, in-process if none was
+// given
+func (opts Options) raftTransport() RaftTransport {
+	if opts.RaftTransport == nil {
+		return NewMemoryTransport()
+	}
+	return opts.RaftTransport
+}
+
+func (opts Options) walOptions() WALOptions {
+	return WALOptions{
+		SegmentSize:  opts.SegmentSize,
+		Durability:   opts.Durability,
+		SyncInterval: opts.SyncInterval,
+		ArchiveDir:   opts.WALArchiveDir,
+	}
+}
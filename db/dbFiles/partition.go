@@ -0,0 +1,293 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Keys are decimal integers, shard Ranges are ranges of them
+	RangePartitioner = "range"
+	// Keys are hashed onto HashSlots slots, shard Ranges are ranges of slots
+	HashPartitioner = "hash"
+	// Keys are hashed onto a consistent hash ring, shard Ranges aren't used
+	RingPartitioner = "ring"
+
+	DefaultPartitioner = RangePartitioner
+	HashSlots          = 16384
+)
+
+var ErrInvalidKey = errors.New("invalid key")
+
+//  Decides which shard a key lives on, and the order scans go in.
+//  Every partitioner works off the shards' Ranges, what a Range is a range
+//  of is up to the partitioner.
+type Partitioner interface {
+	Name() string
+	// Shard key belongs on
+	ShardFor(key string, shards []*Shard) (*Shard, error)
+	// Shards that can hold keys in [start, end), an empty end means no bound
+	ShardsFor(start, end string, shards []*Shard) ([]*Shard, error)
+	// Order of keys in a scan
+	Less(a, b string) bool
+	// First key that can come after key in that order, "" if none can
+	After(key string) string
+	// Up to n of a shard's entries in [start, end) that start with prefix,
+	// in that order. cache lasts as long as the scan's Iterator, for
+	// whatever the partitioner wants to keep between batches.
+	scan(database *db, start, end, prefix string, n int, cache scanCache) ([]KeyValue, error)
+}
+
+// What a partitioner keeps between the batches of one scan, by shard member
+type scanCache map[*db][]string
+
+// virtualNodes is only used by the ring partitioner, 0 for DefaultVirtualNodes
+func NewPartitioner(name string, virtualNodes int) (Partitioner, error) {
+	switch name {
+	case RangePartitioner, "":
+		return rangePartitioner{}, nil
+	case HashPartitioner:
+		return hashPartitioner{}, nil
+	case RingPartitioner:
+		return newRingPartitioner(virtualNodes), nil
+	}
+	return nil, fmt.Errorf("unknown partitioner %q", name)
+}
+
+// Function for finding the shard whose Range holds position
+func shardAt(position int, shards []*Shard) (*Shard, error) {
+	for _, shard := range shards {
+		if position >= shard.Range[0] && position <= shard.Range[1] {
+			return shard, nil
+		}
+	}
+	return nil, errors.New("no shard found for key")
+}
+
+// The original scheme, keys have to be integers and the Ranges split them up
+type rangePartitioner struct{}
+
+func (rangePartitioner) Name() string { return RangePartitioner }
+
+// Keys have to be written the one way strconv.Itoa writes them, "007" and
+// "7" would be different keys in the same place in a scan
+func (rangePartitioner) ShardFor(key string, shards []*Shard) (*Shard, error) {
+	position, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q is not an integer, the range partitioner needs integer keys", ErrInvalidKey, key)
+	}
+	if canonical := strconv.Itoa(position); canonical != key {
+		return nil, fmt.Errorf("%w: %q has to be written as %q", ErrInvalidKey, key, canonical)
+	}
+	return shardAt(position, shards)
+}
+
+func (rangePartitioner) ShardsFor(start, end string, shards []*Shard) ([]*Shard, error) {
+	low, high, err := numericBounds(start, end)
+	if err != nil {
+		return nil, err
+	}
+	overlapping := []*Shard{}
+	for _, shard := range shards {
+		if (end == "" || shard.Range[0] < high) && shard.Range[1] >= low {
+			overlapping = append(overlapping, shard)
+		}
+	}
+	return overlapping, nil
+}
+
+func (rangePartitioner) Less(a, b string) bool {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	return x < y
+}
+
+func (rangePartitioner) After(key string) string {
+	k, _ := strconv.Atoi(key)
+	if k == math.MaxInt {
+		return ""
+	}
+	return strconv.Itoa(k + 1)
+}
+
+//  Keys are stored as decimal strings, which don't sort the way the numbers
+//  do, so the shard's keys in the range are read and sorted once per scan,
+//  see sortedKeys.
+func (partitioner rangePartitioner) scan(database *db, start, end, prefix string, n int, cache scanCache) ([]KeyValue, error) {
+	low, high, err := numericBounds(start, end)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := database.sortedKeys(cache, func(key string) bool {
+		k, err := strconv.Atoi(key)
+		return err == nil && k >= low && (end == "" || k < high) && strings.HasPrefix(key, prefix)
+	}, partitioner.Less)
+	if err != nil {
+		return nil, err
+	}
+	from := sort.Search(len(keys), func(i int) bool {
+		k, _ := strconv.Atoi(keys[i])
+		return k >= low
+	})
+	return database.readKeys(keys[from:], n, func(key string) bool {
+		k, _ := strconv.Atoi(key)
+		return end != "" && k >= high
+	})
+}
+
+// Scan bounds as integers, no end is no bound
+func numericBounds(start, end string) (int, int, error) {
+	high := int(^uint(0) >> 1)
+	low := -high - 1
+	var err error
+	if start != "" {
+		if low, err = strconv.Atoi(start); err != nil {
+			return 0, 0, fmt.Errorf("%w: scan start %q is not an integer", ErrInvalidKey, start)
+		}
+	}
+	if end != "" {
+		if high, err = strconv.Atoi(end); err != nil {
+			return 0, 0, fmt.Errorf("%w: scan end %q is not an integer", ErrInvalidKey, end)
+		}
+	}
+	return low, high, nil
+}
+
+//  Any key, hashed with murmur3 onto a fixed number of slots.
+//  Hashing spreads neighbouring keys over every shard, so scans go to all of
+//  them and come back in plain byte order.
+type hashPartitioner struct{}
+
+func (hashPartitioner) Name() string { return HashPartitioner }
+
+func (hashPartitioner) ShardFor(key string, shards []*Shard) (*Shard, error) {
+	return shardAt(HashSlot(key), shards)
+}
+
+func (hashPartitioner) ShardsFor(start, end string, shards []*Shard) ([]*Shard, error) {
+	return shards, nil
+}
+
+func (hashPartitioner) Less(a, b string) bool   { return a < b }
+func (hashPartitioner) After(key string) string { return keyAfter(key) }
+
+// Prefix scans are always bounded to the prefix's own range
+func (hashPartitioner) scan(database *db, start, end, prefix string, n int, cache scanCache) ([]KeyValue, error) {
+	return database.scanBatch(start, end, n, cache)
+}
+
+// Slot a key hashes to
+func HashSlot(key string) int {
+	return int(murmur3([]byte(key), 0) % HashSlots)
+}
+
+// Function for splitting the slots evenly between n shards
+func HashRanges(n int) [][2]int {
+	ranges := [][2]int{}
+	for i := 0; i < n; i++ {
+		ranges = append(ranges, [2]int{i * HashSlots / n, (i+1)*HashSlots/n - 1})
+	}
+	return ranges
+}
+
+// Function for splitting every integer evenly between n shards
+func IntRanges(n int) [][2]int {
+	step := math.MaxUint64 / uint64(n)
+	// Offsets from math.MinInt, flipping the sign bit turns one into the integer
+	integer := func(offset uint64) int { return int(int64(offset ^ 1<<63)) }
+	ranges := [][2]int{}
+	for i := 0; i < n; i++ {
+		hi := uint64(i+1)*step - 1
+		if i == n-1 {
+			hi = math.MaxUint64
+		}
+		ranges = append(ranges, [2]int{integer(uint64(i) * step), integer(hi)})
+	}
+	return ranges
+}
+
+// 32 bit murmur3 (x86_32)
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	hash := seed
+	length := len(data)
+	for ; len(data) >= 4; data = data[4:] {
+		k := binary.LittleEndian.Uint32(data)
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		hash ^= k
+		hash = bits.RotateLeft32(hash, 13)
+		hash = hash*5 + 0xe6546b64
+	}
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		hash ^= k
+	}
+	hash ^= uint32(length)
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
+
+//  Function for checking a partitioner exists and the ranges make sense for it.
+//  The ranges can't overlap or leave gaps between them, and hash ranges have
+//  to cover every slot.
+func ValidatePartitioner(name string, ranges [][2]int) error {
+	if _, err := NewPartitioner(name, 0); err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		return errors.New("a database needs at least one shard")
+	}
+	if name == RingPartitioner {
+		// Only the number of shards matters
+		return nil
+	}
+	for _, r := range ranges {
+		if r[0] > r[1] {
+			return fmt.Errorf("shard range %v is empty", r)
+		}
+		if name == HashPartitioner && (r[0] < 0 || r[1] >= HashSlots) {
+			return fmt.Errorf("shard range %v is outside the %d hash slots", r, HashSlots)
+		}
+	}
+	sorted := append([][2]int{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	for i := 1; i < len(sorted); i++ {
+		prev, r := sorted[i-1], sorted[i]
+		if r[0] <= prev[1] {
+			return fmt.Errorf("shard ranges %v and %v overlap", prev, r)
+		}
+		if r[0] != prev[1]+1 {
+			return fmt.Errorf("shard ranges %v and %v leave a gap", prev, r)
+		}
+	}
+	if name == HashPartitioner && (sorted[0][0] != 0 || sorted[len(sorted)-1][1] != HashSlots-1) {
+		return fmt.Errorf("shard ranges don't cover all %d hash slots", HashSlots)
+	}
+	return nil
+}
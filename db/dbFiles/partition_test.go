@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMurmur3(t *testing.T) {
+	assert.Equal(t, uint32(0), murmur3([]byte(""), 0))
+	assert.Equal(t, uint32(0x248bfa47), murmur3([]byte("hello"), 0))
+	assert.Equal(t, uint32(0x2e4ff723), murmur3([]byte("The quick brown fox jumps over the lazy dog"), 0))
+}
+
+func TestHashRanges(t *testing.T) {
+	ranges := HashRanges(3)
+	require.Len(t, ranges, 3)
+	assert.Equal(t, 0, ranges[0][0])
+	assert.Equal(t, HashSlots-1, ranges[2][1])
+	for i := 1; i < len(ranges); i++ {
+		assert.Equal(t, ranges[i-1][1]+1, ranges[i][0])
+	}
+	assert.NoError(t, ValidatePartitioner(HashPartitioner, ranges))
+	assert.Error(t, ValidatePartitioner(HashPartitioner, [][2]int{{0, HashSlots}}))
+	assert.Error(t, ValidatePartitioner("modulo", ranges))
+}
+
+func TestValidateRanges(t *testing.T) {
+	assert.NoError(t, ValidatePartitioner(RangePartitioner, [][2]int{{101, 200}, {0, 100}}))
+	assert.ErrorContains(t, ValidatePartitioner(RangePartitioner, [][2]int{{0, 100}, {100, 200}}), "overlap")
+	assert.ErrorContains(t, ValidatePartitioner(RangePartitioner, [][2]int{{0, 100}, {102, 200}}), "gap")
+	assert.ErrorContains(t, ValidatePartitioner(HashPartitioner, [][2]int{{0, 99}, {100, HashSlots - 2}}), "cover")
+	assert.Error(t, ValidatePartitioner(RangePartitioner, nil))
+	assert.NoError(t, ValidatePartitioner(RingPartitioner, make([][2]int, 2)))
+
+	ranges := IntRanges(3)
+	assert.Equal(t, math.MinInt, ranges[0][0])
+	assert.Equal(t, math.MaxInt, ranges[2][1])
+	assert.NoError(t, ValidatePartitioner(RangePartitioner, ranges))
+	assert.Equal(t, [][2]int{{math.MinInt, math.MaxInt}}, IntRanges(1))
+}
+
+func TestHashPartitionedKeys(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "hashed")
+	opts := DefaultOptions()
+	opts.Partitioner = HashPartitioner
+	sdb := mustOpenShardedDB(t, HashRanges(3), base, 1, opts)
+	assert.Equal(t, HashPartitioner, sdb.Partitioner())
+
+	expected := map[string]string{
+		"6f1c2a0e-93a4-4b1e-9c1e-2f0b8d6f4a11": "uuid",
+		"users/42/profile":                     "path",
+		"binary\x00\xff\x01":                   "binary",
+		"":                                     "empty",
+	}
+	for i := 0; i < 300; i++ {
+		expected[fmt.Sprintf("item/%03d", i)] = fmt.Sprint(i)
+	}
+	for key, value := range expected {
+		require.NoError(t, sdb.Set(key, value))
+	}
+	for key, value := range expected {
+		got, err := sdb.Get(key)
+		require.NoError(t, err, "%q", key)
+		assert.Equal(t, value, got)
+	}
+
+	// Hashing spreads the keys over every shard
+	for _, shard := range sdb.Shards {
+		entries, err := shard.Database.collect(func(string) bool { return true })
+		require.NoError(t, err)
+		assert.Greater(t, len(entries), 50, "shard %d", shard.ID)
+	}
+
+	// Scans go to every shard and come back in byte order
+	entries, _, err := sdb.ScanPrefix("item/").Collect(0)
+	require.NoError(t, err)
+	require.Len(t, entries, 300)
+	assert.True(t, sort.SliceIsSorted(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key }))
+	entries, _, err = sdb.Scan("item/100", "item/110", 0).Collect(0)
+	require.NoError(t, err)
+	assert.Equal(t, "item/100", entries[0].Key)
+	assert.Len(t, entries, 10)
+
+	require.NoError(t, sdb.Delete("users/42/profile"))
+	_, err = sdb.Get("users/42/profile")
+	assert.Equal(t, ErrNotFound, err)
+	require.NoError(t, sdb.Save())
+	require.NoError(t, sdb.Close())
+
+	// The partitioner is recorded, opening with the wrong one fails
+	wrong := DefaultOptions()
+	wrong.Partitioner = RangePartitioner
+	_, _, err = OpenShardedDB(HashRanges(3), base, 1, wrong)
+	assert.Error(t, err)
+
+	reopened, _, err := OpenShardedDB(HashRanges(3), base, 1, DefaultOptions())
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, HashPartitioner, reopened.Partitioner())
+	value, err := reopened.Get("6f1c2a0e-93a4-4b1e-9c1e-2f0b8d6f4a11")
+	require.NoError(t, err)
+	assert.Equal(t, "uuid", value)
+}
+
+func TestRangePartitionerRejectsNonIntegerKeys(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 100}}, filepath.Join(t.TempDir(), "ranged"), 0, DefaultOptions())
+	defer sdb.Close()
+	assert.ErrorIs(t, sdb.Set("users/42", "value"), ErrInvalidKey)
+	assert.NoError(t, sdb.Set("42", "value"))
+	assert.Error(t, sdb.Set("101", "value"))
+}
+
+// "007" would share a place in scans with "7", only "7" is taken
+func TestRangePartitionerRejectsNonCanonicalKeys(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{-100, 100}}, filepath.Join(t.TempDir(), "ranged"), 0, DefaultOptions())
+	defer sdb.Close()
+	for _, key := range []string{"007", "+7", "-0", "00"} {
+		assert.ErrorIs(t, sdb.Set(key, "value"), ErrInvalidKey, key)
+	}
+	assert.NoError(t, sdb.Set("7", "value"))
+	assert.NoError(t, sdb.Set("-7", "value"))
+	assert.NoError(t, sdb.Set("0", "value"))
+}
+
+// A scan with no end stops after the largest integer rather than wrapping
+// round to the smallest
+func TestRangeScanEndsAtMaxInt(t *testing.T) {
+	sdb := mustOpenShardedDB(t, IntRanges(2), filepath.Join(t.TempDir(), "ranged"), 0, DefaultOptions())
+	defer sdb.Close()
+	keys := []string{fmt.Sprint(math.MinInt), "0", fmt.Sprint(math.MaxInt - 1), fmt.Sprint(math.MaxInt)}
+	for _, key := range keys {
+		require.NoError(t, sdb.Set(key, "value"))
+	}
+	entries, more, err := sdb.Scan("", "", 0).Collect(0)
+	require.NoError(t, err)
+	assert.False(t, more)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, fmt.Sprint(math.MaxInt), entries[3].Key)
+
+	it := sdb.Scan("0", "", 0)
+	entries, more, err = it.Collect(3)
+	require.NoError(t, err)
+	assert.False(t, more)
+	assert.Len(t, entries, 3)
+	assert.False(t, it.Next())
+	assert.Empty(t, it.Resume())
+}
@@ -0,0 +1,1175 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//  Raft, for shards whose members agree on every write (see ConsensusRaft).
+//  Each member runs a raftNode over its own db. The raft log is the db's
+//  WAL, entry i is the record with LSN i. The term each entry was made in,
+//  the member's vote and the group's membership are kept next to it in
+//  <filename>.raft. Only committed entries are applied to the engine, so the
+//  engine and its snapshots never have anything a majority didn't agree on,
+//  and a member that restarts picks up from its last snapshot as entries
+//  are committed again.
+
+type RaftRole string
+
+const (
+	RaftFollower  RaftRole = "follower"
+	RaftCandidate RaftRole = "candidate"
+	RaftLeader    RaftRole = "leader"
+)
+
+const (
+	DefaultRaftElectionTimeout = 300 * time.Millisecond
+	DefaultRaftHeartbeat       = 50 * time.Millisecond
+	// Most entries sent to a follower in one go
+	raftBatch = 256
+)
+
+// The member asked to write isn't its group's leader
+var ErrNotLeader = errors.New("not the raft leader")
+
+// The leader lost its leadership after taking the write, it may or may not
+// have been committed
+var ErrLeadershipLost = errors.New("raft leader lost its leadership before the write was committed")
+
+// Only one change to a group's members can be in flight at a time
+var ErrMembershipChange = errors.New("raft membership change not allowed")
+
+// An entry on the wire, a record and the term it was made in
+type RaftEntry struct {
+	Term   uint64 `json:"term"`
+	Record Record `json:"record"`
+}
+
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastLSN   uint64 `json:"last_lsn"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type VoteReply struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// Entries follow on from PrevLSN, which was made in PrevTerm. Commit is how
+// far the leader has committed.
+type AppendRequest struct {
+	Term     uint64      `json:"term"`
+	Leader   string      `json:"leader"`
+	PrevLSN  uint64      `json:"prev_lsn"`
+	PrevTerm uint64      `json:"prev_term"`
+	Entries  []RaftEntry `json:"entries"`
+	Commit   uint64      `json:"commit"`
+}
+
+// On success LastLSN is the last entry the follower has that matches the
+// leader's log, otherwise the LSN to try again after
+type AppendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	LastLSN uint64 `json:"last_lsn"`
+}
+
+// Everything in the leader's engine as of LSN, made in LSNTerm, and the
+// group's members
+type SnapshotRequest struct {
+	Term    uint64     `json:"term"`
+	Leader  string     `json:"leader"`
+	LSN     uint64     `json:"lsn"`
+	LSNTerm uint64     `json:"lsn_term"`
+	Members []string   `json:"members"`
+	Entries []KeyValue `json:"entries"`
+}
+
+type SnapshotReply struct {
+	Term uint64 `json:"term"`
+}
+
+// From LSN on, entries were made in Term (until the next run)
+type termRun struct {
+	LSN  uint64 `json:"lsn"`
+	Term uint64 `json:"term"`
+}
+
+// The group's members from the config entry at LSN on
+type raftConfig struct {
+	LSN     uint64   `json:"lsn"`
+	Members []string `json:"members"`
+}
+
+// What's kept in <filename>.raft. Terms and Configs are written before the
+// entries they're about, runs past the end of the log are dropped on load.
+type raftState struct {
+	Term     uint64       `json:"term"`
+	VotedFor string       `json:"voted_for,omitempty"`
+	Terms    []termRun    `json:"terms"`
+	Configs  []raftConfig `json:"configs"`
+}
+
+// What the shard admin API reports about a raft member
+type RaftStatus struct {
+	Member  string   `json:"member"`
+	Role    RaftRole `json:"role"`
+	Term    uint64   `json:"term"`
+	Leader  string   `json:"leader"`
+	LastLSN uint64   `json:"last_lsn"`
+	Commit  uint64   `json:"commit"`
+	Applied uint64   `json:"applied"`
+}
+
+//  A db's member of a raft group.
+//  commit is the last entry known to be committed, applied the last one in
+//  the engine (the db's lastLSN). deadline is when a follower stands for
+//  election if it hasn't heard from a leader, elected when it last became
+//  leader.
+//  The leader keeps next (the entry to send each peer next), match (the
+//  last entry each peer is known to have) and heard (when each peer last
+//  answered), with a replicator goroutine per peer in replicating (with the
+//  term it's replicating for).
+//  changed is closed when anything waiters or replicators care about
+//  happens, and replaced with a new one.
+//  onLeader is called, in its own goroutine, each time the node is elected.
+type raftNode struct {
+	id        string
+	db        *db
+	transport RaftTransport
+	timeout   time.Duration
+	heartbeat time.Duration
+	onLeader  func(node *raftNode, term uint64)
+
+	lock        sync.Mutex
+	role        RaftRole
+	term        uint64
+	votedFor    string
+	leader      string
+	terms       []termRun
+	configs     []raftConfig
+	commit      uint64
+	applied     uint64
+	deadline    time.Time
+	elected     time.Time
+	next        map[string]uint64
+	match       map[string]uint64
+	heard       map[string]time.Time
+	caughtUp    map[string]time.Time
+	replicating map[string]uint64
+	changed     chan struct{}
+	stopped     bool
+	stop        chan struct{}
+	running     sync.WaitGroup
+}
+
+func raftFilename(filename string) string {
+	return filename + ".raft"
+}
+
+//  Function for making db a member of a raft group as id, reachable through
+//  transport. A db that has never been in a group starts out with members
+//  as the group, or with no members (until a leader adds it) if that's
+//  empty. Nothing happens until start is called.
+func newRaftNode(id string, db *db, transport RaftTransport, members []string, opts Options) (*raftNode, error) {
+	opts = opts.withDefaults()
+	node := &raftNode{
+		id:          id,
+		db:          db,
+		transport:   transport,
+		timeout:     opts.RaftElectionTimeout,
+		heartbeat:   opts.RaftHeartbeat,
+		role:        RaftFollower,
+		next:        make(map[string]uint64),
+		match:       make(map[string]uint64),
+		heard:       make(map[string]time.Time),
+		caughtUp:    make(map[string]time.Time),
+		replicating: make(map[string]uint64),
+		changed:     make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	data, err := os.ReadFile(raftFilename(db.filename))
+	switch {
+	case os.IsNotExist(err):
+		node.configs = []raftConfig{{Members: append([]string{}, members...)}}
+		if err := node.saveState(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		state := raftState{}
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", raftFilename(db.filename), err)
+		}
+		node.term, node.votedFor = state.Term, state.VotedFor
+		last := db.wal.LastLSN()
+		for _, run := range state.Terms {
+			if run.LSN <= last {
+				node.terms = append(node.terms, run)
+			}
+		}
+		for _, config := range state.Configs {
+			if config.LSN <= last {
+				node.configs = append(node.configs, config)
+			}
+		}
+	}
+	// The engine only ever has committed entries
+	db.lock.RLock()
+	node.applied = db.lastLSN
+	db.lock.RUnlock()
+	node.commit = node.applied
+	node.resetDeadline()
+	return node, nil
+}
+
+// Function for joining the transport and starting the election timer and
+// the applier
+func (node *raftNode) start() {
+	node.transport.Register(node.id, node)
+	node.running.Add(2)
+	go node.run()
+	go node.applyCommitted()
+}
+
+// Function for leaving the group's traffic and stopping the node's
+// goroutines. The db is left as it is.
+func (node *raftNode) shutdown() {
+	node.lock.Lock()
+	if node.stopped {
+		node.lock.Unlock()
+		return
+	}
+	node.stopped = true
+	close(node.stop)
+	node.signal()
+	node.lock.Unlock()
+	node.transport.Unregister(node.id)
+	node.running.Wait()
+}
+
+// Caller holds the lock
+func (node *raftNode) saveState() error {
+	data, err := json.Marshal(raftState{Term: node.term, VotedFor: node.votedFor, Terms: node.terms, Configs: node.configs})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(raftFilename(node.db.filename), data, node.db.opts.Durability != DurabilityNone)
+}
+
+// Caller holds the lock
+func (node *raftNode) signal() {
+	close(node.changed)
+	node.changed = make(chan struct{})
+}
+
+// Somewhere between one and two election timeouts from now, so members
+// don't all stand at once. Caller holds the lock.
+func (node *raftNode) resetDeadline() {
+	node.deadline = time.Now().Add(node.timeout + time.Duration(rand.Int63n(int64(node.timeout))))
+}
+
+// Term entry lsn was made in, 0 for entries from before the db was in a
+// group. Caller holds the lock.
+func (node *raftNode) termAt(lsn uint64) uint64 {
+	term := uint64(0)
+	for _, run := range node.terms {
+		if run.LSN > lsn {
+			break
+		}
+		term = run.Term
+	}
+	return term
+}
+
+// Caller holds the lock
+func (node *raftNode) last() (uint64, uint64) {
+	lsn := node.db.wal.LastLSN()
+	return lsn, node.termAt(lsn)
+}
+
+// The group's members as of the newest config entry in the log, committed
+// or not. Caller holds the lock.
+func (node *raftNode) members() []string {
+	if len(node.configs) == 0 {
+		return nil
+	}
+	return node.configs[len(node.configs)-1].Members
+}
+
+// The members other than this one. Caller holds the lock.
+func (node *raftNode) peers() []string {
+	peers := []string{}
+	for _, member := range node.members() {
+		if member != node.id {
+			peers = append(peers, member)
+		}
+	}
+	return peers
+}
+
+// Caller holds the lock
+func (node *raftNode) quorum() int {
+	return len(node.members())/2 + 1
+}
+
+// Function for appending entries made in term to the log. Their term and
+// any membership they carry are recorded first, so the log never has an
+// entry the state file doesn't know about. Records without an LSN get the
+// next one. Caller holds the lock.
+func (node *raftNode) appendEntries(term uint64, records []Record) (uint64, error) {
+	last, lastTerm := node.last()
+	if len(records) == 0 {
+		return last, nil
+	}
+	if lastTerm != term {
+		node.terms = append(node.terms, termRun{LSN: last + 1, Term: term})
+	}
+	for i := range records {
+		if records[i].LSN == 0 {
+			records[i].LSN = last + 1 + uint64(i)
+		}
+		if records[i].Type == RecordConfig {
+			node.configs = append(node.configs, raftConfig{LSN: records[i].LSN, Members: splitMembers(records[i].Value)})
+		}
+	}
+	if err := node.saveState(); err != nil {
+		return last, err
+	}
+	for _, record := range records {
+		if _, err := node.db.wal.append(record); err != nil {
+			return node.db.wal.LastLSN(), err
+		}
+	}
+	node.signal()
+	return records[len(records)-1].LSN, nil
+}
+
+// Function for appending entries from the leader, each carrying its own
+// term. Caller holds the lock.
+func (node *raftNode) appendFromLeader(entries []RaftEntry) error {
+	for len(entries) > 0 {
+		run := 1
+		for run < len(entries) && entries[run].Term == entries[0].Term {
+			run++
+		}
+		records := []Record{}
+		for _, entry := range entries[:run] {
+			records = append(records, entry.Record)
+		}
+		if _, err := node.appendEntries(entries[0].Term, records); err != nil {
+			return err
+		}
+		entries = entries[run:]
+	}
+	return nil
+}
+
+// Function for throwing away the entries after lsn, which were never
+// committed. Caller holds the lock.
+func (node *raftNode) truncateAfter(lsn uint64) error {
+	if lsn < node.commit {
+		return fmt.Errorf("%s can't drop entries after %d, it has committed up to %d", node.id, lsn, node.commit)
+	}
+	if err := node.db.wal.truncateAfter(lsn); err != nil {
+		return err
+	}
+	for len(node.terms) > 0 && node.terms[len(node.terms)-1].LSN > lsn {
+		node.terms = node.terms[:len(node.terms)-1]
+	}
+	for len(node.configs) > 1 && node.configs[len(node.configs)-1].LSN > lsn {
+		node.configs = node.configs[:len(node.configs)-1]
+	}
+	return node.saveState()
+}
+
+// Function for stepping down to follower in term (it can't go backwards),
+// following leader if that's known. Caller holds the lock.
+func (node *raftNode) becomeFollower(term uint64, leader string) error {
+	node.role = RaftFollower
+	node.leader = leader
+	node.resetDeadline()
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		return node.saveState()
+	}
+	return nil
+}
+
+//  Function for the election timer, a follower or candidate that hasn't
+//  heard from a leader in time stands for election. A leader that hasn't
+//  heard from a quorum in that long steps down, the rest of the group has
+//  likely moved on without it.
+func (node *raftNode) run() {
+	defer node.running.Done()
+	ticker := time.NewTicker(node.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.stop:
+			return
+		case <-ticker.C:
+		}
+		node.lock.Lock()
+		due := node.role != RaftLeader && time.Now().After(node.deadline)
+		if node.role == RaftLeader && !node.hasQuorum() {
+			fmt.Printf("Raft member %s lost touch with the group, stepping down\n", node.id)
+			node.becomeFollower(node.term, "")
+			node.signal()
+		}
+		node.lock.Unlock()
+		if due {
+			node.campaign()
+		}
+	}
+}
+
+// Function for standing for election straight away, members that aren't
+// in the group don't
+func (node *raftNode) campaign() {
+	node.lock.Lock()
+	if node.stopped || node.role == RaftLeader || !slices.Contains(node.members(), node.id) {
+		node.lock.Unlock()
+		return
+	}
+	node.term++
+	node.role = RaftCandidate
+	node.votedFor = node.id
+	node.leader = ""
+	node.resetDeadline()
+	if err := node.saveState(); err != nil {
+		fmt.Printf("Raft member %s couldn't record its vote: %v\n", node.id, err)
+		node.lock.Unlock()
+		return
+	}
+	lastLSN, lastTerm := node.last()
+	request := VoteRequest{Term: node.term, Candidate: node.id, LastLSN: lastLSN, LastTerm: lastTerm}
+	peers := node.peers()
+	votes := 1
+	if votes >= node.quorum() {
+		node.becomeLeader()
+	}
+	node.lock.Unlock()
+
+	replies := make(chan VoteReply, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			reply, err := node.transport.RequestVote(peer, request)
+			if err != nil {
+				reply = VoteReply{}
+			}
+			replies <- reply
+		}(peer)
+	}
+	for range peers {
+		reply := <-replies
+		node.lock.Lock()
+		if reply.Term > node.term {
+			node.becomeFollower(reply.Term, "")
+		}
+		if node.role != RaftCandidate || node.term != request.Term {
+			node.lock.Unlock()
+			return
+		}
+		if reply.Granted {
+			votes++
+		}
+		if votes >= node.quorum() {
+			node.becomeLeader()
+		}
+		node.lock.Unlock()
+	}
+}
+
+// Whether the leader has heard from a quorum within an election timeout,
+// or was only just elected. Caller holds the lock.
+func (node *raftNode) hasQuorum() bool {
+	if time.Since(node.elected) < node.timeout {
+		return true
+	}
+	heard := 0
+	for _, member := range node.members() {
+		if member == node.id || time.Since(node.heard[member]) < node.timeout {
+			heard++
+		}
+	}
+	return heard >= node.quorum()
+}
+
+// Function for taking over as leader. A no-op entry in the new term gets
+// whatever earlier terms left uncommitted committed. Caller holds the lock.
+func (node *raftNode) becomeLeader() {
+	node.role = RaftLeader
+	node.leader = node.id
+	node.elected = time.Now()
+	last, _ := node.last()
+	node.next = make(map[string]uint64)
+	node.match = make(map[string]uint64)
+	node.heard = make(map[string]time.Time)
+	node.caughtUp = make(map[string]time.Time)
+	if _, err := node.appendEntries(node.term, []Record{{Type: RecordNoop}}); err != nil {
+		fmt.Printf("Raft member %s couldn't start term %d: %v\n", node.id, node.term, err)
+		node.becomeFollower(node.term, "")
+		return
+	}
+	for _, peer := range node.peers() {
+		node.next[peer] = last + 1
+		node.replicate(peer)
+	}
+	node.advanceCommit()
+	fmt.Printf("Raft member %s is the leader for term %d\n", node.id, node.term)
+	if node.onLeader != nil {
+		go node.onLeader(node, node.term)
+	}
+}
+
+// Function for starting a replicator for peer, unless one is already
+// running. Caller holds the lock.
+func (node *raftNode) replicate(peer string) {
+	if node.replicating[peer] == node.term {
+		return
+	}
+	node.replicating[peer] = node.term
+	node.running.Add(1)
+	go node.replicator(peer, node.term)
+}
+
+//  Function for keeping peer's log in line with the leader's for as long
+//  as the node leads in term. Entries are sent as they're appended, and at
+//  least every heartbeat. A peer that needs entries the log has already
+//  checkpointed away gets a snapshot of the engine instead.
+func (node *raftNode) replicator(peer string, term uint64) {
+	defer node.running.Done()
+	defer func() {
+		node.lock.Lock()
+		if node.replicating[peer] == term {
+			delete(node.replicating, peer)
+		}
+		node.lock.Unlock()
+	}()
+	ticker := time.NewTicker(node.heartbeat)
+	defer ticker.Stop()
+	for {
+		node.lock.Lock()
+		if node.stopped || node.role != RaftLeader || node.term != term || !slices.Contains(node.peers(), peer) {
+			node.lock.Unlock()
+			return
+		}
+		prev := max(node.next[peer], 1) - 1
+		changed := node.changed
+		node.lock.Unlock()
+
+		more, err := node.sendEntries(peer, term, prev)
+		if errors.Is(err, ErrWALGap) {
+			more, err = true, node.sendSnapshot(peer, term)
+		}
+		if err == nil && more {
+			continue
+		}
+		select {
+		case <-node.stop:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Function for sending peer the entries after prev, or just a heartbeat if
+// there aren't any. Returns whether there's more to send straight away.
+func (node *raftNode) sendEntries(peer string, term, prev uint64) (bool, error) {
+	records, err := node.db.wal.entriesAfter(prev)
+	if err != nil {
+		return false, err
+	}
+	if len(records) > raftBatch {
+		records = records[:raftBatch]
+	}
+	node.lock.Lock()
+	if node.role != RaftLeader || node.term != term {
+		node.lock.Unlock()
+		return false, nil
+	}
+	request := AppendRequest{Term: term, Leader: node.id, PrevLSN: prev, PrevTerm: node.termAt(prev), Commit: node.commit}
+	for _, record := range records {
+		request.Entries = append(request.Entries, RaftEntry{Term: node.termAt(record.LSN), Record: record})
+	}
+	node.lock.Unlock()
+
+	reply, err := node.transport.AppendEntries(peer, request)
+	if err != nil {
+		return false, nil
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if reply.Term > node.term {
+		node.becomeFollower(reply.Term, "")
+		return false, nil
+	}
+	if node.role != RaftLeader || node.term != term {
+		return false, nil
+	}
+	node.heard[peer] = time.Now()
+	if !reply.Success {
+		// Back up to where the peer's log might agree
+		node.next[peer] = max(1, min(prev, reply.LastLSN+1))
+		return true, nil
+	}
+	if reply.LastLSN > node.match[peer] {
+		// waitReplicated waits on every peer, not just the quorum commit counts
+		node.match[peer] = reply.LastLSN
+		node.signal()
+	}
+	node.next[peer] = node.match[peer] + 1
+	last, _ := node.last()
+	if node.match[peer] >= last {
+		node.caughtUp[peer] = time.Now()
+	}
+	node.advanceCommit()
+	return node.next[peer] <= last, nil
+}
+
+// Function for sending peer everything in the leader's engine, in place of
+// entries it no longer has
+func (node *raftNode) sendSnapshot(peer string, term uint64) error {
+	node.db.lock.RLock()
+	if err := node.db.engineErr(); err != nil {
+		node.db.lock.RUnlock()
+		return err
+	}
+	lsn := node.db.lastLSN
+	entries := []KeyValue{}
+	err := node.db.engine.Iterate(func(key, value string) bool {
+		entries = append(entries, KeyValue{Key: key, Value: value})
+		return true
+	})
+	node.db.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	node.lock.Lock()
+	if node.role != RaftLeader || node.term != term {
+		node.lock.Unlock()
+		return nil
+	}
+	request := SnapshotRequest{Term: term, Leader: node.id, LSN: lsn, LSNTerm: node.termAt(lsn), Members: node.members(), Entries: entries}
+	node.lock.Unlock()
+
+	reply, err := node.transport.InstallSnapshot(peer, request)
+	if err != nil {
+		return err
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if reply.Term > node.term {
+		return node.becomeFollower(reply.Term, "")
+	}
+	if node.role == RaftLeader && node.term == term {
+		node.heard[peer] = time.Now()
+		if lsn > node.match[peer] {
+			node.match[peer] = lsn
+			node.signal()
+		}
+		node.next[peer] = node.match[peer] + 1
+		fmt.Printf("Raft member %s sent %s a snapshot at LSN %d\n", node.id, peer, lsn)
+	}
+	return nil
+}
+
+//  Function for moving commit up to the newest entry a quorum of members
+//  have. Only entries from the leader's own term are committed by
+//  counting, earlier ones come with them. A leader that has committed its
+//  own removal from the group steps down. Caller holds the lock.
+func (node *raftNode) advanceCommit() {
+	matches := []uint64{}
+	for _, member := range node.members() {
+		if member == node.id {
+			last, _ := node.last()
+			matches = append(matches, last)
+		} else {
+			matches = append(matches, node.match[member])
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	if len(matches) > 0 {
+		if lsn := matches[node.quorum()-1]; lsn > node.commit && node.termAt(lsn) == node.term {
+			node.commit = lsn
+			node.signal()
+		}
+	}
+	if config := node.configs[len(node.configs)-1]; config.LSN <= node.commit && !slices.Contains(config.Members, node.id) {
+		fmt.Printf("Raft member %s is out of the group, stepping down\n", node.id)
+		node.becomeFollower(node.term, "")
+	}
+}
+
+// Function for applying committed entries to the engine as commit moves on
+func (node *raftNode) applyCommitted() {
+	defer node.running.Done()
+	for {
+		node.lock.Lock()
+		applied, commit, changed := node.applied, node.commit, node.changed
+		node.lock.Unlock()
+		if applied < commit {
+			records, err := node.db.wal.entriesAfter(applied)
+			if err == nil {
+				for len(records) > 0 && records[len(records)-1].LSN > commit {
+					records = records[:len(records)-1]
+				}
+				applied, err = node.db.applyCommitted(records)
+			}
+			node.lock.Lock()
+			node.applied = max(node.applied, applied)
+			node.signal()
+			node.lock.Unlock()
+			if err == nil {
+				continue
+			}
+			fmt.Printf("Raft member %s couldn't apply entries after %d: %v\n", node.id, applied, err)
+		}
+		select {
+		case <-node.stop:
+			return
+		case <-changed:
+		case <-time.After(node.heartbeat):
+		}
+	}
+}
+
+// Function for applying committed records to the engine, ones it already
+// has are skipped. Returns the last LSN applied.
+func (db *db) applyCommitted(records []Record) (uint64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.engineErr(); err != nil {
+		return db.lastLSN, err
+	}
+	for _, record := range records {
+		if record.LSN <= db.lastLSN {
+			continue
+		}
+		var err error
+		switch record.Type {
+		case RecordSet:
+			err = db.put(record.Key, record.Value)
+		case RecordDelete:
+			err = db.remove(record.Key)
+		}
+		if err != nil {
+			return db.lastLSN, err
+		}
+		db.lastLSN = record.LSN
+	}
+	return db.lastLSN, nil
+}
+
+// Function for answering a candidate, the vote goes to the first candidate
+// in a term whose log is at least as up to date as this member's
+func (node *raftNode) HandleVote(request VoteRequest) VoteReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.stopped || request.Term < node.term {
+		return VoteReply{Term: node.term}
+	}
+	if request.Term > node.term {
+		if err := node.becomeFollower(request.Term, ""); err != nil {
+			return VoteReply{Term: node.term}
+		}
+	}
+	lastLSN, lastTerm := node.last()
+	upToDate := request.LastTerm > lastTerm || (request.LastTerm == lastTerm && request.LastLSN >= lastLSN)
+	if !upToDate || (node.votedFor != "" && node.votedFor != request.Candidate) {
+		return VoteReply{Term: node.term}
+	}
+	node.votedFor = request.Candidate
+	if err := node.saveState(); err != nil {
+		node.votedFor = ""
+		return VoteReply{Term: node.term}
+	}
+	node.resetDeadline()
+	return VoteReply{Term: node.term, Granted: true}
+}
+
+//  Function for taking entries from the leader.
+//  They have to follow on from an entry this member has in the same term.
+//  Anything of its own that conflicts with them was never committed and
+//  is dropped. Entries up to commit are already known to match.
+func (node *raftNode) HandleAppend(request AppendRequest) AppendReply {
+	reply, last := node.handleAppend(request)
+	if reply.Success {
+		// Entries have to be as durable as the durability mode asks for
+		// before the leader counts them
+		if err := node.db.wal.Commit(last); err != nil {
+			reply.Success = false
+		}
+	}
+	return reply
+}
+
+func (node *raftNode) handleAppend(request AppendRequest) (AppendReply, uint64) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.stopped || request.Term < node.term {
+		return AppendReply{Term: node.term}, 0
+	}
+	if err := node.becomeFollower(request.Term, request.Leader); err != nil {
+		return AppendReply{Term: node.term}, 0
+	}
+	last, _ := node.last()
+	if request.PrevLSN > last {
+		return AppendReply{Term: node.term, LastLSN: last}, 0
+	}
+	if request.PrevLSN > node.commit && node.termAt(request.PrevLSN) != request.PrevTerm {
+		// Skip back over the whole conflicting term
+		hint := request.PrevLSN - 1
+		for _, run := range node.terms {
+			if run.LSN <= request.PrevLSN {
+				hint = run.LSN - 1
+			}
+		}
+		return AppendReply{Term: node.term, LastLSN: max(hint, node.commit)}, 0
+	}
+	entries := request.Entries
+	for len(entries) > 0 && entries[0].Record.LSN <= last {
+		entry := entries[0]
+		if entry.Record.LSN <= node.commit || node.termAt(entry.Record.LSN) == entry.Term {
+			entries = entries[1:]
+			continue
+		}
+		if err := node.truncateAfter(entry.Record.LSN - 1); err != nil {
+			fmt.Printf("Raft member %s: %v\n", node.id, err)
+			return AppendReply{Term: node.term, LastLSN: node.commit}, 0
+		}
+		break
+	}
+	if err := node.appendFromLeader(entries); err != nil {
+		fmt.Printf("Raft member %s couldn't append entries from %s: %v\n", node.id, request.Leader, err)
+		last, _ = node.last()
+		return AppendReply{Term: node.term, LastLSN: min(last, request.PrevLSN)}, 0
+	}
+	matched := request.PrevLSN + uint64(len(request.Entries))
+	if commit := min(request.Commit, matched); commit > node.commit {
+		node.commit = commit
+		node.signal()
+	}
+	return AppendReply{Term: node.term, Success: true, LastLSN: matched}, matched
+}
+
+// Function for replacing everything the member has with the leader's
+// snapshot, the log starts again after it
+func (node *raftNode) HandleSnapshot(request SnapshotRequest) SnapshotReply {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.stopped || request.Term < node.term {
+		return SnapshotReply{Term: node.term}
+	}
+	if err := node.becomeFollower(request.Term, request.Leader); err != nil {
+		return SnapshotReply{Term: node.term}
+	}
+	if request.LSN <= node.commit {
+		return SnapshotReply{Term: node.term}
+	}
+	if err := node.db.replaceWith(request.Entries, request.LSN); err != nil {
+		fmt.Printf("Raft member %s couldn't install a snapshot from %s: %v\n", node.id, request.Leader, err)
+		return SnapshotReply{Term: node.term}
+	}
+	node.terms = []termRun{{LSN: request.LSN, Term: request.LSNTerm}}
+	node.configs = []raftConfig{{LSN: request.LSN, Members: request.Members}}
+	node.commit, node.applied = request.LSN, request.LSN
+	if err := node.saveState(); err != nil {
+		fmt.Printf("Raft member %s couldn't record its snapshot: %v\n", node.id, err)
+	}
+	node.signal()
+	return SnapshotReply{Term: node.term}
+}
+
+//  Function for throwing away everything the db has for entries as of lsn.
+//  The WAL starts again after lsn, so the engine is snapshotted straight
+//  away, nothing else could bring it back after a restart.
+func (db *db) replaceWith(entries []KeyValue, lsn uint64) error {
+	db.lock.Lock()
+	if err := db.engineErr(); err != nil {
+		db.lock.Unlock()
+		return err
+	}
+	keys := []string{}
+	err := db.engine.Iterate(func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		if err == nil {
+			err = db.remove(key)
+		}
+	}
+	for _, entry := range entries {
+		if err == nil {
+			err = db.put(entry.Key, entry.Value)
+		}
+	}
+	if err == nil {
+		err = db.wal.reset(lsn)
+	}
+	if err == nil {
+		db.lastLSN = lsn
+	}
+	db.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.Save()
+}
+
+//  Function for adding a record to the group's log through the member,
+//  which has to be the leader. Returns its LSN once it's committed and
+//  applied here. ErrNotLeader means nothing was written, ErrLeadershipLost
+//  that the record may or may not end up committed.
+func (node *raftNode) propose(record Record, timeout time.Duration) (uint64, error) {
+	node.lock.Lock()
+	if node.stopped || node.role != RaftLeader {
+		err := node.notLeader()
+		node.lock.Unlock()
+		return 0, err
+	}
+	term := node.term
+	record.LSN = 0
+	lsn, err := node.appendEntries(term, []Record{record})
+	if err == nil {
+		node.advanceCommit()
+	}
+	node.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := node.db.wal.Commit(lsn); err != nil {
+		return lsn, err
+	}
+	return lsn, node.waitApplied(lsn, term, timeout)
+}
+
+// Caller holds the lock
+func (node *raftNode) notLeader() error {
+	if node.leader == "" || node.leader == node.id {
+		return fmt.Errorf("%w: %s doesn't know who is", ErrNotLeader, node.id)
+	}
+	return fmt.Errorf("%w: %s is", ErrNotLeader, node.leader)
+}
+
+// Function for waiting until the entry the node appended at lsn as leader
+// in term has been applied
+func (node *raftNode) waitApplied(lsn, term uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		node.lock.Lock()
+		applied, kept := node.applied >= lsn, node.termAt(lsn) == term
+		lost := node.stopped || node.term != term || node.role != RaftLeader
+		changed := node.changed
+		node.lock.Unlock()
+		switch {
+		case applied && kept:
+			return nil
+		case applied || lost:
+			return fmt.Errorf("%w: entry %d from term %d on %s", ErrLeadershipLost, lsn, term, node.id)
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%w: entry %d on %s wasn't committed after %v", ErrReplicationTimeout, lsn, node.id, timeout)
+		}
+	}
+}
+
+// Function for waiting until the leader has applied everything committed
+// before it took over, so reads from it see every write acknowledged so far
+func (node *raftNode) readBarrier(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		node.lock.Lock()
+		if node.stopped || node.role != RaftLeader {
+			err := node.notLeader()
+			node.lock.Unlock()
+			return err
+		}
+		ready := node.termAt(node.commit) == node.term && node.applied >= node.commit
+		changed := node.changed
+		node.lock.Unlock()
+		if ready {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s hadn't caught up on its own term after %v", ErrReplicationTimeout, node.id, timeout)
+		}
+	}
+}
+
+//  Function for waiting until every peer the leader has heard from within
+//  an election timeout has the entry at lsn in its log, peers that are
+//  down aren't waited for. After timeout it's ErrReplicationTimeout.
+func (node *raftNode) waitReplicated(lsn uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		node.lock.Lock()
+		behind := []string{}
+		for _, peer := range node.peers() {
+			if node.match[peer] < lsn && time.Since(node.heard[peer]) < node.timeout {
+				behind = append(behind, peer)
+			}
+		}
+		leading := node.role == RaftLeader
+		changed := node.changed
+		node.lock.Unlock()
+		if len(behind) == 0 || !leading {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s hadn't reached LSN %d after %v", ErrReplicationTimeout, strings.Join(behind, ", "), lsn, timeout)
+		}
+	}
+}
+
+//  Function for changing the group's members to members, through the
+//  leader. One member can be added or removed at a time, and only once the
+//  last change is committed. A member being added starts out empty and is
+//  caught up by the leader. Returns once the change is committed.
+func (node *raftNode) changeMembers(members []string, timeout time.Duration) error {
+	node.lock.Lock()
+	if node.stopped || node.role != RaftLeader {
+		err := node.notLeader()
+		node.lock.Unlock()
+		return err
+	}
+	current := node.configs[len(node.configs)-1]
+	changes := 0
+	for _, member := range members {
+		if !slices.Contains(current.Members, member) {
+			changes++
+		}
+	}
+	for _, member := range current.Members {
+		if !slices.Contains(members, member) {
+			changes++
+		}
+	}
+	switch {
+	case current.LSN > node.commit:
+		node.lock.Unlock()
+		return fmt.Errorf("%w: the change at LSN %d isn't committed yet", ErrMembershipChange, current.LSN)
+	case changes > 1:
+		node.lock.Unlock()
+		return fmt.Errorf("%w: %v to %v is more than one member at a time", ErrMembershipChange, current.Members, members)
+	case changes == 0:
+		node.lock.Unlock()
+		return nil
+	}
+	term := node.term
+	last, _ := node.last()
+	lsn, err := node.appendEntries(term, []Record{{Type: RecordConfig, Value: strings.Join(members, ",")}})
+	if err == nil {
+		for _, peer := range node.peers() {
+			if _, ok := node.next[peer]; !ok {
+				node.next[peer] = last + 1
+			}
+			node.replicate(peer)
+		}
+		node.advanceCommit()
+	}
+	node.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Raft member %s changing the group to %v\n", node.id, members)
+	return node.waitApplied(lsn, term, timeout)
+}
+
+// Function for adding id to the group, see changeMembers
+func (node *raftNode) addMember(id string, timeout time.Duration) error {
+	node.lock.Lock()
+	members := append(slices.Clone(node.members()), id)
+	node.lock.Unlock()
+	return node.changeMembers(members, timeout)
+}
+
+// Function for taking id out of the group, see changeMembers
+func (node *raftNode) removeMember(id string, timeout time.Duration) error {
+	node.lock.Lock()
+	members := slices.DeleteFunc(slices.Clone(node.members()), func(member string) bool { return member == id })
+	node.lock.Unlock()
+	return node.changeMembers(members, timeout)
+}
+
+func splitMembers(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+func (node *raftNode) isLeader() bool {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.role == RaftLeader && !node.stopped
+}
+
+//  Function for finding how far behind the leader peer could be, 0 if it
+//  has everything the leader has, otherwise how long since it last did.
+//  As stale as can be if the node isn't the leader or the peer hasn't
+//  caught up since it took over.
+func (node *raftNode) staleness(peer string) time.Duration {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if node.role != RaftLeader {
+		return math.MaxInt64
+	}
+	if last, _ := node.last(); node.match[peer] >= last {
+		return 0
+	}
+	if node.caughtUp[peer].IsZero() {
+		return math.MaxInt64
+	}
+	return time.Since(node.caughtUp[peer])
+}
+
+// How far each of the other members has got, as far as the leader knows
+func (node *raftNode) replicationStatus() []ReplicaStatus {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	last, _ := node.last()
+	statuses := []ReplicaStatus{}
+	for _, peer := range node.peers() {
+		status := ReplicaStatus{Member: peer, AppliedLSN: node.match[peer]}
+		if node.role != RaftLeader {
+			status.Error = "not the leader"
+		} else if last > status.AppliedLSN {
+			status.Lag = last - status.AppliedLSN
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (node *raftNode) status() RaftStatus {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	last, _ := node.last()
+	return RaftStatus{Member: node.id, Role: node.role, Term: node.term, Leader: node.leader, LastLSN: last, Commit: node.commit, Applied: node.applied}
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func raftTestOptions() Options {
+	return Options{RaftElectionTimeout: 50 * time.Millisecond, RaftHeartbeat: 10 * time.Millisecond, ReplicationTimeout: 2 * time.Second}
+}
+
+// Function for starting a raft group with a member per id, each with its
+// own db in dir
+func startRaftGroup(t *testing.T, dir string, transport *MemoryTransport, ids ...string) map[string]*db {
+	dbs := make(map[string]*db)
+	for _, id := range ids {
+		dbs[id] = startRaftMember(t, dir, transport, id, ids)
+	}
+	return dbs
+}
+
+func startRaftMember(t *testing.T, dir string, transport *MemoryTransport, id string, members []string) *db {
+	database := newDb(filepath.Join(dir, id), raftTestOptions())
+	node, err := newRaftNode(id, database, transport, members, raftTestOptions())
+	require.NoError(t, err)
+	database.raft = node
+	node.start()
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// Function for waiting until exactly one of dbs leads, and everyone else
+// that's in the group follows it
+func waitForLeader(t *testing.T, dbs map[string]*db) *db {
+	var leader *db
+	require.Eventually(t, func() bool {
+		leader = nil
+		for _, database := range dbs {
+			if database.raft.isLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = database
+			}
+		}
+		return leader != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+// Function for waiting until every one of dbs has applied up to lsn
+func waitForApplied(t *testing.T, dbs map[string]*db, lsn uint64) {
+	require.Eventually(t, func() bool {
+		for _, database := range dbs {
+			if database.raft.status().Applied < lsn {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// A group elects a leader, and its writes make it into every member's engine
+// under the same LSNs
+func TestRaftElectsAndReplicates(t *testing.T) {
+	transport := NewMemoryTransport()
+	dbs := startRaftGroup(t, t.TempDir(), transport, "a", "b", "c")
+	leader := waitForLeader(t, dbs)
+
+	var lsn uint64
+	for i := 0; i < 20; i++ {
+		var err error
+		lsn, err = leader.raft.propose(Record{Type: RecordSet, Key: fmt.Sprint(i), Value: "value"}, time.Second)
+		require.NoError(t, err)
+	}
+	lsn, err := leader.raft.propose(Record{Type: RecordDelete, Key: "3"}, time.Second)
+	require.NoError(t, err)
+	waitForApplied(t, dbs, lsn)
+	for id, database := range dbs {
+		assert.Equal(t, leader.wal.GetEntries(), database.wal.GetEntries(), id)
+		assert.Equal(t, leader.digest(), database.digest(), id)
+		status := database.raft.status()
+		assert.Equal(t, leader.raft.id, status.Leader, id)
+		assert.Equal(t, leader.raft.status().Term, status.Term, id)
+	}
+	_, err = leader.Get("3")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	for _, database := range dbs {
+		if database != leader {
+			_, err := database.raft.propose(Record{Type: RecordSet, Key: "x", Value: "y"}, time.Second)
+			assert.ErrorIs(t, err, ErrNotLeader)
+		}
+	}
+}
+
+//  A leader cut off from the majority can't commit. The others elect a new
+//  leader that can, and once the network heals the old leader's uncommitted
+//  entries are replaced with the new leader's.
+func TestRaftLeaderPartitioned(t *testing.T) {
+	transport := NewMemoryTransport()
+	dbs := startRaftGroup(t, t.TempDir(), transport, "a", "b", "c")
+	old := waitForLeader(t, dbs)
+	lsn, err := old.raft.propose(Record{Type: RecordSet, Key: "committed", Value: "1"}, time.Second)
+	require.NoError(t, err)
+	waitForApplied(t, dbs, lsn)
+
+	transport.Disconnect(old.raft.id)
+	_, err = old.raft.propose(Record{Type: RecordSet, Key: "lost", Value: "1"}, 200*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrReplicationTimeout) || errors.Is(err, ErrLeadershipLost), "%v", err)
+
+	majority := make(map[string]*db)
+	for id, database := range dbs {
+		if database != old {
+			majority[id] = database
+		}
+	}
+	leader := waitForLeader(t, majority)
+	lsn, err = leader.raft.propose(Record{Type: RecordSet, Key: "after", Value: "2"}, time.Second)
+	require.NoError(t, err)
+
+	transport.Heal()
+	waitForLeader(t, dbs)
+	waitForApplied(t, dbs, lsn)
+	for id, database := range dbs {
+		assert.Equal(t, leader.digest(), database.digest(), id)
+		value, err := database.Get("committed")
+		require.NoError(t, err, id)
+		assert.Equal(t, "1", value)
+		_, err = database.Get("lost")
+		assert.ErrorIs(t, err, ErrNotFound, id)
+	}
+}
+
+//  Members can be added and removed one at a time. A new member the
+//  leader's WAL no longer goes back far enough for is sent a snapshot.
+func TestRaftMembershipAndSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	transport := NewMemoryTransport()
+	dbs := startRaftGroup(t, dir, transport, "a", "b", "c")
+	leader := waitForLeader(t, dbs)
+	for i := 0; i < 30; i++ {
+		_, err := leader.raft.propose(Record{Type: RecordSet, Key: fmt.Sprint(i), Value: "value"}, time.Second)
+		require.NoError(t, err)
+	}
+	// The WAL only goes back as far as the snapshot now
+	require.NoError(t, leader.Save())
+	require.Empty(t, leader.wal.GetEntries())
+
+	// Already a member, nothing to change
+	require.NoError(t, leader.raft.addMember("b", time.Second))
+	assert.Len(t, leader.raft.members(), 3)
+	dbs["d"] = startRaftMember(t, dir, transport, "d", nil)
+	require.NoError(t, leader.raft.addMember("d", time.Second))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, leader.raft.members())
+	lsn, err := leader.raft.propose(Record{Type: RecordDelete, Key: "0"}, time.Second)
+	require.NoError(t, err)
+	waitForApplied(t, dbs, lsn)
+	assert.Equal(t, leader.digest(), dbs["d"].digest())
+	assert.ElementsMatch(t, leader.raft.members(), dbs["d"].raft.members())
+
+	var removed *db
+	for _, database := range dbs {
+		if database != leader {
+			removed = database
+			break
+		}
+	}
+	require.NoError(t, leader.raft.removeMember(removed.raft.id, time.Second))
+	assert.Len(t, leader.raft.members(), 3)
+	assert.NotContains(t, leader.raft.members(), removed.raft.id)
+	// Three members, a majority is still two, so losing one more is fine
+	transport.Disconnect(removed.raft.id)
+	_, err = leader.raft.propose(Record{Type: RecordSet, Key: "more", Value: "value"}, time.Second)
+	assert.NoError(t, err)
+}
+
+//  A raft ShardedDB keeps taking writes when its primary is cut off,
+//  acknowledged writes survive, and the group carries on where it was once
+//  it's opened again.
+func TestRaftShardSurvivesMinorityFailure(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "raft")
+	opts := raftTestOptions()
+	opts.Consensus = ConsensusRaft
+	transport := NewMemoryTransport()
+	opts.RaftTransport = transport
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, base, 2, opts)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprint(i), "before"))
+	}
+	info := sdb.ShardInfo()[0]
+	require.Len(t, info.Raft, 3)
+	assert.Equal(t, RaftLeader, info.Raft[0].Role)
+
+	sdb.lock.RLock()
+	old := sdb.Shards[0].Database
+	sdb.lock.RUnlock()
+	transport.Disconnect(old.raft.id)
+	for i := 0; i < 20; i++ {
+		err := sdb.SetWithOptions(fmt.Sprint(i), "after", WriteOptions{Concern: WriteMajority})
+		// A write the old leader had in hand may or may not have been
+		// committed, it's up to the caller to make it again
+		if errors.Is(err, ErrLeadershipLost) {
+			err = sdb.SetWithOptions(fmt.Sprint(i), "after", WriteOptions{Concern: WriteMajority})
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, sdb.Delete("5"))
+	sdb.lock.RLock()
+	assert.NotSame(t, old, sdb.Shards[0].Database)
+	sdb.lock.RUnlock()
+	promotions := sdb.Promotions()
+	require.NotEmpty(t, promotions)
+	assert.Contains(t, promotions[len(promotions)-1].Reason, "elected raft leader")
+	value, err := sdb.Get("1")
+	require.NoError(t, err)
+	assert.Equal(t, "after", value)
+
+	transport.Heal()
+	require.NoError(t, sdb.Set("50", "healed"))
+	require.NoError(t, sdb.Close())
+
+	// The mode is the shard map's, whatever opts say
+	_, _, err = OpenShardedDB(nil, base, 2, Options{Consensus: ConsensusPrimaryBackup})
+	assert.Error(t, err)
+	opts.RaftTransport = NewMemoryTransport()
+	sdb, _, err = OpenShardedDB(nil, base, 2, opts)
+	require.NoError(t, err)
+	defer sdb.Close()
+	for i := 0; i < 20; i++ {
+		value, err := sdb.Get(fmt.Sprint(i))
+		if i == 5 {
+			assert.ErrorIs(t, err, ErrNotFound)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, "after", value)
+	}
+	value, err = sdb.Get("50")
+	require.NoError(t, err)
+	assert.Equal(t, "healed", value)
+}
@@ -0,0 +1,357 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRebalanceInterval = time.Minute
+	DefaultSplitKeys         = 1000000
+	DefaultSplitBytes        = 256 << 20
+	DefaultSplitOpsPerSec    = 5000
+	DefaultMaxShards         = 64
+	DefaultMoveBytesPerSec   = 8 << 20
+)
+
+//  Settings for the rebalancer.
+//  A shard is split once it has more than SplitKeys keys, SplitBytes bytes or
+//  SplitOpsPerSec reads and writes a second, as long as there are fewer than
+//  MaxShards shards.
+//  Two neighbouring shards are merged once together they're under MergeKeys,
+//  MergeBytes and MergeOpsPerSec (a quarter of the split thresholds by
+//  default), as long as there are more than MinShards shards.
+//  MoveBytesPerSec caps how fast keys are copied, so the copying doesn't
+//  crowd out reads and writes.
+type RebalanceOptions struct {
+	Interval        time.Duration
+	SplitKeys       int
+	SplitBytes      int64
+	SplitOpsPerSec  float64
+	MergeKeys       int
+	MergeBytes      int64
+	MergeOpsPerSec  float64
+	MinShards       int
+	MaxShards       int
+	MoveBytesPerSec int64
+}
+
+// Function for filling in anything left unset with the defaults
+func (opts RebalanceOptions) withDefaults() RebalanceOptions {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultRebalanceInterval
+	}
+	if opts.SplitKeys <= 0 {
+		opts.SplitKeys = DefaultSplitKeys
+	}
+	if opts.SplitBytes <= 0 {
+		opts.SplitBytes = DefaultSplitBytes
+	}
+	if opts.SplitOpsPerSec <= 0 {
+		opts.SplitOpsPerSec = DefaultSplitOpsPerSec
+	}
+	if opts.MergeKeys <= 0 {
+		opts.MergeKeys = opts.SplitKeys / 4
+	}
+	if opts.MergeBytes <= 0 {
+		opts.MergeBytes = opts.SplitBytes / 4
+	}
+	if opts.MergeOpsPerSec <= 0 {
+		opts.MergeOpsPerSec = opts.SplitOpsPerSec / 4
+	}
+	if opts.MinShards <= 0 {
+		opts.MinShards = 1
+	}
+	if opts.MaxShards <= 0 {
+		opts.MaxShards = DefaultMaxShards
+	}
+	if opts.MoveBytesPerSec <= 0 {
+		opts.MoveBytesPerSec = DefaultMoveBytesPerSec
+	}
+	return opts
+}
+
+// Size and load of a shard
+type ShardStats struct {
+	ID        int     `json:"id"`
+	Range     [2]int  `json:"range"`
+	Keys      int     `json:"keys"`
+	Bytes     int64   `json:"bytes"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+}
+
+// Ops count of a shard when its stats were last taken
+type opsSample struct {
+	ops uint64
+	at  time.Time
+}
+
+//  Function for measuring every shard.
+//  OpsPerSec is the rate since the last time the stats were taken, 0 the
+//  first time.
+func (sdb *ShardedDB) ShardStats() ([]ShardStats, error) {
+	// Splits change ranges under the lock
+	sdb.lock.RLock()
+	shards := append([]*Shard{}, sdb.Shards...)
+	ranges := [][2]int{}
+	for _, shard := range shards {
+		ranges = append(ranges, shard.Range)
+	}
+	sdb.lock.RUnlock()
+
+	sdb.statsLock.Lock()
+	defer sdb.statsLock.Unlock()
+	stats := []ShardStats{}
+	for i, shard := range shards {
+		keys, bytes, err := shard.Database.size()
+		if err != nil {
+			return nil, err
+		}
+		now, ops := time.Now(), shard.ops.Load()
+		rate := 0.0
+		if last := shard.sampled; !last.at.IsZero() && now.After(last.at) {
+			rate = float64(ops-last.ops) / now.Sub(last.at).Seconds()
+		}
+		shard.sampled = opsSample{ops: ops, at: now}
+		stats = append(stats, ShardStats{ID: shard.ID, Range: ranges[i], Keys: keys, Bytes: bytes, OpsPerSec: rate})
+	}
+	return stats, nil
+}
+
+//  Function for counting the keys in the database and the bytes of keys and
+//  values. The first call goes through everything, under the lock, from
+//  then on put and remove keep the count up to date so it's read straight
+//  off.
+func (db *db) size() (int, int64, error) {
+	db.lock.RLock()
+	if db.sized {
+		defer db.lock.RUnlock()
+		return db.keys, db.bytes, nil
+	}
+	db.lock.RUnlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.sized {
+		return db.keys, db.bytes, nil
+	}
+	keys, bytes := 0, int64(0)
+	err := db.engine.Iterate(func(key, value string) bool {
+		keys++
+		bytes += int64(len(key) + len(value))
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	db.keys, db.bytes, db.sized = keys, bytes, true
+	return keys, bytes, nil
+}
+
+// Function for putting key into the engine, counting it if the size is
+// being kept. Caller holds the lock.
+func (db *db) put(key, value string) error {
+	if db.sized {
+		old, err := db.engine.Get(key)
+		switch {
+		case err == nil:
+			db.bytes += int64(len(value) - len(old))
+		case err == ErrNotFound:
+			db.keys++
+			db.bytes += int64(len(key) + len(value))
+		default:
+			// Counted again next time
+			db.sized = false
+		}
+	}
+	return db.engine.Put(key, value)
+}
+
+// Same as put, for taking key out of the engine
+func (db *db) remove(key string) error {
+	if db.sized {
+		old, err := db.engine.Get(key)
+		switch {
+		case err == nil:
+			db.keys--
+			db.bytes -= int64(len(key) + len(old))
+		case err != ErrNotFound:
+			db.sized = false
+		}
+	}
+	return db.engine.Delete(key)
+}
+
+// A split or merge the rebalancer made
+type RebalanceAction struct {
+	Kind   string `json:"kind"`
+	Shards []int  `json:"shards"`
+	At     string `json:"at,omitempty"`
+	Reason string `json:"reason"`
+}
+
+//  Function for making at most one split or merge, whichever the shards need
+//  most. Splits come first, the shard furthest over a threshold is split at
+//  its median key. Otherwise the coldest pair of neighbours under the merge
+//  thresholds is merged. Returns nil if nothing needed doing.
+func (sdb *ShardedDB) Rebalance(opts RebalanceOptions) (*RebalanceAction, error) {
+	opts = opts.withDefaults()
+	if _, err := sdb.rangedPartitioner(); err != nil {
+		return nil, err
+	}
+	stats, err := sdb.ShardStats()
+	if err != nil {
+		return nil, err
+	}
+	limiter := &rateLimiter{rate: float64(opts.MoveBytesPerSec)}
+
+	if len(stats) < opts.MaxShards {
+		sort.Slice(stats, func(i, j int) bool { return splitPressure(stats[i], opts) > splitPressure(stats[j], opts) })
+		for _, shard := range stats {
+			if splitPressure(shard, opts) <= 1 {
+				break
+			}
+			at, ok := sdb.splitPoint(shard.ID)
+			if !ok {
+				continue
+			}
+			if _, err := sdb.splitShard(shard.ID, at, limiter); err != nil {
+				return nil, err
+			}
+			return &RebalanceAction{Kind: "split", Shards: []int{shard.ID}, At: at, Reason: splitReason(shard, opts)}, nil
+		}
+	}
+
+	if len(stats) > opts.MinShards {
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Range[0] < stats[j].Range[0] })
+		best := -1
+		for i := 0; i+1 < len(stats); i++ {
+			a, b := stats[i], stats[i+1]
+			if a.Range[1]+1 != b.Range[0] || a.Keys+b.Keys >= opts.MergeKeys ||
+				a.Bytes+b.Bytes >= opts.MergeBytes || a.OpsPerSec+b.OpsPerSec >= opts.MergeOpsPerSec {
+				continue
+			}
+			if best < 0 || a.OpsPerSec+b.OpsPerSec < stats[best].OpsPerSec+stats[best+1].OpsPerSec {
+				best = i
+			}
+		}
+		if best >= 0 {
+			a, b := stats[best], stats[best+1]
+			if _, err := sdb.mergeShards(a.ID, b.ID, limiter); err != nil {
+				return nil, err
+			}
+			reason := fmt.Sprintf("%d keys, %d bytes and %.1f ops/sec together", a.Keys+b.Keys, a.Bytes+b.Bytes, a.OpsPerSec+b.OpsPerSec)
+			return &RebalanceAction{Kind: "merge", Shards: []int{a.ID, b.ID}, Reason: reason}, nil
+		}
+	}
+	return nil, nil
+}
+
+// How far over its worst split threshold a shard is, over 1 means split it
+func splitPressure(shard ShardStats, opts RebalanceOptions) float64 {
+	return max(float64(shard.Keys)/float64(opts.SplitKeys),
+		float64(shard.Bytes)/float64(opts.SplitBytes),
+		shard.OpsPerSec/opts.SplitOpsPerSec)
+}
+
+func splitReason(shard ShardStats, opts RebalanceOptions) string {
+	switch {
+	case shard.Keys > opts.SplitKeys:
+		return fmt.Sprintf("%d keys, over %d", shard.Keys, opts.SplitKeys)
+	case shard.Bytes > opts.SplitBytes:
+		return fmt.Sprintf("%d bytes, over %d", shard.Bytes, opts.SplitBytes)
+	}
+	return fmt.Sprintf("%.1f ops/sec, over %.1f", shard.OpsPerSec, opts.SplitOpsPerSec)
+}
+
+// Function for picking where to split a shard, the position of its median
+// key. False if all its keys are at the bottom of its Range.
+func (sdb *ShardedDB) splitPoint(id int) (string, bool) {
+	partitioner, err := sdb.rangedPartitioner()
+	if err != nil {
+		return "", false
+	}
+	sdb.lock.RLock()
+	shard, err := shardByID(id, sdb.Shards)
+	var bottom int
+	if err == nil {
+		bottom = shard.Range[0]
+	}
+	sdb.lock.RUnlock()
+	if err != nil {
+		return "", false
+	}
+	positions := []int{}
+	err = shard.Database.forEachKeyUnlocked(func(key string) {
+		if position, err := partitioner.position(key); err == nil {
+			positions = append(positions, position)
+		}
+	})
+	if err != nil || len(positions) == 0 {
+		return "", false
+	}
+	sort.Ints(positions)
+	for _, position := range positions[len(positions)/2:] {
+		if position > bottom {
+			return strconv.Itoa(position), true
+		}
+	}
+	return "", false
+}
+
+//  Function for rebalancing every opts.Interval until stop is called.
+//  Databases that use the ring partitioner have nothing to rebalance.
+func (sdb *ShardedDB) StartRebalancing(opts RebalanceOptions) (stop func()) {
+	opts = opts.withDefaults()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			action, err := sdb.Rebalance(opts)
+			if err == ErrNotRanged {
+				return
+			}
+			if err != nil {
+				fmt.Printf("Error rebalancing %s: %v\n", sdb.basedFilename, err)
+			} else if action != nil {
+				fmt.Printf("Rebalanced %s: %s of shards %v, %s\n", sdb.basedFilename, action.Kind, action.Shards, action.Reason)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Spaces out work so it averages no more than rate units a second. A nil
+// limiter doesn't limit.
+type rateLimiter struct {
+	rate  float64
+	start time.Time
+	used  float64
+}
+
+// Function for accounting for n units, sleeping if they're ahead of the rate
+func (limiter *rateLimiter) wait(n int64) {
+	if limiter == nil || limiter.rate <= 0 {
+		return
+	}
+	if limiter.start.IsZero() {
+		limiter.start = time.Now()
+	}
+	limiter.used += float64(n)
+	due := limiter.start.Add(time.Duration(limiter.used / limiter.rate * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Function for rebalancing until there's nothing left to do
+func rebalanceAll(t *testing.T, sdb *ShardedDB, opts RebalanceOptions) []*RebalanceAction {
+	actions := []*RebalanceAction{}
+	for i := 0; i < 20; i++ {
+		action, err := sdb.Rebalance(opts)
+		require.NoError(t, err)
+		if action == nil {
+			return actions
+		}
+		actions = append(actions, action)
+	}
+	t.Fatal("rebalancing never settled")
+	return nil
+}
+
+func TestRebalanceBySize(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 999}}, filepath.Join(t.TempDir(), "size"), 1, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i < 300; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"))
+	}
+
+	// Only size counts here, the writes themselves would make the shards hot
+	opts := RebalanceOptions{SplitKeys: 100, MergeKeys: 50, SplitOpsPerSec: 1e9, MergeOpsPerSec: 1e9}
+	actions := rebalanceAll(t, sdb, opts)
+	require.NotEmpty(t, actions)
+	for _, action := range actions {
+		assert.Equal(t, "split", action.Kind)
+	}
+	stats, err := sdb.ShardStats()
+	require.NoError(t, err)
+	total := 0
+	for _, shard := range stats {
+		assert.LessOrEqual(t, shard.Keys, 100)
+		total += shard.Keys
+	}
+	assert.Equal(t, 300, total)
+
+	// Emptied out, the shards are merged back together
+	for i := 30; i < 300; i++ {
+		require.NoError(t, sdb.Delete(strconv.Itoa(i)))
+	}
+	actions = rebalanceAll(t, sdb, opts)
+	require.NotEmpty(t, actions)
+	for _, action := range actions {
+		assert.Equal(t, "merge", action.Kind)
+	}
+	require.Len(t, sdb.Shards, 1)
+	assert.Equal(t, [2]int{0, 999}, sdb.Shards[0].Range)
+	for i := 0; i < 30; i++ {
+		_, err := sdb.Get(strconv.Itoa(i))
+		assert.NoError(t, err)
+	}
+}
+
+func TestRebalanceHotShard(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, filepath.Join(t.TempDir(), "hot"), 0, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"))
+	}
+	// The first stats start the ops clock
+	_, err := sdb.ShardStats()
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := sdb.Get(strconv.Itoa(100 + i%100))
+		require.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	action, err := sdb.Rebalance(RebalanceOptions{SplitOpsPerSec: 100, MergeOpsPerSec: 1})
+	require.NoError(t, err)
+	require.NotNil(t, action)
+	assert.Equal(t, "split", action.Kind)
+	assert.Equal(t, []int{1}, action.Shards)
+	assert.Contains(t, action.Reason, "ops/sec")
+	assert.Len(t, sdb.Shards, 3)
+}
+
+// Sizes are kept as keys are written, overwritten and deleted, without going
+// through everything again
+func TestShardSizeKeptUpToDate(t *testing.T) {
+	database := NewDb(filepath.Join(t.TempDir(), "sized"))
+	defer database.Close()
+	require.NoError(t, database.Set("a", "1"))
+	keys, bytes, err := database.size()
+	require.NoError(t, err)
+	assert.Equal(t, 1, keys)
+	assert.Equal(t, int64(2), bytes)
+
+	require.NoError(t, database.Set("a", "1234"))
+	require.NoError(t, database.Set("bb", "22"))
+	require.NoError(t, database.Set("c", "3"))
+	require.NoError(t, database.Delete("c"))
+	_, err = database.applyCommitted([]Record{{LSN: 100, Type: RecordDelete, Key: "bb"}})
+	require.NoError(t, err)
+	keys, bytes, err = database.size()
+	require.NoError(t, err)
+	assert.Equal(t, 1, keys)
+	assert.Equal(t, int64(5), bytes)
+}
+
+// Stats can be taken while a shard is being split
+func TestShardStatsDuringSplit(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 999}}, filepath.Join(t.TempDir(), "stats"), 0, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i < 1000; i += 10 {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for at := 500; at > 0; at /= 2 {
+			sdb.SplitShard(0, strconv.Itoa(at))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			stats, err := sdb.ShardStats()
+			require.NoError(t, err)
+			total := 0
+			for _, shard := range stats {
+				total += shard.Keys
+			}
+			assert.Equal(t, 100, total)
+			return
+		default:
+			_, err := sdb.ShardStats()
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{rate: 10000}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.wait(1000)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	var unlimited *rateLimiter
+	start = time.Now()
+	unlimited.wait(1 << 30)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
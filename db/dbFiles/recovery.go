@@ -0,0 +1,175 @@
+package db
+
+import (
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// What opening a single database found and did
+type RecoveryReport struct {
+	Filename        string
+	SnapshotLSN     uint64
+	RecordsReplayed int
+	BytesTruncated  int64
+	Duration        time.Duration
+}
+
+//  Recovery of one shard.
+//  ReplicaMismatches lists the replicas whose data didn't match the primary
+//  once everything was replayed.
+type ShardRecoveryReport struct {
+	ShardID           int
+	Primary           RecoveryReport
+	Replicas          []RecoveryReport
+	ReplicaMismatches []string
+	Duration          time.Duration
+}
+
+type ShardedRecoveryReport struct {
+	Shards          []ShardRecoveryReport
+	RecordsReplayed int
+	BytesTruncated  int64
+	Duration        time.Duration
+}
+
+// Function for opening a database from disk: loads the newest good snapshot
+// and replays the WAL records that came after it
+func OpenDb(filename string, opts Options) (*db, *RecoveryReport, error) {
+	start := time.Now()
+	database := newDb(filename, opts)
+	report := &RecoveryReport{
+		Filename:       filename,
+		BytesTruncated: database.wal.Truncated(),
+	}
+	if err := database.engineErr(); err != nil {
+		database.Close()
+		return nil, nil, fmt.Errorf("loading %s: %w", filename, err)
+	}
+	report.SnapshotLSN = database.lastLSN
+	replayed, err := database.replay()
+	if err != nil {
+		database.Close()
+		return nil, nil, fmt.Errorf("replaying %s: %w", filename, err)
+	}
+	report.RecordsReplayed = replayed
+	report.Duration = time.Since(start)
+	return database, report, nil
+}
+
+//  Function for opening a sharded database from disk.
+//  The shards, their Ranges and their members come from the shard map, it's
+//  an error if that doesn't match the files on disk. sharedRanges and
+//  replicas only matter for databases that don't have a shard map yet.
+//  Every primary and replica goes through OpenDb, then each replica is
+//  checked against its primary and starts streaming its WAL again. Members
+//  of raft shards rejoin their groups instead, replaying nothing until
+//  entries are committed again.
+func OpenShardedDB(sharedRanges [][2]int, basedFilename string, replicas int, opts Options) (*ShardedDB, *ShardedRecoveryReport, error) {
+	start := time.Now()
+	opts = opts.withSharedCache()
+	shardMap, partitioner, changed, err := openShardMap(basedFilename, opts, sharedRanges, replicas)
+	if err != nil {
+		return nil, nil, err
+	}
+	shardedDb := &ShardedDB{cache: opts.BlockCache, partitioner: partitioner,
+		basedFilename: basedFilename, replicas: replicas, opts: opts,
+		epoch: shardMap.Epoch, shardMap: shardMap,
+		consensus: shardMap.Consensus, transport: opts.raftTransport()}
+	open := OpenDb
+	if shardedDb.consensus == ConsensusRaft {
+		open = openRaftMember
+	}
+	dir := filepath.Dir(basedFilename)
+	report := &ShardedRecoveryReport{}
+	for _, entry := range shardMap.Shards {
+		shardStart := time.Now()
+		shard := &Shard{ID: entry.ID, Range: entry.Range}
+		shardReport := ShardRecoveryReport{ShardID: entry.ID}
+
+		primary, primaryReport, err := open(filepath.Join(dir, entry.Primary), opts)
+		if err != nil {
+			shardedDb.Close()
+			return nil, nil, err
+		}
+		shard.Database = primary
+		shardReport.Primary = *primaryReport
+		report.add(primaryReport)
+		shardedDb.Shards = append(shardedDb.Shards, shard)
+
+		for _, replicaFilename := range entry.Replicas {
+			replica, replicaReport, err := open(filepath.Join(dir, replicaFilename), opts)
+			if err != nil {
+				shardedDb.Close()
+				return nil, nil, err
+			}
+			shard.Replicas = append(shard.Replicas, replica)
+			shardReport.Replicas = append(shardReport.Replicas, *replicaReport)
+			report.add(replicaReport)
+			// A replica that's behind catches up from the primary's WAL, one
+			// that's ahead or has the same LSN but different data has gone
+			// its own way
+			ahead := replica.lastLSN > primary.lastLSN
+			if shardedDb.consensus == ConsensusRaft {
+				continue
+			}
+			if ahead || (replica.lastLSN == primary.lastLSN && replica.digest() != primary.digest()) {
+				fmt.Printf("Replica %s does not match primary %s\n", replica.filename, primary.filename)
+				shardReport.ReplicaMismatches = append(shardReport.ReplicaMismatches, replica.filename)
+			}
+		}
+		if err := shard.settleEpoch(entry.Epoch); err != nil {
+			shardedDb.Close()
+			return nil, nil, err
+		}
+		if shard.Epoch != entry.Epoch {
+			changed = true
+		}
+		// Replicas carry on streaming from the last LSN they have
+		if err := shardedDb.startShard(shard); err != nil {
+			shardedDb.Close()
+			return nil, nil, err
+		}
+		shardReport.Duration = time.Since(shardStart)
+		report.Shards = append(report.Shards, shardReport)
+	}
+	if changed {
+		if err := shardedDb.writeLayout(shardedDb.Shards); err != nil {
+			shardedDb.Close()
+			return nil, nil, err
+		}
+	}
+	report.Duration = time.Since(start)
+	return shardedDb, report, nil
+}
+
+func (report *ShardedRecoveryReport) add(member *RecoveryReport) {
+	report.RecordsReplayed += member.RecordsReplayed
+	report.BytesTruncated += member.BytesTruncated
+}
+
+// Function for summarising the contents of a database so two copies can be
+// compared, independent of the order the engine iterates in
+func (db *db) digest() uint32 {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	store := make(map[string]string)
+	db.engine.Iterate(func(key, value string) bool {
+		store[key] = value
+		return true
+	})
+	keys := make([]string, 0, len(store))
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := crc32.New(crcTable)
+	for _, key := range keys {
+		value := store[key]
+		hash.Write([]byte(strconv.Itoa(len(key)) + ":" + key + strconv.Itoa(len(value)) + ":" + value))
+	}
+	return hash.Sum32()
+}
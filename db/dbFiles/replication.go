@@ -0,0 +1,351 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultReplicationTimeout = 5 * time.Second
+
+// A replica has records its primary doesn't, it can't stream from it
+var ErrReplicaDiverged = errors.New("replica is ahead of its primary")
+
+// The write is on the primary, not enough replicas applied it in time
+var ErrReplicationTimeout = errors.New("replicas didn't apply the write in time")
+
+// For waitReplicated, every one of the replicas
+const allReplicas = -1
+
+//  A replica streaming a primary's WAL.
+//  acked is the last LSN the replica has applied and reported back,
+//  caughtUp when it last had everything the primary had (unix nanoseconds, 0
+//  for never). err is why the stream stopped if it did, guarded by the
+//  primary's replication lock. Closing stop ends the stream, done is closed
+//  once it has.
+type follower struct {
+	replica  *db
+	epoch    uint64
+	acked    atomic.Uint64
+	caughtUp atomic.Int64
+	err      error
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+//  The replicas streaming a db's WAL, see follow.
+//  changed is closed when a replica acknowledges records or its stream
+//  stops, and replaced with a new one.
+type replication struct {
+	lock      sync.Mutex
+	followers map[*db]*follower
+	changed   chan struct{}
+}
+
+// How far a replica has got streaming its primary's WAL
+type ReplicaStatus struct {
+	Member     string `json:"member"`
+	AppliedLSN uint64 `json:"applied_lsn"`
+	Lag        uint64 `json:"lag"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Caller holds the lock
+func (r *replication) notify() {
+	if r.changed != nil {
+		close(r.changed)
+	}
+	r.changed = make(chan struct{})
+}
+
+// Caller holds the lock
+func (r *replication) add(f *follower) {
+	if r.followers == nil {
+		r.followers = make(map[*db]*follower)
+	}
+	r.followers[f.replica] = f
+}
+
+//  Function for streaming the db's WAL to replica, picking up after the last
+//  record replica has. Records are applied in epoch. A stream to replica
+//  that's already running in epoch is left alone, one that stopped is
+//  started again, unless it can't ever catch up from this WAL, then the
+//  reason it stopped is returned.
+func (db *db) follow(replica *db, epoch uint64) error {
+	r := &db.replication
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if f := r.followers[replica]; f != nil {
+		switch {
+		case f.err == nil && f.epoch == epoch:
+			return nil
+		case errors.Is(f.err, ErrWALGap), errors.Is(f.err, ErrReplicaDiverged):
+			return f.err
+		}
+		close(f.stop)
+	}
+	f := &follower{replica: replica, epoch: epoch, stop: make(chan struct{}), done: make(chan struct{})}
+	f.acked.Store(replica.appliedLSN())
+	if f.acked.Load() >= db.wal.LastLSN() {
+		f.caughtUp.Store(time.Now().UnixNano())
+	}
+	r.add(f)
+	// Records the replica doesn't have yet stay put from the start
+	db.wal.hold(f, f.acked.Load())
+	go db.ship(f)
+	return nil
+}
+
+// Function for ending the stream to replica, without waiting for it. The
+// records it was keeping in the WAL are let go straight away.
+func (db *db) unfollow(replica *db) {
+	r := &db.replication
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if f := r.followers[replica]; f != nil {
+		close(f.stop)
+		db.wal.release(f)
+		delete(r.followers, replica)
+		r.notify()
+	}
+}
+
+// Function for ending every stream from the db and waiting for them to finish
+func (db *db) stopFollowers() {
+	r := &db.replication
+	r.lock.Lock()
+	followers := r.followers
+	r.followers = nil
+	for _, f := range followers {
+		close(f.stop)
+	}
+	r.notify()
+	r.lock.Unlock()
+	for _, f := range followers {
+		<-f.done
+	}
+}
+
+//  Function for shipping the db's WAL records to f.replica in order as
+//  they're appended, until f is stopped or something goes wrong.
+//  The WAL keeps everything the replica hasn't acknowledged.
+func (db *db) ship(f *follower) {
+	defer close(f.done)
+	defer db.wal.release(f)
+	applied := f.acked.Load()
+	err := func() error {
+		if last := db.wal.LastLSN(); applied > last {
+			return fmt.Errorf("%w: %s is at LSN %d, %s at %d", ErrReplicaDiverged, f.replica.filename, applied, db.filename, last)
+		}
+		for {
+			appended, err := db.wal.appendedAfter(applied)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-f.stop:
+				return nil
+			case <-appended:
+			}
+			// Stopping wins over records that came in at the same time
+			select {
+			case <-f.stop:
+				return nil
+			default:
+			}
+			records, err := db.wal.entriesAfter(applied)
+			if err != nil {
+				return err
+			}
+			if applied, err = f.replica.applyShipped(f.epoch, records); err != nil {
+				return err
+			}
+			f.acked.Store(applied)
+			if applied >= db.wal.LastLSN() {
+				f.caughtUp.Store(time.Now().UnixNano())
+			}
+			db.replication.lock.Lock()
+			// A stopped stream has let go of its records already
+			select {
+			case <-f.stop:
+			default:
+				db.wal.hold(f, applied)
+			}
+			db.replication.notify()
+			db.replication.lock.Unlock()
+		}
+	}()
+	if err == nil {
+		return
+	}
+	r := &db.replication
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f.err = err
+	r.notify()
+	select {
+	case <-f.stop:
+	default:
+		fmt.Printf("Replication from %s to %s stopped at LSN %d: %v\n", db.filename, f.replica.filename, applied, err)
+	}
+}
+
+//  Function for waiting until needed of replicas have applied lsn, or every
+//  one of them for allReplicas. A replica whose stream has stopped, or that
+//  isn't streaming, doesn't have it. After the db's ReplicationTimeout it's
+//  ErrReplicationTimeout, the write is still on the db.
+func (db *db) waitReplicated(lsn uint64, replicas []*db, needed int) error {
+	if needed == allReplicas {
+		needed = len(replicas)
+	}
+	timer := time.NewTimer(db.opts.ReplicationTimeout)
+	defer timer.Stop()
+	r := &db.replication
+	for {
+		r.lock.Lock()
+		missing := []string{}
+		applied := 0
+		for _, replica := range replicas {
+			f := r.followers[replica]
+			switch {
+			case f == nil:
+				missing = append(missing, replica.filename+" (not streaming)")
+			case f.acked.Load() >= lsn:
+				applied++
+			case f.err != nil:
+				missing = append(missing, fmt.Sprintf("%s (stopped: %v)", replica.filename, f.err))
+			default:
+				missing = append(missing, replica.filename)
+			}
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.lock.Unlock()
+		if applied >= needed {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s hadn't reached LSN %d after %v", ErrReplicationTimeout, strings.Join(missing, ", "), lsn, db.opts.ReplicationTimeout)
+		}
+	}
+}
+
+//  Function for finding how far behind the db replica could be, 0 if it has
+//  everything the db has, otherwise how long since it last did. A replica
+//  that hasn't caught up since it started streaming is as stale as can be.
+func (db *db) staleness(replica *db) time.Duration {
+	if replica.appliedLSN() >= db.wal.LastLSN() {
+		return 0
+	}
+	r := &db.replication
+	r.lock.Lock()
+	f := r.followers[replica]
+	r.lock.Unlock()
+	if f == nil || f.caughtUp.Load() == 0 {
+		return math.MaxInt64
+	}
+	return time.Since(time.Unix(0, f.caughtUp.Load()))
+}
+
+// Function for reporting how far each of replicas has got streaming from
+// the db
+func (db *db) replicationStatus(replicas []*db) []ReplicaStatus {
+	last := db.wal.LastLSN()
+	r := &db.replication
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	statuses := []ReplicaStatus{}
+	for _, replica := range replicas {
+		status := ReplicaStatus{Member: filepath.Base(replica.filename), AppliedLSN: replica.appliedLSN()}
+		if f := r.followers[replica]; f != nil && f.err != nil {
+			status.Error = f.err.Error()
+		}
+		if last > status.AppliedLSN {
+			status.Lag = last - status.AppliedLSN
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+//  Function for applying records shipped from the primary's WAL, made in
+//  epoch. They go into the replica's own WAL under the primary's LSNs, so
+//  after a restart it picks up where it left off. Records it already has are
+//  skipped. Returns the LSN of the last record it has.
+func (db *db) applyShipped(epoch uint64, records []Record) (uint64, error) {
+	db.lock.Lock()
+	err := db.engineErr()
+	if err == nil {
+		err = db.checkEpoch(epoch)
+	}
+	for _, record := range records {
+		if err != nil {
+			break
+		}
+		if record.LSN <= db.wal.LastLSN() {
+			continue
+		}
+		if err = db.wal.appendShipped(record); err != nil {
+			break
+		}
+		switch record.Type {
+		case RecordSet:
+			err = db.put(record.Key, record.Value)
+		case RecordDelete:
+			err = db.remove(record.Key)
+		}
+		db.lastLSN = record.LSN
+	}
+	applied := db.wal.LastLSN()
+	db.lock.Unlock()
+	if err != nil {
+		return applied, err
+	}
+	return applied, db.wal.Commit(applied)
+}
+
+// Function for filling an empty db with a snapshot of its primary taken at
+// lsn, records shipped after it follow on from there
+func (db *db) installSnapshot(entries []KeyValue, lsn uint64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.engineErr(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := db.put(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	db.lastLSN = lsn
+	db.wal.SkipTo(lsn)
+	return nil
+}
+
+// LSN of the last record in the db's WAL, a replica has everything up to
+// there (a restart replays it) and streams from there
+func (db *db) appliedLSN() uint64 {
+	return db.wal.LastLSN()
+}
+
+//  Function for making sure every replica is streaming the primary's WAL in
+//  the shard's epoch. Returns the replicas that can't catch up from it, and
+//  why, they have to be replaced. Caller holds the lock.
+func (shard *Shard) replicate() map[*db]error {
+	lost := make(map[*db]error)
+	for _, replica := range shard.Replicas {
+		if err := shard.Database.follow(replica, shard.Epoch); err != nil {
+			lost[replica] = err
+		}
+	}
+	return lost
+}
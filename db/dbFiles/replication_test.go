@@ -0,0 +1,102 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Replicas end up with the primary's records under the primary's LSNs
+func TestReplicasStreamWAL(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, filepath.Join(t.TempDir(), "stream"), 2, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprint(i), "value"))
+	}
+	require.NoError(t, sdb.Delete("7"))
+	// Nothing to delete, nothing logged
+	assert.ErrorIs(t, sdb.Delete("7"), ErrItemDoesNotExist)
+
+	shard := sdb.Shards[0]
+	primaryRecords := shard.Database.wal.GetEntries()
+	require.Len(t, primaryRecords, 51)
+	for _, replica := range shard.Replicas {
+		assert.Equal(t, primaryRecords, replica.wal.GetEntries())
+		assert.Equal(t, shard.Database.digest(), replica.digest())
+	}
+	info := sdb.ShardInfo()[0]
+	assert.Equal(t, uint64(51), info.LSN)
+	require.Len(t, info.Replication, 2)
+	for _, status := range info.Replication {
+		assert.Equal(t, uint64(51), status.AppliedLSN)
+		assert.Zero(t, status.Lag)
+		assert.Empty(t, status.Error)
+	}
+}
+
+// A replica that missed records picks up from its last LSN once it's
+// opened again
+func TestReplicaResumesAfterRestart(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "resume")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, base, 1, DefaultOptions())
+	require.NoError(t, sdb.Set("1", "one"))
+	shard := sdb.Shards[0]
+	shard.Database.unfollow(shard.Replicas[0])
+	primaryOnly := WriteOptions{Concern: WritePrimary}
+	require.NoError(t, sdb.SetWithOptions("2", "two", primaryOnly))
+	require.NoError(t, sdb.DeleteWithOptions("1", primaryOnly))
+	assert.Equal(t, uint64(1), shard.Replicas[0].appliedLSN())
+	assert.Equal(t, uint64(2), sdb.ShardInfo()[0].Replication[0].Lag)
+	require.NoError(t, sdb.Close())
+
+	sdb, report, err := OpenShardedDB(nil, base, 1, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	// Being behind isn't a mismatch
+	assert.Empty(t, report.Shards[0].ReplicaMismatches)
+	shard = sdb.Shards[0]
+	replica := shard.Replicas[0]
+	assert.Eventually(t, func() bool { return replica.appliedLSN() == 3 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, shard.Database.digest(), replica.digest())
+	_, err = replica.Get("1")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// A replica the primary's WAL can't catch up any more is replaced. One that
+// fails holds up writes that need every replica, not ones that don't.
+func TestReplicaStreamFailures(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ReplicationTimeout = time.Second
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}}, filepath.Join(t.TempDir(), "failures"), 1, opts)
+	defer sdb.Close()
+	require.NoError(t, sdb.Set("1", "one"))
+	shard := sdb.Shards[0]
+	replica := shard.Replicas[0]
+
+	// The primary checkpoints away records the replica doesn't have
+	shard.Database.unfollow(replica)
+	primaryOnly := WriteOptions{Concern: WritePrimary}
+	require.NoError(t, sdb.SetWithOptions("2", "two", primaryOnly))
+	require.NoError(t, sdb.Save())
+	require.NoError(t, sdb.SetWithOptions("3", "three", primaryOnly))
+	require.NoError(t, sdb.Save())
+	require.NoError(t, shard.Database.follow(replica, shard.Epoch))
+	assert.Eventually(t, func() bool {
+		return errors.Is(shard.Database.follow(replica, shard.Epoch), ErrWALGap)
+	}, time.Second, 10*time.Millisecond)
+	sdb.CheckHealth(HealthOptions{})
+	sdb.repairs.Wait()
+	require.Len(t, shard.Replicas, 1)
+	assert.NotEqual(t, replica, shard.Replicas[0])
+	assert.Equal(t, shard.Database.digest(), shard.Replicas[0].digest())
+
+	require.NoError(t, shard.Replicas[0].Close())
+	require.NoError(t, sdb.SetWithOptions("4", "four", primaryOnly))
+	assert.Eventually(t, func() bool { return sdb.ShardInfo()[0].Replication[0].Error != "" }, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, sdb.Set("5", "five"), ErrReplicationTimeout)
+}
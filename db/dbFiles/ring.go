@@ -0,0 +1,567 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const DefaultVirtualNodes = 128
+
+// Seed for hashing ring points, so they don't line up with key hashes
+const ringPointSeed = 0x9747b28c
+
+var (
+	ErrNotRing      = errors.New("the database does not use the ring partitioner")
+	ErrUnknownShard = errors.New("no such shard")
+)
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+//  Consistent hash ring.
+//  Every shard owns virtualNodes points on a 32 bit ring, and a key belongs
+//  to the shard owning the first point at or after the key's hash (wrapping
+//  round past the top). Adding or removing a shard only changes who owns the
+//  arcs next to its own points, about 1/N of the keys.
+type HashRing struct {
+	shards       []int
+	virtualNodes int
+	points       []ringPoint
+}
+
+func NewHashRing(shardIDs []int, virtualNodes int) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	ring := &HashRing{shards: append([]int{}, shardIDs...), virtualNodes: virtualNodes}
+	for _, id := range shardIDs {
+		for v := 0; v < virtualNodes; v++ {
+			point := []byte(strconv.Itoa(id) + "#" + strconv.Itoa(v))
+			ring.points = append(ring.points, ringPoint{hash: murmur3(point, ringPointSeed), shard: id})
+		}
+	}
+	// Ties go to the lower shard ID, whatever order the shards came in
+	sort.Slice(ring.points, func(i, j int) bool {
+		a, b := ring.points[i], ring.points[j]
+		return a.hash < b.hash || (a.hash == b.hash && a.shard < b.shard)
+	})
+	return ring
+}
+
+// Position of a key on the ring
+func RingHash(key string) uint32 {
+	return murmur3([]byte(key), 0)
+}
+
+// Shard that owns hash, -1 if the ring is empty
+func (ring *HashRing) Owner(hash uint32) int {
+	if len(ring.points) == 0 {
+		return -1
+	}
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].shard
+}
+
+// IDs of the shards on the ring
+func (ring *HashRing) Shards() []int {
+	return append([]int{}, ring.shards...)
+}
+
+// Function for building the ring with shard added
+func (ring *HashRing) With(shard int) *HashRing {
+	return NewHashRing(append(ring.Shards(), shard), ring.virtualNodes)
+}
+
+// Function for building the ring with shard taken off
+func (ring *HashRing) Without(shard int) *HashRing {
+	remaining := []int{}
+	for _, id := range ring.shards {
+		if id != shard {
+			remaining = append(remaining, id)
+		}
+	}
+	return NewHashRing(remaining, ring.virtualNodes)
+}
+
+//  An arc of the ring that changes owner.
+//  It covers the hashes h with Start < h <= End, and wraps round past the
+//  top of the ring when Start >= End. Keys is how many keys are on it.
+type RingMove struct {
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+	Keys  int    `json:"keys"`
+}
+
+//  Function for working out which arcs change owner going from before to after.
+//  locate returns the index of the move a hash falls in, -1 if it stays put.
+//  Every point of either ring is a boundary, so each arc between neighbouring
+//  boundaries has one owner before and one after.
+func diffRings(before, after *HashRing) (moves []RingMove, locate func(hash uint32) int) {
+	boundaries := []uint32{}
+	for _, ring := range []*HashRing{before, after} {
+		for _, point := range ring.points {
+			boundaries = append(boundaries, point.hash)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	unique := boundaries[:0]
+	for i, hash := range boundaries {
+		if i == 0 || hash != boundaries[i-1] {
+			unique = append(unique, hash)
+		}
+	}
+	boundaries = unique
+
+	// arcs[i] is the move (hashes just below and up to) boundaries[i] is in
+	arcs := make([]int, len(boundaries))
+	for i, end := range boundaries {
+		arcs[i] = -1
+		from, to := before.Owner(end), after.Owner(end)
+		if from == to {
+			continue
+		}
+		start := boundaries[(i+len(boundaries)-1)%len(boundaries)]
+		if last := len(moves) - 1; last >= 0 && arcs[i-1] == last && moves[last].From == from && moves[last].To == to {
+			moves[last].End = end
+			arcs[i] = last
+			continue
+		}
+		moves = append(moves, RingMove{From: from, To: to, Start: start, End: end})
+		arcs[i] = len(moves) - 1
+	}
+
+	locate = func(hash uint32) int {
+		if len(boundaries) == 0 {
+			return -1
+		}
+		i := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] >= hash })
+		if i == len(boundaries) {
+			i = 0
+		}
+		return arcs[i]
+	}
+	return moves, locate
+}
+
+//  The ring partitioner, placement comes from a HashRing of the shards' IDs.
+//  The ring is rebuilt whenever the shards it's asked about change, so
+//  adding a shard to a ShardedDB is all it takes to put it on the ring.
+type ringPartitioner struct {
+	virtualNodes int
+	lock         sync.Mutex
+	ring         *HashRing
+}
+
+func newRingPartitioner(virtualNodes int) *ringPartitioner {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &ringPartitioner{virtualNodes: virtualNodes}
+}
+
+func (partitioner *ringPartitioner) Name() string { return RingPartitioner }
+
+// Function for getting the ring for shards, building it if they've changed
+func (partitioner *ringPartitioner) ringFor(shards []*Shard) *HashRing {
+	partitioner.lock.Lock()
+	defer partitioner.lock.Unlock()
+	if ring := partitioner.ring; ring != nil && len(ring.shards) == len(shards) {
+		same := true
+		for i, shard := range shards {
+			if ring.shards[i] != shard.ID {
+				same = false
+				break
+			}
+		}
+		if same {
+			return ring
+		}
+	}
+	partitioner.ring = NewHashRing(shardIDs(shards), partitioner.virtualNodes)
+	return partitioner.ring
+}
+
+func (partitioner *ringPartitioner) ShardFor(key string, shards []*Shard) (*Shard, error) {
+	return shardByID(partitioner.ringFor(shards).Owner(RingHash(key)), shards)
+}
+
+func (partitioner *ringPartitioner) ShardsFor(start, end string, shards []*Shard) ([]*Shard, error) {
+	return shards, nil
+}
+
+func (*ringPartitioner) Less(a, b string) bool   { return a < b }
+func (*ringPartitioner) After(key string) string { return keyAfter(key) }
+
+func (*ringPartitioner) scan(database *db, start, end, prefix string, n int, cache scanCache) ([]KeyValue, error) {
+	return database.scanBatch(start, end, n, cache)
+}
+
+func shardIDs(shards []*Shard) []int {
+	ids := []int{}
+	for _, shard := range shards {
+		ids = append(ids, shard.ID)
+	}
+	return ids
+}
+
+func shardByID(id int, shards []*Shard) (*Shard, error) {
+	for _, shard := range shards {
+		if shard.ID == id {
+			return shard, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownShard, id)
+}
+
+//  What adding or removing a shard on the ring does.
+//  Shard is the shard being added or removed, Moves the arcs that change
+//  owner, KeysMoved how many keys are on them out of TotalKeys.
+type RingPlan struct {
+	Shard     int        `json:"shard"`
+	Added     bool       `json:"added"`
+	Moves     []RingMove `json:"moves"`
+	KeysMoved int        `json:"keys_moved"`
+	TotalKeys int        `json:"total_keys"`
+}
+
+// Function for getting the ring partitioner, if the database uses one
+func (sdb *ShardedDB) ringPartitioner() (*ringPartitioner, error) {
+	partitioner, ok := sdb.partitioner.(*ringPartitioner)
+	if !ok {
+		return nil, ErrNotRing
+	}
+	return partitioner, nil
+}
+
+// Function for planning a change to the ring, counting the keys on each arc
+// that would move. Caller holds the lock.
+func (sdb *ShardedDB) planRing(shard int, added bool) (RingPlan, *HashRing, func(uint32) int, error) {
+	partitioner, err := sdb.ringPartitioner()
+	if err != nil {
+		return RingPlan{}, nil, nil, err
+	}
+	before := partitioner.ringFor(sdb.Shards)
+	after := before.With(shard)
+	if !added {
+		after = before.Without(shard)
+	}
+	plan := RingPlan{Shard: shard, Added: added}
+	var locate func(uint32) int
+	plan.Moves, locate = diffRings(before, after)
+	for _, source := range sdb.Shards {
+		err := source.Database.forEachKey(func(key string) {
+			plan.TotalKeys++
+			if i := locate(RingHash(key)); i >= 0 {
+				plan.Moves[i].Keys++
+				plan.KeysMoved++
+			}
+		})
+		if err != nil {
+			return RingPlan{}, nil, nil, err
+		}
+	}
+	return plan, after, locate, nil
+}
+
+// Function for reporting which key ranges adding a shard would move, without
+// adding it
+func (sdb *ShardedDB) PlanAddShard() (RingPlan, error) {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	plan, _, _, err := sdb.planRing(sdb.nextShardID(), true)
+	return plan, err
+}
+
+// Function for reporting which key ranges removing a shard would move,
+// without removing it
+func (sdb *ShardedDB) PlanRemoveShard(id int) (RingPlan, error) {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	if err := sdb.checkRemovable(id); err != nil {
+		return RingPlan{}, err
+	}
+	plan, _, _, err := sdb.planRing(id, false)
+	return plan, err
+}
+
+//  Function for adding a shard (and its replicas) to the ring.
+//  The keys on the arcs it takes over are copied to it, the new set of
+//  shards is recorded, then the keys are deleted from where they were.
+//  Reads and writes wait until it's done.
+func (sdb *ShardedDB) AddShard() (RingPlan, error) {
+	sdb.changes.Lock()
+	defer sdb.changes.Unlock()
+	if _, err := sdb.ringPartitioner(); err != nil {
+		return RingPlan{}, err
+	}
+	sdb.lock.RLock()
+	id := sdb.nextShardID()
+	sdb.lock.RUnlock()
+	shard, err := sdb.createShard(id)
+	if err != nil {
+		return RingPlan{}, err
+	}
+
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	plan, _, locate, err := sdb.planRing(id, true)
+	if err != nil {
+		sdb.destroyShard(shard)
+		return RingPlan{}, err
+	}
+	moved := make(map[*Shard][]string)
+	for _, source := range sdb.Shards {
+		entries, err := source.Database.collect(func(key string) bool {
+			return locate(RingHash(key)) >= 0
+		})
+		if err == nil {
+			err = shard.put(entries)
+		}
+		if err != nil {
+			sdb.destroyShard(shard)
+			return RingPlan{}, err
+		}
+		for _, entry := range entries {
+			moved[source] = append(moved[source], entry.Key)
+		}
+	}
+
+	sdb.forget(shard.filenames()...)
+	if err := sdb.writeLayout(append(sdb.Shards, shard)); err != nil {
+		sdb.destroyShard(shard)
+		return RingPlan{}, err
+	}
+	sdb.Shards = append(sdb.Shards, shard)
+	for source, sourceKeys := range moved {
+		source.remove(sourceKeys)
+	}
+	return plan, nil
+}
+
+//  Function for taking a shard off the ring.
+//  Its keys are copied to the shards that take over its arcs, the new set of
+//  shards is recorded, then the shard's files are deleted.
+//  Reads and writes wait until it's done.
+func (sdb *ShardedDB) RemoveShard(id int) (RingPlan, error) {
+	sdb.changes.Lock()
+	defer sdb.changes.Unlock()
+	sdb.lock.Lock()
+	defer sdb.lock.Unlock()
+	if err := sdb.checkRemovable(id); err != nil {
+		return RingPlan{}, err
+	}
+	plan, after, _, err := sdb.planRing(id, false)
+	if err != nil {
+		return RingPlan{}, err
+	}
+
+	shard, _ := shardByID(id, sdb.Shards)
+	remaining := []*Shard{}
+	for _, other := range sdb.Shards {
+		if other != shard {
+			remaining = append(remaining, other)
+		}
+	}
+	entries, err := shard.Database.collect(func(string) bool { return true })
+	if err != nil {
+		return RingPlan{}, err
+	}
+	targets := make(map[*Shard][]KeyValue)
+	for _, entry := range entries {
+		target, err := shardByID(after.Owner(RingHash(entry.Key)), remaining)
+		if err != nil {
+			return RingPlan{}, err
+		}
+		targets[target] = append(targets[target], entry)
+	}
+	for target, targetEntries := range targets {
+		if err := target.put(targetEntries); err != nil {
+			return RingPlan{}, err
+		}
+	}
+
+	sdb.discard(shard.filenames()...)
+	if err := sdb.writeLayout(remaining); err != nil {
+		sdb.forget(shard.filenames()...)
+		return RingPlan{}, err
+	}
+	sdb.Shards = remaining
+	sdb.destroyShard(shard)
+	return plan, nil
+}
+
+func (sdb *ShardedDB) checkRemovable(id int) error {
+	if _, err := sdb.ringPartitioner(); err != nil {
+		return err
+	}
+	if _, err := shardByID(id, sdb.Shards); err != nil {
+		return err
+	}
+	if len(sdb.Shards) == 1 {
+		return errors.New("can't remove the last shard")
+	}
+	return nil
+}
+
+// A new shard gets one past the highest ID
+func (sdb *ShardedDB) nextShardID() int {
+	next := 0
+	for _, shard := range sdb.Shards {
+		if shard.ID >= next {
+			next = shard.ID + 1
+		}
+	}
+	return next
+}
+
+//  Function for creating an empty shard and its replicas.
+//  Until the shard makes it into the layout its members are listed as
+//  discarded in the shard map, so whatever a crash part way leaves behind
+//  gets cleaned up. Anything left by an earlier attempt is thrown away first.
+func (sdb *ShardedDB) createShard(id int) (*Shard, error) {
+	filenames := []string{}
+	for i := -1; i < sdb.replicas; i++ {
+		filenames = append(filenames, memberFilename(sdb.basedFilename, id, i))
+	}
+	sdb.discard(filenames...)
+	sdb.lock.RLock()
+	err := sdb.writeLayout(sdb.Shards)
+	sdb.lock.RUnlock()
+	if err != nil {
+		sdb.forget(filenames...)
+		return nil, err
+	}
+
+	shard := &Shard{ID: id}
+	for i, filename := range filenames {
+		if err := removeDbFiles(filename); err != nil {
+			sdb.destroyShard(shard)
+			sdb.forget(filenames...)
+			return nil, err
+		}
+		member, _, err := OpenDb(filename, sdb.opts)
+		if err != nil {
+			sdb.destroyShard(shard)
+			sdb.forget(filenames...)
+			return nil, err
+		}
+		if i == 0 {
+			shard.Database = member
+		} else {
+			shard.Replicas = append(shard.Replicas, member)
+		}
+	}
+	if err := shard.settleEpoch(1); err != nil {
+		sdb.destroyShard(shard)
+		sdb.forget(filenames...)
+		return nil, err
+	}
+	if err := sdb.startShard(shard); err != nil {
+		sdb.destroyShard(shard)
+		sdb.forget(filenames...)
+		return nil, err
+	}
+	return shard, nil
+}
+
+// Function for getting rid of a shard that's out of the layout (or never
+// made it in)
+func (sdb *ShardedDB) destroyShard(shard *Shard) {
+	shard.destroy()
+	sdb.forget(shard.filenames()...)
+}
+
+// Function for writing entries to the shard, once the replicas have them
+// too it's done
+func (shard *Shard) put(entries []KeyValue) error {
+	var lsn uint64
+	for _, entry := range entries {
+		var err error
+		if lsn, err = shard.setAt(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	return shard.replicated(lsn, WriteAll)
+}
+
+// Function for deleting keys that have moved off the shard. They're already
+// elsewhere, so failures are only reported.
+func (shard *Shard) remove(keys []string) {
+	var lsn uint64
+	for _, key := range keys {
+		deleted, err := shard.deleteAt(key)
+		if err != nil {
+			fmt.Printf("Error removing moved key %q from %s: %v\n", key, shard.Database.filename, err)
+			continue
+		}
+		lsn = deleted
+	}
+	if err := shard.replicated(lsn, WriteAll); err != nil {
+		fmt.Printf("Error removing moved keys from shard %d: %v\n", shard.ID, err)
+	}
+}
+
+// Function for closing the shard's members and deleting their files
+func (shard *Shard) destroy() {
+	for _, member := range shard.members() {
+		if member == nil {
+			continue
+		}
+		member.Close()
+		if err := removeDbFiles(member.filename); err != nil {
+			fmt.Printf("Error removing %s: %v\n", member.filename, err)
+		}
+	}
+}
+
+// Function for deleting everything a db keeps on disk, its WAL segments and
+// whatever the engine wrote
+func removeDbFiles(filename string) error {
+	for _, pattern := range []string{filename + "_wal*", filename + ".*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err := os.RemoveAll(match); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Function for calling fn with every key in the database
+func (db *db) forEachKey(fn func(key string)) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.engine.Iterate(func(key, value string) bool {
+		fn(key)
+		return true
+	})
+}
+
+// Same as forEachKey without holding the lock, so writes carry on while it
+// goes through the keys (engines take care of their own concurrency). Keys
+// written in the meantime may or may not be seen.
+func (db *db) forEachKeyUnlocked(fn func(key string)) error {
+	db.lock.RLock()
+	engine := db.engine
+	db.lock.RUnlock()
+	return engine.Iterate(func(key, value string) bool {
+		fn(key)
+		return true
+	})
+}
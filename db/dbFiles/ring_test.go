@@ -0,0 +1,142 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Adding a fifth shard should take about a fifth of the keys, all of them
+// from the other shards onto the new one, and removing one of four should
+// only move that shard's keys
+func TestHashRingMovesOneNth(t *testing.T) {
+	before := NewHashRing([]int{0, 1, 2, 3}, 0)
+	cases := []struct {
+		name     string
+		after    *HashRing
+		added    bool
+		expected float64
+	}{
+		{"add", before.With(4), true, 1.0 / 5},
+		{"remove", before.Without(1), false, 1.0 / 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			moves, locate := diffRings(before, c.after)
+			moved := 0
+			const total = 20000
+			for i := 0; i < total; i++ {
+				hash := RingHash(fmt.Sprintf("key%d", i))
+				from, to := before.Owner(hash), c.after.Owner(hash)
+				move := locate(hash)
+				if from == to {
+					assert.Equal(t, -1, move)
+					continue
+				}
+				moved++
+				require.GreaterOrEqual(t, move, 0)
+				assert.Equal(t, from, moves[move].From)
+				assert.Equal(t, to, moves[move].To)
+				if c.added {
+					assert.Equal(t, 4, to)
+				} else {
+					assert.Equal(t, 1, from)
+				}
+			}
+			assert.InDelta(t, c.expected, float64(moved)/total, 0.05)
+		})
+	}
+}
+
+func TestShardedDBAddRemoveShard(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "ring")
+	opts := DefaultOptions()
+	opts.Partitioner = RingPartitioner
+	opts.VirtualNodes = 64
+	sdb := mustOpenShardedDB(t, make([][2]int, 3), base, 1, opts)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+	}
+	assertAll := func(sdb *ShardedDB) {
+		for i := 0; i < 1000; i++ {
+			value, err := sdb.Get(fmt.Sprintf("key%d", i))
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("value%d", i), value)
+		}
+	}
+
+	plan, err := sdb.PlanAddShard()
+	require.NoError(t, err)
+	assert.Equal(t, 3, plan.Shard)
+	assert.Equal(t, 1000, plan.TotalKeys)
+	assert.InDelta(t, 250, plan.KeysMoved, 100)
+	counted := 0
+	for _, move := range plan.Moves {
+		assert.Equal(t, 3, move.To)
+		counted += move.Keys
+	}
+	assert.Equal(t, plan.KeysMoved, counted)
+	// Planning doesn't change anything
+	assert.Len(t, sdb.Shards, 3)
+
+	added, err := sdb.AddShard()
+	require.NoError(t, err)
+	assert.Equal(t, plan.KeysMoved, added.KeysMoved)
+	require.Len(t, sdb.Shards, 4)
+	assertAll(sdb)
+	// Moved keys live on the new shard and its replica and nowhere else
+	for _, shard := range sdb.Shards {
+		count := 0
+		require.NoError(t, shard.Database.forEachKey(func(string) { count++ }))
+		if shard.ID == 3 {
+			assert.Equal(t, plan.KeysMoved, count)
+			assert.Equal(t, shard.Database.digest(), shard.Replicas[0].digest())
+		}
+	}
+	entries, _, err := sdb.Scan("", "", 0).Collect(0)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1000)
+	require.NoError(t, sdb.Close())
+
+	// The new shard is recorded, reopening with the original ranges finds it
+	sdb, _, err = OpenShardedDB(make([][2]int, 3), base, 1, Options{Partitioner: RingPartitioner})
+	require.NoError(t, err)
+	require.Len(t, sdb.Shards, 4)
+	assertAll(sdb)
+
+	_, _, err = OpenShardedDB(make([][2]int, 3), base, 1, Options{VirtualNodes: 32})
+	assert.Error(t, err)
+
+	removed, err := sdb.RemoveShard(1)
+	require.NoError(t, err)
+	for _, move := range removed.Moves {
+		assert.Equal(t, 1, move.From)
+	}
+	assert.Equal(t, []int{0, 2, 3}, shardIDs(sdb.Shards))
+	assertAll(sdb)
+	files, err := filepath.Glob(base + "_1*")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	_, err = sdb.RemoveShard(1)
+	assert.ErrorIs(t, err, ErrUnknownShard)
+	require.NoError(t, sdb.Close())
+
+	sdb, _, err = OpenShardedDB(make([][2]int, 3), base, 1, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	assert.Equal(t, []int{0, 2, 3}, shardIDs(sdb.Shards))
+	assertAll(sdb)
+}
+
+func TestRingChangesNeedRingPartitioner(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 100}}, filepath.Join(t.TempDir(), "range"), 0, DefaultOptions())
+	defer sdb.Close()
+	_, err := sdb.PlanAddShard()
+	assert.ErrorIs(t, err, ErrNotRing)
+	_, err = sdb.RemoveShard(0)
+	assert.ErrorIs(t, err, ErrNotRing)
+}
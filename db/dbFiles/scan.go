@@ -0,0 +1,314 @@
+package db
+
+import (
+	"sort"
+)
+
+// How many entries an Iterator fetches at a time
+const scanBatchSize = 256
+
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+//  Iterator over a range of keys in key order.
+//  Entries are fetched in batches and no lock is held in between, so a long
+//  scan doesn't hold up writes, but writes made during it may or may not
+//  show up in the batches still to come.
+//
+//	it := database.Scan("a", "b", 0)
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator struct {
+	// fetch returns up to n entries from start on, in key order
+	fetch func(start string, n int) ([]KeyValue, error)
+	// after returns the first key that could come after key, "" if there
+	// can't be one
+	after func(key string) string
+
+	start     string
+	remaining int // -1 for no limit
+	batch     []KeyValue
+	pos       int
+	exhausted bool
+	current   KeyValue
+	err       error
+}
+
+func newIterator(start string, limit int, fetch func(string, int) ([]KeyValue, error), after func(string) string) *Iterator {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &Iterator{fetch: fetch, after: after, start: start, remaining: limit}
+}
+
+// Function for moving to the next entry, false once there are none left or
+// something went wrong (see Err)
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.remaining == 0 {
+		return false
+	}
+	if it.pos == len(it.batch) {
+		if it.exhausted {
+			return false
+		}
+		n := scanBatchSize
+		if it.remaining > 0 && it.remaining < n {
+			n = it.remaining
+		}
+		batch, err := it.fetch(it.start, n)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.exhausted = len(batch) < n
+		if len(batch) == 0 {
+			return false
+		}
+		it.batch, it.pos = batch, 0
+		it.start = it.after(batch[len(batch)-1].Key)
+		if it.start == "" {
+			it.exhausted = true
+		}
+	}
+	it.current = it.batch[it.pos]
+	it.pos++
+	if it.remaining > 0 {
+		it.remaining--
+	}
+	return true
+}
+
+func (it *Iterator) Key() string   { return it.current.Key }
+func (it *Iterator) Value() string { return it.current.Value }
+func (it *Iterator) Err() error    { return it.err }
+
+// The start key for carrying on after the current entry, "" if nothing can
+// come after it
+func (it *Iterator) Resume() string {
+	return it.after(it.current.Key)
+}
+
+// Function for reading up to limit entries, and whether there are more after them
+func (it *Iterator) Collect(limit int) ([]KeyValue, bool, error) {
+	entries := []KeyValue{}
+	for (limit <= 0 || len(entries) < limit) && it.Next() {
+		entries = append(entries, it.current)
+	}
+	if it.err != nil {
+		return nil, false, it.err
+	}
+	more := false
+	if limit > 0 && len(entries) == limit && it.remaining != 0 {
+		if it.pos < len(it.batch) {
+			more = true
+		} else if !it.exhausted {
+			next, err := it.fetch(it.start, 1)
+			if err != nil {
+				return nil, false, err
+			}
+			more = len(next) > 0
+		}
+	}
+	return entries, more, nil
+}
+
+// Smallest key greater than key
+func keyAfter(key string) string {
+	return key + "\x00"
+}
+
+// Smallest key greater than every key starting with prefix, "" if there isn't one
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Function for scanning keys in [start, end) in key order, at most limit of
+// them (0 for no limit). An empty end means no upper bound.
+func (db *db) Scan(start, end string, limit int) *Iterator {
+	cache := scanCache{}
+	fetch := func(from string, n int) ([]KeyValue, error) {
+		return db.scanBatch(from, end, n, cache)
+	}
+	return newIterator(start, limit, fetch, keyAfter)
+}
+
+// Function for scanning every key starting with prefix, in key order
+func (db *db) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, prefixEnd(prefix), 0)
+}
+
+//  Function for reading up to n entries in [start, end). Engines that keep
+//  their keys sorted seek straight to start. The others have their keys in
+//  the range read and sorted on the first batch of a scan, later batches
+//  pick up from cache where the last one left off.
+func (db *db) scanBatch(start, end string, n int, cache scanCache) ([]KeyValue, error) {
+	inRange := func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+	db.lock.RLock()
+	if ordered, ok := db.engine.(OrderedEngine); ok {
+		defer db.lock.RUnlock()
+		entries := []KeyValue{}
+		err := ordered.IterateFrom(start, func(key, value string) bool {
+			if !inRange(key) {
+				return false
+			}
+			entries = append(entries, KeyValue{Key: key, Value: value})
+			return len(entries) < n
+		})
+		return entries, err
+	}
+	db.lock.RUnlock()
+
+	keys, err := db.sortedKeys(cache, inRange, func(a, b string) bool { return a < b })
+	if err != nil {
+		return nil, err
+	}
+	from := sort.SearchStrings(keys, start)
+	return db.readKeys(keys[from:], n, func(key string) bool { return !inRange(key) })
+}
+
+//  Function for getting the keys that pass match in the order less. They're
+//  read on the first batch of a scan and sorted once the lock is let go,
+//  then kept in cache for the batches after it.
+func (db *db) sortedKeys(cache scanCache, match func(key string) bool, less func(a, b string) bool) ([]string, error) {
+	if keys, cached := cache[db]; cached {
+		return keys, nil
+	}
+	keys, err := db.collectKeys(match)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	if cache != nil {
+		cache[db] = keys
+	}
+	return keys, nil
+}
+
+// Function for reading up to n of keys with their values, in order, up to
+// the first one that's past the end. Keys deleted since they were read are
+// skipped, keys written since don't show up, as with any scan.
+func (db *db) readKeys(keys []string, n int, past func(key string) bool) ([]KeyValue, error) {
+	entries := []KeyValue{}
+	for _, key := range keys {
+		if len(entries) == n || past(key) {
+			break
+		}
+		value, err := db.Get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, KeyValue{Key: key, Value: value})
+	}
+	return entries, nil
+}
+
+// Function for reading every key that passes match, in no order
+func (db *db) collectKeys(match func(key string) bool) ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	keys := []string{}
+	err := db.engine.Iterate(func(key, value string) bool {
+		if match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Function for reading every entry whose key passes match, in no order
+func (db *db) collect(match func(key string) bool) ([]KeyValue, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	entries := []KeyValue{}
+	err := db.engine.Iterate(func(key, value string) bool {
+		if match(key) {
+			entries = append(entries, KeyValue{Key: key, Value: value})
+		}
+		return true
+	})
+	return entries, err
+}
+
+//  Function for scanning keys in [start, end) across the shards, at most
+//  limit of them (0 for no limit), in the partitioner's key order.
+//  Only the shards the partitioner says can hold such keys are read.
+//  An empty end means no upper bound.
+func (sdb *ShardedDB) Scan(start, end string, limit int) *Iterator {
+	return sdb.scan(start, end, "", limit)
+}
+
+// Function for scanning every key starting with prefix
+func (sdb *ShardedDB) ScanPrefix(prefix string) *Iterator {
+	if sdb.partitioner.Name() == RangePartitioner {
+		// Integer keys with a prefix aren't a range, any shard can hold them
+		return sdb.scan("", "", prefix, 0)
+	}
+	return sdb.scan(prefix, prefixEnd(prefix), prefix, 0)
+}
+
+func (sdb *ShardedDB) scan(start, end, prefix string, limit int) *Iterator {
+	cache := scanCache{}
+	fetch := func(from string, n int) ([]KeyValue, error) {
+		return sdb.scanBatch(from, end, prefix, n, cache)
+	}
+	return newIterator(start, limit, fetch, sdb.partitioner.After)
+}
+
+// Function for reading up to n entries in [start, end) from every shard
+// that can hold them, merged in key order
+func (sdb *ShardedDB) scanBatch(start, end, prefix string, n int, cache scanCache) ([]KeyValue, error) {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	shards, err := sdb.partitioner.ShardsFor(start, end, sdb.Shards)
+	if err != nil {
+		return nil, err
+	}
+	sources := [][]KeyValue{}
+	for _, shard := range shards {
+		entries, err := sdb.partitioner.scan(shard.Database, start, end, prefix, n, cache)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, entries)
+	}
+	return mergeSorted(sources, n, sdb.partitioner.Less), nil
+}
+
+// Function for merging sorted lists into the first n entries overall. A key
+// on two shards at once, part way through being moved, comes up once.
+func mergeSorted(sources [][]KeyValue, n int, less func(a, b string) bool) []KeyValue {
+	merged := []KeyValue{}
+	for len(merged) < n {
+		next := -1
+		for i, source := range sources {
+			if len(source) > 0 && (next < 0 || less(source[0].Key, sources[next][0].Key)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if len(merged) == 0 || merged[len(merged)-1].Key != sources[next][0].Key {
+			merged = append(merged, sources[next][0])
+		}
+		sources[next] = sources[next][1:]
+	}
+	return merged
+}
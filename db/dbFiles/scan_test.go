@@ -0,0 +1,176 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func keys(entries []KeyValue) []string {
+	result := []string{}
+	for _, entry := range entries {
+		result = append(result, entry.Key)
+	}
+	return result
+}
+
+func TestDbScan(t *testing.T) {
+	for _, name := range EngineNames() {
+		t.Run(name, func(t *testing.T) {
+			database, _, err := OpenDb(filepath.Join(t.TempDir(), "scan"), Options{Engine: name})
+			require.NoError(t, err)
+			defer database.Close()
+
+			for i := 0; i < 1000; i++ {
+				require.NoError(t, database.Set(fmt.Sprintf("key%04d", i), strconv.Itoa(i)))
+			}
+			require.NoError(t, database.Set("other", "x"))
+
+			// Crosses several fetch batches
+			entries, more, err := database.Scan("key0100", "key0700", 0).Collect(0)
+			require.NoError(t, err)
+			assert.False(t, more)
+			require.Len(t, entries, 600)
+			for i, entry := range entries {
+				assert.Equal(t, fmt.Sprintf("key%04d", i+100), entry.Key)
+				assert.Equal(t, strconv.Itoa(i+100), entry.Value)
+			}
+
+			it := database.Scan("key0990", "", 5)
+			entries, more, err = it.Collect(0)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"key0990", "key0991", "key0992", "key0993", "key0994"}, keys(entries))
+			assert.False(t, more)
+
+			// Picking up where a page left off
+			it = database.Scan("key0995", "", 0)
+			entries, more, err = it.Collect(3)
+			require.NoError(t, err)
+			assert.True(t, more)
+			entries, more, err = database.Scan(it.Resume(), "", 0).Collect(3)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"key0998", "key0999", "other"}, keys(entries))
+			assert.False(t, more)
+
+			entries, _, err = database.ScanPrefix("key012").Collect(0)
+			require.NoError(t, err)
+			assert.Len(t, entries, 10)
+			assert.Equal(t, "key0120", entries[0].Key)
+			assert.Equal(t, "key0129", entries[9].Key)
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "abd", prefixEnd("abc"))
+	assert.Equal(t, "b", prefixEnd("a\xff"))
+	assert.Equal(t, "", prefixEnd("\xff\xff"))
+	assert.Equal(t, "", prefixEnd(""))
+}
+
+func TestShardedDBScan(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "sharded")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 100}, {101, 200}, {201, 300}}, base, 1, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i <= 300; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+
+	// In numeric order across the shard boundaries, not string order
+	entries, more, err := sdb.Scan("95", "205", 0).Collect(0)
+	require.NoError(t, err)
+	assert.False(t, more)
+	require.Len(t, entries, 110)
+	for i, entry := range entries {
+		assert.Equal(t, strconv.Itoa(95+i), entry.Key)
+		assert.Equal(t, "value"+strconv.Itoa(95+i), entry.Value)
+	}
+
+	it := sdb.Scan("0", "301", 0)
+	page, more, err := it.Collect(100)
+	require.NoError(t, err)
+	assert.True(t, more)
+	assert.Equal(t, "99", page[99].Key)
+	page, _, err = sdb.Scan(it.Resume(), "301", 0).Collect(100)
+	require.NoError(t, err)
+	assert.Equal(t, "100", page[0].Key)
+
+	entries, _, err = sdb.ScanPrefix("25").Collect(0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"25", "250", "251", "252", "253", "254", "255", "256", "257", "258", "259"}, keys(entries))
+
+	// Only the shards the range overlaps are read
+	sdb.Shards[0].Database.engine = failedEngine{errors.New("shard 0 is down")}
+	entries, _, err = sdb.Scan("150", "250", 0).Collect(0)
+	require.NoError(t, err)
+	assert.Len(t, entries, 100)
+	_, _, err = sdb.Scan("50", "150", 0).Collect(0)
+	assert.Error(t, err)
+}
+
+//  A long scan of integer keys reads each shard's keys once and carries on
+//  from where it got to, batch after batch. Keys deleted part way through
+//  don't come up.
+func TestShardedDBLongScan(t *testing.T) {
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 999}, {1000, 1999}}, filepath.Join(t.TempDir(), "long"), 0, DefaultOptions())
+	defer sdb.Close()
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+	it := sdb.Scan("", "", 0)
+	seen := []string{}
+	for it.Next() {
+		seen = append(seen, it.Key())
+		if it.Key() == "10" {
+			require.NoError(t, sdb.Delete("900"))
+			require.NoError(t, sdb.Delete("1500"))
+		}
+	}
+	require.NoError(t, it.Err())
+	require.Len(t, seen, 1998)
+	assert.Equal(t, "0", seen[0])
+	assert.Equal(t, "1999", seen[len(seen)-1])
+	assert.NotContains(t, seen, "900")
+	assert.NotContains(t, seen, "1500")
+	for i := 1; i < len(seen); i++ {
+		a, _ := strconv.Atoi(seen[i-1])
+		b, _ := strconv.Atoi(seen[i])
+		require.Less(t, a, b)
+	}
+}
+
+//  Scans of an unsorted engine, and of integer keys on the range partitioner,
+//  read and sort the keys in the range on the first batch and carry on from
+//  them after that. Keys past the end aren't kept.
+func TestScanSortsKeysOnce(t *testing.T) {
+	database, _, err := OpenDb(filepath.Join(t.TempDir(), "once"), Options{Engine: DefaultEngine})
+	require.NoError(t, err)
+	defer database.Close()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, database.Set(strconv.Itoa(i), "value"))
+	}
+
+	cache := scanCache{}
+	entries, err := database.scanBatch("100", "200", 10, cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "101", "102", "103", "104", "105", "106", "107", "108", "109"}, keys(entries))
+	assert.Len(t, cache[database], 111)
+	require.NoError(t, database.Delete("110"))
+	entries, err = database.scanBatch("11", "200", 3, cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"11", "111", "112"}, keys(entries))
+
+	cache = scanCache{}
+	entries, err = rangePartitioner{}.scan(database, "100", "200", "", 10, cache)
+	require.NoError(t, err)
+	assert.Len(t, entries, 10)
+	assert.Len(t, cache[database], 99)
+	entries, err = rangePartitioner{}.scan(database, "195", "200", "", 10, cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"195", "196", "197", "198", "199"}, keys(entries))
+}
@@ -1,162 +1,287 @@
 package db
 import (
-	"errors"
 	"sync"
+	"sync/atomic"
 	"fmt"
-	"strconv"
-	"time"
 )
 
 
+//  migration is set while part of the shard is being copied to another one,
+//  see SplitShard and MergeShards
+//  ops counts the reads and writes routed to the shard, see ShardStats
+//  seeding is a replica being brought up to date before it joins Replicas,
+//  repairing is set while replicas are being added, see repair
+//  Epoch goes up every time the shard gets a new primary, writes are made in
+//  it, see fence
+//  reads counts replica reads, so they take turns, see reader
 type Shard struct {
 	ID int
 	Range [2]int
+	Epoch uint64
 	Database *db
 	Replicas []*db
+	migration *shardMigration
+	ops atomic.Uint64
+	sampled opsSample
+	seeding *db
+	repairing bool
+	reads atomic.Uint64
 }
 
 
+// The primary followed by the replicas
+func (shard *Shard) members() []*db {
+	return append([]*db{shard.Database}, shard.Replicas...)
+}
+
+
+//  basedFilename, replicas and opts are kept for creating shards later on
+//  changes lets one change to the shard layout happen at a time
+//  statsLock guards the shards' ops samples
+//  mapLock guards the shard map as last written, its epoch, and the members
+//  to list as discarded in the next one
+//  healthLock guards the promotions made, see CheckHealth
+//  repairs tracks the replicas being added in the background, closed tells
+//  them to give up
+//  consensus is how the shards replicate writes, transport how raft
+//  members reach each other
 type ShardedDB struct {
 	Shards []*Shard
 	lock sync.RWMutex
+	cache *BlockCache
+	partitioner Partitioner
+	basedFilename string
+	replicas int
+	opts Options
+	changes sync.Mutex
+	statsLock sync.Mutex
+	mapLock sync.Mutex
+	epoch uint64
+	shardMap *ShardMap
+	discarded []string
+	healthLock sync.Mutex
+	promotions []Promotion
+	repairs sync.WaitGroup
+	closed atomic.Bool
+	consensus string
+	transport RaftTransport
 }
 
 
-func NewShardedDB(sharedRanges [][2]int, basedFilename string, replicas int) *ShardedDB {
-    shardedDb := &ShardedDB{}
-    for id, r := range sharedRanges {
-        filename := fmt.Sprintf("%s_%d", basedFilename, id)
-        shard := &Shard{
-            ID: id,
-            Range: r,
-            Database: NewDb(filename),
-        }
-        // Add replicas
-        for i := 0; i < replicas; i++ {
-            replicaFilename := fmt.Sprintf("%s_%d_replica_%d", basedFilename, id, i)
-            shard.Replicas = append(shard.Replicas, NewDb(replicaFilename))
-        }
-        shardedDb.Shards = append(shardedDb.Shards, shard)
-    }
-    return shardedDb
+// Hit/miss counters of the block cache shared by the shards
+func (sdb *ShardedDB) CacheStats() CacheStats {
+	return sdb.cache.Stats()
 }
 
 
+// What the shard admin API reports about a shard
+// LSN is the primary's last, Replication how far behind it each replica is
+// Raft is where each member of a raft shard has got
+type ShardInfo struct {
+	ID          int             `json:"id"`
+	Range       [2]int          `json:"range"`
+	Epoch       uint64          `json:"epoch"`
+	Replicas    int             `json:"replicas"`
+	Moving      bool            `json:"moving"`
+	Health      HealthState     `json:"health"`
+	Seeding     bool            `json:"seeding"`
+	LSN         uint64          `json:"lsn"`
+	Replication []ReplicaStatus `json:"replication"`
+	Raft        []RaftStatus    `json:"raft,omitempty"`
+}
 
+// Function for listing the shards, Moving ones are part way through a
+// split or merge
+func (sdb *ShardedDB) ShardInfo() []ShardInfo {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	infos := []ShardInfo{}
+	for _, shard := range sdb.Shards {
+		infos = append(infos, shard.info())
+	}
+	return infos
+}
 
+func (shard *Shard) info() ShardInfo {
+	info := ShardInfo{ID: shard.ID, Range: shard.Range, Epoch: shard.Epoch, Replicas: len(shard.Replicas), Moving: shard.migration != nil,
+		Health: shard.Database.healthState(), Seeding: shard.seeding != nil, LSN: shard.Database.wal.LastLSN(),
+		Replication: shard.Database.replicationStatus(shard.Replicas), Raft: shard.raftStatus()}
+	if shard.Database.raft != nil {
+		info.Replication = shard.Database.raft.replicationStatus()
+	}
+	return info
+}
 
 
+// Name of the partitioner keys are placed with
+func (sdb *ShardedDB) Partitioner() string {
+	return sdb.partitioner.Name()
+}
 
-func (sdb *ShardedDB) getShard(key int) (*Shard, error) {
-	for _, shard := range sdb.Shards {
-		if key >= shard.Range[0] && key <= shard.Range[1] {
-			return shard, nil
-		}
+// How the shards replicate writes, see ConsensusRaft
+func (sdb *ShardedDB) Consensus() string {
+	return sdb.consensus
+}
+
+
+func (sdb *ShardedDB) getShard(key string) (*Shard, error) {
+	shard, err := sdb.partitioner.ShardFor(key, sdb.Shards)
+	if err != nil {
+		fmt.Printf("Key %q not found in any shard range: %v\n", key, err)
+		return nil, err
 	}
-	fmt.Printf("Key '%d' not found in any shard range\n", key)
-	return nil, errors.New("no shard found for key")
+	shard.ops.Add(1)
+	return shard, nil
 }
 
 
 //function for setting item in shardedDb
-func (sdb *ShardedDB) Set(key int, value string) error {
-	sdb.lock.Lock()
-	defer sdb.lock.Unlock()
+// Only the read lock is held, each db does its own locking, so writes can
+// run concurrently and share WAL fsyncs
+func (sdb *ShardedDB) Set(key, value string) error {
+	return sdb.SetWithOptions(key, value, WriteOptions{})
+}
+
+// Same as Set, opts.Concern decides how many copies of the write there have
+// to be before it returns
+func (sdb *ShardedDB) SetWithOptions(key, value string, opts WriteOptions) error {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
 	shard, err := sdb.getShard(key)
 	if err != nil {
 		return err
 	}
-	if err := shard.Database.Set(strconv.Itoa(key), value); err != nil {
+	if shard.migration != nil {
+		return shard.migration.apply(shard, key, func(shard *Shard) error {
+			return shard.set(key, value, opts.Concern)
+		})
+	}
+	return shard.set(key, value, opts.Concern)
+}
+
+// Function for writing to the primary, then waiting for as many replicas as
+// concern asks for to apply the write from its WAL
+func (shard *Shard) set(key, value string, concern WriteConcern) error {
+	lsn, err := shard.setAt(key, value)
+	if err != nil {
 		return err
 	}
+	return shard.replicated(lsn, concern)
+}
+
+// Function for making a write on the primary in the shard's epoch, or
+// through the shard's raft group. Returns the LSN it was logged at.
+func (shard *Shard) setAt(key, value string) (uint64, error) {
+	if shard.Database.raft != nil {
+		return shard.propose(Record{Type: RecordSet, Key: key, Value: value})
+	}
+	return shard.Database.setAt(shard.Epoch, key, value)
+}
 
-	// Replicate to all replicas
-	for _, replica := range shard.Replicas {
-		if err := replica.Set(strconv.Itoa(key), value); err != nil {
-			return err
-		}
+// Same as setAt for a delete
+func (shard *Shard) deleteAt(key string) (uint64, error) {
+	if shard.Database.raft != nil {
+		return shard.propose(Record{Type: RecordDelete, Key: key})
 	}
-	return nil
+	return shard.Database.deleteAt(shard.Epoch, key)
 }
 
 
 
 // Function for getting an item from a shard
-func (sdb *ShardedDB) Get(key int) (string, error) {
+func (sdb *ShardedDB) Get(key string) (string, error) {
+	return sdb.GetWithOptions(key, ReadOptions{})
+}
+
+// Same as Get, opts.Preference decides which member of the shard it's read
+// from
+func (sdb *ShardedDB) GetWithOptions(key string, opts ReadOptions) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
 	sdb.lock.RLock()
 	defer sdb.lock.RUnlock()
 	shard, err := sdb.getShard(key)
 	if err != nil {
 		return "", err
 	}
-	return shard.Database.Get(strconv.Itoa(key))
+	member, err := shard.reader(opts)
+	if err != nil {
+		return "", err
+	}
+	return member.Get(key)
 }
 
 
-func (sdb *ShardedDB) Delete(key int) error {
-	sdb.lock.Lock()
-	defer sdb.lock.Unlock()
+func (sdb *ShardedDB) Delete(key string) error {
+	return sdb.DeleteWithOptions(key, WriteOptions{})
+}
+
+// Same as Delete, see SetWithOptions
+func (sdb *ShardedDB) DeleteWithOptions(key string, opts WriteOptions) error {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
 	shard, err := sdb.getShard(key)
 	if err != nil {
 		return err
 	}
-	if err := shard.Database.Delete(strconv.Itoa(key)); err != nil {
-		return err
+	if shard.migration != nil {
+		return shard.migration.apply(shard, key, func(shard *Shard) error {
+			return shard.delete(key, opts.Concern)
+		})
 	}
-	// Replicate to all replicas
-	for _, replica := range shard.Replicas {
-		if err := replica.Delete(strconv.Itoa(key)); err != nil {
-			return err
-		}
+	return shard.delete(key, opts.Concern)
+}
+
+func (shard *Shard) delete(key string, concern WriteConcern) error {
+	lsn, err := shard.deleteAt(key)
+	if err != nil {
+		return err
 	}
-	return nil
+	return shard.replicated(lsn, concern)
 }
 
 
 
-func (sdb *ShardedDB) PromoteReplica(shard *Shard, replica *db) {
+// Function for closing every primary and replica
+func (sdb *ShardedDB) Close() error {
+	sdb.lock.Lock()
+	sdb.closed.Store(true)
+	sdb.lock.Unlock()
+	// Replicas being seeded give up and clean up after themselves
+	sdb.repairs.Wait()
 	sdb.lock.Lock()
 	defer sdb.lock.Unlock()
-	shard.Database = replica
-	// Remove promoted replica from replicas list
-	newReplicas := []*db{}
-	for _, rep := range shard.Replicas {
-		if rep != replica {
-			newReplicas = append(newReplicas, rep)
+	var firstErr error
+	for _, shard := range sdb.Shards {
+		for _, member := range shard.members() {
+			if err := member.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
-	shard.Replicas = newReplicas
+	return firstErr
 }
 
 
-// Function to check if a shard has failed
-func shardFailed(shard *db) bool {
-    // Example: try to read a known key to check if the shard is responding
-    _, err := shard.Get("healthcheck")
-    return err != nil
+// Function for making replica the shard's primary by hand. In a raft shard
+// it stands for election, and takes over if it wins.
+func (sdb *ShardedDB) PromoteReplica(shard *Shard, replica *db) {
+	if replica.raft != nil {
+		replica.raft.campaign()
+		return
+	}
+	sdb.lock.RLock()
+	primary := shard.Database
+	sdb.lock.RUnlock()
+	sdb.promote(shard, primary, replica, "requested")
 }
 
 
-// Function to detect and handle shard failures 
+// Function to detect and handle shard failures, one round of health checks
+// with the default settings. It takes DefaultFailAfter rounds in a row to
+// fail a primary.
 func (sdb *ShardedDB) MonitorShards() {
-	for _, shard := range sdb.Shards {
-		// Simulated check for shard availability
-		if shardFailed(shard.Database) {
-			if len(shard.Replicas) > 0 {
-				sdb.PromoteReplica(shard, shard.Replicas[0])
-			} else {
-				// Handle no replicas available scenario
-				fmt.Println("No replicas available for shard:", shard.ID)
-			}
-		}
-	}
-}
-
-func (sdb *ShardedDB) StartMonitoring() {
-	ticker := time.NewTicker(30 * time.Second) 
-	defer ticker.Stop()
-	for range ticker.C {
-		sdb.MonitorShards()
-	}
+	sdb.CheckHealth(HealthOptions{})
 }
 
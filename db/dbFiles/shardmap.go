@@ -0,0 +1,354 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Version of the shard map format this code writes
+const shardMapVersion = 1
+
+var ErrShardMapMismatch = errors.New("shard map does not match the files on disk")
+
+//  The shard layout of a sharded database, kept in <basedFilename>.shardmap.
+//  Epoch goes up by one every time the map is written.
+//  Member files are named relative to the shard map's directory.
+//  Discarded members are out of the layout but may still have files, they're
+//  deleted the next time the database is opened.
+//  Consensus is how the shards replicate writes.
+type ShardMap struct {
+	Version      int             `json:"version"`
+	Epoch        uint64          `json:"epoch"`
+	Partitioner  string          `json:"partitioner"`
+	VirtualNodes int             `json:"virtual_nodes,omitempty"`
+	Consensus    string          `json:"consensus"`
+	Shards       []ShardMapEntry `json:"shards"`
+	Discarded    []string        `json:"discarded,omitempty"`
+}
+
+// Range isn't used by the ring partitioner. Epoch is the shard's own, see
+// Shard.
+type ShardMapEntry struct {
+	ID       int      `json:"id"`
+	Range    [2]int   `json:"range"`
+	Epoch    uint64   `json:"epoch"`
+	Primary  string   `json:"primary"`
+	Replicas []string `json:"replicas"`
+}
+
+func shardMapFilename(basedFilename string) string {
+	return basedFilename + ".shardmap"
+}
+
+// nil if there isn't one
+func readShardMap(basedFilename string) (*ShardMap, error) {
+	data, err := os.ReadFile(shardMapFilename(basedFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	shardMap := &ShardMap{}
+	if err := json.Unmarshal(data, shardMap); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", shardMapFilename(basedFilename), err)
+	}
+	if shardMap.Version > shardMapVersion {
+		return nil, fmt.Errorf("%s is version %d, only up to %d is understood", shardMapFilename(basedFilename), shardMap.Version, shardMapVersion)
+	}
+	return shardMap, nil
+}
+
+func writeShardMap(basedFilename string, shardMap *ShardMap) error {
+	data, err := json.MarshalIndent(shardMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(shardMapFilename(basedFilename), data, true)
+}
+
+func memberFilename(basedFilename string, id, replica int) string {
+	if replica < 0 {
+		return fmt.Sprintf("%s_%d", basedFilename, id)
+	}
+	return fmt.Sprintf("%s_%d_replica_%d", basedFilename, id, replica)
+}
+
+// Function for building the map a brand new layout starts with, every shard
+// with the standard member names
+func newShardMap(basedFilename string, partitioner Partitioner, ranges [][2]int, replicas int) *ShardMap {
+	shardMap := &ShardMap{Version: shardMapVersion, Partitioner: partitioner.Name()}
+	if ring, ok := partitioner.(*ringPartitioner); ok {
+		shardMap.VirtualNodes = ring.virtualNodes
+	}
+	dir := filepath.Dir(basedFilename)
+	for id, r := range ranges {
+		entry := ShardMapEntry{ID: id, Epoch: 1, Primary: relativeTo(dir, memberFilename(basedFilename, id, -1)), Replicas: []string{}}
+		if shardMap.Partitioner != RingPartitioner {
+			entry.Range = r
+		}
+		for i := 0; i < replicas; i++ {
+			entry.Replicas = append(entry.Replicas, relativeTo(dir, memberFilename(basedFilename, id, i)))
+		}
+		shardMap.Shards = append(shardMap.Shards, entry)
+	}
+	return shardMap
+}
+
+func relativeTo(dir, filename string) string {
+	if relative, err := filepath.Rel(dir, filename); err == nil {
+		return relative
+	}
+	return filename
+}
+
+// Every member of every shard, as paths
+func (shardMap *ShardMap) members(basedFilename string) []string {
+	dir := filepath.Dir(basedFilename)
+	members := []string{}
+	for _, entry := range shardMap.Shards {
+		members = append(members, filepath.Join(dir, entry.Primary))
+		for _, replica := range entry.Replicas {
+			members = append(members, filepath.Join(dir, replica))
+		}
+	}
+	return members
+}
+
+// Picks the member a shard file belongs to out of its name, the shard ID and
+// the replica suffix if there is one
+var memberFilePattern = regexp.MustCompile(`^(\d+(?:_replica_\d+)?)(?:_wal|\.)`)
+
+//  Function for checking the shard map against the files on disk.
+//  Every member in it has to have files, and every shard file next to it has
+//  to belong to a member in it (or to one it has discarded).
+func (shardMap *ShardMap) verify(basedFilename string) error {
+	members := make(map[string]bool)
+	for _, member := range shardMap.members(basedFilename) {
+		members[member] = true
+		if !dbFilesExist(member) {
+			return fmt.Errorf("%w: %s has no files", ErrShardMapMismatch, member)
+		}
+	}
+	for _, discarded := range shardMap.Discarded {
+		members[filepath.Join(filepath.Dir(basedFilename), discarded)] = true
+	}
+
+	files, err := filepath.Glob(basedFilename + "_*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		match := memberFilePattern.FindStringSubmatch(strings.TrimPrefix(file, basedFilename+"_"))
+		if match == nil {
+			continue
+		}
+		if member := basedFilename + "_" + match[1]; !members[member] {
+			return fmt.Errorf("%w: %s belongs to %s, which is not in the shard map", ErrShardMapMismatch, file, member)
+		}
+	}
+	return nil
+}
+
+// Whether a db has anything on disk under filename
+func dbFilesExist(filename string) bool {
+	for _, pattern := range []string{filename + "_wal*", filename + ".*"} {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//  Function for getting the shard map to open a database with.
+//  Databases from before the shard map are range partitioned over ranges,
+//  the map is written when the database is opened.
+//  Asking for a different partitioner or number of virtual nodes than the
+//  database has is an error, keys would go to the wrong shards.
+//  Returns whether the map has to be written.
+func openShardMap(basedFilename string, opts Options, ranges [][2]int, replicas int) (*ShardMap, Partitioner, bool, error) {
+	shardMap, err := readShardMap(basedFilename)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	changed, fresh := false, false
+	if shardMap == nil {
+		changed = true
+		shardMap, fresh, err = unmappedShardMap(basedFilename, opts, ranges, replicas)
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	switch {
+	case opts.Partitioner != "" && opts.Partitioner != shardMap.Partitioner:
+		return nil, nil, false, fmt.Errorf("%s uses the %s partitioner, not %s", basedFilename, shardMap.Partitioner, opts.Partitioner)
+	case shardMap.Partitioner == RingPartitioner && opts.VirtualNodes > 0 && opts.VirtualNodes != shardMap.VirtualNodes:
+		return nil, nil, false, fmt.Errorf("%s has %d virtual nodes per shard, not %d", basedFilename, shardMap.VirtualNodes, opts.VirtualNodes)
+	}
+	partitioner, err := NewPartitioner(shardMap.Partitioner, shardMap.VirtualNodes)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	mapRanges := [][2]int{}
+	for _, entry := range shardMap.Shards {
+		mapRanges = append(mapRanges, entry.Range)
+	}
+	if err := ValidatePartitioner(shardMap.Partitioner, mapRanges); err != nil {
+		return nil, nil, false, err
+	}
+
+	dir := filepath.Dir(basedFilename)
+	for _, discarded := range shardMap.Discarded {
+		if err := removeDbFiles(filepath.Join(dir, discarded)); err != nil {
+			return nil, nil, false, err
+		}
+		changed = true
+	}
+	shardMap.Discarded = nil
+	if !fresh {
+		if err := shardMap.verify(basedFilename); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if shardMap.Consensus != ConsensusPrimaryBackup && shardMap.Consensus != ConsensusRaft {
+		return nil, nil, false, fmt.Errorf("%s has unknown consensus %q", basedFilename, shardMap.Consensus)
+	}
+	// The consensus can't change once there's data, members of each kind
+	// keep their WALs differently
+	if opts.Consensus != "" && opts.Consensus != shardMap.Consensus {
+		return nil, nil, false, fmt.Errorf("%s uses %s replication, not %s", basedFilename, shardMap.Consensus, opts.Consensus)
+	}
+	return shardMap, partitioner, changed, nil
+}
+
+// The layout of a database without a shard map over ranges. One that has
+// files is from before the shard map, when every database was range
+// partitioned with primary-backup replicas. Returns whether the database is
+// brand new.
+func unmappedShardMap(basedFilename string, opts Options, ranges [][2]int, replicas int) (*ShardMap, bool, error) {
+	existing, _ := filepath.Glob(basedFilename + "_0*")
+	fresh := len(existing) == 0
+	name := RangePartitioner
+	if fresh {
+		name = opts.Partitioner
+	}
+	if name == "" {
+		name = DefaultPartitioner
+	}
+	partitioner, err := NewPartitioner(name, opts.VirtualNodes)
+	if err != nil {
+		return nil, false, err
+	}
+	consensus := ConsensusPrimaryBackup
+	if fresh {
+		if consensus, err = ParseConsensus(opts.Consensus); err != nil {
+			return nil, false, err
+		}
+	}
+	shardMap := newShardMap(basedFilename, partitioner, ranges, replicas)
+	shardMap.Consensus = consensus
+	return shardMap, fresh, nil
+}
+
+//  Function for recording shards as the layout, it's what OpenShardedDB
+//  opens from then on. Bumps the epoch.
+//  Caller holds the lock (or has the only reference), so the members can't
+//  change under it. A ShardedDB put together by hand has nowhere to record it.
+func (sdb *ShardedDB) writeLayout(shards []*Shard) error {
+	sdb.mapLock.Lock()
+	defer sdb.mapLock.Unlock()
+	if sdb.basedFilename == "" {
+		return nil
+	}
+	shardMap := &ShardMap{
+		Version:     shardMapVersion,
+		Epoch:       sdb.epoch + 1,
+		Partitioner: sdb.partitioner.Name(),
+		Consensus:   sdb.consensus,
+		Discarded:   append([]string{}, sdb.discarded...),
+	}
+	if ring, ok := sdb.partitioner.(*ringPartitioner); ok {
+		shardMap.VirtualNodes = ring.virtualNodes
+	}
+	dir := filepath.Dir(sdb.basedFilename)
+	for _, shard := range shards {
+		entry := ShardMapEntry{ID: shard.ID, Epoch: shard.Epoch, Primary: relativeTo(dir, shard.Database.filename), Replicas: []string{}}
+		if shardMap.Partitioner != RingPartitioner {
+			entry.Range = shard.Range
+		}
+		for _, replica := range shard.Replicas {
+			entry.Replicas = append(entry.Replicas, relativeTo(dir, replica.filename))
+		}
+		shardMap.Shards = append(shardMap.Shards, entry)
+	}
+	if err := writeShardMap(sdb.basedFilename, shardMap); err != nil {
+		return err
+	}
+	sdb.epoch = shardMap.Epoch
+	sdb.shardMap = shardMap
+	return nil
+}
+
+// Function for marking members as on their way out, the next layout written
+// lists them so their files get cleaned up if they're left behind
+func (sdb *ShardedDB) discard(filenames ...string) {
+	sdb.mapLock.Lock()
+	defer sdb.mapLock.Unlock()
+	dir := filepath.Dir(sdb.basedFilename)
+	for _, filename := range filenames {
+		sdb.discarded = append(sdb.discarded, relativeTo(dir, filename))
+	}
+}
+
+// Function for unmarking members, once their files are gone or they turned
+// out to be wanted after all
+func (sdb *ShardedDB) forget(filenames ...string) {
+	sdb.mapLock.Lock()
+	defer sdb.mapLock.Unlock()
+	dir := filepath.Dir(sdb.basedFilename)
+	gone := make(map[string]bool)
+	for _, filename := range filenames {
+		gone[relativeTo(dir, filename)] = true
+	}
+	kept := []string{}
+	for _, name := range sdb.discarded {
+		if !gone[name] {
+			kept = append(kept, name)
+		}
+	}
+	sdb.discarded = kept
+}
+
+// Epoch of the shard map the database is running with
+func (sdb *ShardedDB) Epoch() uint64 {
+	sdb.mapLock.Lock()
+	defer sdb.mapLock.Unlock()
+	return sdb.epoch
+}
+
+// The shard map as last written
+func (sdb *ShardedDB) ShardMap() ShardMap {
+	sdb.mapLock.Lock()
+	defer sdb.mapLock.Unlock()
+	if sdb.shardMap == nil {
+		return ShardMap{}
+	}
+	return *sdb.shardMap
+}
+
+// Filenames of the shard's members
+func (shard *Shard) filenames() []string {
+	filenames := []string{}
+	for _, member := range shard.members() {
+		if member != nil {
+			filenames = append(filenames, member.filename)
+		}
+	}
+	return filenames
+}
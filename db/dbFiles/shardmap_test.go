@@ -0,0 +1,145 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardMapEpochs(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "epochs")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 1, DefaultOptions())
+	assert.Equal(t, uint64(1), sdb.Epoch())
+	for i := 0; i < 200; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"))
+	}
+	_, err := sdb.SplitShard(0, "50")
+	require.NoError(t, err)
+	// Once with the new shard's files listed as discarded while they're
+	// filled, once for the split itself
+	epoch := sdb.Epoch()
+	assert.Equal(t, uint64(3), epoch)
+	require.NoError(t, sdb.Close())
+
+	shardMap, err := readShardMap(base)
+	require.NoError(t, err)
+	assert.Equal(t, shardMapVersion, shardMap.Version)
+	assert.Equal(t, epoch, shardMap.Epoch)
+	assert.Equal(t, RangePartitioner, shardMap.Partitioner)
+	require.Len(t, shardMap.Shards, 3)
+	assert.Equal(t, ShardMapEntry{ID: 2, Range: [2]int{50, 99}, Epoch: 1, Primary: "epochs_2", Replicas: []string{"epochs_2_replica_0"}}, shardMap.Shards[2])
+
+	// Opening doesn't change the layout, the epoch stays put
+	sdb, _, err = OpenShardedDB(nil, base, 1, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, epoch, sdb.Epoch())
+	assert.Equal(t, *shardMap, sdb.ShardMap())
+	require.NoError(t, sdb.Close())
+}
+
+// Ranges asked for when the database already has a shard map don't replace
+// its layout, the files stay with the shards they were recorded for
+func TestShardMapKeepsLayout(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "layout")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 0, DefaultOptions())
+	require.NoError(t, sdb.Set("150", "value"))
+	require.NoError(t, sdb.Close())
+	shardMap, err := readShardMap(base)
+	require.NoError(t, err)
+
+	sdb, _, err = OpenShardedDB([][2]int{{0, 149}, {150, 299}}, base, 0, DefaultOptions())
+	require.NoError(t, err)
+	defer sdb.Close()
+	assert.Equal(t, *shardMap, sdb.ShardMap())
+	assert.Equal(t, [2]int{100, 199}, sdb.Shards[1].Range)
+	value, err := sdb.Get("150")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+// A database from before the shard map is range partitioned over the ranges
+// it's opened with, and gets a map
+func TestShardMapForUnmappedDatabase(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "unmapped")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 0, DefaultOptions())
+	require.NoError(t, sdb.Set("150", "value"))
+	require.NoError(t, sdb.Close())
+	require.NoError(t, os.Remove(shardMapFilename(base)))
+
+	sdb, _, err := OpenShardedDB([][2]int{{0, 99}, {100, 199}}, base, 0, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	value, err := sdb.Get("150")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, RangePartitioner, sdb.Partitioner())
+	assert.Equal(t, uint64(1), sdb.Epoch())
+	assert.FileExists(t, shardMapFilename(base))
+}
+
+func TestShardMapMismatch(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "mismatch")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 0, DefaultOptions())
+	require.NoError(t, sdb.Set("1", "value"))
+	require.NoError(t, sdb.Set("101", "value"))
+	require.NoError(t, sdb.Close())
+
+	// Files for a shard the map doesn't have
+	stray := NewDb(memberFilename(base, 7, -1))
+	stray.Set("1", "value")
+	require.NoError(t, stray.Close())
+	_, _, err := OpenShardedDB(nil, base, 0, Options{})
+	assert.ErrorIs(t, err, ErrShardMapMismatch)
+	require.NoError(t, removeDbFiles(memberFilename(base, 7, -1)))
+
+	// A shard in the map without files
+	sdb, _, err = OpenShardedDB(nil, base, 0, Options{})
+	require.NoError(t, err)
+	require.NoError(t, sdb.Close())
+	require.NoError(t, removeDbFiles(memberFilename(base, 1, -1)))
+	_, _, err = OpenShardedDB(nil, base, 0, Options{})
+	assert.ErrorIs(t, err, ErrShardMapMismatch)
+}
+
+func TestShardMapCleansUpDiscarded(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "discarded")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 0, DefaultOptions())
+	require.NoError(t, sdb.Set("150", "value"))
+	require.NoError(t, sdb.Close())
+
+	// A merge that stopped after recording the new layout, before deleting
+	// the merged shard's files
+	shardMap, err := readShardMap(base)
+	require.NoError(t, err)
+	shardMap.Shards[0].Range = [2]int{0, 199}
+	shardMap.Discarded = []string{shardMap.Shards[1].Primary}
+	shardMap.Shards = shardMap.Shards[:1]
+	require.NoError(t, writeShardMap(base, shardMap))
+
+	sdb, _, err = OpenShardedDB(nil, base, 0, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	assert.Len(t, sdb.Shards, 1)
+	assert.False(t, dbFilesExist(memberFilename(base, 1, -1)))
+	assert.Empty(t, sdb.ShardMap().Discarded)
+}
+
+func TestLoadChecksShardMap(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "load")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 99}, {100, 199}}, base, 0, DefaultOptions())
+	defer sdb.Close()
+	require.NoError(t, sdb.Set("1", "value"))
+	require.NoError(t, sdb.Save())
+	require.NoError(t, sdb.Load())
+
+	// Someone else changed the layout on disk
+	shardMap, err := readShardMap(base)
+	require.NoError(t, err)
+	shardMap.Epoch++
+	require.NoError(t, writeShardMap(base, shardMap))
+	assert.ErrorIs(t, sdb.Load(), ErrShardMapMismatch)
+}
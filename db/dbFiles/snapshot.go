@@ -0,0 +1,223 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// How many snapshot generations are kept around by default
+const DefaultSnapshotRetention = 3
+
+//  Snapshots are written as numbered generations, <filename>.snap.000001 and up.
+//  The manifest (<filename>.manifest) lists the generations that are kept,
+//  newest first, with enough to check each one before trusting it.
+type snapshotManifest struct {
+	Current   uint64         `json:"current"`
+	Snapshots []snapshotInfo `json:"snapshots"`
+}
+
+type snapshotInfo struct {
+	Generation uint64 `json:"generation"`
+	File       string `json:"file"`
+	Size       int64  `json:"size"`
+	CRC32C     uint32 `json:"crc32c"`
+	LastLSN    uint64 `json:"last_lsn"`
+}
+
+func (engine *mapEngine) snapshotName(generation uint64) string {
+	return fmt.Sprintf("%s.snap.%06d", engine.filename, generation)
+}
+
+func (engine *mapEngine) manifestName() string {
+	return engine.filename + ".manifest"
+}
+
+// Function for writing a new snapshot generation and recording it in the manifest.
+// Returns the LSN of the oldest generation still kept, the WAL has to hold on
+// to everything after it in case Load needs to fall back that far.
+func (engine *mapEngine) writeSnapshot(data []byte, lsn uint64) (uint64, error) {
+	sync := engine.opts.Durability != DurabilityNone
+	manifest, err := engine.readManifest()
+	if err != nil {
+		// An unreadable manifest only costs us the older generations
+		fmt.Printf("Snapshot manifest for %s unreadable, starting a new one: %v\n", engine.filename, err)
+		manifest = &snapshotManifest{Current: engine.newestGenerationOnDisk()}
+	}
+
+	info := snapshotInfo{
+		Generation: manifest.Current + 1,
+		Size:       int64(len(data)),
+		CRC32C:     crc32.Checksum(data, crcTable),
+		LastLSN:    lsn,
+	}
+	info.File = filepath.Base(engine.snapshotName(info.Generation))
+	if err := writeFileAtomic(engine.snapshotName(info.Generation), data, sync); err != nil {
+		return 0, err
+	}
+
+	manifest.Current = info.Generation
+	manifest.Snapshots = append([]snapshotInfo{info}, manifest.Snapshots...)
+	retention := engine.opts.SnapshotRetention
+	var expired []snapshotInfo
+	if len(manifest.Snapshots) > retention {
+		expired = manifest.Snapshots[retention:]
+		manifest.Snapshots = manifest.Snapshots[:retention]
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(engine.manifestName(), encoded, sync); err != nil {
+		return 0, err
+	}
+	// Only once the manifest stops pointing at them
+	for _, old := range expired {
+		os.Remove(filepath.Join(filepath.Dir(engine.filename), old.File))
+	}
+
+	oldest := manifest.Snapshots[len(manifest.Snapshots)-1].LastLSN
+	return oldest, nil
+}
+
+// Function for reading the newest snapshot that checks out.
+// Falls back through older generations when the newest is corrupt, and to
+// the pre-manifest single file as a last resort. Returns nil if there are
+// no snapshots at all.
+func (engine *mapEngine) readSnapshot() (*Database, error) {
+	candidates := []snapshotInfo{}
+	manifest, err := engine.readManifest()
+	if err == nil {
+		candidates = manifest.Snapshots
+	} else {
+		fmt.Printf("Snapshot manifest for %s unreadable, scanning for generations: %v\n", engine.filename, err)
+		for _, generation := range engine.generationsOnDisk() {
+			candidates = append(candidates, snapshotInfo{
+				Generation: generation,
+				File:       filepath.Base(engine.snapshotName(generation)),
+				Size:       -1,
+			})
+		}
+	}
+	// Snapshots written before generations existed
+	candidates = append(candidates, snapshotInfo{File: filepath.Base(engine.filename), Size: -1})
+
+	found := false
+	for _, info := range candidates {
+		path := filepath.Join(filepath.Dir(engine.filename), info.File)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err == nil && info.Size >= 0 {
+			if int64(len(data)) != info.Size || crc32.Checksum(data, crcTable) != info.CRC32C {
+				err = errors.New("checksum mismatch")
+			}
+		}
+		snapshot := &Database{}
+		if err == nil {
+			err = proto.Unmarshal(data, snapshot)
+		}
+		if err != nil {
+			fmt.Printf("Snapshot %s is unusable, trying an older one: %v\n", path, err)
+			continue
+		}
+		return snapshot, nil
+	}
+	if found {
+		return nil, fmt.Errorf("no usable snapshot for %s", engine.filename)
+	}
+	return nil, nil
+}
+
+func (engine *mapEngine) readManifest() (*snapshotManifest, error) {
+	data, err := ioutil.ReadFile(engine.manifestName())
+	if os.IsNotExist(err) {
+		return &snapshotManifest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest := &snapshotManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Generation numbers of the snapshot files on disk, newest first
+func (engine *mapEngine) generationsOnDisk() []uint64 {
+	prefix := engine.filename + ".snap."
+	matches, _ := filepath.Glob(prefix + "*")
+	generations := []uint64{}
+	for _, match := range matches {
+		generation, err := strconv.ParseUint(strings.TrimPrefix(match, prefix), 10, 64)
+		if err == nil {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] > generations[j] })
+	return generations
+}
+
+func (engine *mapEngine) newestGenerationOnDisk() uint64 {
+	if generations := engine.generationsOnDisk(); len(generations) > 0 {
+		return generations[0]
+	}
+	return 0
+}
+
+// Function for replacing a file so a crash leaves either the old or the new
+// contents, never a mix. Writes to a temp file, fsyncs it, renames it over
+// the target and fsyncs the directory so the rename itself is durable.
+func writeFileAtomic(path string, data []byte, sync bool) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,320 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// How many keys a migration copies between letting writes through
+const migrationBatchSize = 256
+
+var (
+	ErrBadShardChange = errors.New("invalid shard change")
+	ErrNotRanged      = errors.New("the ring partitioner's shards have no ranges, add or remove shards instead")
+)
+
+//  Part of a shard being copied to target.
+//  Writes to keys that move go to both shards, one at a time under lock,
+//  and the copy takes the lock for each batch, so target never ends up with
+//  an older value than the source.
+//  err is the first write target failed, the migration is abandoned if set.
+type shardMigration struct {
+	target *Shard
+	moves  func(key string) bool
+	lock   sync.Mutex
+	err    error
+}
+
+// Function for applying a write to source, and to target too if key moves
+func (migration *shardMigration) apply(source *Shard, key string, write func(*Shard) error) error {
+	if !migration.moves(key) {
+		return write(source)
+	}
+	migration.lock.Lock()
+	defer migration.lock.Unlock()
+	if err := write(source); err != nil {
+		return err
+	}
+	// Deletes of keys the copy hasn't reached yet have nothing to delete
+	if err := write(migration.target); err != nil && !errors.Is(err, ErrItemDoesNotExist) && migration.err == nil {
+		migration.err = err
+	}
+	return nil
+}
+
+// Function for copying every key that moves from source to target, a batch
+// at a time. Writes carry on in between, and limiter (nil for no limit)
+// spaces the batches out.
+func (migration *shardMigration) copy(source *Shard, limiter *rateLimiter) error {
+	moving := []string{}
+	err := source.Database.forEachKey(func(key string) {
+		if migration.moves(key) {
+			moving = append(moving, key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for len(moving) > 0 {
+		n := min(migrationBatchSize, len(moving))
+		copied, err := migration.copyBatch(source, moving[:n])
+		if err != nil {
+			return err
+		}
+		moving = moving[n:]
+		limiter.wait(copied)
+	}
+	return nil
+}
+
+// Returns how many bytes it copied
+func (migration *shardMigration) copyBatch(source *Shard, keys []string) (int64, error) {
+	migration.lock.Lock()
+	defer migration.lock.Unlock()
+	if migration.err != nil {
+		return 0, migration.err
+	}
+	var copied int64
+	for _, key := range keys {
+		value, err := source.Database.Get(key)
+		if err == ErrNotFound {
+			// Deleted since the keys were listed
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := migration.target.set(key, value, WriteAll); err != nil {
+			return 0, err
+		}
+		copied += int64(len(key) + len(value))
+	}
+	return copied, nil
+}
+
+// Partitioners whose shards own Ranges of positions
+type rangedPartitioner interface {
+	Partitioner
+	// Position of key within the Ranges
+	position(key string) (int, error)
+}
+
+func (rangePartitioner) position(key string) (int, error) {
+	position, err := strconv.Atoi(key)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not an integer, the range partitioner needs integer keys", ErrInvalidKey, key)
+	}
+	return position, nil
+}
+
+func (hashPartitioner) position(key string) (int, error) {
+	return HashSlot(key), nil
+}
+
+func (sdb *ShardedDB) rangedPartitioner() (rangedPartitioner, error) {
+	partitioner, ok := sdb.partitioner.(rangedPartitioner)
+	if !ok {
+		return nil, ErrNotRanged
+	}
+	return partitioner, nil
+}
+
+//  Function for splitting a shard in two at atKey.
+//  The shard keeps the part of its Range below atKey, a new shard (with as
+//  many replicas) takes atKey and up. For the hash partitioner atKey is a
+//  slot. Reads and writes carry on while the keys are copied, then the
+//  routing switches over in one go.
+func (sdb *ShardedDB) SplitShard(id int, atKey string) (ShardInfo, error) {
+	return sdb.splitShard(id, atKey, nil)
+}
+
+// Same as SplitShard, copying no faster than limiter allows
+func (sdb *ShardedDB) splitShard(id int, atKey string, limiter *rateLimiter) (ShardInfo, error) {
+	sdb.changes.Lock()
+	defer sdb.changes.Unlock()
+	partitioner, err := sdb.rangedPartitioner()
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	at, err := strconv.Atoi(atKey)
+	if err != nil {
+		return ShardInfo{}, fmt.Errorf("%w: split point %q is not an integer", ErrBadShardChange, atKey)
+	}
+
+	sdb.lock.RLock()
+	source, err := shardByID(id, sdb.Shards)
+	nextID := sdb.nextShardID()
+	sdb.lock.RUnlock()
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	if at <= source.Range[0] || at > source.Range[1] {
+		return ShardInfo{}, fmt.Errorf("%w: %d isn't inside shard %d's range %v", ErrBadShardChange, at, id, source.Range)
+	}
+
+	target, err := sdb.createShard(nextID)
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	target.Range = [2]int{at, source.Range[1]}
+	moves := func(key string) bool {
+		position, err := partitioner.position(key)
+		return err == nil && position >= at
+	}
+	if err := sdb.migrate(source, target, moves, limiter); err != nil {
+		sdb.destroyShard(target)
+		return ShardInfo{}, err
+	}
+
+	sdb.lock.Lock()
+	layout := []*Shard{}
+	for _, shard := range sdb.Shards {
+		if shard == source {
+			shard = &Shard{ID: source.ID, Range: [2]int{source.Range[0], at - 1}, Epoch: source.Epoch, Database: source.Database, Replicas: source.Replicas}
+		}
+		layout = append(layout, shard)
+	}
+	sdb.forget(target.filenames()...)
+	err = sdb.finishMigration(source, append(layout, target), func() {
+		source.Range[1] = at - 1
+		sdb.Shards = append(sdb.Shards, target)
+	})
+	sdb.lock.Unlock()
+	if err != nil {
+		sdb.destroyShard(target)
+		return ShardInfo{}, err
+	}
+	source.removeMatching(moves)
+	return target.info(), nil
+}
+
+//  Function for merging two shards with neighbouring Ranges into one.
+//  The one with the lower Range takes over the other's Range and keys, the
+//  other is deleted. Reads and writes carry on while the keys are copied,
+//  then the routing switches over in one go.
+func (sdb *ShardedDB) MergeShards(a, b int) (ShardInfo, error) {
+	return sdb.mergeShards(a, b, nil)
+}
+
+// Same as MergeShards, copying no faster than limiter allows
+func (sdb *ShardedDB) mergeShards(a, b int, limiter *rateLimiter) (ShardInfo, error) {
+	sdb.changes.Lock()
+	defer sdb.changes.Unlock()
+	partitioner, err := sdb.rangedPartitioner()
+	if err != nil {
+		return ShardInfo{}, err
+	}
+
+	sdb.lock.RLock()
+	var target, source *Shard
+	target, err = shardByID(a, sdb.Shards)
+	if err == nil {
+		source, err = shardByID(b, sdb.Shards)
+	}
+	sdb.lock.RUnlock()
+	if err != nil {
+		return ShardInfo{}, err
+	}
+	if source.Range[0] < target.Range[0] {
+		source, target = target, source
+	}
+	if a == b || target.Range[1]+1 != source.Range[0] {
+		return ShardInfo{}, fmt.Errorf("%w: shards %d and %d aren't next to each other", ErrBadShardChange, a, b)
+	}
+
+	// If it doesn't work out, whatever was copied has to come back off target
+	copied := func(key string) bool {
+		position, err := partitioner.position(key)
+		return err == nil && position >= source.Range[0] && position <= source.Range[1]
+	}
+	if err := sdb.migrate(source, target, func(string) bool { return true }, limiter); err != nil {
+		target.removeMatching(copied)
+		return ShardInfo{}, err
+	}
+
+	sdb.lock.Lock()
+	layout := []*Shard{}
+	for _, shard := range sdb.Shards {
+		if shard == source {
+			continue
+		}
+		if shard == target {
+			shard = &Shard{ID: target.ID, Range: [2]int{target.Range[0], source.Range[1]}, Epoch: target.Epoch, Database: target.Database, Replicas: target.Replicas}
+		}
+		layout = append(layout, shard)
+	}
+	sdb.discard(source.filenames()...)
+	err = sdb.finishMigration(source, layout, func() {
+		target.Range[1] = source.Range[1]
+		remaining := []*Shard{}
+		for _, shard := range sdb.Shards {
+			if shard != source {
+				remaining = append(remaining, shard)
+			}
+		}
+		sdb.Shards = remaining
+	})
+	sdb.lock.Unlock()
+	if err != nil {
+		sdb.forget(source.filenames()...)
+		target.removeMatching(copied)
+		return ShardInfo{}, err
+	}
+	sdb.destroyShard(source)
+	return target.info(), nil
+}
+
+// Function for copying the keys moves picks from source to target while
+// source keeps taking writes
+func (sdb *ShardedDB) migrate(source, target *Shard, moves func(string) bool, limiter *rateLimiter) error {
+	migration := &shardMigration{target: target, moves: moves}
+	sdb.lock.Lock()
+	source.migration = migration
+	sdb.lock.Unlock()
+
+	err := migration.copy(source, limiter)
+	if err != nil {
+		sdb.lock.Lock()
+		source.migration = nil
+		sdb.lock.Unlock()
+	}
+	return err
+}
+
+//  Function for switching the routing over to layout once a migration is
+//  done, apply makes the same change to the shards in memory.
+//  The new layout is recorded first, if that fails nothing changes.
+//  Caller holds the lock, so no write is half way through either shard.
+func (sdb *ShardedDB) finishMigration(source *Shard, layout []*Shard, apply func()) error {
+	migration := source.migration
+	source.migration = nil
+	migration.lock.Lock()
+	err := migration.err
+	migration.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := sdb.writeLayout(layout); err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Function for deleting the keys match picks from every member of the
+// shard, once they live somewhere else
+func (shard *Shard) removeMatching(match func(string) bool) {
+	moved := []string{}
+	err := shard.Database.forEachKey(func(key string) {
+		if match(key) {
+			moved = append(moved, key)
+		}
+	})
+	if err != nil {
+		fmt.Printf("Error listing moved keys on shard %d: %v\n", shard.ID, err)
+		return
+	}
+	shard.remove(moved)
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countKeys(t *testing.T, database *db) int {
+	count := 0
+	require.NoError(t, database.forEachKey(func(string) { count++ }))
+	return count
+}
+
+func TestSplitAndMergeShards(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "split")
+	sdb := mustOpenShardedDB(t, [][2]int{{0, 100}, {101, 200}}, base, 1, DefaultOptions())
+	for i := 0; i <= 200; i++ {
+		require.NoError(t, sdb.Set(strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+	assertAll := func(sdb *ShardedDB) {
+		for i := 0; i <= 200; i++ {
+			value, err := sdb.Get(strconv.Itoa(i))
+			require.NoError(t, err)
+			assert.Equal(t, "value"+strconv.Itoa(i), value)
+		}
+	}
+
+	shard, err := sdb.SplitShard(0, "50")
+	require.NoError(t, err)
+	assert.Equal(t, 2, shard.ID)
+	assert.Equal(t, [2]int{50, 100}, shard.Range)
+	assert.Equal(t, [2]int{0, 49}, sdb.Shards[0].Range)
+	assertAll(sdb)
+	assert.Equal(t, 50, countKeys(t, sdb.Shards[0].Database))
+	assert.Equal(t, 51, countKeys(t, sdb.Shards[2].Database))
+	assert.Equal(t, sdb.Shards[2].Database.digest(), sdb.Shards[2].Replicas[0].digest())
+
+	_, err = sdb.SplitShard(0, "50")
+	assert.ErrorIs(t, err, ErrBadShardChange)
+	_, err = sdb.MergeShards(0, 1)
+	assert.ErrorIs(t, err, ErrBadShardChange)
+	require.NoError(t, sdb.Close())
+
+	// The layout is recorded, the ranges passed in no longer matter
+	sdb, _, err = OpenShardedDB([][2]int{{0, 300}}, base, 1, Options{})
+	require.NoError(t, err)
+	require.Len(t, sdb.Shards, 3)
+	assertAll(sdb)
+
+	merged, err := sdb.MergeShards(1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, merged.ID)
+	assert.Equal(t, [2]int{50, 200}, merged.Range)
+	assert.Equal(t, []int{0, 2}, shardIDs(sdb.Shards))
+	assert.Equal(t, 151, countKeys(t, sdb.Shards[1].Database))
+	assertAll(sdb)
+	files, err := filepath.Glob(base + "_1*")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	require.NoError(t, sdb.Close())
+
+	sdb, _, err = OpenShardedDB(nil, base, 1, Options{})
+	require.NoError(t, err)
+	defer sdb.Close()
+	assert.Equal(t, []int{0, 2}, shardIDs(sdb.Shards))
+	assertAll(sdb)
+}
+
+// Writers keep going while a hash partitioned shard is split, none of their
+// writes are lost or left behind on the wrong shard
+func TestSplitShardOnline(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Partitioner = HashPartitioner
+	opts.Durability = DurabilityNone
+	sdb := mustOpenShardedDB(t, HashRanges(1), filepath.Join(t.TempDir(), "online"), 1, opts)
+	defer sdb.Close()
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, sdb.Set(fmt.Sprintf("key%d", i), "initial"))
+	}
+
+	const writers = 4
+	expected := make([]map[string]string, writers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		expected[w] = make(map[string]string)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; ; round++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Each writer has its own keys, every other one it deletes
+				key := fmt.Sprintf("key%d", (round*writers+w)%5000)
+				if round%2 == 0 {
+					if assert.NoError(t, sdb.Set(key, fmt.Sprintf("w%d-%d", w, round))) {
+						expected[w][key] = fmt.Sprintf("w%d-%d", w, round)
+					}
+				} else if err := sdb.Delete(key); err == nil {
+					expected[w][key] = ""
+				}
+			}
+		}(w)
+	}
+
+	_, err := sdb.SplitShard(0, strconv.Itoa(HashSlots/2))
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err)
+
+	for _, writes := range expected {
+		for key, value := range writes {
+			got, err := sdb.Get(key)
+			if value == "" {
+				assert.Equal(t, ErrNotFound, err, key)
+				continue
+			}
+			require.NoError(t, err, key)
+			assert.Equal(t, value, got, key)
+		}
+	}
+	total := 0
+	for _, shard := range sdb.Shards {
+		require.NoError(t, shard.Database.forEachKey(func(key string) {
+			assert.True(t, HashSlot(key) >= shard.Range[0] && HashSlot(key) <= shard.Range[1], key)
+			total++
+		}))
+		assert.Equal(t, shard.Database.digest(), shard.Replicas[0].digest())
+	}
+	entries, _, err := sdb.Scan("", "", 0).Collect(0)
+	require.NoError(t, err)
+	assert.Equal(t, len(entries), total)
+}
+
+func TestSplitNeedsRanges(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Partitioner = RingPartitioner
+	sdb := mustOpenShardedDB(t, make([][2]int, 2), filepath.Join(t.TempDir(), "ring"), 0, opts)
+	defer sdb.Close()
+	_, err := sdb.SplitShard(0, "10")
+	assert.ErrorIs(t, err, ErrNotRanged)
+	_, err = sdb.MergeShards(0, 1)
+	assert.ErrorIs(t, err, ErrNotRanged)
+}
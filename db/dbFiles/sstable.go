@@ -0,0 +1,445 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync"
+)
+
+//  SSTable layout, everything sorted by key and never modified once written:
+//
+//	data block 0 | crc
+//	data block 1 | crc
+//	...
+//	filter block | crc    bloom filter over every key in the table
+//	index block  | crc    one entry per data block: its last key, offset and size
+//	footer               index offset and size, filter offset and size,
+//	                     entry count, magic
+//
+//  Each data block entry is kind (0 value, 1 tombstone), key length and value
+//  length as uvarints, then the key and value.
+const (
+	sstableMagic      uint64 = 0x676f64622d737332 // "godb-ss2"
+	sstableFooterSize        = 48
+	blockTrailerSize         = 4
+
+	entryValue     byte = 0
+	entryTombstone byte = 1
+)
+
+var errCorruptTable = errors.New("sstable: corrupt table")
+
+type blockHandle struct {
+	lastKey string
+	offset  uint64
+	size    uint64
+}
+
+type sstableWriter struct {
+	file      *os.File
+	buf       *bufio.Writer
+	offset    uint64
+	blockSize int
+	block     []byte
+	lastKey   string
+	index     []blockHandle
+	count     uint64
+	hashes    [][2]uint32
+	fpRate    float64
+}
+
+func newSSTableWriter(path string, blockSize int, falsePositiveRate float64) (*sstableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{
+		file:      file,
+		buf:       bufio.NewWriterSize(file, 64<<10),
+		blockSize: blockSize,
+		fpRate:    falsePositiveRate,
+	}, nil
+}
+
+// Function for adding the next entry, keys have to come in increasing order
+func (w *sstableWriter) add(entry memEntry) error {
+	if w.count > 0 && entry.key <= w.lastKey {
+		return fmt.Errorf("sstable: key %q added out of order", entry.key)
+	}
+	kind := entryValue
+	if entry.tombstone {
+		kind = entryTombstone
+	}
+	w.block = append(w.block, kind)
+	w.block = binary.AppendUvarint(w.block, uint64(len(entry.key)))
+	w.block = binary.AppendUvarint(w.block, uint64(len(entry.value)))
+	w.block = append(w.block, entry.key...)
+	w.block = append(w.block, entry.value...)
+	w.lastKey = entry.key
+	w.count++
+	h1, h2 := bloomHash(entry.key)
+	w.hashes = append(w.hashes, [2]uint32{h1, h2})
+	if len(w.block) >= w.blockSize {
+		return w.finishBlock()
+	}
+	return nil
+}
+
+// Bytes written so far, counting the block still being built
+func (w *sstableWriter) size() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+func (w *sstableWriter) writeBlock(block []byte) (uint64, error) {
+	var trailer [blockTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:], crc32.Checksum(block, crcTable))
+	offset := w.offset
+	if _, err := w.buf.Write(block); err != nil {
+		return 0, err
+	}
+	if _, err := w.buf.Write(trailer[:]); err != nil {
+		return 0, err
+	}
+	w.offset += uint64(len(block) + blockTrailerSize)
+	return offset, nil
+}
+
+func (w *sstableWriter) finishBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	offset, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: offset, size: uint64(len(w.block))})
+	w.block = w.block[:0]
+	return nil
+}
+
+// Function for writing out the filter, index and footer and closing the file
+func (w *sstableWriter) finish(sync bool) error {
+	err := w.finishBlock()
+	filter := newBloomFilter(len(w.hashes), w.fpRate)
+	for _, hash := range w.hashes {
+		filter.addHash(hash[0], hash[1])
+	}
+	encodedFilter := filter.encode()
+	var filterOffset uint64
+	if err == nil {
+		filterOffset, err = w.writeBlock(encodedFilter)
+	}
+
+	var index []byte
+	for _, handle := range w.index {
+		index = binary.AppendUvarint(index, uint64(len(handle.lastKey)))
+		index = append(index, handle.lastKey...)
+		index = binary.AppendUvarint(index, handle.offset)
+		index = binary.AppendUvarint(index, handle.size)
+	}
+	var indexOffset uint64
+	if err == nil {
+		indexOffset, err = w.writeBlock(index)
+	}
+	if err == nil {
+		var footer [sstableFooterSize]byte
+		binary.BigEndian.PutUint64(footer[0:8], indexOffset)
+		binary.BigEndian.PutUint64(footer[8:16], uint64(len(index)))
+		binary.BigEndian.PutUint64(footer[16:24], filterOffset)
+		binary.BigEndian.PutUint64(footer[24:32], uint64(len(encodedFilter)))
+		binary.BigEndian.PutUint64(footer[32:40], w.count)
+		binary.BigEndian.PutUint64(footer[40:48], sstableMagic)
+		_, err = w.buf.Write(footer[:])
+	}
+	if err == nil {
+		err = w.buf.Flush()
+	}
+	if err == nil && sync {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Function for giving up on a table halfway through
+func (w *sstableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+//  An open SSTable.
+//  The index and bloom filter are kept in memory, data blocks are read from
+//  disk as needed and go through the block cache when there is one.
+//  refs counts the engine versions and iterators using the table, once it's
+//  obsolete (compacted away) the file is removed when the last one lets go.
+type sstable struct {
+	id       uint64
+	path     string
+	file     *os.File
+	size     int64
+	count    uint64
+	index    []blockHandle
+	filter   *bloomFilter
+	smallest string
+	largest  string
+	cache    *BlockCache
+	cacheID  uint64
+
+	lock     sync.Mutex
+	refs     int
+	obsolete bool
+}
+
+// cache can be nil
+func openSSTable(path string, id uint64, cache *BlockCache) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	table, err := loadSSTable(file, path, id, cache)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return table, nil
+}
+
+func loadSSTable(file *os.File, path string, id uint64, cache *BlockCache) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, errCorruptTable
+	}
+	var footer [sstableFooterSize]byte
+	if _, err := file.ReadAt(footer[:], info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(footer[40:48]) != sstableMagic {
+		return nil, errCorruptTable
+	}
+
+	table := &sstable{
+		id:      id,
+		path:    path,
+		file:    file,
+		size:    info.Size(),
+		count:   binary.BigEndian.Uint64(footer[32:40]),
+		refs:    1,
+		cache:   cache,
+		cacheID: newCacheID(),
+	}
+	filter, err := table.readBlockAt(binary.BigEndian.Uint64(footer[16:24]), binary.BigEndian.Uint64(footer[24:32]))
+	if err != nil {
+		return nil, err
+	}
+	table.filter = decodeBloomFilter(filter)
+	index, err := table.readBlockAt(binary.BigEndian.Uint64(footer[0:8]), binary.BigEndian.Uint64(footer[8:16]))
+	if err != nil {
+		return nil, err
+	}
+	for len(index) > 0 {
+		var handle blockHandle
+		keyLen, n := binary.Uvarint(index)
+		if n <= 0 || keyLen > uint64(len(index)-n) {
+			return nil, errCorruptTable
+		}
+		handle.lastKey = string(index[n : n+int(keyLen)])
+		index = index[n+int(keyLen):]
+		if handle.offset, n = binary.Uvarint(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		if handle.size, n = binary.Uvarint(index); n <= 0 {
+			return nil, errCorruptTable
+		}
+		index = index[n:]
+		table.index = append(table.index, handle)
+	}
+
+	if len(table.index) > 0 {
+		table.largest = table.index[len(table.index)-1].lastKey
+		it := table.iterator("")
+		if !it.valid() {
+			if it.err() != nil {
+				return nil, it.err()
+			}
+			return nil, errCorruptTable
+		}
+		table.smallest = it.entry().key
+	}
+	return table, nil
+}
+
+// Function for reading a block and checking its crc
+func (table *sstable) readBlockAt(offset, size uint64) ([]byte, error) {
+	if offset+size+blockTrailerSize > uint64(table.size) {
+		return nil, errCorruptTable
+	}
+	data := make([]byte, size+blockTrailerSize)
+	if _, err := table.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	block := data[:size]
+	if crc32.Checksum(block, crcTable) != binary.BigEndian.Uint32(data[size:]) {
+		return nil, errCorruptTable
+	}
+	return block, nil
+}
+
+// Function for reading data block i, through the cache if there is one
+func (table *sstable) readBlock(i int) ([]byte, error) {
+	handle := table.index[i]
+	if table.cache == nil {
+		return table.readBlockAt(handle.offset, handle.size)
+	}
+	key := blockCacheKey{table: table.cacheID, offset: handle.offset}
+	if block, found := table.cache.get(key); found {
+		return block, nil
+	}
+	block, err := table.readBlockAt(handle.offset, handle.size)
+	if err != nil {
+		return nil, err
+	}
+	table.cache.put(key, block)
+	return block, nil
+}
+
+// Index of the first block that could hold key
+func (table *sstable) findBlock(key string) int {
+	return sort.Search(len(table.index), func(i int) bool {
+		return table.index[i].lastKey >= key
+	})
+}
+
+// Function for looking up key. found is false when the table knows nothing
+// about the key, a tombstone is returned as found so it shadows older tables.
+// Keys outside the table's range or ruled out by the filter never touch disk.
+func (table *sstable) get(key string) (memEntry, bool, error) {
+	if key < table.smallest || key > table.largest {
+		return memEntry{}, false, nil
+	}
+	if table.filter != nil && !table.filter.mayContain(key) {
+		return memEntry{}, false, nil
+	}
+	it := table.iterator(key)
+	if it.valid() && it.entry().key == key {
+		return it.entry(), true, nil
+	}
+	return memEntry{}, false, it.err()
+}
+
+func (table *sstable) ref() {
+	table.lock.Lock()
+	table.refs++
+	table.lock.Unlock()
+}
+
+func (table *sstable) unref() {
+	table.lock.Lock()
+	table.refs--
+	remove := table.refs == 0
+	obsolete := table.obsolete
+	table.lock.Unlock()
+	if remove {
+		table.file.Close()
+		if obsolete {
+			os.Remove(table.path)
+		}
+	}
+}
+
+// Function for marking a table as compacted away, drops the engine's reference
+func (table *sstable) retire() {
+	table.lock.Lock()
+	table.obsolete = true
+	table.lock.Unlock()
+	table.unref()
+}
+
+// Iterator over a table in key order, starting at the first key >= start
+func (table *sstable) iterator(start string) *sstableIterator {
+	it := &sstableIterator{table: table, blockIndex: table.findBlock(start)}
+	it.loadBlock()
+	for it.valid() && it.current.key < start {
+		it.next()
+	}
+	return it
+}
+
+type sstableIterator struct {
+	table      *sstable
+	blockIndex int
+	block      []byte
+	current    memEntry
+	ok         bool
+	failure    error
+}
+
+func (it *sstableIterator) loadBlock() {
+	it.ok = false
+	for it.failure == nil && it.blockIndex < len(it.table.index) {
+		block, err := it.table.readBlock(it.blockIndex)
+		if err != nil {
+			it.failure = err
+			return
+		}
+		it.block = block
+		if len(block) > 0 {
+			it.decode()
+			return
+		}
+		it.blockIndex++
+	}
+}
+
+func (it *sstableIterator) decode() {
+	block := it.block
+	if len(block) < 3 {
+		it.failure = errCorruptTable
+		it.ok = false
+		return
+	}
+	kind := block[0]
+	keyLen, n := binary.Uvarint(block[1:])
+	if n <= 0 {
+		it.failure = errCorruptTable
+		it.ok = false
+		return
+	}
+	valueLen, m := binary.Uvarint(block[1+n:])
+	start := 1 + n + m
+	if m <= 0 || keyLen+valueLen > uint64(len(block)-start) {
+		it.failure = errCorruptTable
+		it.ok = false
+		return
+	}
+	it.current = memEntry{
+		key:       string(block[start : start+int(keyLen)]),
+		value:     string(block[start+int(keyLen) : start+int(keyLen+valueLen)]),
+		tombstone: kind == entryTombstone,
+	}
+	it.block = block[start+int(keyLen+valueLen):]
+	it.ok = true
+}
+
+func (it *sstableIterator) valid() bool     { return it.ok }
+func (it *sstableIterator) entry() memEntry { return it.current }
+func (it *sstableIterator) err() error      { return it.failure }
+
+func (it *sstableIterator) next() {
+	if len(it.block) > 0 {
+		it.decode()
+		return
+	}
+	it.blockIndex++
+	it.loadBlock()
+}
@@ -1,43 +1,55 @@
 package db
 
 import (
-	"google.golang.org/protobuf/proto"
 	"io/ioutil"
 	"os"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 
-// Function for saving db data to file for persistant saves
+// Function for saving db data to file for persistant saves.
+// The engine snapshots everything up to the last applied LSN, then the WAL
+// segments it no longer needs are dropped.
 func (db *db) Save() error {
-	data, err := proto.Marshal(db.Database)
+	db.saveLock.Lock()
+	defer db.saveLock.Unlock()
+	db.lock.RLock()
+	lsn := db.lastLSN
+	engine := db.engine
+	db.lock.RUnlock()
+	// Writes that land while the snapshot is taken may end up in it as
+	// well. That's fine, replaying them on top again gives the same result.
+	checkpoint, err := engine.Snapshot(lsn)
 	if err != nil {
 		return err
 	}
-
-	return ioutil.WriteFile(db.filename, data, 0644)
+	return db.wal.Checkpoint(checkpoint)
 }
 
 
 
+// Function for re-reading the database from its persisted state, the
+// snapshot and the WAL records after it. A raft member's engine only has
+// what its group committed, it can't be re-read on its own.
 func (db *db) Load() error {
-	data, err := ioutil.ReadFile(db.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return err
-		}
+	if db.raft != nil {
+		return fmt.Errorf("%s is a raft member, it's loaded when it rejoins its group", db.filename)
 	}
-
-	// Decoding from proocol buffer
-	err = proto.Unmarshal(data, db.Database)
-
-	if err != nil {
+	db.saveLock.Lock()
+	defer db.saveLock.Unlock()
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.engine.Close()
+	if err := db.openEngine(); err != nil {
 		return err
 	}
-	return nil
+	_, err := db.replayLocked()
+	return err
 }
 
 
@@ -45,22 +57,100 @@ func (sdb *ShardedDB) Save() error {
 	sdb.lock.Lock()
 	defer sdb.lock.Unlock()
 	for _, shard := range sdb.Shards {
-		if err := shard.Database.Save(); err != nil {
-			return err
+		for _, member := range shard.members() {
+			if err := member.Save(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 
+// How often StartCheckpointing saves the members that took writes
+const DefaultCheckpointInterval = time.Minute
+
+// Function for saving every member that's had writes since it was last
+// saved, every interval until stop is called. Each save checkpoints the
+// member's WAL, so the log doesn't grow without bound and recovery only
+// replays what came after.
+func (sdb *ShardedDB) StartCheckpointing(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		saved := make(map[*db]uint64)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			saved = sdb.checkpoint(saved)
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Function for saving the members with records after the LSN saved has for
+// them, returns the LSN each member has been saved at. Members no longer in
+// a shard are left out.
+func (sdb *ShardedDB) checkpoint(saved map[*db]uint64) map[*db]uint64 {
+	sdb.lock.RLock()
+	defer sdb.lock.RUnlock()
+	now := make(map[*db]uint64)
+	for _, shard := range sdb.Shards {
+		for _, member := range shard.members() {
+			lsn := member.appliedLSN()
+			if lsn <= saved[member] {
+				now[member] = saved[member]
+				continue
+			}
+			if err := member.Save(); err != nil {
+				fmt.Printf("Error checkpointing %s: %v\n", member.filename, err)
+				continue
+			}
+			now[member] = lsn
+		}
+	}
+	return now
+}
+
+// Refuses to if the shard map on disk isn't the one the shards were opened
+// with, or doesn't match the files
 func (sdb *ShardedDB) Load() error {
 	sdb.lock.Lock()
 	defer sdb.lock.Unlock()
-	for _, shard := range sdb.Shards {
-		if err := shard.Database.Load(); err != nil {
+	if sdb.basedFilename != "" {
+		shardMap, err := readShardMap(sdb.basedFilename)
+		if err != nil {
+			return err
+		}
+		if shardMap == nil {
+			return fmt.Errorf("%w: %s is missing", ErrShardMapMismatch, shardMapFilename(sdb.basedFilename))
+		}
+		if shardMap.Epoch != sdb.Epoch() {
+			return fmt.Errorf("%w: the shard map is at epoch %d, the shards were opened at %d", ErrShardMapMismatch, shardMap.Epoch, sdb.Epoch())
+		}
+		if err := shardMap.verify(sdb.basedFilename); err != nil {
 			return err
 		}
 	}
+	for _, shard := range sdb.Shards {
+		for _, member := range shard.members() {
+			if err := member.Load(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -68,29 +158,132 @@ func (sdb *ShardedDB) Load() error {
 
 
 
-func (wal *WAL) save() {
-    data := []byte{}
-    for _, entry := range wal.entries {
-        data = append(data, []byte(entry+"\n")...)
+// Function for reading the log back from disk and opening the last segment for appends.
+// Stops at the first torn or corrupt record, the rest of that segment and any
+// segments after it are dropped.
+func (wal *WAL) load() {
+    indexes, err := wal.listSegments()
+    if err != nil {
+        fmt.Println("Error loading WAL:", err)
+        return
     }
-    if err := ioutil.WriteFile(wal.filename, data, 0644); err != nil {
-        fmt.Println("Error saving WAL:", err)
+    // Logs written before segmenting are a single file, pick it up as the first segment
+    if len(indexes) == 0 {
+        if _, err := os.Stat(wal.filename); err == nil {
+            if err := os.Rename(wal.filename, wal.segmentName(1)); err != nil {
+                fmt.Println("Error loading WAL:", err)
+                return
+            }
+            indexes = []int{1}
+        }
     }
-}
 
-func (wal *WAL) load() {
-    data, err := ioutil.ReadFile(wal.filename)
-    if err != nil {
-        if os.IsNotExist(err) {
+    for i, index := range indexes {
+        data, err := ioutil.ReadFile(wal.segmentName(index))
+        if err != nil {
+            fmt.Println("Error loading WAL:", err)
             return
         }
-        fmt.Println("Error loading WAL:", err)
+        segment := walSegment{index: index, firstLSN: wal.lastLSN + 1}
+        valid, lastLSN, err := scanRecords(data, wal.lastLSN)
+        segment.size = int64(valid)
+        wal.lastLSN = lastLSN
+        wal.segments = append(wal.segments, segment)
+        if err == nil {
+            continue
+        }
+
+        wal.truncated = int64(len(data) - valid)
+        if err := os.Truncate(wal.segmentName(index), int64(valid)); err != nil {
+            fmt.Println("Error truncating WAL:", err)
+        }
+        for _, later := range indexes[i+1:] {
+            if info, err := os.Stat(wal.segmentName(later)); err == nil {
+                wal.truncated += info.Size()
+            }
+            os.Remove(wal.segmentName(later))
+        }
+        fmt.Printf("WAL %s: %v in segment %d at offset %d, truncated %d bytes\n", wal.filename, err, index, valid, wal.truncated)
+        break
+    }
+
+    if len(wal.segments) == 0 {
+        wal.segments = append(wal.segments, walSegment{index: 1, firstLSN: wal.lastLSN + 1})
+    }
+    file, err := openSegment(wal.segmentName(wal.segments[len(wal.segments)-1].index))
+    if err != nil {
+        fmt.Println("Error opening WAL:", err)
         return
     }
-    wal.entries = []string{}
-    for _, line := range strings.Split(string(data), "\n") {
-        if line != "" {
-            wal.entries = append(wal.entries, line)
+    wal.file = file
+}
+
+// Function for decoding every record in a segment.
+// Returns how many bytes were valid and the last LSN seen. LSNs have to keep
+// increasing, a record that goes backwards is treated as corrupt.
+func scanRecords(data []byte, lastLSN uint64) (int, uint64, error) {
+    offset := 0
+    for offset < len(data) {
+        rec, n, err := decodeRecord(data[offset:])
+        if err == nil && rec.LSN <= lastLSN {
+            err = errCorruptRecord
         }
+        if err != nil {
+            return offset, lastLSN, err
+        }
+        lastLSN = rec.LSN
+        offset += n
     }
-}
\ No newline at end of file
+    return offset, lastLSN, nil
+}
+
+func (wal *WAL) readSegment(index int) ([]Record, error) {
+    data, err := ioutil.ReadFile(wal.segmentName(index))
+    if err != nil {
+        return nil, err
+    }
+    records := []Record{}
+    for offset := 0; offset < len(data); {
+        rec, n, err := decodeRecord(data[offset:])
+        if err != nil {
+            return records, err
+        }
+        records = append(records, rec)
+        offset += n
+    }
+    return records, nil
+}
+
+// Function for finding the segment files that belong to this log, in order
+func (wal *WAL) listSegments() ([]int, error) {
+    matches, err := filepath.Glob(wal.filename + ".*")
+    if err != nil {
+        return nil, err
+    }
+    indexes := []int{}
+    for _, match := range matches {
+        suffix := strings.TrimPrefix(match, wal.filename+".")
+        index, err := strconv.Atoi(suffix)
+        if err != nil || len(suffix) != 6 {
+            continue
+        }
+        indexes = append(indexes, index)
+    }
+    sort.Ints(indexes)
+    return indexes, nil
+}
+
+func (wal *WAL) dropSegment(index int) error {
+    name := wal.segmentName(index)
+    if wal.opts.ArchiveDir == "" {
+        return os.Remove(name)
+    }
+    if err := os.MkdirAll(wal.opts.ArchiveDir, 0755); err != nil {
+        return err
+    }
+    return os.Rename(name, filepath.Join(wal.opts.ArchiveDir, filepath.Base(name)))
+}
+
+func openSegment(name string) (*os.File, error) {
+    return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
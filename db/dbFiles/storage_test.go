@@ -0,0 +1,175 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDbWithOptions(path, Options{SnapshotRetention: 2})
+	for _, value := range []string{"1", "2", "3"} {
+		require.NoError(t, database.Set("key", value))
+		require.NoError(t, database.Save())
+	}
+
+	assert.NoFileExists(t, path+".snap.000001")
+	assert.FileExists(t, path+".snap.000002")
+	assert.FileExists(t, path+".snap.000003")
+	assert.FileExists(t, path+".manifest")
+	matches, _ := filepath.Glob(path + "*.tmp")
+	assert.Empty(t, matches)
+
+	manifest, err := database.engine.(*mapEngine).readManifest()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), manifest.Current)
+	require.Len(t, manifest.Snapshots, 2)
+	assert.Equal(t, uint64(3), manifest.Snapshots[0].Generation)
+
+	// The WAL keeps what the oldest kept generation is missing, whole
+	// segments at a time
+	entries := database.wal.GetEntries()
+	require.NotEmpty(t, entries)
+	assert.Equal(t, uint64(2), entries[0].LSN)
+	assert.Equal(t, uint64(3), entries[len(entries)-1].LSN)
+}
+
+// A corrupt newest snapshot falls back to the one before it, and the WAL
+// fills in what that older snapshot is missing
+func TestSnapshotFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDb(path)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+	require.NoError(t, database.Set("b", "2"))
+	require.NoError(t, database.Save())
+	require.NoError(t, database.Close())
+
+	// Simulate a crash halfway through writing the newest snapshot
+	data, err := os.ReadFile(path + ".snap.000002")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path+".snap.000002", data[:len(data)/2], 0644))
+
+	recovered, report, err := OpenDb(path, DefaultOptions())
+	require.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, uint64(1), report.SnapshotLSN)
+	assert.Equal(t, 1, report.RecordsReplayed)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, contents(t, recovered))
+}
+
+func TestSnapshotWithoutManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDb(path)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+	require.NoError(t, database.Close())
+	require.NoError(t, os.WriteFile(path+".manifest", []byte("{not json"), 0644))
+
+	recovered := NewDb(path)
+	require.NoError(t, recovered.Load())
+	assert.Equal(t, map[string]string{"a": "1"}, contents(t, recovered))
+
+	// Saving again carries on from the newest generation on disk
+	require.NoError(t, recovered.Save())
+	assert.FileExists(t, path+".snap.000002")
+}
+
+func TestSnapshotAllCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDb(path)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+	require.NoError(t, os.WriteFile(path+".snap.000001", []byte("garbage"), 0644))
+
+	assert.Error(t, NewDb(path).Load())
+}
+
+// Writes that never made it into a snapshot come back from the WAL
+func TestOpenShardedDBReplaysWAL(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "test_db")
+	ranges := [][2]int{{0, 9}, {10, 19}}
+
+	shardedDB, report, err := OpenShardedDB(ranges, base, 1, DefaultOptions())
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.RecordsReplayed)
+	require.NoError(t, shardedDB.Set("5", "low"))
+	require.NoError(t, shardedDB.Save())
+	require.NoError(t, shardedDB.Set("15", "high"))
+	require.NoError(t, shardedDB.Close())
+
+	reopened, report, err := OpenShardedDB(ranges, base, 1, DefaultOptions())
+	require.NoError(t, err)
+	defer reopened.Close()
+	value, err := reopened.Get("15")
+	require.NoError(t, err)
+	assert.Equal(t, "high", value)
+	value, err = reopened.Get("5")
+	require.NoError(t, err)
+	assert.Equal(t, "low", value)
+
+	// Shard 1's primary and replica each replay the one write
+	assert.Equal(t, 2, report.RecordsReplayed)
+	require.Len(t, report.Shards, 2)
+	assert.Equal(t, uint64(1), report.Shards[0].Primary.SnapshotLSN)
+	assert.Equal(t, 1, report.Shards[1].Primary.RecordsReplayed)
+	assert.Empty(t, report.Shards[0].ReplicaMismatches)
+	assert.Empty(t, report.Shards[1].ReplicaMismatches)
+}
+
+func TestOpenShardedDBReportsReplicaMismatch(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "test_db")
+	ranges := [][2]int{{0, 9}}
+
+	shardedDB, _, err := OpenShardedDB(ranges, base, 1, DefaultOptions())
+	require.NoError(t, err)
+	require.NoError(t, shardedDB.Set("5", "low"))
+	// Write to the replica only, it has a record the primary doesn't
+	_, err = shardedDB.Shards[0].Replicas[0].setAt(shardedDB.Shards[0].Epoch, "6", "diverged")
+	require.NoError(t, err)
+	require.NoError(t, shardedDB.Close())
+
+	reopened, report, err := OpenShardedDB(ranges, base, 1, DefaultOptions())
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, []string{base + "_0_replica_0"}, report.Shards[0].ReplicaMismatches)
+}
+
+// Everything in a database, for comparing against a map
+func contents(t *testing.T, database *db) map[string]string {
+	store := make(map[string]string)
+	require.NoError(t, database.engine.Iterate(func(key, value string) bool {
+		store[key] = value
+		return true
+	}))
+	return store
+}
+
+// Members that took writes are saved in the background, after which their
+// WALs only hold what came since
+func TestStartCheckpointing(t *testing.T) {
+	shardedDB, _, err := OpenShardedDB([][2]int{{0, 99}}, filepath.Join(t.TempDir(), "test_db"), 1, DefaultOptions())
+	require.NoError(t, err)
+	defer shardedDB.Close()
+	stop := shardedDB.StartCheckpointing(10 * time.Millisecond)
+	defer stop()
+
+	require.NoError(t, shardedDB.Set("1", "one"))
+	require.Eventually(t, func() bool {
+		for _, member := range shardedDB.Shards[0].members() {
+			if member.appliedLSN() != 1 || len(member.wal.GetEntries()) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,367 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// A call that couldn't be made, the other node never saw it
+var errNotSent = fmt.Errorf("%w, nothing was sent", ErrUnreachable)
+
+// The call a node makes to another for one of the other's raft members
+type VoteCall struct {
+	To      string
+	Request VoteRequest
+}
+
+type AppendCall struct {
+	To      string
+	Request AppendRequest
+}
+
+type SnapshotCall struct {
+	To      string
+	Request SnapshotRequest
+}
+
+//  RaftTransport and GossipTransport between the nodes of a cluster, over
+//  TCP with net/rpc. Members registered here are called directly, members
+//  of other nodes through a connection to their node (see nodeOf, gossip
+//  members are named after their node), kept open between calls. A call that fails or gets no reply in time is ErrUnreachable and
+//  the connection is dropped, the next call makes a new one. One that was
+//  never sent, with no connection to be had, is errNotSent as well.
+//  timeout is for votes, entries and pings, snapshotTimeout for snapshots
+//  and requests passed on to another node, which both take longer.
+type TCPTransport struct {
+	lock            sync.Mutex
+	addrs           map[string]string
+	members         map[string]RaftMember
+	gossip          map[string]GossipHandler
+	clients         map[string]*rpc.Client
+	timeout         time.Duration
+	snapshotTimeout time.Duration
+}
+
+func NewTCPTransport(nodes []ClusterNode, opts Options) *TCPTransport {
+	opts = opts.withDefaults()
+	transport := &TCPTransport{addrs: make(map[string]string), members: make(map[string]RaftMember),
+		gossip: make(map[string]GossipHandler), clients: make(map[string]*rpc.Client), timeout: opts.RaftElectionTimeout, snapshotTimeout: 2 * opts.ReplicationTimeout}
+	for _, node := range nodes {
+		transport.addrs[node.ID] = node.Addr
+	}
+	return transport
+}
+
+func (t *TCPTransport) Register(id string, member RaftMember) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.members[id] = member
+}
+
+func (t *TCPTransport) Unregister(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.members, id)
+}
+
+// The member registered as id here, nil if there isn't one
+func (t *TCPTransport) local(id string) RaftMember {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.members[id]
+}
+
+func (t *TCPTransport) RequestVote(to string, request VoteRequest) (VoteReply, error) {
+	if member := t.local(to); member != nil {
+		return member.HandleVote(request), nil
+	}
+	reply := VoteReply{}
+	err := t.call(nodeOf(to), "Node.RequestVote", VoteCall{To: to, Request: request}, &reply, t.timeout)
+	return reply, err
+}
+
+func (t *TCPTransport) AppendEntries(to string, request AppendRequest) (AppendReply, error) {
+	if member := t.local(to); member != nil {
+		return member.HandleAppend(request), nil
+	}
+	reply := AppendReply{}
+	err := t.call(nodeOf(to), "Node.AppendEntries", AppendCall{To: to, Request: request}, &reply, t.timeout)
+	return reply, err
+}
+
+func (t *TCPTransport) InstallSnapshot(to string, request SnapshotRequest) (SnapshotReply, error) {
+	if member := t.local(to); member != nil {
+		return member.HandleSnapshot(request), nil
+	}
+	reply := SnapshotReply{}
+	err := t.call(nodeOf(to), "Node.InstallSnapshot", SnapshotCall{To: to, Request: request}, &reply, t.snapshotTimeout)
+	return reply, err
+}
+
+func (t *TCPTransport) RegisterGossip(id string, member GossipHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.gossip[id] = member
+}
+
+func (t *TCPTransport) UnregisterGossip(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.gossip, id)
+}
+
+// The gossip member registered as id here, nil if there isn't one
+func (t *TCPTransport) localGossip(id string) GossipHandler {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.gossip[id]
+}
+
+func (t *TCPTransport) Ping(to string, message GossipMessage) (GossipMessage, error) {
+	if member := t.localGossip(to); member != nil {
+		return member.HandlePing(message), nil
+	}
+	ack := GossipMessage{}
+	err := t.call(to, "Node.GossipPing", message, &ack, t.timeout)
+	return ack, err
+}
+
+// The node asked has a ping of its own to wait for
+func (t *TCPTransport) PingReq(via string, message GossipMessage) (GossipMessage, error) {
+	if member := t.localGossip(via); member != nil {
+		return member.HandlePingReq(message)
+	}
+	ack := GossipMessage{}
+	err := t.call(via, "Node.GossipPingReq", message, &ack, 2*t.timeout)
+	return ack, err
+}
+
+// Function for passing request on to node
+func (t *TCPTransport) forward(node string, request NodeRequest) (NodeReply, error) {
+	reply := NodeReply{}
+	err := t.call(node, "Node.Do", request, &reply, t.snapshotTimeout)
+	return reply, err
+}
+
+// Function for asking node for its status
+func (t *TCPTransport) status(node string) (NodeStatus, error) {
+	status := NodeStatus{}
+	err := t.call(node, "Node.Status", true, &status, t.timeout)
+	return status, err
+}
+
+// Function for calling method on node, waiting up to timeout for the reply
+func (t *TCPTransport) call(node, method string, args, reply any, timeout time.Duration) error {
+	client, err := t.client(node)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errNotSent, node, err)
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		// A connection that was already shut down fails the call before
+		// writing it
+		if errors.Is(call.Error, rpc.ErrShutdown) {
+			t.drop(node, client)
+			return fmt.Errorf("%w: %s on %s: %v", errNotSent, method, node, call.Error)
+		}
+		call.Done <- call
+	default:
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return nil
+		}
+		err = call.Error
+	case <-timer.C:
+		err = fmt.Errorf("no reply after %v", timeout)
+	}
+	// The node answered, the connection is fine
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.drop(node, client)
+	}
+	return fmt.Errorf("%w: %s on %s: %v", ErrUnreachable, method, node, err)
+}
+
+// The connection to node, made if there isn't one
+func (t *TCPTransport) client(node string) (*rpc.Client, error) {
+	t.lock.Lock()
+	client, addr := t.clients[node], t.addrs[node]
+	t.lock.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("no address for node %s", node)
+	}
+	conn, err := net.DialTimeout("tcp", addr, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	client = rpc.NewClient(conn)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Someone else got there first
+	if existing := t.clients[node]; existing != nil {
+		client.Close()
+		return existing, nil
+	}
+	t.clients[node] = client
+	return client, nil
+}
+
+func (t *TCPTransport) drop(node string, client *rpc.Client) {
+	t.lock.Lock()
+	if t.clients[node] == client {
+		delete(t.clients, node)
+	}
+	t.lock.Unlock()
+	client.Close()
+}
+
+// Function for closing the connections to other nodes
+func (t *TCPTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for node, client := range t.clients {
+		client.Close()
+		delete(t.clients, node)
+	}
+}
+
+// The net/rpc service a node serves to other nodes and NodeClients
+type nodeService struct {
+	node *Node
+}
+
+func newNodeServer(node *Node) *rpc.Server {
+	server := rpc.NewServer()
+	server.RegisterName("Node", &nodeService{node: node})
+	return server
+}
+
+// Function for finding the member a call is for
+func (service *nodeService) member(to string) (RaftMember, error) {
+	member := service.node.transport.local(to)
+	if member == nil {
+		return nil, fmt.Errorf("no raft member %s on node %s", to, service.node.ID)
+	}
+	return member, nil
+}
+
+func (service *nodeService) RequestVote(call VoteCall, reply *VoteReply) error {
+	member, err := service.member(call.To)
+	if err != nil {
+		return err
+	}
+	*reply = member.HandleVote(call.Request)
+	return nil
+}
+
+func (service *nodeService) AppendEntries(call AppendCall, reply *AppendReply) error {
+	member, err := service.member(call.To)
+	if err != nil {
+		return err
+	}
+	*reply = member.HandleAppend(call.Request)
+	return nil
+}
+
+func (service *nodeService) InstallSnapshot(call SnapshotCall, reply *SnapshotReply) error {
+	member, err := service.member(call.To)
+	if err != nil {
+		return err
+	}
+	*reply = member.HandleSnapshot(call.Request)
+	return nil
+}
+
+// Function for finding the node's gossip member, it's gone once the node
+// has left
+func (service *nodeService) gossip() (GossipHandler, error) {
+	member := service.node.transport.localGossip(service.node.ID)
+	if member == nil {
+		return nil, fmt.Errorf("node %s isn't gossiping", service.node.ID)
+	}
+	return member, nil
+}
+
+func (service *nodeService) GossipPing(message GossipMessage, ack *GossipMessage) error {
+	member, err := service.gossip()
+	if err != nil {
+		return err
+	}
+	*ack = member.HandlePing(message)
+	return nil
+}
+
+func (service *nodeService) GossipPingReq(message GossipMessage, ack *GossipMessage) error {
+	member, err := service.gossip()
+	if err != nil {
+		return err
+	}
+	*ack, err = member.HandlePingReq(message)
+	return err
+}
+
+func (service *nodeService) Do(request NodeRequest, reply *NodeReply) error {
+	*reply = service.node.do(request)
+	return nil
+}
+
+func (service *nodeService) Status(_ bool, status *NodeStatus) error {
+	*status = service.node.Status()
+	return nil
+}
+
+//  A client of one node of a cluster, over the same protocol the nodes use
+//  between themselves. Requests for shards the node doesn't lead are passed
+//  on by the node.
+type NodeClient struct {
+	addr      string
+	transport *TCPTransport
+}
+
+// Function for making a client of the node at addr, timeout is how long
+// requests wait for a reply
+func DialNode(addr string, timeout time.Duration) *NodeClient {
+	transport := NewTCPTransport([]ClusterNode{{ID: addr, Addr: addr}}, Options{})
+	transport.timeout, transport.snapshotTimeout = timeout, timeout
+	return &NodeClient{addr: addr, transport: transport}
+}
+
+func (client *NodeClient) Set(key, value string) error {
+	return client.do(NodeRequest{Op: opSet, Key: key, Value: value}).err()
+}
+
+func (client *NodeClient) Get(key string) (string, error) {
+	reply := client.do(NodeRequest{Op: opGet, Key: key})
+	return reply.Value, reply.err()
+}
+
+func (client *NodeClient) Delete(key string) error {
+	return client.do(NodeRequest{Op: opDelete, Key: key}).err()
+}
+
+func (client *NodeClient) Status() (NodeStatus, error) {
+	return client.transport.status(client.addr)
+}
+
+func (client *NodeClient) do(request NodeRequest) NodeReply {
+	reply, err := client.transport.forward(client.addr, request)
+	if err != nil {
+		return replyFor(err)
+	}
+	return reply
+}
+
+func (client *NodeClient) Close() {
+	client.transport.Close()
+}
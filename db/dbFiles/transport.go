@@ -0,0 +1,209 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// The member called can't be reached
+var ErrUnreachable = errors.New("raft member unreachable")
+
+//  How raft members reach each other. Members register under their ID to
+//  be called. Calls are made without any of the caller's locks held and
+//  return the reply, or an error if it couldn't be had.
+type RaftTransport interface {
+	Register(id string, member RaftMember)
+	Unregister(id string)
+	RequestVote(to string, request VoteRequest) (VoteReply, error)
+	AppendEntries(to string, request AppendRequest) (AppendReply, error)
+	InstallSnapshot(to string, request SnapshotRequest) (SnapshotReply, error)
+}
+
+// The receiving end of a RaftTransport
+type RaftMember interface {
+	HandleVote(request VoteRequest) VoteReply
+	HandleAppend(request AppendRequest) AppendReply
+	HandleSnapshot(request SnapshotRequest) SnapshotReply
+}
+
+//  RaftTransport and GossipTransport for members in the same process, calls
+//  go straight to the member called. Tests use it to simulate the network
+//  failing: a member can be cut off from everyone, or from one other member,
+//  or the members split into partitions that can't reach each other.
+type MemoryTransport struct {
+	lock      sync.RWMutex
+	members   map[string]RaftMember
+	gossip    map[string]GossipHandler
+	cut       map[string]bool
+	links     map[[2]string]bool
+	partition map[string]int
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{members: make(map[string]RaftMember), gossip: make(map[string]GossipHandler),
+		cut: make(map[string]bool), links: make(map[[2]string]bool), partition: make(map[string]int)}
+}
+
+func (t *MemoryTransport) Register(id string, member RaftMember) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.members[id] = member
+}
+
+func (t *MemoryTransport) Unregister(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.members, id)
+}
+
+func (t *MemoryTransport) RegisterGossip(id string, member GossipHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.gossip[id] = member
+}
+
+func (t *MemoryTransport) UnregisterGossip(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.gossip, id)
+}
+
+// Function for cutting members off from everyone else, both ways
+func (t *MemoryTransport) Disconnect(ids ...string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, id := range ids {
+		t.cut[id] = true
+	}
+}
+
+// Function for undoing Disconnect
+func (t *MemoryTransport) Reconnect(ids ...string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, id := range ids {
+		delete(t.cut, id)
+	}
+}
+
+// Function for cutting a and b off from each other, both ways
+func (t *MemoryTransport) CutLink(a, b string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.links[[2]string{a, b}] = true
+	t.links[[2]string{b, a}] = true
+}
+
+// Function for splitting members into groups that can only reach members
+// in the same group. Members not in any group can reach each other.
+func (t *MemoryTransport) Partition(groups ...[]string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			t.partition[id] = i + 1
+		}
+	}
+}
+
+// Function for undoing Disconnect, CutLink and Partition for every member
+func (t *MemoryTransport) Heal() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cut = make(map[string]bool)
+	t.links = make(map[[2]string]bool)
+	t.partition = make(map[string]int)
+}
+
+// The member to is, if from can reach it
+func (t *MemoryTransport) reach(from, to string) (RaftMember, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	member := t.members[to]
+	if member == nil || !t.connected(from, to) {
+		return nil, fmt.Errorf("%w: %s from %s", ErrUnreachable, to, from)
+	}
+	return member, nil
+}
+
+// Same as reach for a gossip member
+func (t *MemoryTransport) reachGossip(from, to string) (GossipHandler, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	member := t.gossip[to]
+	if member == nil || !t.connected(from, to) {
+		return nil, fmt.Errorf("%w: %s from %s", ErrUnreachable, to, from)
+	}
+	return member, nil
+}
+
+// Caller holds the lock
+func (t *MemoryTransport) connected(from, to string) bool {
+	return !t.cut[from] && !t.cut[to] && !t.links[[2]string{from, to}] && t.partition[from] == t.partition[to]
+}
+
+func (t *MemoryTransport) RequestVote(to string, request VoteRequest) (VoteReply, error) {
+	member, err := t.reach(request.Candidate, to)
+	if err != nil {
+		return VoteReply{}, err
+	}
+	reply := member.HandleVote(request)
+	// The reply has to make it back as well
+	if _, err := t.reach(to, request.Candidate); err != nil {
+		return VoteReply{}, err
+	}
+	return reply, nil
+}
+
+func (t *MemoryTransport) AppendEntries(to string, request AppendRequest) (AppendReply, error) {
+	member, err := t.reach(request.Leader, to)
+	if err != nil {
+		return AppendReply{}, err
+	}
+	reply := member.HandleAppend(request)
+	if _, err := t.reach(to, request.Leader); err != nil {
+		return AppendReply{}, err
+	}
+	return reply, nil
+}
+
+func (t *MemoryTransport) InstallSnapshot(to string, request SnapshotRequest) (SnapshotReply, error) {
+	member, err := t.reach(request.Leader, to)
+	if err != nil {
+		return SnapshotReply{}, err
+	}
+	reply := member.HandleSnapshot(request)
+	if _, err := t.reach(to, request.Leader); err != nil {
+		return SnapshotReply{}, err
+	}
+	return reply, nil
+}
+
+func (t *MemoryTransport) Ping(to string, message GossipMessage) (GossipMessage, error) {
+	member, err := t.reachGossip(message.From.ID, to)
+	if err != nil {
+		return GossipMessage{}, err
+	}
+	ack := member.HandlePing(message)
+	if _, err := t.reachGossip(to, message.From.ID); err != nil {
+		return GossipMessage{}, err
+	}
+	return ack, nil
+}
+
+func (t *MemoryTransport) PingReq(via string, message GossipMessage) (GossipMessage, error) {
+	member, err := t.reachGossip(message.From.ID, via)
+	if err != nil {
+		return GossipMessage{}, err
+	}
+	ack, err := member.HandlePingReq(message)
+	if err != nil {
+		return GossipMessage{}, err
+	}
+	if _, err := t.reachGossip(via, message.From.ID); err != nil {
+		return GossipMessage{}, err
+	}
+	return ack, nil
+}
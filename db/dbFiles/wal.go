@@ -1,40 +1,524 @@
-package db 
+package db
 
 
 import (
-	"sync"
+	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Size a segment can grow to before the log rolls over to a new one
+const DefaultSegmentSize = 16 << 20
+
+// How much of the end of the log is kept in memory for entriesAfter, in
+// records and bytes of keys and values
+const (
+    tailRecords = 1024
+    tailBytes   = 1 << 20
 )
 
+// Records asked for have already been checkpointed away
+var ErrWALGap = errors.New("wal no longer has the records asked for")
+
+// ArchiveDir, when set, is where checkpointed segments are moved to
+// instead of being deleted
+type WALOptions struct {
+    SegmentSize  int64
+    Durability   Durability
+    SyncInterval time.Duration
+    ArchiveDir   string
+}
+
+// One file of the log, named <filename>.000001, <filename>.000002, ...
+type walSegment struct {
+    index    int
+    firstLSN uint64
+    size     int64
+}
+
+//  Struct for the write ahead log.
+//  Records are only ever appended to the active (last) segment,
+//  older segments are never written again.
+//  syncedLSN is the last record known to be on stable storage, syncing is
+//  set while one caller is running fsync on behalf of everyone waiting.
+//  Checkpoints keep every record after the lowest LSN in holds, someone
+//  still has to read them. appended is closed when a record is appended and
+//  replaced with a new one, see appendedAfter.
+//  tail is the end of the log, the records up to lastLSN, so replicas
+//  streaming it don't have to read it back from disk.
 type WAL struct {
-    entries  []string
-    lock     sync.Mutex
-    filename string
+    lock      sync.Mutex
+    filename  string
+    opts      WALOptions
+    segments  []walSegment
+    file      *os.File
+    lastLSN   uint64
+    truncated int64
+
+    synced    *sync.Cond
+    syncing   bool
+    syncedLSN uint64
+    syncCount int
+    stop      chan struct{}
+
+    holds     map[any]uint64
+    appended  chan struct{}
+    tail      []Record
+    tailSize  int
 }
 
 
 
 func NewWAL(filename string) *WAL {
+    return NewWALWithOptions(filename, WALOptions{})
+}
+
+func NewWALWithOptions(filename string, opts WALOptions) *WAL {
+    defaults := DefaultOptions()
+    if opts.SegmentSize <= 0 {
+        opts.SegmentSize = defaults.SegmentSize
+    }
+    if opts.Durability == "" {
+        opts.Durability = defaults.Durability
+    }
+    if opts.SyncInterval <= 0 {
+        opts.SyncInterval = defaults.SyncInterval
+    }
     wal := &WAL{
-        entries:  make([]string, 0),
         filename: filename,
+        opts:     opts,
+        stop:     make(chan struct{}),
+        holds:    make(map[any]uint64),
+        appended: make(chan struct{}),
     }
+    wal.synced = sync.NewCond(&wal.lock)
     wal.load()
+    // Everything that survived loading is already on disk
+    wal.syncedLSN = wal.lastLSN
+    if opts.Durability == DurabilityInterval {
+        go wal.syncLoop()
+    }
     return wal
 }
 
-func (wal *WAL) Append(entry string) {
+// Function for appending a record to the log, returns the LSN it was given.
+// The record is written but not necessarily synced, see Commit.
+func (wal *WAL) Append(recordType byte, key, value string) (uint64, error) {
+    return wal.append(Record{Type: recordType, Key: key, Value: value})
+}
+
+// Function for appending a record shipped from another log. It keeps its
+// LSN, which has to be the one after this log's last.
+func (wal *WAL) appendShipped(rec Record) error {
+    _, err := wal.append(rec)
+    return err
+}
+
+// A record with LSN 0 gets the next one
+func (wal *WAL) append(rec Record) (uint64, error) {
     wal.lock.Lock()
     defer wal.lock.Unlock()
-    fmt.Println("Appending to WAL:", entry) // Debug log
-    wal.entries = append(wal.entries, entry)
-    wal.save()
+    shipped := rec.LSN != 0
+    data := encodeRecord(rec)
+
+    for {
+        if wal.file == nil {
+            return 0, fmt.Errorf("wal %s is closed", wal.filename)
+        }
+        active := wal.segments[len(wal.segments)-1]
+        if active.size == 0 || active.size+int64(len(data)) <= wal.opts.SegmentSize {
+            break
+        }
+        // Don't pull the file out from under an fsync that's in flight
+        if wal.syncing {
+            wal.synced.Wait()
+            continue
+        }
+        if err := wal.roll(); err != nil {
+            return 0, err
+        }
+    }
+    // Other appends may have run while we waited, so the LSN is settled last
+    if !shipped {
+        rec.LSN = wal.lastLSN + 1
+    } else if rec.LSN != wal.lastLSN+1 {
+        return 0, fmt.Errorf("%w: %s is at LSN %d, record %d doesn't follow on", ErrWALGap, wal.filename, wal.lastLSN, rec.LSN)
+    }
+    data = encodeRecord(rec)
+
+    active := &wal.segments[len(wal.segments)-1]
+    if _, err := wal.file.Write(data); err != nil {
+        // Cut off whatever part of the record made it to disk so the next
+        // append doesn't land behind a torn record
+        wal.file.Truncate(active.size)
+        return 0, err
+    }
+    active.size += int64(len(data))
+    wal.lastLSN = rec.LSN
+    wal.tail = append(wal.tail, rec)
+    wal.tailSize += len(rec.Key) + len(rec.Value)
+    for len(wal.tail) > tailRecords || (len(wal.tail) > 1 && wal.tailSize > tailBytes) {
+        wal.tailSize -= len(wal.tail[0].Key) + len(wal.tail[0].Value)
+        wal.tail = wal.tail[1:]
+    }
+    close(wal.appended)
+    wal.appended = make(chan struct{})
+    return rec.LSN, nil
+}
+
+// Function for making a record as durable as the durability mode asks for.
+// Only waits for an fsync in "always" mode.
+func (wal *WAL) Commit(lsn uint64) error {
+    if wal.opts.Durability != DurabilityAlways {
+        return nil
+    }
+    return wal.Sync(lsn)
 }
 
-func (wal *WAL) GetEntries() []string {
+// Function for waiting until everything up to lsn has been fsynced.
+// Group commit: if another caller is already syncing we wait for it, and
+// whoever syncs next covers every record written so far, so a burst of
+// concurrent writes shares a single fsync.
+func (wal *WAL) Sync(lsn uint64) error {
     wal.lock.Lock()
     defer wal.lock.Unlock()
-    return wal.entries
+    for wal.syncedLSN < lsn {
+        if wal.syncing {
+            wal.synced.Wait()
+            continue
+        }
+        if wal.file == nil {
+            return fmt.Errorf("wal %s is closed", wal.filename)
+        }
+        wal.syncing = true
+        target := wal.lastLSN
+        file := wal.file
+        wal.lock.Unlock()
+        err := file.Sync()
+        wal.lock.Lock()
+        wal.syncing = false
+        wal.syncCount++
+        if err == nil && target > wal.syncedLSN {
+            wal.syncedLSN = target
+        }
+        wal.synced.Broadcast()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Background fsync for "interval" mode
+func (wal *WAL) syncLoop() {
+    ticker := time.NewTicker(wal.opts.SyncInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-wal.stop:
+            return
+        case <-ticker.C:
+            if err := wal.Sync(wal.LastLSN()); err != nil {
+                fmt.Println("Error syncing WAL:", err)
+            }
+        }
+    }
+}
+
+// Function for reading every record in the log, oldest first
+func (wal *WAL) GetEntries() []Record {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    entries := []Record{}
+    for _, segment := range wal.segments {
+        records, err := wal.readSegment(segment.index)
+        if err != nil {
+            fmt.Println("Error reading WAL:", err)
+            break
+        }
+        entries = append(entries, records...)
+    }
+    return entries
+}
+
+// Function for reading the records after lsn, oldest first. ErrWALGap if
+// a checkpoint has already dropped some of them.
+func (wal *WAL) entriesAfter(lsn uint64) ([]Record, error) {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    if lsn >= wal.lastLSN {
+        return []Record{}, nil
+    }
+    if len(wal.tail) > 0 && wal.tail[0].LSN <= lsn+1 {
+        return append([]Record{}, wal.tail[lsn+1-wal.tail[0].LSN:]...), nil
+    }
+    entries := []Record{}
+    for i, segment := range wal.segments {
+        // Everything in this segment is at or before lsn
+        if i+1 < len(wal.segments) && wal.segments[i+1].firstLSN <= lsn+1 {
+            continue
+        }
+        records, err := wal.readSegment(segment.index)
+        if err != nil {
+            return nil, err
+        }
+        for _, record := range records {
+            if record.LSN > lsn {
+                entries = append(entries, record)
+            }
+        }
+    }
+    if (len(entries) > 0 && entries[0].LSN != lsn+1) || (len(entries) == 0 && wal.lastLSN > lsn) {
+        return nil, fmt.Errorf("%w: %s no longer has record %d", ErrWALGap, wal.filename, lsn+1)
+    }
+    return entries, nil
+}
+
+// Function for keeping every record after lsn through checkpoints, until
+// owner releases them. Holding again moves owner's hold to lsn.
+func (wal *WAL) hold(owner any, lsn uint64) {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    wal.holds[owner] = lsn
 }
 
+func (wal *WAL) release(owner any) {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    delete(wal.holds, owner)
+}
+
+// Function for getting a channel that's closed once the log has a record
+// after lsn, straight away if it already has. Errors if the log is closed.
+func (wal *WAL) appendedAfter(lsn uint64) (<-chan struct{}, error) {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    if wal.file == nil {
+        return nil, fmt.Errorf("wal %s is closed", wal.filename)
+    }
+    if wal.lastLSN > lsn {
+        done := make(chan struct{})
+        close(done)
+        return done, nil
+    }
+    return wal.appended, nil
+}
 
+// LSN of the last record in the log
+func (wal *WAL) LastLSN() uint64 {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    return wal.lastLSN
+}
+
+// Number of bytes dropped from the end of the log when it was loaded
+func (wal *WAL) Truncated() int64 {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    return wal.truncated
+}
+
+// Function for dropping the segments made redundant by a snapshot that
+// includes everything up to lsn. If the active segment holds covered records
+// it's rolled first so the log can shrink all the way down.
+func (wal *WAL) Checkpoint(lsn uint64) error {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    for wal.syncing {
+        wal.synced.Wait()
+    }
+    if wal.file == nil {
+        return fmt.Errorf("wal %s is closed", wal.filename)
+    }
+    for _, kept := range wal.holds {
+        lsn = min(lsn, kept)
+    }
+    active := wal.segments[len(wal.segments)-1]
+    if active.size > 0 && active.firstLSN <= lsn {
+        if err := wal.roll(); err != nil {
+            return err
+        }
+    }
+    // A segment is covered when the one after it starts at or before lsn+1
+    for len(wal.segments) > 1 && wal.segments[1].firstLSN <= lsn+1 {
+        if err := wal.dropSegment(wal.segments[0].index); err != nil {
+            return err
+        }
+        wal.segments = wal.segments[1:]
+    }
+    for len(wal.tail) > 0 && wal.tail[0].LSN < wal.segments[0].firstLSN {
+        wal.tailSize -= len(wal.tail[0].Key) + len(wal.tail[0].Value)
+        wal.tail = wal.tail[1:]
+    }
+    return nil
+}
+
+// Function for moving the log past lsn without writing anything, used when
+// a snapshot is ahead of what's left in the log
+func (wal *WAL) SkipTo(lsn uint64) {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    if lsn <= wal.lastLSN || len(wal.segments) == 0 {
+        return
+    }
+    wal.lastLSN = lsn
+    // Nothing before lsn is in the log any more
+    wal.tail = nil
+    wal.tailSize = 0
+    if wal.syncedLSN < lsn {
+        wal.syncedLSN = lsn
+    }
+    active := &wal.segments[len(wal.segments)-1]
+    if active.size == 0 {
+        active.firstLSN = lsn + 1
+    }
+}
+
+// Function for dropping every record after lsn, for a raft member throwing
+// away entries its leader doesn't have. Records up to lsn have to still be
+// in the log.
+func (wal *WAL) truncateAfter(lsn uint64) error {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    for wal.syncing {
+        wal.synced.Wait()
+    }
+    if wal.file == nil {
+        return fmt.Errorf("wal %s is closed", wal.filename)
+    }
+    if lsn >= wal.lastLSN {
+        return nil
+    }
+    if lsn+1 < wal.segments[0].firstLSN {
+        return fmt.Errorf("%w: %s starts at LSN %d, can't cut it back to %d", ErrWALGap, wal.filename, wal.segments[0].firstLSN, lsn)
+    }
+    // Segments that start after lsn go altogether
+    for len(wal.segments) > 1 && wal.segments[len(wal.segments)-1].firstLSN > lsn {
+        wal.file.Close()
+        wal.file = nil
+        if err := os.Remove(wal.segmentName(wal.segments[len(wal.segments)-1].index)); err != nil {
+            return err
+        }
+        wal.segments = wal.segments[:len(wal.segments)-1]
+        file, err := openSegment(wal.segmentName(wal.segments[len(wal.segments)-1].index))
+        if err != nil {
+            return err
+        }
+        wal.file = file
+    }
+    active := &wal.segments[len(wal.segments)-1]
+    records, err := wal.readSegment(active.index)
+    if err != nil {
+        return err
+    }
+    var size int64
+    for _, record := range records {
+        if record.LSN > lsn {
+            break
+        }
+        size += int64(len(encodeRecord(record)))
+    }
+    if err := wal.file.Truncate(size); err != nil {
+        return err
+    }
+    active.size = size
+    wal.lastLSN = lsn
+    wal.syncedLSN = min(wal.syncedLSN, lsn)
+    for len(wal.tail) > 0 && wal.tail[len(wal.tail)-1].LSN > lsn {
+        last := wal.tail[len(wal.tail)-1]
+        wal.tailSize -= len(last.Key) + len(last.Value)
+        wal.tail = wal.tail[:len(wal.tail)-1]
+    }
+    return nil
+}
+
+// Function for throwing the whole log away and starting it again after lsn,
+// for a snapshot that replaces everything the db had
+func (wal *WAL) reset(lsn uint64) error {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    for wal.syncing {
+        wal.synced.Wait()
+    }
+    if wal.file == nil {
+        return fmt.Errorf("wal %s is closed", wal.filename)
+    }
+    wal.file.Close()
+    wal.file = nil
+    for _, segment := range wal.segments {
+        if err := os.Remove(wal.segmentName(segment.index)); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    next := walSegment{index: wal.segments[len(wal.segments)-1].index + 1, firstLSN: lsn + 1}
+    file, err := openSegment(wal.segmentName(next.index))
+    if err != nil {
+        return err
+    }
+    wal.file = file
+    wal.segments = []walSegment{next}
+    wal.lastLSN = lsn
+    wal.syncedLSN = lsn
+    wal.tail = nil
+    wal.tailSize = 0
+    return nil
+}
+
+// Function for closing the log, anything still unsynced is synced first
+// unless durability is "none"
+func (wal *WAL) Close() error {
+    wal.lock.Lock()
+    defer wal.lock.Unlock()
+    if wal.file == nil {
+        return nil
+    }
+    close(wal.stop)
+    for wal.syncing {
+        wal.synced.Wait()
+    }
+    var err error
+    if wal.opts.Durability != DurabilityNone {
+        if err = wal.file.Sync(); err == nil {
+            wal.syncedLSN = wal.lastLSN
+        }
+    }
+    if closeErr := wal.file.Close(); err == nil {
+        err = closeErr
+    }
+    wal.file = nil
+    wal.synced.Broadcast()
+    // Wakes anyone waiting on appends, they find the log closed
+    close(wal.appended)
+    wal.appended = make(chan struct{})
+    return err
+}
+
+// Function for closing the active segment and starting a new one.
+// The old segment is synced first so syncedLSN never has to look back at it.
+// Must not be called while an fsync is in flight.
+func (wal *WAL) roll() error {
+    if wal.opts.Durability != DurabilityNone {
+        if err := wal.file.Sync(); err != nil {
+            return err
+        }
+        wal.syncedLSN = wal.lastLSN
+    }
+    next := walSegment{
+        index:    wal.segments[len(wal.segments)-1].index + 1,
+        firstLSN: wal.lastLSN + 1,
+    }
+    file, err := openSegment(wal.segmentName(next.index))
+    if err != nil {
+        return err
+    }
+    wal.file.Close()
+    wal.file = file
+    wal.segments = append(wal.segments, next)
+    return nil
+}
+
+func (wal *WAL) segmentName(index int) string {
+    return fmt.Sprintf("%s.%06d", wal.filename, index)
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendRecord(t *testing.T, wal *WAL, recordType byte, key, value string) uint64 {
+	lsn, err := wal.Append(recordType, key, value)
+	require.NoError(t, err)
+	return lsn
+}
+
+// Values with spaces and newlines used to break the text format
+func TestWALRecordsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_wal")
+
+	wal := NewWAL(path)
+	appendRecord(t, wal, RecordSet, "key one", "value with spaces\nand a newline")
+	appendRecord(t, wal, RecordDelete, "key two", "")
+	require.NoError(t, wal.Close())
+
+	reloaded := NewWAL(path)
+	entries := reloaded.GetEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, Record{Type: RecordSet, LSN: 1, Key: "key one", Value: "value with spaces\nand a newline"}, entries[0])
+	assert.Equal(t, Record{Type: RecordDelete, LSN: 2, Key: "key two"}, entries[1])
+	assert.Equal(t, uint64(2), reloaded.LastLSN())
+	assert.Equal(t, int64(0), reloaded.Truncated())
+}
+
+func TestWALTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_wal")
+
+	wal := NewWAL(path)
+	appendRecord(t, wal, RecordSet, "a", "1")
+	appendRecord(t, wal, RecordSet, "b", "2")
+	require.NoError(t, wal.Close())
+
+	// Simulate a crash halfway through writing the second record
+	segment := path + ".000001"
+	data, err := os.ReadFile(segment)
+	require.NoError(t, err)
+	torn := len(encodeRecord(Record{Type: RecordSet, LSN: 2, Key: "b", Value: "2"})) / 2
+	require.NoError(t, os.WriteFile(segment, data[:len(data)-torn], 0644))
+
+	reloaded := NewWAL(path)
+	entries := reloaded.GetEntries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "a", entries[0].Key)
+	assert.Equal(t, int64(len(data)-torn-len(encodeRecord(entries[0]))), reloaded.Truncated())
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_wal")
+
+	wal := NewWAL(path)
+	appendRecord(t, wal, RecordSet, "a", "1")
+	appendRecord(t, wal, RecordSet, "b", "2")
+	appendRecord(t, wal, RecordSet, "c", "3")
+	require.NoError(t, wal.Close())
+
+	// Flip a byte in the value of the second record
+	segment := path + ".000001"
+	data, err := os.ReadFile(segment)
+	require.NoError(t, err)
+	first := len(encodeRecord(Record{Type: RecordSet, LSN: 1, Key: "a", Value: "1"}))
+	data[first*2-1] ^= 0xff
+	require.NoError(t, os.WriteFile(segment, data, 0644))
+
+	reloaded := NewWAL(path)
+	require.Len(t, reloaded.GetEntries(), 1)
+	assert.Equal(t, int64(len(data)-first), reloaded.Truncated())
+
+	// New records continue from the last good LSN and land after it on disk
+	assert.Equal(t, uint64(2), appendRecord(t, reloaded, RecordSet, "d", "4"))
+	entries := NewWAL(path).GetEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "d", entries[1].Key)
+}
+
+func TestWALSegmentRollover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_wal")
+	recordSize := int64(len(encodeRecord(Record{Type: RecordSet, LSN: 1, Key: "k", Value: "v"})))
+
+	// Room for two records per segment
+	wal := NewWALWithOptions(path, WALOptions{SegmentSize: recordSize * 2})
+	for i := 0; i < 5; i++ {
+		appendRecord(t, wal, RecordSet, "k", "v")
+	}
+	require.NoError(t, wal.Close())
+
+	for _, name := range []string{".000001", ".000002", ".000003"} {
+		assert.FileExists(t, path+name)
+	}
+	assert.NoFileExists(t, path+".000004")
+
+	reloaded := NewWALWithOptions(path, WALOptions{SegmentSize: recordSize * 2})
+	entries := reloaded.GetEntries()
+	require.Len(t, entries, 5)
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.LSN)
+	}
+	assert.Equal(t, uint64(6), appendRecord(t, reloaded, RecordSet, "k", "v"))
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, mode := range []string{"always", "interval", "none"} {
+		durability, err := ParseDurability(mode)
+		require.NoError(t, err)
+		assert.Equal(t, Durability(mode), durability)
+	}
+	_, err := ParseDurability("sometimes")
+	assert.Error(t, err)
+}
+
+// Concurrent writers in "always" mode are all durable when Set returns,
+// and share fsyncs instead of doing one each
+func TestGroupCommit(t *testing.T) {
+	database := NewDbWithOptions(filepath.Join(t.TempDir(), "test_db"), Options{Durability: DurabilityAlways})
+	defer database.Close()
+
+	// Stands in for a slow fsync that's in flight, the writers queue up
+	// behind it
+	database.wal.lock.Lock()
+	database.wal.syncing = true
+	database.wal.lock.Unlock()
+
+	const writers = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- database.Set(strconv.Itoa(i), "value")
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		database.wal.lock.Lock()
+		defer database.wal.lock.Unlock()
+		return database.wal.lastLSN == writers
+	}, 5*time.Second, time.Millisecond)
+
+	database.wal.lock.Lock()
+	database.wal.syncing = false
+	database.wal.synced.Broadcast()
+	database.wal.lock.Unlock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	database.wal.lock.Lock()
+	defer database.wal.lock.Unlock()
+	assert.Equal(t, uint64(writers), database.wal.syncedLSN)
+	assert.Less(t, database.wal.syncCount, writers)
+}
+
+func TestIntervalDurability(t *testing.T) {
+	database := NewDbWithOptions(filepath.Join(t.TempDir(), "test_db"), Options{
+		Durability:   DurabilityInterval,
+		SyncInterval: 5 * time.Millisecond,
+	})
+	defer database.Close()
+
+	require.NoError(t, database.Set("key", "value"))
+	assert.Eventually(t, func() bool {
+		database.wal.lock.Lock()
+		defer database.wal.lock.Unlock()
+		return database.wal.syncedLSN == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestNoDurabilitySkipsFsync(t *testing.T) {
+	database := NewDbWithOptions(filepath.Join(t.TempDir(), "test_db"), Options{Durability: DurabilityNone})
+	defer database.Close()
+
+	require.NoError(t, database.Set("key", "value"))
+	database.wal.lock.Lock()
+	defer database.wal.lock.Unlock()
+	assert.Equal(t, 0, database.wal.syncCount)
+}
+
+// After a save the WAL only holds what the snapshot doesn't, and recovery
+// replays just that on top of the snapshot
+func TestCheckpointTruncatesWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDb(path)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Set("b", "2"))
+	require.NoError(t, database.Save())
+	assert.Empty(t, database.wal.GetEntries())
+
+	require.NoError(t, database.Set("c", "3"))
+	require.NoError(t, database.Delete("a"))
+	require.NoError(t, database.Close())
+
+	recovered, report, err := OpenDb(path, DefaultOptions())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), report.SnapshotLSN)
+	assert.Equal(t, 2, report.RecordsReplayed)
+	entries := recovered.wal.GetEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(3), entries[0].LSN)
+	assert.Equal(t, map[string]string{"b": "2", "c": "3"}, contents(t, recovered))
+	assert.Equal(t, uint64(4), recovered.lastLSN)
+
+	// A save with nothing left in the WAL still carries the LSN forward
+	require.NoError(t, recovered.Save())
+	require.NoError(t, recovered.Close())
+	reopened := NewDb(path)
+	require.NoError(t, reopened.Load())
+	require.NoError(t, reopened.Set("d", "4"))
+	assert.Equal(t, uint64(5), reopened.lastLSN)
+}
+
+// Writes acknowledged since the last save survive reopening or reloading
+// and saving again, they're replayed before the WAL is checkpointed
+func TestLoadReplaysBeforeCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test_db")
+
+	database := NewDb(path)
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+	require.NoError(t, database.Set("b", "2"))
+	require.NoError(t, database.Load())
+	require.NoError(t, database.Save())
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, contents(t, database))
+	require.NoError(t, database.Set("c", "3"))
+	require.NoError(t, database.Close())
+
+	reopened := NewDb(path)
+	require.NoError(t, reopened.Save())
+	require.NoError(t, reopened.Close())
+	reopened = NewDb(path)
+	defer reopened.Close()
+	assert.Equal(t, map[string]string{"a": "1", "b": "2", "c": "3"}, contents(t, reopened))
+}
+
+func TestCheckpointArchivesSegments(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+
+	database := NewDbWithOptions(filepath.Join(dir, "test_db"), Options{WALArchiveDir: archive})
+	require.NoError(t, database.Set("a", "1"))
+	require.NoError(t, database.Save())
+
+	assert.FileExists(t, filepath.Join(archive, "test_db_wal.000001"))
+	assert.NoFileExists(t, filepath.Join(dir, "test_db_wal.000001"))
+}
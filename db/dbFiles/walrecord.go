@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Record types stored in the WAL. Noop and config records only show up in
+// the WALs of raft members, see raftNode, and never reach the engine.
+const (
+	RecordSet    byte = 1
+	RecordDelete byte = 2
+	RecordNoop   byte = 3
+	RecordConfig byte = 4
+)
+
+// Every record on disk is laid out as
+//
+//	length  uint32  size of the body that follows the header
+//	crc     uint32  CRC32C of the body
+//	body:
+//	  type    byte
+//	  lsn     uint64
+//	  keyLen  uvarint
+//	  key     []byte
+//	  value   []byte  rest of the body
+const (
+	recordHeaderSize = 8
+	recordMinBody    = 1 + 8 + 1
+	maxRecordBody    = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errTornRecord    = errors.New("wal: torn record")
+	errCorruptRecord = errors.New("wal: corrupt record")
+)
+
+// Record is a single decoded WAL entry
+type Record struct {
+	Type  byte
+	LSN   uint64
+	Key   string
+	Value string
+}
+
+// Function for encoding a record into its on-disk form
+func encodeRecord(rec Record) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(rec.Key)))
+
+	bodyLen := 1 + 8 + n + len(rec.Key) + len(rec.Value)
+	buf := make([]byte, recordHeaderSize+bodyLen)
+	body := buf[recordHeaderSize:]
+	body[0] = rec.Type
+	binary.BigEndian.PutUint64(body[1:9], rec.LSN)
+	copy(body[9:], lenBuf[:n])
+	copy(body[9+n:], rec.Key)
+	copy(body[9+n+len(rec.Key):], rec.Value)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(bodyLen))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(body, crcTable))
+	return buf
+}
+
+// Function for decoding the record at the start of data.
+// Returns the record and the number of bytes it used. A record that runs
+// past the end of data is reported as torn, anything else that doesn't
+// check out is reported as corrupt.
+func decodeRecord(data []byte) (Record, int, error) {
+	if len(data) < recordHeaderSize {
+		return Record{}, 0, errTornRecord
+	}
+	bodyLen := int(binary.BigEndian.Uint32(data[0:4]))
+	if bodyLen < recordMinBody || bodyLen > maxRecordBody {
+		return Record{}, 0, errCorruptRecord
+	}
+	if len(data) < recordHeaderSize+bodyLen {
+		return Record{}, 0, errTornRecord
+	}
+	body := data[recordHeaderSize : recordHeaderSize+bodyLen]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return Record{}, 0, errCorruptRecord
+	}
+
+	rec := Record{
+		Type: body[0],
+		LSN:  binary.BigEndian.Uint64(body[1:9]),
+	}
+	if rec.Type < RecordSet || rec.Type > RecordConfig {
+		return Record{}, 0, errCorruptRecord
+	}
+	keyLen, n := binary.Uvarint(body[9:])
+	if n <= 0 || keyLen > uint64(len(body)-9-n) {
+		return Record{}, 0, errCorruptRecord
+	}
+	rest := body[9+n:]
+	rec.Key = string(rest[:keyLen])
+	rec.Value = string(rest[keyLen:])
+	return rec, recordHeaderSize + bodyLen, nil
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	 "encoding/base64"
 	 "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
     "log"
     "net/http"
+    "net/url"
     "strconv"
+    "strings"
     "sync"
     "bryan/GoDB/dbFiles"
     "github.com/gorilla/mux"
@@ -19,6 +26,12 @@ import (
 
 var (
     shardedDBInstances = make(map[string]*db.ShardedDB)
+    // Stops each database's background rebalancer
+    stopRebalancing    = make(map[string]func())
+    // Stops each database's health checks
+    stopMonitoring     = make(map[string]func())
+    // Stops each database's background checkpoints
+    stopCheckpointing  = make(map[string]func())
     dbMutex            sync.Mutex
 )
 
@@ -27,53 +40,250 @@ type Response struct {
 	Message string `json:"message"`
 }
 
+// Default number of copies of each shard, the primary and two replicas
+const defaultReplicationFactor = 3
+
+//  Settings picked when a database is created, kept in <userID>_db.config.json
+//  Shards is how many shards to split the keys evenly between, or Ranges
+//  gives each shard's range outright (not for the ring partitioner).
+//  ReplicationFactor counts the primary, so 1 means no replicas.
+type dbConfig struct {
+    Engine            string     `json:"engine"`
+    Partitioner       string     `json:"partitioner,omitempty"`
+    VirtualNodes      int        `json:"virtual_nodes,omitempty"`
+    Shards            int        `json:"shards,omitempty"`
+    Ranges            [][2]int   `json:"ranges,omitempty"`
+    ReplicationFactor int        `json:"replication_factor,omitempty"`
+    Durability        string     `json:"durability,omitempty"`
+    Consensus         string     `json:"consensus,omitempty"`
+}
 
+func configFilename(userID string) string {
+    return userID + "_db.config.json"
+}
 
-func loadUserIDs() []string {
-    var userIDs []string
-    files, err := filepath.Glob("*.db")
+// Databases created before there was a config use the defaults
+func loadDbConfig(userID string) (dbConfig, error) {
+    var config dbConfig
+    data, err := os.ReadFile(configFilename(userID))
+    if os.IsNotExist(err) {
+        return config, nil
+    }
     if err != nil {
-        log.Fatalf("Failed to load user IDs: %v", err)
+        return config, err
+    }
+    err = json.Unmarshal(data, &config)
+    return config, err
+}
+
+func saveDbConfig(userID string, config dbConfig) error {
+    data, err := json.MarshalIndent(config, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(configFilename(userID), data, 0644)
+}
+
+// Function for filling in everything left out with the defaults, so the
+// config says exactly what the database was created with
+func (config dbConfig) withDefaults() dbConfig {
+    if config.Engine == "" {
+        config.Engine = db.DefaultEngine
+    }
+    if config.Partitioner == "" {
+        config.Partitioner = db.DefaultPartitioner
+    }
+    if config.Partitioner == db.RingPartitioner && config.VirtualNodes == 0 {
+        config.VirtualNodes = db.DefaultVirtualNodes
+    }
+    if config.ReplicationFactor == 0 {
+        config.ReplicationFactor = defaultReplicationFactor
+    }
+    if config.Durability == "" {
+        config.Durability = string(db.DurabilityAlways)
+    }
+    if config.Consensus == "" {
+        config.Consensus = db.DefaultConsensus
+    }
+    if config.Shards == 0 {
+        config.Shards = len(config.Ranges)
+    }
+    if config.Shards == 0 {
+        config.Shards = 3
     }
-    for _, file := range files {
-        userID := file[:len(file)-3] // Assuming ".db" extension
-        userIDs = append(userIDs, userID)
+    return config
+}
+
+// Function for checking the settings before anything is created, bad ones
+// are the client's fault
+func (config dbConfig) validate() error {
+    if err := db.ValidateEngine(config.Engine); err != nil {
+        return err
+    }
+    if _, err := db.ParseDurability(config.Durability); err != nil {
+        return err
+    }
+    if _, err := db.ParseConsensus(config.Consensus); err != nil {
+        return err
+    }
+    switch {
+    case config.Shards < 0:
+        return fmt.Errorf("shards must be positive, not %d", config.Shards)
+    case config.Shards > db.DefaultMaxShards:
+        return fmt.Errorf("at most %d shards", db.DefaultMaxShards)
+    case config.Ranges != nil && config.Shards != 0 && config.Shards != len(config.Ranges):
+        return fmt.Errorf("%d shards but %d ranges", config.Shards, len(config.Ranges))
+    case config.Ranges != nil && config.Partitioner == db.RingPartitioner:
+        return errors.New("the ring partitioner doesn't take ranges, only a number of shards")
+    case config.VirtualNodes < 0:
+        return fmt.Errorf("virtual_nodes must be positive, not %d", config.VirtualNodes)
+    case config.ReplicationFactor < 0:
+        return fmt.Errorf("replication_factor must be at least 1, not %d", config.ReplicationFactor)
+    }
+    return db.ValidatePartitioner(config.Partitioner, config.shardRanges())
+}
+
+func (config dbConfig) options() db.Options {
+    opts := db.DefaultOptions()
+    if config.Engine != "" {
+        opts.Engine = config.Engine
+    }
+    if durability, err := db.ParseDurability(config.Durability); err == nil {
+        opts.Durability = durability
+    }
+    opts.Partitioner = config.Partitioner
+    opts.VirtualNodes = config.VirtualNodes
+    opts.Consensus = config.Consensus
+    return opts
+}
+
+// Replicas per shard, on top of the primary
+func (config dbConfig) replicas() int {
+    if config.ReplicationFactor == 0 {
+        return defaultReplicationFactor - 1
+    }
+    return config.ReplicationFactor - 1
+}
+
+// Explicit Ranges are used as they are. Otherwise integer keys are split into
+// the original three ranges, with the outer two running on to cover every
+// integer, or into Shards equal runs of integers, hashed keys into equal runs
+// of slots. The ring starts with Shards shards. Once created the layout is
+// recorded with the database and changed through the admin API.
+func (config dbConfig) shardRanges() [][2]int {
+    if config.Ranges != nil {
+        return config.Ranges
+    }
+    shards := config.Shards
+    if shards == 0 {
+        shards = 3
+    }
+    switch config.Partitioner {
+    case db.HashPartitioner:
+        return db.HashRanges(shards)
+    case db.RingPartitioner:
+        return make([][2]int, shards)
+    }
+    if config.Shards == 0 {
+        return [][2]int{{math.MinInt, 100}, {101, 200}, {201, math.MaxInt}}
+    }
+    return db.IntRanges(shards)
+}
+
+
+
+// Every database has a config, a partitioner record or at least a first
+// shard, found by its snapshot manifest or its WAL
+func loadUserIDs() []string {
+    var userIDs []string
+    seen := make(map[string]bool)
+    for _, pattern := range []string{"*_db.config.json", "*_db.shardmap", "*_db_0.manifest", "*_db_0_wal.*"} {
+        files, err := filepath.Glob(pattern)
+        if err != nil {
+            log.Fatalf("Failed to load user IDs: %v", err)
+        }
+        for _, file := range files {
+            userID := file[:strings.LastIndex(file, "_db")]
+            if !seen[userID] {
+                seen[userID] = true
+                userIDs = append(userIDs, userID)
+            }
+        }
     }
     return userIDs
 }
 
-func getUserShardedDB(userID string) *db.ShardedDB {
+func getUserShardedDB(userID string) (*db.ShardedDB, error) {
     dbMutex.Lock()
     defer dbMutex.Unlock()
 
     if _, exists := shardedDBInstances[userID]; !exists {
-        shardedDBInstances[userID] = db.NewShardedDB([][2]int{{0, 100}, {101, 200}, {201, 300}}, userID+"_db", 2)
-        shardedDBInstances[userID].Load() // Load data from files
+        config, err := loadDbConfig(userID)
+        if err != nil {
+            return nil, err
+        }
+        // Load the snapshots and replay the WAL
+        shardedDB, report, err := db.OpenShardedDB(config.shardRanges(), userID+"_db", config.replicas(), config.options())
+        if err != nil {
+            return nil, err
+        }
+        logRecoveryReport(userID, report)
+        shardedDBInstances[userID] = shardedDB
+        stopRebalancing[userID] = shardedDB.StartRebalancing(db.RebalanceOptions{})
+        stopMonitoring[userID] = shardedDB.StartMonitoring(db.HealthOptions{})
+        stopCheckpointing[userID] = shardedDB.StartCheckpointing(0)
+    }
+    return shardedDBInstances[userID], nil
+}
+
+func logRecoveryReport(userID string, report *db.ShardedRecoveryReport) {
+    log.Printf("Recovered database for %s in %v: %d records replayed, %d bytes truncated",
+        userID, report.Duration, report.RecordsReplayed, report.BytesTruncated)
+    for _, shard := range report.Shards {
+        log.Printf("  shard %d: %v, snapshot LSN %d, %d records replayed",
+            shard.ShardID, shard.Duration, shard.Primary.SnapshotLSN, shard.Primary.RecordsReplayed)
+        for _, replica := range shard.ReplicaMismatches {
+            log.Printf("  shard %d: replica %s does not match its primary", shard.ShardID, replica)
+        }
     }
-    return shardedDBInstances[userID]
 }
 
 func main() {
+    if topologyFile := os.Getenv("GODB_TOPOLOGY"); topologyFile != "" {
+        runCluster(topologyFile)
+        return
+    }
     userIDs := loadUserIDs()
     for _, userID := range userIDs {
-        getUserShardedDB(userID)
+        if _, err := getUserShardedDB(userID); err != nil {
+            log.Fatalf("Failed to open database for %s: %v", userID, err)
+        }
     }
 
-    router := mux.NewRouter()
+    // Keys can hold anything, slashes and binary included, percent-encoded
+    router := mux.NewRouter().UseEncodedPath()
 
     router.HandleFunc("/api/{userID}/createdb", createShardedDBHandler).Methods("POST")
+    router.HandleFunc("/api/{userID}/config", configHandler).Methods("GET")
     router.HandleFunc("/api/{userID}/set/{key}/{value}", setHandler).Methods("POST")
     router.HandleFunc("/api/{userID}/get/{key}", getHandler).Methods("GET")
     router.HandleFunc("/api/{userID}/delete/{key}", deleteHandler).Methods("DELETE")
+    router.HandleFunc("/api/{userID}/scan", scanHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/admin/shards", listShardsHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/admin/stats", shardStatsHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/admin/shardmap", shardMapHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/admin/health", healthHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/admin/shards/{shardID}/split", splitShardHandler).Methods("POST")
+    router.HandleFunc("/api/{userID}/admin/shards/{shardID}/merge", mergeShardsHandler).Methods("POST")
+    router.HandleFunc("/api/{userID}/ring/plan", ringPlanHandler).Methods("GET")
+    router.HandleFunc("/api/{userID}/ring/shards", addShardHandler).Methods("POST")
+    router.HandleFunc("/api/{userID}/ring/shards/{shardID}", removeShardHandler).Methods("DELETE")
 
     srv := &http.Server{
         Addr:    ":8080",
         Handler: router,
     }
 
-    // Start monitoring shards in a separate goroutine
-    go startMonitoringAllShards()
-
     go func() {
         log.Println("Server starting on port 8080")
         if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -86,17 +296,6 @@ func main() {
 
 
 
-func startMonitoringAllShards() {
-    for {
-        dbMutex.Lock()
-        for _, shardedDB := range shardedDBInstances {
-            go shardedDB.StartMonitoring()
-        }
-        dbMutex.Unlock()
-        time.Sleep(30 * time.Second)
-    }
-}
-
 func gracefulShutdown(srv *http.Server) {
     c := make(chan os.Signal, 1)
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -105,10 +304,22 @@ func gracefulShutdown(srv *http.Server) {
     log.Println("Shutting down gracefully...")
 
     dbMutex.Lock()
+    for _, stop := range stopRebalancing {
+        stop()
+    }
+    for _, stop := range stopMonitoring {
+        stop()
+    }
+    for _, stop := range stopCheckpointing {
+        stop()
+    }
     for _, shardedDB := range shardedDBInstances {
         if err := shardedDB.Save(); err != nil {
             log.Printf("Failed to save database: %v", err)
         }
+        if err := shardedDB.Close(); err != nil {
+            log.Printf("Failed to close database: %v", err)
+        }
     }
     dbMutex.Unlock()
 
@@ -124,10 +335,36 @@ func gracefulShutdown(srv *http.Server) {
 
 
 
+//  Takes an optional JSON body picking the storage engine, how keys are spread
+//  over the shards, how many copies of each there are and when writes are
+//  fsynced, e.g.
+//  {"engine": "lsm", "partitioner": "range", "ranges": [[0, 999], [1000, 1999]],
+//   "replication_factor": 2, "durability": "interval"}
+//  Anything left out gets the default, GET /api/{userID}/config shows what
+//  was picked.
 func createShardedDBHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userID"]
 
+    var config dbConfig
+    decoder := json.NewDecoder(r.Body)
+    // A misspelt setting would otherwise quietly get the default
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(&config); err != nil && err != io.EOF {
+        http.Error(w, "Invalid database config: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := config.validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // Shards goes with the ranges picked for it, e.g. the default three
+    config.Ranges = config.shardRanges()
+    if config.Partitioner == db.RingPartitioner {
+        config.Ranges = nil
+    }
+    config = config.withDefaults()
+
     dbMutex.Lock()
     defer dbMutex.Unlock()
 
@@ -135,52 +372,123 @@ func createShardedDBHandler(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Database already exists for user", http.StatusBadRequest)
         return
     }
+    // One that's on disk but didn't load (see the startup log) isn't
+    // overwritten, a new shard map would claim its member files
+    for _, filename := range []string{configFilename(userID), userID + "_db.shardmap"} {
+        if _, err := os.Stat(filename); err == nil || !os.IsNotExist(err) {
+            http.Error(w, "Database already exists on disk for user", http.StatusBadRequest)
+            return
+        }
+    }
 
-    shardedDBInstances[userID] = db.NewShardedDB([][2]int{{0, 100}, {101, 200}, {201, 300}}, userID+"_db", 2)
+    if err := saveDbConfig(userID, config); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    shardedDB, _, err := db.OpenShardedDB(config.shardRanges(), userID+"_db", config.replicas(), config.options())
+    if err != nil {
+        os.Remove(configFilename(userID))
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    shardedDBInstances[userID] = shardedDB
     shardedDBInstances[userID].Save() // Save initial state to disk
+    stopRebalancing[userID] = shardedDBInstances[userID].StartRebalancing(db.RebalanceOptions{})
+    stopMonitoring[userID] = shardedDBInstances[userID].StartMonitoring(db.HealthOptions{})
+    stopCheckpointing[userID] = shardedDBInstances[userID].StartCheckpointing(0)
     json.NewEncoder(w).Encode(Response{Message: "Sharded database created successfully"})
 }
 
-func setHandler(w http.ResponseWriter, r *http.Request) {
+// GET /api/{userID}/config
+// The settings the database was created with, defaults filled in. The
+// shards may have been split, merged, added or removed since, the shard map
+// has the current layout.
+func configHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userID"]
-    keyStr := vars["key"]
-    value := vars["value"]
 
-    key, err := strconv.Atoi(keyStr)
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    config, err := loadDbConfig(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    // Databases from before the config was kept get what they were opened with
+    if config.Partitioner == "" {
+        config.Partitioner = userDB.Partitioner()
+    }
+    if config.Consensus == "" {
+        config.Consensus = userDB.Consensus()
+    }
+    if config.Ranges == nil && config.Partitioner != db.RingPartitioner {
+        config.Ranges = config.shardRanges()
+    }
+    json.NewEncoder(w).Encode(config.withDefaults())
+}
+
+func setHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+    key, err := url.PathUnescape(vars["key"])
     if err != nil {
         http.Error(w, "Invalid key", http.StatusBadRequest)
         return
     }
+    value, err := url.PathUnescape(vars["value"])
+    if err != nil {
+        http.Error(w, "Invalid value", http.StatusBadRequest)
+        return
+    }
+
+    opts, err := writeOptions(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-    userDB := getUserShardedDB(userID)
-    err = userDB.Set(key, value)
+    userDB, err := getUserShardedDB(userID)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    err = userDB.SetWithOptions(key, value, opts)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
 
-    userDB.Save() // Save after setting a value
     json.NewEncoder(w).Encode(Response{Message: "Key set successfully"})
 }
 
 func getHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userID"]
-    keyStr := vars["key"]
-
-    key, err := strconv.Atoi(keyStr)
+    key, err := url.PathUnescape(vars["key"])
     if err != nil {
         http.Error(w, "Invalid key", http.StatusBadRequest)
         return
     }
 
-    userDB := getUserShardedDB(userID)
-    value, err := userDB.Get(key)
+    opts, err := readOptions(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    userDB, err := getUserShardedDB(userID)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    value, err := userDB.GetWithOptions(key, opts)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
 
     json.NewEncoder(w).Encode(Response{Message: value})
 }
@@ -188,21 +496,413 @@ func getHandler(w http.ResponseWriter, r *http.Request) {
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     userID := vars["userID"]
-    keyStr := vars["key"]
-
-    key, err := strconv.Atoi(keyStr)
+    key, err := url.PathUnescape(vars["key"])
     if err != nil {
         http.Error(w, "Invalid key", http.StatusBadRequest)
         return
     }
 
-    userDB := getUserShardedDB(userID)
-    err = userDB.Delete(key)
+    opts, err := writeOptions(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    userDB, err := getUserShardedDB(userID)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    err = userDB.DeleteWithOptions(key, opts)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
 
-    userDB.Save() // Save after deleting a value
     json.NewEncoder(w).Encode(Response{Message: "Key deleted successfully"})
-}
\ No newline at end of file
+}
+
+// A per-request setting, from the query param or else the header
+func requestSetting(r *http.Request, param, header string) string {
+    if value := r.URL.Query().Get(param); value != "" {
+        return value
+    }
+    return r.Header.Get(header)
+}
+
+// ?write_concern=primary|majority|all or the X-Write-Concern header,
+// all by default
+func writeOptions(r *http.Request) (db.WriteOptions, error) {
+    concern, err := db.ParseWriteConcern(requestSetting(r, "write_concern", "X-Write-Concern"))
+    return db.WriteOptions{Concern: concern}, err
+}
+
+// ?read_preference=primary|any-replica|bounded-staleness or the
+// X-Read-Preference header, primary by default. Bounded staleness takes
+// ?max_staleness= or X-Max-Staleness as a duration, like 500ms.
+func readOptions(r *http.Request) (db.ReadOptions, error) {
+    var opts db.ReadOptions
+    var err error
+    if opts.Preference, err = db.ParseReadPreference(requestSetting(r, "read_preference", "X-Read-Preference")); err != nil {
+        return opts, err
+    }
+    if staleness := requestSetting(r, "max_staleness", "X-Max-Staleness"); staleness != "" {
+        if opts.MaxStaleness, err = time.ParseDuration(staleness); err != nil {
+            return opts, fmt.Errorf("invalid max staleness %q", staleness)
+        }
+    }
+    return opts, opts.Validate()
+}
+
+
+const (
+    defaultScanLimit = 100
+    maxScanLimit     = 1000
+    // How long a page's iterator is kept for the next page, and how many
+    // are kept at once
+    scanCursorTTL    = time.Minute
+    maxScanCursors   = 1000
+)
+
+// An iterator part way through a scan, the next page carries on from it
+// instead of reading and sorting the shards' keys all over again
+type openScan struct {
+    it      *db.Iterator
+    sdb     *db.ShardedDB
+    end     string
+    expires time.Time
+}
+
+var (
+    // By userID and the cursor the iterator stopped at
+    openScans     = make(map[string]*openScan)
+    openScansLock sync.Mutex
+)
+
+// Function for taking the iterator a page stopped at, nil if it's expired
+// or it was for something else
+func takeScan(userID, cursor, end string, sdb *db.ShardedDB) *db.Iterator {
+    openScansLock.Lock()
+    defer openScansLock.Unlock()
+    key := userID + "/" + cursor
+    scan, ok := openScans[key]
+    if !ok {
+        return nil
+    }
+    delete(openScans, key)
+    if scan.sdb != sdb || scan.end != end || time.Now().After(scan.expires) {
+        return nil
+    }
+    return scan.it
+}
+
+// Function for keeping the iterator a page stopped at, dropping the ones
+// nobody came back for
+func keepScan(userID, cursor, end string, sdb *db.ShardedDB, it *db.Iterator) {
+    openScansLock.Lock()
+    defer openScansLock.Unlock()
+    now := time.Now()
+    for key, scan := range openScans {
+        if now.After(scan.expires) {
+            delete(openScans, key)
+        }
+    }
+    if len(openScans) >= maxScanCursors {
+        return
+    }
+    openScans[userID+"/"+cursor] = &openScan{it: it, sdb: sdb, end: end, expires: now.Add(scanCursorTTL)}
+}
+
+type ScanResponse struct {
+    Items  []db.KeyValue `json:"items"`
+    Cursor string        `json:"cursor,omitempty"`
+}
+
+// Cursors are the key the next page starts at, encoded so clients don't
+// go building them by hand
+func encodeCursor(start string) string {
+    return base64.RawURLEncoding.EncodeToString([]byte(start))
+}
+
+func decodeCursor(cursor string) (string, error) {
+    start, err := base64.RawURLEncoding.DecodeString(cursor)
+    return string(start), err
+}
+
+// Function for parsing an optional int query parameter
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+    value := r.URL.Query().Get(name)
+    if value == "" {
+        return fallback, nil
+    }
+    return strconv.Atoi(value)
+}
+
+// GET /api/{userID}/scan?start=&end=&limit=&cursor=
+// Keys in [start, end) in order, a page at a time. Leaving out start or end
+// leaves that side unbounded. When there are more keys the response has a
+// cursor, pass it back (with the same end) to get the next page. The page's
+// iterator is kept for a while, so the next page carries on from it.
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    query := r.URL.Query()
+    start, end := query.Get("start"), query.Get("end")
+    limit, err := queryInt(r, "limit", defaultScanLimit)
+    if err != nil || limit <= 0 || limit > maxScanLimit {
+        http.Error(w, "Invalid limit", http.StatusBadRequest)
+        return
+    }
+    var it *db.Iterator
+    if cursor := query.Get("cursor"); cursor != "" {
+        start, err = decodeCursor(cursor)
+        if err != nil {
+            http.Error(w, "Invalid cursor", http.StatusBadRequest)
+            return
+        }
+        it = takeScan(userID, cursor, end, userDB)
+    }
+
+    if it == nil {
+        it = userDB.Scan(start, end, 0)
+    }
+    items, more, err := it.Collect(limit)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    response := ScanResponse{Items: items}
+    if more {
+        response.Cursor = encodeCursor(it.Resume())
+        keepScan(userID, response.Cursor, end, userDB, it)
+    }
+    json.NewEncoder(w).Encode(response)
+}
+
+// GET /api/{userID}/ring/plan?add=true or ?remove={shardID}
+// Which arcs of the ring, and how many keys, adding a shard or removing one
+// would move, without doing it
+func ringPlanHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    var plan db.RingPlan
+    query := r.URL.Query()
+    switch {
+    case query.Get("remove") != "":
+        shardID, convErr := strconv.Atoi(query.Get("remove"))
+        if convErr != nil {
+            http.Error(w, "Invalid shard ID", http.StatusBadRequest)
+            return
+        }
+        plan, err = userDB.PlanRemoveShard(shardID)
+    case query.Get("add") == "true":
+        plan, err = userDB.PlanAddShard()
+    default:
+        http.Error(w, "Pass add=true or remove={shardID}", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    json.NewEncoder(w).Encode(plan)
+}
+
+// POST /api/{userID}/ring/shards
+// Adds a shard to the ring and moves its keys over, responds with what moved
+func addShardHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    plan, err := userDB.AddShard()
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    userDB.Save()
+    json.NewEncoder(w).Encode(plan)
+}
+
+// DELETE /api/{userID}/ring/shards/{shardID}
+// Moves the shard's keys to the rest of the ring and deletes it
+func removeShardHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+    shardID, err := strconv.Atoi(vars["shardID"])
+    if err != nil {
+        http.Error(w, "Invalid shard ID", http.StatusBadRequest)
+        return
+    }
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    plan, err := userDB.RemoveShard(shardID)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    userDB.Save()
+    json.NewEncoder(w).Encode(plan)
+}
+
+// GET /api/{userID}/admin/shards
+func listShardsHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(userDB.ShardInfo())
+}
+
+// GET /api/{userID}/admin/stats
+// Keys, bytes and ops/sec per shard, what the rebalancer goes by
+func shardStatsHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    stats, err := userDB.ShardStats()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(stats)
+}
+
+// GET /api/{userID}/admin/shardmap
+// The recorded shard layout, with its epoch
+func shardMapHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(userDB.ShardMap())
+}
+
+// GET /api/{userID}/admin/health
+// Every member's health as of its last probe, and the promotions made
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    json.NewEncoder(w).Encode(struct {
+        Shards     []db.ShardHealth `json:"shards"`
+        Promotions []db.Promotion   `json:"promotions"`
+    }{userDB.Health(), userDB.Promotions()})
+}
+
+// POST /api/{userID}/admin/shards/{shardID}/split?at={key}
+// Splits the shard so a new shard holds at (a slot for hashed keys) and up.
+// Reads and writes carry on while the keys are copied. Responds with the new
+// shard.
+func splitShardHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+    shardID, err := strconv.Atoi(vars["shardID"])
+    if err != nil {
+        http.Error(w, "Invalid shard ID", http.StatusBadRequest)
+        return
+    }
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    shard, err := userDB.SplitShard(shardID, r.URL.Query().Get("at"))
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    userDB.Save()
+    json.NewEncoder(w).Encode(shard)
+}
+
+// POST /api/{userID}/admin/shards/{shardID}/merge?with={otherShardID}
+// Merges two shards with neighbouring ranges, responds with the one left
+func mergeShardsHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    userID := vars["userID"]
+    shardID, err := strconv.Atoi(vars["shardID"])
+    if err != nil {
+        http.Error(w, "Invalid shard ID", http.StatusBadRequest)
+        return
+    }
+    otherID, err := queryInt(r, "with", -1)
+    if err != nil || otherID < 0 {
+        http.Error(w, "Invalid shard ID to merge with", http.StatusBadRequest)
+        return
+    }
+
+    userDB, err := getUserShardedDB(userID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    shard, err := userDB.MergeShards(shardID, otherID)
+    if err != nil {
+        http.Error(w, err.Error(), errorStatus(err))
+        return
+    }
+    userDB.Save()
+    json.NewEncoder(w).Encode(shard)
+}
+
+// Bad keys and requests are the client's fault, anything else is ours
+func errorStatus(err error) int {
+    switch {
+    case errors.Is(err, db.ErrInvalidKey), errors.Is(err, db.ErrNotRing),
+        errors.Is(err, db.ErrNotRanged), errors.Is(err, db.ErrBadShardChange):
+        return http.StatusBadRequest
+    case errors.Is(err, db.ErrUnknownShard):
+        return http.StatusNotFound
+    case errors.Is(err, db.ErrStaleEpoch):
+        return http.StatusConflict
+    case errors.Is(err, db.ErrReplicationTimeout):
+        return http.StatusGatewayTimeout
+    case errors.Is(err, db.ErrLeadershipLost):
+        return http.StatusGatewayTimeout
+    case errors.Is(err, db.ErrStaleRead), errors.Is(err, db.ErrNotLeader), errors.Is(err, db.ErrUnreachable):
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}